@@ -0,0 +1,105 @@
+// Package compression dispatches to the codecs a record batch can be
+// compressed with. All of them are implemented in this tree, in pure Go.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression/lz4"
+	"github.com/codecrafters-io/kafka-starter-go/app/compression/snappy"
+	"github.com/codecrafters-io/kafka-starter-go/app/compression/zstd"
+)
+
+// Codec is numbered as in the compression bits of batch attributes.
+type Codec int8
+
+const (
+	None   Codec = 0
+	Gzip   Codec = 1
+	Snappy Codec = 2
+	Lz4    Codec = 3
+	Zstd   Codec = 4
+)
+
+var names = map[Codec]string{
+	None:   "none",
+	Gzip:   "gzip",
+	Snappy: "snappy",
+	Lz4:    "lz4",
+	Zstd:   "zstd",
+}
+
+func (c Codec) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", int8(c))
+}
+
+// ParseCodec parses a compression.type value, where no compression is
+// spelled "uncompressed". "producer" is not a codec and is rejected.
+func ParseCodec(name string) (Codec, bool) {
+	if name == "uncompressed" {
+		return None, true
+	}
+	for c, n := range names {
+		if n == name && c != None {
+			return c, true
+		}
+	}
+	return None, false
+}
+
+// Compress compresses data with the codec, which must be one of the above.
+func Compress(c Codec, data []byte) []byte {
+	switch c {
+	case None:
+		return data
+	case Gzip:
+		// Writes to a bytes.Buffer cannot fail.
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	case Snappy:
+		return snappy.Compress(data)
+	case Lz4:
+		return lz4.Compress(data)
+	case Zstd:
+		return zstd.Compress(data)
+	}
+	panic(fmt.Sprintf("compression: unknown codec %d", c))
+}
+
+// Decompress decompresses data compressed with the codec, failing rather than
+// producing more than limit bytes.
+func Decompress(c Codec, data []byte, limit int) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, fmt.Errorf("gzip: decompressed size exceeds %d bytes", limit)
+		}
+		return out, nil
+	case Snappy:
+		return snappy.Decompress(data, limit)
+	case Lz4:
+		return lz4.Decompress(data, limit)
+	case Zstd:
+		return zstd.Decompress(data, limit)
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", c)
+}
@@ -0,0 +1,326 @@
+// Package lz4 implements the LZ4 frame format, which Kafka uses for lz4
+// compressed batches.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	frameMagic          = 0x184D2204
+	skippableFrameMagic = 0x184D2A50
+	skippableFrameMask  = 0xFFFFFFF0
+
+	flagVersion         = 0x40
+	flagIndependent     = 0x20
+	flagBlockChecksum   = 0x10
+	flagContentSize     = 0x08
+	flagContentChecksum = 0x04
+	flagDictionaryId    = 0x01
+
+	// blockSize64KB is the BD byte of the 64KB maximum block size, the one
+	// Kafka's Java client writes.
+	blockSize64KB = 4 << 4
+	blockSize     = 64 << 10
+
+	uncompressedBlock = 0x80000000
+
+	minMatch = 4
+	// The last match must start mfLimit bytes before the end of a block and
+	// the last lastLiterals bytes are always literals.
+	mfLimit      = 12
+	lastLiterals = 5
+	maxOffset    = 65535
+	hashLog      = 16
+)
+
+// ErrCorrupt is wrapped by every error about malformed input.
+var ErrCorrupt = errors.New("lz4: corrupt input")
+
+func corruptf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// Compress encodes src as an LZ4 frame of independent 64KB blocks without
+// checksums, as Kafka's Java client writes them.
+func Compress(src []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, frameMagic)
+	descriptor := []byte{flagVersion | flagIndependent, blockSize64KB}
+	out = append(out, descriptor...)
+	out = append(out, byte(xxhash32(descriptor)>>8))
+
+	table := make([]int32, 1<<hashLog)
+	for len(src) > 0 {
+		n := min(len(src), blockSize)
+		clear(table)
+		block := compressBlock(nil, src[:n], table)
+		if len(block) >= n {
+			out = binary.LittleEndian.AppendUint32(out, uint32(n)|uncompressedBlock)
+			out = append(out, src[:n]...)
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(block)))
+			out = append(out, block...)
+		}
+		src = src[n:]
+	}
+	return binary.LittleEndian.AppendUint32(out, 0) // EndMark
+}
+
+// Decompress decodes one or more concatenated LZ4 frames, skipping
+// skippable frames, failing once the output would exceed limit bytes.
+func Decompress(src []byte, limit int) ([]byte, error) {
+	out := []byte{}
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, corruptf("truncated frame header")
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&skippableFrameMask == skippableFrameMagic {
+			size := int64(binary.LittleEndian.Uint32(src[4:]))
+			if size > int64(len(src)-8) {
+				return nil, corruptf("truncated skippable frame")
+			}
+			src = src[8+size:]
+			continue
+		}
+		if magic != frameMagic {
+			return nil, corruptf("unknown frame magic %#x", magic)
+		}
+		var n int
+		var err error
+		if out, n, err = decodeFrame(out, src, limit); err != nil {
+			return nil, err
+		}
+		src = src[n:]
+	}
+	return out, nil
+}
+
+// decodeFrame appends the content of the frame starting src to out and
+// returns the size of the frame.
+func decodeFrame(out []byte, src []byte, limit int) ([]byte, int, error) {
+	flags, bd := src[4], src[5]
+	if flags&0xC0 != flagVersion {
+		return nil, 0, corruptf("unsupported frame version %d", flags>>6)
+	}
+	if flags&flagDictionaryId != 0 {
+		return nil, 0, fmt.Errorf("lz4: dictionaries are not supported")
+	}
+	maxBlockSize := 0
+	switch bd >> 4 & 0x07 {
+	case 4, 5, 6, 7:
+		maxBlockSize = blockSize << (2 * (bd>>4&0x07 - 4))
+	default:
+		return nil, 0, corruptf("invalid block maximum size %d", bd>>4&0x07)
+	}
+	pos := 6
+	contentSize := int64(-1)
+	if flags&flagContentSize != 0 {
+		if len(src) < pos+8 {
+			return nil, 0, corruptf("truncated frame header")
+		}
+		contentSize = int64(binary.LittleEndian.Uint64(src[pos:]))
+		pos += 8
+	}
+	if len(src) < pos+1 {
+		return nil, 0, corruptf("truncated frame header")
+	}
+	// Before Kafka 0.10, Kafka's Java client hashed the magic too. Those
+	// frames only come with legacy message sets, but are accepted anyway.
+	if hc := src[pos]; hc != byte(xxhash32(src[4:pos])>>8) && hc != byte(xxhash32(src[:pos])>>8) {
+		return nil, 0, corruptf("frame descriptor checksum %#x does not match", hc)
+	}
+	pos++
+
+	start := len(out)
+	for {
+		if len(src) < pos+4 {
+			return nil, 0, corruptf("truncated block size")
+		}
+		size := binary.LittleEndian.Uint32(src[pos:])
+		pos += 4
+		if size == 0 {
+			break
+		}
+		n := int(size &^ uncompressedBlock)
+		if n > maxBlockSize || n > len(src)-pos {
+			return nil, 0, corruptf("block of %d bytes overflows the frame", n)
+		}
+		block := src[pos : pos+n]
+		pos += n
+		if flags&flagBlockChecksum != 0 {
+			if len(src) < pos+4 {
+				return nil, 0, corruptf("truncated block checksum")
+			}
+			if binary.LittleEndian.Uint32(src[pos:]) != xxhash32(block) {
+				return nil, 0, corruptf("block checksum does not match")
+			}
+			pos += 4
+		}
+
+		if size&uncompressedBlock != 0 {
+			out = append(out, block...)
+		} else {
+			// Dependent blocks may copy from the blocks before them.
+			window := len(out)
+			if flags&flagIndependent == 0 {
+				window = start
+			}
+			var err error
+			if out, err = decodeBlock(out, block, window, maxBlockSize); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(out) > limit {
+			return nil, 0, fmt.Errorf("lz4: decompressed size exceeds %d bytes", limit)
+		}
+	}
+
+	if contentSize >= 0 && int64(len(out)-start) != contentSize {
+		return nil, 0, corruptf("frame content size %d does not match %d decoded bytes", contentSize, len(out)-start)
+	}
+	if flags&flagContentChecksum != 0 {
+		if len(src) < pos+4 {
+			return nil, 0, corruptf("truncated content checksum")
+		}
+		if binary.LittleEndian.Uint32(src[pos:]) != xxhash32(out[start:]) {
+			return nil, 0, corruptf("content checksum does not match")
+		}
+		pos += 4
+	}
+	return out, pos, nil
+}
+
+// decodeBlock appends the content of a compressed block, at most maxSize
+// bytes, to out. Matches may reach back to out[window].
+func decodeBlock(out []byte, src []byte, window int, maxSize int) ([]byte, error) {
+	blockStart := len(out)
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, corruptf("block ends without literals")
+		}
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var err error
+			if literals, i, err = readLength(src, i, literals); err != nil {
+				return nil, err
+			}
+		}
+		if literals > len(src)-i {
+			return nil, corruptf("literals of %d bytes overflow the block", literals)
+		}
+		out = append(out, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			// The last sequence only has literals.
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, corruptf("truncated match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(out)-window {
+			return nil, corruptf("match offset %d out of range", offset)
+		}
+		length := int(token & 0x0F)
+		if length == 15 {
+			var err error
+			if length, i, err = readLength(src, i, length); err != nil {
+				return nil, err
+			}
+		}
+		length += minMatch
+		if len(out)-blockStart+length > maxSize {
+			return nil, corruptf("block decodes past %d bytes", maxSize)
+		}
+		from := len(out) - offset
+		if offset >= length {
+			out = append(out, out[from:from+length]...)
+		} else {
+			for j := 0; j < length; j++ {
+				out = append(out, out[from+j])
+			}
+		}
+	}
+	if len(out)-blockStart > maxSize {
+		return nil, corruptf("block decodes past %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// readLength adds the 255 terminated bytes extending a length of 15.
+func readLength(src []byte, i int, length int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, corruptf("truncated length")
+		}
+		b := src[i]
+		i++
+		length += int(b)
+		if b != 255 {
+			return length, i, nil
+		}
+	}
+}
+
+// compressBlock appends the sequences encoding src as an independent block.
+// table maps hashes of 4 bytes to their position plus one.
+func compressBlock(out []byte, src []byte, table []int32) []byte {
+	literalStart := 0
+	matchLimit := len(src) - lastLiterals
+	for i := 0; i+mfLimit <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 2654435761) >> (32 - hashLog)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i += 1 + (i-literalStart)>>6
+			continue
+		}
+		length := minMatch
+		for i+length < matchLimit && src[candidate+length] == src[i+length] {
+			length++
+		}
+		for i > literalStart && candidate > 0 && src[i-1] == src[candidate-1] {
+			i, candidate, length = i-1, candidate-1, length+1
+		}
+		out = appendSequence(out, src[literalStart:i], i-candidate, length)
+		i += length
+		literalStart = i
+	}
+	return appendSequence(out, src[literalStart:], 0, 0)
+}
+
+// appendSequence appends literals followed by a match, or by nothing for the
+// last sequence of a block, whose length is 0.
+func appendSequence(out []byte, literals []byte, offset int, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-minMatch, 15))
+	}
+	out = append(out, token)
+	out = appendLength(out, len(literals))
+	out = append(out, literals...)
+	if length == 0 {
+		return out
+	}
+	out = binary.LittleEndian.AppendUint16(out, uint16(offset))
+	return appendLength(out, length-minMatch)
+}
+
+func appendLength(out []byte, length int) []byte {
+	if length < 15 {
+		return out
+	}
+	for length -= 15; length >= 255; length -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(length))
+}
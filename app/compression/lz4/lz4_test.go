@@ -0,0 +1,166 @@
+package lz4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// inputs are the contents round tripped through Compress and Decompress.
+func inputs(t testing.TB) map[string][]byte {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	return map[string][]byte{
+		"empty":      {},
+		"one byte":   {'a'},
+		"short":      []byte("hello, world"),
+		"run":        bytes.Repeat([]byte{'x'}, 200<<10),
+		"random":     random,
+		"text":       opticks,
+		"repeated":   bytes.Repeat(opticks, 20),
+		"block size": random[:blockSize],
+		"short runs": []byte(strings.Repeat("abcabcabd", 1000)),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range inputs(t) {
+		compressed := Compress(data)
+		out, err := Decompress(compressed, len(data))
+		if err != nil {
+			t.Errorf("%s: Decompress: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip returned %d bytes, want the %d compressed", name, len(out), len(data))
+		}
+		if len(data) > 0 {
+			if _, err := Decompress(compressed, len(data)-1); err == nil {
+				t.Errorf("%s: Decompress succeeded past its limit", name)
+			}
+		}
+	}
+}
+
+// TestKnownVectors decodes frames written by the reference lz4 tool. See
+// testdata/README.
+func TestKnownVectors(t *testing.T) {
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	tests := map[string][]byte{
+		"opticks-x5.java.lz4":      bytes.Repeat(opticks, 5),
+		"opticks-x5.linked.lz4":    bytes.Repeat(opticks, 5),
+		"opticks.content-size.lz4": opticks,
+		"opticks.9.lz4":            opticks,
+	}
+	for name, want := range tests {
+		out, err := Decompress(readFile(t, filepath.Join("testdata", name)), 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(out, want) {
+			t.Errorf("%s: decoded %d bytes, want %d", name, len(out), len(want))
+		}
+	}
+}
+
+func TestCompressWritesJavaFrameDescriptor(t *testing.T) {
+	java := readFile(t, "testdata/opticks-x5.java.lz4")
+	// Magic, FLG, BD and the header checksum.
+	if got := Compress([]byte("hello")); !bytes.Equal(got[:7], java[:7]) {
+		t.Errorf("Compress wrote frame header %x, want %x as the Java client does", got[:7], java[:7])
+	}
+}
+
+func TestConcatenatedAndSkippableFrames(t *testing.T) {
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic+7)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "abcde"...)
+
+	reference := readFile(t, "testdata/opticks.content-size.lz4")
+	content, err := Decompress(reference, 1<<20)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+
+	var src []byte
+	src = append(src, Compress([]byte("first"))...)
+	src = append(src, skippable...)
+	src = append(src, reference...)
+	src = append(src, Compress([]byte("last"))...)
+	out, err := Decompress(src, 1<<20)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	want := append(append([]byte("first"), content...), "last"...)
+	if !bytes.Equal(out, want) {
+		t.Errorf("decoded %d bytes, want the %d of the frames in order", len(out), len(want))
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	frame := readFile(t, "testdata/opticks.content-size.lz4")
+	java := readFile(t, "testdata/opticks-x5.java.lz4")
+	tests := map[string][]byte{
+		"short header":    frame[:5],
+		"truncated":       frame[:len(frame)/2],
+		"no end mark":     java[:len(java)-4],
+		"bad magic":       append([]byte{0x05}, frame[1:]...),
+		"short skippable": binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, skippableFrameMagic), 10),
+	}
+	flipped := bytes.Clone(frame)
+	flipped[len(flipped)-1] ^= 0xFF
+	tests["content checksum mismatch"] = flipped
+	header := bytes.Clone(frame)
+	header[14] ^= 0xFF // After the magic, FLG, BD and content size.
+	tests["header checksum mismatch"] = header
+
+	for name, src := range tests {
+		if _, err := Decompress(src, 1<<20); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Decompress returned %v, want ErrCorrupt", name, err)
+		}
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	paths, _ := filepath.Glob("testdata/*.lz4")
+	for _, path := range paths {
+		f.Add(readFile(f, path))
+	}
+	f.Add(Compress([]byte("hello, hello, hello, world")))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		const limit = 1 << 20
+		out, err := Decompress(src, limit)
+		if err == nil && len(out) > limit {
+			t.Errorf("Decompress returned %d bytes, over its limit", len(out))
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("hello, hello, hello, world"))
+	f.Add(bytes.Repeat([]byte("abcd"), 1000))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := Decompress(Compress(data), len(data))
+		if err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("round trip returned %x, want %x", out, data)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Package snappy implements the Snappy block format, framed the way Kafka's
+// Java client frames it: the xerial snappy-java stream of length prefixed
+// blocks.
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	// maxBlockSize is the size of the chunks the input is split into, each
+	// compressed on its own.
+	maxBlockSize = 64 << 10
+	// xerialBlockSize is the block size of snappy-java's output stream.
+	xerialBlockSize = 32 << 10
+
+	hashLog = 14
+)
+
+// xerialHeader starts a snappy-java stream: a magic, then its version and the
+// oldest compatible version.
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0, 0, 0, 0, 1, 0, 0, 0, 1}
+
+// ErrCorrupt is wrapped by every error about malformed input.
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+func corruptf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// Compress encodes src as a xerial stream, which every Kafka client reads.
+func Compress(src []byte) []byte {
+	out := append([]byte{}, xerialHeader...)
+	for len(src) > 0 {
+		n := min(len(src), xerialBlockSize)
+		block := Encode(src[:n])
+		out = binary.BigEndian.AppendUint32(out, uint32(len(block)))
+		out = append(out, block...)
+		src = src[n:]
+	}
+	return out
+}
+
+// Decompress decodes a xerial stream, or a bare Snappy block as some clients
+// send, failing once the output would exceed limit bytes.
+func Decompress(src []byte, limit int) ([]byte, error) {
+	if len(src) < 8 || !bytes.Equal(src[:8], xerialHeader[:8]) {
+		return Decode(src, limit)
+	}
+	if len(src) < len(xerialHeader) {
+		return nil, corruptf("truncated xerial header")
+	}
+	src = src[len(xerialHeader):]
+	out := []byte{}
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, corruptf("truncated xerial block length")
+		}
+		n := int64(binary.BigEndian.Uint32(src))
+		if n > int64(len(src)-4) {
+			return nil, corruptf("xerial block of %d bytes overflows the input", n)
+		}
+		block, err := Decode(src[4:4+n], limit-len(out))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+		src = src[4+n:]
+	}
+	return out, nil
+}
+
+// Decode decodes a Snappy block of at most limit bytes: the uvarint decoded
+// length, then literals and copies.
+func Decode(src []byte, limit int) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > 1<<32-1 {
+		return nil, corruptf("invalid decoded length")
+	}
+	if length > uint64(limit) {
+		return nil, fmt.Errorf("snappy: decompressed size exceeds %d bytes", limit)
+	}
+	// A byte of input decodes to at most a few dozen bytes, so the length
+	// bounds the allocation only once it is plausible.
+	if length > uint64(len(src))*64 {
+		return nil, corruptf("decoded length %d too large for %d bytes", length, len(src))
+	}
+	out := make([]byte, 0, length)
+	for i := n; i < len(src); {
+		tag := src[i]
+		var literal, offset, size int
+		switch tag & 0x03 {
+		case tagLiteral:
+			size = int(tag >> 2)
+			i++
+			if size >= 60 {
+				extra := size - 59
+				if i+extra > len(src) {
+					return nil, corruptf("truncated literal length")
+				}
+				size = 0
+				for j := extra - 1; j >= 0; j-- {
+					size = size<<8 | int(src[i+j])
+				}
+				i += extra
+			}
+			literal = size + 1
+			if literal > len(src)-i {
+				return nil, corruptf("literal of %d bytes overflows the input", literal)
+			}
+			out = append(out, src[i:i+literal]...)
+			i += literal
+		case tagCopy1:
+			if i+2 > len(src) {
+				return nil, corruptf("truncated copy")
+			}
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xE0)<<3 | int(src[i+1])
+			i += 2
+		case tagCopy2:
+			if i+3 > len(src) {
+				return nil, corruptf("truncated copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[i+1:]))
+			i += 3
+		case tagCopy4:
+			if i+5 > len(src) {
+				return nil, corruptf("truncated copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[i+1:]))
+			i += 5
+		}
+		if literal > 0 {
+			continue
+		}
+		if offset <= 0 || offset > len(out) {
+			return nil, corruptf("copy offset %d out of range", offset)
+		}
+		from := len(out) - offset
+		for j := 0; j < size; j++ {
+			out = append(out, out[from+j])
+		}
+		if uint64(len(out)) > length {
+			return nil, corruptf("block decodes past its length %d", length)
+		}
+	}
+	if uint64(len(out)) != length {
+		return nil, corruptf("block decoded to %d bytes instead of %d", len(out), length)
+	}
+	return out, nil
+}
+
+// Encode encodes src as a single Snappy block.
+func Encode(src []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(src)))
+	table := make([]int32, 1<<hashLog)
+	for start := 0; start < len(src); start += maxBlockSize {
+		clear(table)
+		out = encodeChunk(out, src[start:min(start+maxBlockSize, len(src))], table)
+	}
+	return out
+}
+
+// encodeChunk appends the literals and copies of a chunk of at most
+// maxBlockSize bytes, so every copy offset fits in 2 bytes. table maps
+// hashes of 4 bytes to their position plus one.
+func encodeChunk(out []byte, src []byte, table []int32) []byte {
+	literalStart := 0
+	for i := 0; i+4 <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 0x1e35a7bd) >> (32 - hashLog)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i += 1 + (i-literalStart)>>5
+			continue
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		out = appendLiteral(out, src[literalStart:i])
+		out = appendCopy(out, i-candidate, length)
+		i += length
+		literalStart = i
+	}
+	return appendLiteral(out, src[literalStart:])
+}
+
+func appendLiteral(out []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return out
+	}
+	switch n := len(literal) - 1; {
+	case n < 60:
+		out = append(out, byte(n<<2)|tagLiteral)
+	case n < 1<<8:
+		out = append(out, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		out = append(out, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	default:
+		out = append(out, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(out, literal...)
+}
+
+// appendCopy appends copies of at most 64 bytes, keeping the last one at
+// least 4 bytes long so it can use the short form.
+func appendCopy(out []byte, offset int, length int) []byte {
+	for length >= 68 {
+		out = append(out, 63<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		out = append(out, 59<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length < 12 && offset < 2048 {
+		return append(out, byte(offset>>8)<<5|byte(length-4)<<2|tagCopy1, byte(offset))
+	}
+	return append(out, byte(length-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+}
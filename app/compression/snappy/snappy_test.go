@@ -0,0 +1,159 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readFile(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// inputs are the contents round tripped through Compress and Decompress.
+func inputs(t testing.TB) map[string][]byte {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	return map[string][]byte{
+		"empty":      {},
+		"one byte":   {'a'},
+		"short":      []byte("hello, world"),
+		"run":        bytes.Repeat([]byte{'x'}, 200<<10),
+		"random":     random,
+		"text":       opticks,
+		"repeated":   bytes.Repeat(opticks, 20),
+		"block size": random[:maxBlockSize+1],
+		"short runs": []byte(strings.Repeat("abcabcabd", 1000)),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range inputs(t) {
+		compressed := Compress(data)
+		out, err := Decompress(compressed, len(data))
+		if err != nil {
+			t.Errorf("%s: Decompress: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip returned %d bytes, want the %d compressed", name, len(out), len(data))
+		}
+		if len(data) > 0 {
+			if _, err := Decompress(compressed, len(data)-1); err == nil {
+				t.Errorf("%s: Decompress succeeded past its limit", name)
+			}
+		}
+
+		block, err := Decode(Encode(data), len(data))
+		if err != nil || !bytes.Equal(block, data) {
+			t.Errorf("%s: block round trip returned %d bytes and %v, want the %d encoded", name, len(block), err, len(data))
+		}
+	}
+}
+
+// xerialStream frames blocks the way snappy-java's SnappyOutputStream does.
+func xerialStream(blocks ...[]byte) []byte {
+	out := append([]byte{}, xerialHeader...)
+	for _, block := range blocks {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(block)))
+		out = append(out, block...)
+	}
+	return out
+}
+
+// TestKnownVectors decodes a block written by the reference C++ snappy, bare
+// as librdkafka sends it and framed as the Java client does. See
+// testdata/README.
+func TestKnownVectors(t *testing.T) {
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	reference := readFile(t, "testdata/Isaac.Newton-Opticks.txt.rawsnappy")
+	tests := map[string]struct {
+		src  []byte
+		want []byte
+	}{
+		"bare block":    {reference, opticks},
+		"xerial stream": {xerialStream(reference), opticks},
+		"two blocks":    {xerialStream(reference, reference), bytes.Repeat(opticks, 2)},
+	}
+	for name, test := range tests {
+		out, err := Decompress(test.src, 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(out, test.want) {
+			t.Errorf("%s: decoded %d bytes, want %d", name, len(out), len(test.want))
+		}
+	}
+}
+
+func TestCompressWritesXerialStream(t *testing.T) {
+	// snappy-java's stream of "hello": its header, then the block length
+	// and a block of the length and a single literal.
+	want := append(append([]byte{}, xerialHeader...), 0, 0, 0, 7, 0x05, 0x10, 'h', 'e', 'l', 'l', 'o')
+	if got := Compress([]byte("hello")); !bytes.Equal(got, want) {
+		t.Errorf("Compress wrote %x, want %x", got, want)
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	reference := readFile(t, "testdata/Isaac.Newton-Opticks.txt.rawsnappy")
+	stream := xerialStream(reference)
+	tests := map[string][]byte{
+		"truncated header":      stream[:12],
+		"truncated length":      stream[:len(xerialHeader)+2],
+		"overflowing length":    stream[:len(stream)-1],
+		"truncated block":       reference[:len(reference)/2],
+		"invalid length":        {0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+		"implausible length":    {0xFF, 0xFF, 0x03, 0x00, 'a'},
+		"copy before output":    {0x04, 0x01 | 0<<2, 0x01},
+		"copy offset zero":      {0x05, 0x00, 'a', 0x01, 0x00},
+		"literal past length":   {0x01, 0x04, 'a', 'b'},
+		"literal past input":    {0x05, 0x10, 'h', 'e'},
+		"copy past its length":  {0x03, 0x00, 'a', 0x01 | 3<<2, 0x01},
+		"truncated long copy":   {0x05, 0x00, 'a', 0x03, 0x01},
+		"truncated long length": {0x05, 62 << 2, 0x01},
+	}
+	for name, src := range tests {
+		if _, err := Decompress(src, 1<<20); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Decompress returned %v, want ErrCorrupt", name, err)
+		}
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	reference := readFile(f, "testdata/Isaac.Newton-Opticks.txt.rawsnappy")
+	f.Add(reference)
+	f.Add(xerialStream(reference))
+	f.Add(Compress([]byte("hello, hello, hello, world")))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		const limit = 1 << 20
+		out, err := Decompress(src, limit)
+		if err == nil && len(out) > limit {
+			t.Errorf("Decompress returned %d bytes, over its limit", len(out))
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("hello, hello, hello, world"))
+	f.Add(bytes.Repeat([]byte("abcd"), 1000))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := Decompress(Compress(data), len(data))
+		if err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("round trip returned %x, want %x", out, data)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package zstd
+
+import "math/bits"
+
+// backwardReader reads a bitstream the way zstd stores its FSE and Huffman
+// streams: written forwards, read from the end. The highest set bit of the
+// last byte marks where the stream starts and values are read from the most
+// significant unread bits down.
+type backwardReader struct {
+	data []byte
+	// pos is the number of unread bits. Reading past the start makes it
+	// negative, with the missing bits read as zeros.
+	pos int
+}
+
+func newBackwardReader(data []byte) (*backwardReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, corruptf("bitstream without end mark")
+	}
+	return &backwardReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// peek returns the next n bits without consuming them.
+func (r *backwardReader) peek(n int) uint64 {
+	start := r.pos - n
+	if start >= 0 {
+		return r.extract(start, n)
+	}
+	if r.pos <= 0 {
+		return 0
+	}
+	return r.extract(0, r.pos) << -start
+}
+
+func (r *backwardReader) read(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.pos -= n
+	return v
+}
+
+func (r *backwardReader) overflowed() bool {
+	return r.pos < 0
+}
+
+// extract returns n <= 56 bits starting at bit start.
+func (r *backwardReader) extract(start int, n int) uint64 {
+	i := start >> 3
+	var v uint64
+	for j := 0; j < 8 && i+j < len(r.data); j++ {
+		v |= uint64(r.data[i+j]) << (8 * j)
+	}
+	return (v >> (start & 7)) & (1<<n - 1)
+}
+
+// forwardReader reads little endian bits from the start of data, as zstd
+// stores FSE table descriptions. Bits past the end read as zeros.
+type forwardReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *forwardReader) peek(n int) int {
+	i := r.pos >> 3
+	var v uint64
+	for j := 0; j < 8 && i+j < len(r.data); j++ {
+		v |= uint64(r.data[i+j]) << (8 * j)
+	}
+	return int((v >> (r.pos & 7)) & (1<<n - 1))
+}
+
+func (r *forwardReader) read(n int) int {
+	v := r.peek(n)
+	r.pos += n
+	return v
+}
+
+// bitWriter writes the forward bitstreams that decoders read backwards.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) addBits(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// close writes the end mark and pads the last byte.
+func (w *bitWriter) close() []byte {
+	w.addBits(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
@@ -0,0 +1,452 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	frameMagic          = 0xFD2FB528
+	skippableFrameMagic = 0x184D2A50
+	skippableFrameMask  = 0xFFFFFFF0
+
+	maxBlockSize = 128 << 10
+)
+
+const (
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+const (
+	literalsRaw        = 0
+	literalsRLE        = 1
+	literalsCompressed = 2
+	literalsTreeless   = 3
+)
+
+const (
+	modePredefined = 0
+	modeRLE        = 1
+	modeCompressed = 2
+	modeRepeat     = 3
+)
+
+// Baselines and extra bits of the literals length and match length codes.
+var (
+	literalsLengthBase = [36]int{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	literalsLengthBits = [36]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	matchLengthBase = [53]int{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	matchLengthBits = [53]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+type sequence struct {
+	literalsLength int
+	offsetValue    int
+	matchLength    int
+}
+
+// frameDecoder holds the state that blocks of a frame share: the previous
+// tables, for Repeat_Mode and treeless literals, and the repeat offsets.
+type frameDecoder struct {
+	huffman        *huffmanTable
+	literalsLength *fseTable
+	offset         *fseTable
+	matchLength    *fseTable
+	repeatOffsets  [3]int
+}
+
+// Decompress decodes one or more concatenated zstd frames, skipping
+// skippable frames, failing once the output would exceed limit bytes.
+// Dictionaries are not supported.
+func Decompress(src []byte, limit int) ([]byte, error) {
+	out := []byte{}
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, corruptf("truncated frame header")
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&skippableFrameMask == skippableFrameMagic {
+			size := int64(binary.LittleEndian.Uint32(src[4:]))
+			if size > int64(len(src)-8) {
+				return nil, corruptf("truncated skippable frame")
+			}
+			src = src[8+size:]
+			continue
+		}
+		if magic != frameMagic {
+			return nil, corruptf("unknown frame magic %#x", magic)
+		}
+		var n int
+		var err error
+		if out, n, err = decodeFrame(out, src, limit); err != nil {
+			return nil, err
+		}
+		src = src[n:]
+	}
+	return out, nil
+}
+
+// decodeFrame appends the content of the frame starting src to out and
+// returns the size of the frame.
+func decodeFrame(out []byte, src []byte, limit int) ([]byte, int, error) {
+	descriptor := src[4]
+	pos := 5
+	singleSegment := descriptor&0x20 != 0
+	hasChecksum := descriptor&0x04 != 0
+	if descriptor&0x08 != 0 {
+		return nil, 0, corruptf("reserved frame header bit set")
+	}
+	if !singleSegment {
+		pos++ // Window_Descriptor
+	}
+	dictionaryIdSize := [4]int{0, 1, 2, 4}[descriptor&0x03]
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	if pos+dictionaryIdSize+contentSizeSize > len(src) {
+		return nil, 0, corruptf("truncated frame header")
+	}
+	if readLittleEndian(src[pos:pos+dictionaryIdSize]) != 0 {
+		return nil, 0, fmt.Errorf("zstd: dictionaries are not supported")
+	}
+	pos += dictionaryIdSize
+	contentSize := int64(-1)
+	if contentSizeSize > 0 {
+		contentSize = int64(readLittleEndian(src[pos : pos+contentSizeSize]))
+		if contentSizeSize == 2 {
+			contentSize += 256
+		}
+	}
+	pos += contentSizeSize
+
+	start := len(out)
+	if contentSize > 0 {
+		// The declared size is untrusted, so it only bounds the first
+		// allocation.
+		out = append(make([]byte, 0, len(out)+int(min(contentSize, int64(limit), 1<<20))), out...)
+	}
+	d := &frameDecoder{repeatOffsets: [3]int{1, 4, 8}}
+	for last := false; !last; {
+		if pos+3 > len(src) {
+			return nil, 0, corruptf("truncated block header")
+		}
+		header := int(src[pos]) | int(src[pos+1])<<8 | int(src[pos+2])<<16
+		pos += 3
+		last = header&1 != 0
+		size := header >> 3
+		switch blockType := (header >> 1) & 3; blockType {
+		case blockRaw:
+			if pos+size > len(src) {
+				return nil, 0, corruptf("truncated raw block")
+			}
+			out = append(out, src[pos:pos+size]...)
+			pos += size
+		case blockRLE:
+			if pos+1 > len(src) || size > maxBlockSize {
+				return nil, 0, corruptf("invalid RLE block")
+			}
+			for range size {
+				out = append(out, src[pos])
+			}
+			pos++
+		case blockCompressed:
+			if pos+size > len(src) || size > maxBlockSize {
+				return nil, 0, corruptf("invalid compressed block of %d bytes", size)
+			}
+			var err error
+			if out, err = d.decodeBlock(out, start, src[pos:pos+size]); err != nil {
+				return nil, 0, err
+			}
+			pos += size
+		default:
+			return nil, 0, corruptf("reserved block type %d", blockType)
+		}
+		if len(out) > limit {
+			return nil, 0, fmt.Errorf("zstd: decompressed size exceeds %d bytes", limit)
+		}
+	}
+
+	if contentSize >= 0 && int64(len(out)-start) != contentSize {
+		return nil, 0, corruptf("frame content size %d does not match %d decoded bytes", contentSize, len(out)-start)
+	}
+	if hasChecksum {
+		if pos+4 > len(src) {
+			return nil, 0, corruptf("truncated content checksum")
+		}
+		if checksum := binary.LittleEndian.Uint32(src[pos:]); checksum != uint32(xxhash64(out[start:])) {
+			return nil, 0, corruptf("content checksum %#x does not match", checksum)
+		}
+		pos += 4
+	}
+	return out, pos, nil
+}
+
+// decodeBlock appends the content of a compressed block to out. Matches may
+// reach back to the start of the frame at out[start].
+func (d *frameDecoder) decodeBlock(out []byte, start int, block []byte) ([]byte, error) {
+	literals, n, err := d.decodeLiterals(block)
+	if err != nil {
+		return nil, err
+	}
+	sequences, err := d.decodeSequences(block[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range sequences {
+		if s.literalsLength > len(literals) {
+			return nil, corruptf("literals length %d overflows the literals", s.literalsLength)
+		}
+		out = append(out, literals[:s.literalsLength]...)
+		literals = literals[s.literalsLength:]
+
+		offset := d.resolveOffset(s)
+		if offset <= 0 || offset > len(out)-start {
+			return nil, corruptf("match offset %d before the start of the frame", offset)
+		}
+		from := len(out) - offset
+		if offset >= s.matchLength {
+			out = append(out, out[from:from+s.matchLength]...)
+		} else {
+			for i := 0; i < s.matchLength; i++ {
+				out = append(out, out[from+i])
+			}
+		}
+	}
+	return append(out, literals...), nil
+}
+
+// resolveOffset resolves the offset of a sequence, updating the repeat offsets.
+func (d *frameDecoder) resolveOffset(s sequence) int {
+	rep := &d.repeatOffsets
+	if s.offsetValue > 3 {
+		offset := s.offsetValue - 3
+		rep[0], rep[1], rep[2] = offset, rep[0], rep[1]
+		return offset
+	}
+	i := s.offsetValue - 1
+	if s.literalsLength == 0 {
+		i++
+	}
+	switch i {
+	case 0:
+		return rep[0]
+	case 1:
+		rep[0], rep[1] = rep[1], rep[0]
+	case 2:
+		rep[0], rep[1], rep[2] = rep[2], rep[0], rep[1]
+	case 3:
+		rep[0], rep[1], rep[2] = rep[0]-1, rep[0], rep[1]
+	}
+	return rep[0]
+}
+
+// decodeLiterals decodes the literals section of a block and returns the
+// literals and the size of the section.
+func (d *frameDecoder) decodeLiterals(block []byte) ([]byte, int, error) {
+	if len(block) == 0 {
+		return nil, 0, corruptf("empty block")
+	}
+	literalsType := block[0] & 3
+	sizeFormat := (block[0] >> 2) & 3
+
+	if literalsType == literalsRaw || literalsType == literalsRLE {
+		var size, headerSize int
+		switch sizeFormat {
+		case 0, 2:
+			size, headerSize = int(block[0]>>3), 1
+		case 1:
+			headerSize = 2
+		case 3:
+			headerSize = 3
+		}
+		if headerSize > len(block) {
+			return nil, 0, corruptf("truncated literals header")
+		}
+		if headerSize > 1 {
+			size = int(readLittleEndian(block[:headerSize])) >> 4
+		}
+		if literalsType == literalsRaw {
+			if headerSize+size > len(block) {
+				return nil, 0, corruptf("raw literals overflow the block")
+			}
+			return block[headerSize : headerSize+size], headerSize + size, nil
+		}
+		if headerSize+1 > len(block) || size > maxBlockSize {
+			return nil, 0, corruptf("invalid RLE literals")
+		}
+		literals := make([]byte, size)
+		for i := range literals {
+			literals[i] = block[headerSize]
+		}
+		return literals, headerSize + 1, nil
+	}
+
+	streams, headerSize, sizeBits := 4, 3, 10
+	switch sizeFormat {
+	case 0:
+		streams = 1
+	case 2:
+		headerSize, sizeBits = 4, 14
+	case 3:
+		headerSize, sizeBits = 5, 18
+	}
+	if headerSize > len(block) {
+		return nil, 0, corruptf("truncated literals header")
+	}
+	header := readLittleEndian(block[:headerSize]) >> 4
+	regenerated := int(header & (1<<sizeBits - 1))
+	compressed := int(header >> sizeBits & (1<<sizeBits - 1))
+	if headerSize+compressed > len(block) || regenerated > maxBlockSize {
+		return nil, 0, corruptf("compressed literals overflow the block")
+	}
+	src := block[headerSize : headerSize+compressed]
+	if literalsType == literalsCompressed {
+		table, n, err := readHuffmanTable(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.huffman = table
+		src = src[n:]
+	} else if d.huffman == nil {
+		return nil, 0, corruptf("treeless literals without a previous Huffman table")
+	}
+	literals, err := d.huffman.decode(src, regenerated, streams)
+	return literals, headerSize + compressed, err
+}
+
+// decodeSequences decodes the sequences section that ends a block.
+func (d *frameDecoder) decodeSequences(src []byte) ([]sequence, error) {
+	if len(src) == 0 {
+		return nil, corruptf("missing sequences section")
+	}
+	count, pos := int(src[0]), 1
+	switch {
+	case count == 0:
+		return nil, nil
+	case count < 128:
+	case count < 255:
+		if len(src) < 2 {
+			return nil, corruptf("truncated sequences header")
+		}
+		count, pos = (count-128)<<8+int(src[1]), 2
+	default:
+		if len(src) < 3 {
+			return nil, corruptf("truncated sequences header")
+		}
+		count, pos = int(src[1])+int(src[2])<<8+0x7F00, 3
+	}
+	if pos >= len(src) {
+		return nil, corruptf("truncated sequences header")
+	}
+	modes := src[pos]
+	pos++
+
+	var err error
+	var n int
+	if d.literalsLength, n, err = selectTable(modes>>6, src[pos:], d.literalsLength, literalsLengthTable, 35, 9); err != nil {
+		return nil, err
+	}
+	pos += n
+	if d.offset, n, err = selectTable(modes>>4&3, src[pos:], d.offset, offsetTable, 31, 8); err != nil {
+		return nil, err
+	}
+	pos += n
+	if d.matchLength, n, err = selectTable(modes>>2&3, src[pos:], d.matchLength, matchLengthTable, 52, 9); err != nil {
+		return nil, err
+	}
+	pos += n
+
+	r, err := newBackwardReader(src[pos:])
+	if err != nil {
+		return nil, err
+	}
+	ll, of, ml := d.literalsLength, d.offset, d.matchLength
+	llState := int(r.read(ll.accuracyLog))
+	ofState := int(r.read(of.accuracyLog))
+	mlState := int(r.read(ml.accuracyLog))
+
+	sequences := make([]sequence, 0, min(count, maxBlockSize))
+	for i := 0; i < count; i++ {
+		llCode, ofCode, mlCode := ll.entries[llState].symbol, of.entries[ofState].symbol, ml.entries[mlState].symbol
+		if int(llCode) >= len(literalsLengthBase) || int(mlCode) >= len(matchLengthBase) || ofCode > 31 {
+			return nil, corruptf("invalid sequence codes")
+		}
+		s := sequence{}
+		s.offsetValue = 1<<ofCode + int(r.read(int(ofCode)))
+		s.matchLength = matchLengthBase[mlCode] + int(r.read(matchLengthBits[mlCode]))
+		s.literalsLength = literalsLengthBase[llCode] + int(r.read(literalsLengthBits[llCode]))
+		sequences = append(sequences, s)
+
+		if i < count-1 {
+			llState = nextState(r, ll, llState)
+			mlState = nextState(r, ml, mlState)
+			ofState = nextState(r, of, ofState)
+		}
+		if r.overflowed() {
+			return nil, corruptf("sequences overflow the block")
+		}
+	}
+	if r.pos != 0 {
+		return nil, corruptf("sequences bitstream not fully consumed")
+	}
+	return sequences, nil
+}
+
+func nextState(r *backwardReader, table *fseTable, state int) int {
+	e := table.entries[state]
+	return int(e.base) + int(r.read(int(e.nbBits)))
+}
+
+// selectTable returns the table a sequences section uses for one kind of
+// code and the number of bytes its description took.
+func selectTable(mode byte, src []byte, previous *fseTable, predefined *fseTable, maxSymbol int, maxAccuracyLog int) (*fseTable, int, error) {
+	switch mode {
+	case modePredefined:
+		return predefined, 0, nil
+	case modeRLE:
+		if len(src) == 0 {
+			return nil, 0, corruptf("truncated RLE sequence table")
+		}
+		if int(src[0]) > maxSymbol {
+			return nil, 0, corruptf("RLE sequence code %d above %d", src[0], maxSymbol)
+		}
+		return rleFSETable(src[0]), 1, nil
+	case modeCompressed:
+		return readFSETable(src, maxSymbol, maxAccuracyLog)
+	default:
+		if previous == nil {
+			return nil, 0, corruptf("repeated sequence table without a previous one")
+		}
+		return previous, 0, nil
+	}
+}
+
+func readLittleEndian(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
@@ -0,0 +1,176 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	minMatch  = 4
+	hashLog   = 16
+	maxOffset = 1 << 24
+)
+
+var (
+	literalsLengthEncoder = newFSEEncoder(literalsLengthDefault, 6)
+	matchLengthEncoder    = newFSEEncoder(matchLengthDefault, 6)
+	offsetEncoder         = newFSEEncoder(offsetDefault, 5)
+)
+
+// Compress encodes src as a single zstd frame with a content checksum.
+//
+// Matches are found greedily with a hash table and their sequences coded with
+// the predefined FSE tables, literals are stored raw. That is far from
+// zstd's own ratios but cheap, and any zstd decoder reads the result.
+func Compress(src []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, frameMagic)
+	// Single_Segment_Flag and Content_Checksum_Flag, with the smallest
+	// Frame_Content_Size field the size fits in.
+	switch size := uint64(len(src)); {
+	case size < 256:
+		out = append(out, 0x24, byte(size))
+	case size < 65536+256:
+		out = append(out, 0x64)
+		out = binary.LittleEndian.AppendUint16(out, uint16(size-256))
+	case size < 1<<32:
+		out = append(out, 0xA4)
+		out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	default:
+		out = append(out, 0xE4)
+		out = binary.LittleEndian.AppendUint64(out, size)
+	}
+
+	table := make([]int32, 1<<hashLog)
+	for start := 0; start < len(src) || start == 0; start += maxBlockSize {
+		end := min(start+maxBlockSize, len(src))
+		last := 0
+		if end == len(src) {
+			last = 1
+		}
+		block := compressBlock(src, start, end, table)
+		if block == nil || len(block) >= end-start {
+			out = appendBlockHeader(out, last, blockRaw, end-start)
+			out = append(out, src[start:end]...)
+		} else {
+			out = appendBlockHeader(out, last, blockCompressed, len(block))
+			out = append(out, block...)
+		}
+		if end == len(src) {
+			break
+		}
+	}
+	return binary.LittleEndian.AppendUint32(out, uint32(xxhash64(src)))
+}
+
+func appendBlockHeader(out []byte, last int, blockType int, size int) []byte {
+	header := size<<3 | blockType<<1 | last
+	return append(out, byte(header), byte(header>>8), byte(header>>16))
+}
+
+// compressBlock returns the compressed block for src[start:end], whose
+// matches may reach back to the start of src, or nil if it found none.
+// table maps hashes of 4 bytes to their position plus one.
+func compressBlock(src []byte, start int, end int, table []int32) []byte {
+	literals := []byte{}
+	sequences := []sequence{}
+	literalsStart := start
+	for i := start; i+minMatch <= end; {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 2654435761) >> (32 - hashLog)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			// Skip faster through data that does not compress.
+			i += 1 + (i-literalsStart)>>6
+			continue
+		}
+		length := minMatch
+		for i+length < end && src[candidate+length] == src[i+length] {
+			length++
+		}
+		for i > literalsStart && candidate > 0 && src[i-1] == src[candidate-1] {
+			i, candidate, length = i-1, candidate-1, length+1
+		}
+		literals = append(literals, src[literalsStart:i]...)
+		sequences = append(sequences, sequence{
+			literalsLength: i - literalsStart,
+			offsetValue:    i - candidate + 3,
+			matchLength:    length,
+		})
+		i += length
+		literalsStart = i
+	}
+	if len(sequences) == 0 {
+		return nil
+	}
+	literals = append(literals, src[literalsStart:end]...)
+
+	// Raw literals section.
+	var block []byte
+	switch size := len(literals); {
+	case size < 32:
+		block = append(block, byte(size<<3))
+	case size < 4096:
+		block = append(block, byte(size<<4|0x04), byte(size>>4))
+	default:
+		block = append(block, byte(size<<4|0x0C), byte(size>>4), byte(size>>12))
+	}
+	block = append(block, literals...)
+
+	switch n := len(sequences); {
+	case n < 128:
+		block = append(block, byte(n))
+	case n < 0x7F00:
+		block = append(block, byte(n>>8+128), byte(n))
+	default:
+		block = append(block, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	block = append(block, 0) // Predefined_Mode for all three codes
+	return append(block, encodeSequences(sequences)...)
+}
+
+// encodeSequences writes the sequences bitstream, last sequence first so the
+// decoder reads them in order.
+func encodeSequences(sequences []sequence) []byte {
+	type codes struct{ ll, of, ml uint8 }
+	coded := make([]codes, len(sequences))
+	for i, s := range sequences {
+		coded[i] = codes{
+			ll: code(literalsLengthBase[:], s.literalsLength),
+			of: uint8(bits.Len(uint(s.offsetValue)) - 1),
+			ml: code(matchLengthBase[:], s.matchLength),
+		}
+	}
+	w := &bitWriter{}
+	addExtraBits := func(i int) {
+		s, c := sequences[i], coded[i]
+		w.addBits(uint64(s.literalsLength-literalsLengthBase[c.ll]), uint(literalsLengthBits[c.ll]))
+		w.addBits(uint64(s.matchLength-matchLengthBase[c.ml]), uint(matchLengthBits[c.ml]))
+		w.addBits(uint64(s.offsetValue), uint(c.of))
+	}
+
+	last := len(sequences) - 1
+	mlState := matchLengthEncoder.init(coded[last].ml)
+	ofState := offsetEncoder.init(coded[last].of)
+	llState := literalsLengthEncoder.init(coded[last].ll)
+	addExtraBits(last)
+	for i := last - 1; i >= 0; i-- {
+		ofState = offsetEncoder.encode(w, ofState, coded[i].of)
+		mlState = matchLengthEncoder.encode(w, mlState, coded[i].ml)
+		llState = literalsLengthEncoder.encode(w, llState, coded[i].ll)
+		addExtraBits(i)
+	}
+	matchLengthEncoder.flush(w, mlState)
+	offsetEncoder.flush(w, ofState)
+	literalsLengthEncoder.flush(w, llState)
+	return w.close()
+}
+
+// code returns the largest code whose baseline is at most value.
+func code(baselines []int, value int) uint8 {
+	c := len(baselines) - 1
+	for baselines[c] > value {
+		c--
+	}
+	return uint8(c)
+}
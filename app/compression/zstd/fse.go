@@ -0,0 +1,244 @@
+package zstd
+
+import "math/bits"
+
+// fseTable is an FSE decoding table: each state gives a symbol and how to
+// read the next state.
+type fseTable struct {
+	accuracyLog int
+	entries     []fseEntry
+}
+
+type fseEntry struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+// Predefined distributions used by sequences in Predefined_Mode.
+var (
+	literalsLengthDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	matchLengthDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	offsetDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	literalsLengthTable = mustFSETable(literalsLengthDefault, 6)
+	matchLengthTable    = mustFSETable(matchLengthDefault, 6)
+	offsetTable         = mustFSETable(offsetDefault, 5)
+)
+
+func mustFSETable(norm []int16, accuracyLog int) *fseTable {
+	table, err := buildFSETable(norm, accuracyLog)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// rleFSETable is the table of RLE_Mode, which always decodes symbol.
+func rleFSETable(symbol uint8) *fseTable {
+	return &fseTable{entries: []fseEntry{{symbol: symbol}}}
+}
+
+// readFSETable decodes an FSE table description and returns the table and
+// the number of bytes it took.
+func readFSETable(src []byte, maxSymbol int, maxAccuracyLog int) (*fseTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, corruptf("empty FSE table description")
+	}
+	r := &forwardReader{data: src}
+	accuracyLog := r.read(4) + 5
+	if accuracyLog > maxAccuracyLog {
+		return nil, 0, corruptf("FSE accuracy log %d above %d", accuracyLog, maxAccuracyLog)
+	}
+
+	remaining := 1<<accuracyLog + 1
+	threshold := 1 << accuracyLog
+	nbBits := accuracyLog + 1
+	norm := []int16{}
+	previousZero := false
+	for remaining > 1 && len(norm) <= maxSymbol {
+		if previousZero {
+			// A zero probability is followed by 2 bit repeat flags
+			// giving how many more zeros follow, 3 meaning 3 and
+			// another flag.
+			for {
+				repeat := r.read(2)
+				for range repeat {
+					norm = append(norm, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+			if len(norm) > maxSymbol {
+				return nil, 0, corruptf("FSE symbol %d above %d", len(norm), maxSymbol)
+			}
+		}
+
+		limit := 2*threshold - 1 - remaining
+		var count int
+		if low := r.peek(nbBits - 1); low < limit {
+			count = low
+			r.pos += nbBits - 1
+		} else {
+			count = r.peek(nbBits)
+			if count >= threshold {
+				count -= limit
+			}
+			r.pos += nbBits
+		}
+		// count is the probability plus one, 0 meaning "less than 1".
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		previousZero = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 {
+		return nil, 0, corruptf("FSE probabilities do not add up")
+	}
+	size := (r.pos + 7) / 8
+	if size > len(src) {
+		return nil, 0, corruptf("FSE table description overflows its %d bytes", len(src))
+	}
+	table, err := buildFSETable(norm, accuracyLog)
+	return table, size, err
+}
+
+// spreadSymbols places the symbols of a normalized distribution in the
+// table the way both the encoder and the decoder must.
+func spreadSymbols(norm []int16, accuracyLog int) ([]uint8, error) {
+	tableSize := 1 << accuracyLog
+	symbols := make([]uint8, tableSize)
+	high := tableSize - 1
+	for s, count := range norm {
+		if count == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := tableSize>>1 + tableSize>>3 + 3
+	mask := tableSize - 1
+	pos := 0
+	for s, count := range norm {
+		for i := 0; i < int(count); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, corruptf("FSE probabilities do not fill the table")
+	}
+	return symbols, nil
+}
+
+func buildFSETable(norm []int16, accuracyLog int) (*fseTable, error) {
+	symbols, err := spreadSymbols(norm, accuracyLog)
+	if err != nil {
+		return nil, err
+	}
+	tableSize := 1 << accuracyLog
+	next := make([]int, len(norm))
+	for s, count := range norm {
+		next[s] = max(int(count), 1)
+	}
+	table := &fseTable{accuracyLog: accuracyLog, entries: make([]fseEntry, tableSize)}
+	for u, s := range symbols {
+		state := next[s]
+		next[s]++
+		nbBits := accuracyLog - (bits.Len(uint(state)) - 1)
+		table.entries[u] = fseEntry{symbol: s, nbBits: uint8(nbBits), base: uint16(state<<nbBits - tableSize)}
+	}
+	return table, nil
+}
+
+// fseEncoder encodes symbols with a normalized distribution so that an
+// fseTable built from the same distribution decodes them.
+type fseEncoder struct {
+	accuracyLog int
+	stateTable  []uint16
+	transforms  []fseTransform
+}
+
+type fseTransform struct {
+	deltaNbBits    int
+	deltaFindState int
+}
+
+func newFSEEncoder(norm []int16, accuracyLog int) *fseEncoder {
+	symbols, err := spreadSymbols(norm, accuracyLog)
+	if err != nil {
+		panic(err)
+	}
+	tableSize := 1 << accuracyLog
+	cumul := make([]int, len(norm)+1)
+	for s, count := range norm {
+		if count == -1 {
+			count = 1
+		}
+		cumul[s+1] = cumul[s] + int(count)
+	}
+	e := &fseEncoder{
+		accuracyLog: accuracyLog,
+		stateTable:  make([]uint16, tableSize),
+		transforms:  make([]fseTransform, len(norm)),
+	}
+	for u, s := range symbols {
+		e.stateTable[cumul[s]] = uint16(tableSize + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, count := range norm {
+		switch count {
+		case 0:
+		case -1, 1:
+			e.transforms[s] = fseTransform{deltaNbBits: accuracyLog<<16 - tableSize, deltaFindState: total - 1}
+			total++
+		default:
+			maxBitsOut := accuracyLog - (bits.Len(uint(count-1)) - 1)
+			e.transforms[s] = fseTransform{deltaNbBits: maxBitsOut<<16 - int(count)<<maxBitsOut, deltaFindState: total - int(count)}
+			total += int(count)
+		}
+	}
+	return e
+}
+
+func (e *fseEncoder) init(symbol uint8) int {
+	t := e.transforms[symbol]
+	nbBitsOut := (t.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - t.deltaNbBits
+	return int(e.stateTable[value>>nbBitsOut+t.deltaFindState])
+}
+
+func (e *fseEncoder) encode(w *bitWriter, state int, symbol uint8) int {
+	t := e.transforms[symbol]
+	nbBitsOut := (state + t.deltaNbBits) >> 16
+	w.addBits(uint64(state), uint(nbBitsOut))
+	return int(e.stateTable[state>>nbBitsOut+t.deltaFindState])
+}
+
+func (e *fseEncoder) flush(w *bitWriter, state int) {
+	w.addBits(uint64(state), uint(e.accuracyLog))
+}
@@ -0,0 +1,180 @@
+package zstd
+
+import "math/bits"
+
+const maxHuffmanBits = 11
+
+// huffmanTable decodes literals by looking up the next maxBits bits.
+type huffmanTable struct {
+	maxBits int
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	symbol byte
+	nbBits uint8
+}
+
+// readHuffmanTable decodes a Huffman tree description and returns the table
+// and the number of bytes it took.
+func readHuffmanTable(src []byte) (*huffmanTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, corruptf("empty Huffman tree description")
+	}
+	var weights []byte
+	size := 0
+	if header := int(src[0]); header < 128 {
+		// FSE compressed weights, decoded with two interleaved states.
+		size = 1 + header
+		if size > len(src) {
+			return nil, 0, corruptf("Huffman weights overflow the literals section")
+		}
+		table, n, err := readFSETable(src[1:size], 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := newBackwardReader(src[1+n : size])
+		if err != nil {
+			return nil, 0, err
+		}
+		state1, state2 := int(r.read(table.accuracyLog)), int(r.read(table.accuracyLog))
+		next := func(state int) (byte, int) {
+			e := table.entries[state]
+			return e.symbol, int(e.base) + int(r.read(int(e.nbBits)))
+		}
+		var w byte
+		for len(weights) < 255 {
+			w, state1 = next(state1)
+			weights = append(weights, w)
+			if r.overflowed() {
+				weights = append(weights, table.entries[state2].symbol)
+				break
+			}
+			w, state2 = next(state2)
+			weights = append(weights, w)
+			if r.overflowed() {
+				weights = append(weights, table.entries[state1].symbol)
+				break
+			}
+		}
+	} else {
+		// Weights stored directly, 4 bits each.
+		count := header - 127
+		size = 1 + (count+1)/2
+		if size > len(src) {
+			return nil, 0, corruptf("Huffman weights overflow the literals section")
+		}
+		for i := 0; i < count; i++ {
+			w := src[1+i/2]
+			if i%2 == 0 {
+				w >>= 4
+			}
+			weights = append(weights, w&0x0F)
+		}
+	}
+
+	table, err := buildHuffmanTable(weights)
+	return table, size, err
+}
+
+// buildHuffmanTable builds the decoding table from the weights of all but
+// the last symbol, whose weight is implied by the total being a power of 2.
+func buildHuffmanTable(weights []byte) (*huffmanTable, error) {
+	total := 0
+	for _, w := range weights {
+		if w > maxHuffmanBits {
+			return nil, corruptf("Huffman weight %d above %d", w, maxHuffmanBits)
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, corruptf("Huffman weights are all zero")
+	}
+	maxBits := bits.Len(uint(total))
+	if maxBits > maxHuffmanBits {
+		return nil, corruptf("Huffman table of %d bits above %d", maxBits, maxHuffmanBits)
+	}
+	rest := 1<<maxBits - total
+	if rest&(rest-1) != 0 {
+		return nil, corruptf("Huffman weights do not add up to a power of 2")
+	}
+	weights = append(weights, byte(bits.Len(uint(rest))))
+
+	// Codes are assigned by increasing weight, then symbol.
+	counts := make([]int, maxBits+1)
+	for _, w := range weights {
+		if int(w) > maxBits {
+			return nil, corruptf("Huffman weight %d above %d", w, maxBits)
+		}
+		counts[w]++
+	}
+	starts := make([]int, maxBits+1)
+	next := 0
+	for w := 1; w <= maxBits; w++ {
+		starts[w] = next
+		next += counts[w] << (w - 1)
+	}
+
+	table := &huffmanTable{maxBits: maxBits, entries: make([]huffmanEntry, 1<<maxBits)}
+	for symbol, w := range weights {
+		if w == 0 {
+			continue
+		}
+		length := 1 << (w - 1)
+		for i := starts[w]; i < starts[w]+length; i++ {
+			table.entries[i] = huffmanEntry{symbol: byte(symbol), nbBits: uint8(maxBits + 1 - int(w))}
+		}
+		starts[w] += length
+	}
+	return table, nil
+}
+
+// decodeStream appends size literals decoded from one Huffman stream.
+func (t *huffmanTable) decodeStream(dst []byte, src []byte, size int) ([]byte, error) {
+	r, err := newBackwardReader(src)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < size; i++ {
+		e := t.entries[r.peek(t.maxBits)]
+		dst = append(dst, e.symbol)
+		r.pos -= int(e.nbBits)
+	}
+	if r.pos != 0 {
+		return nil, corruptf("Huffman stream not fully consumed")
+	}
+	return dst, nil
+}
+
+// decode decodes a single Huffman stream, or four of them preceded by a
+// jump table giving the sizes of the first three.
+func (t *huffmanTable) decode(src []byte, size int, streams int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	if streams == 1 {
+		return t.decodeStream(out, src, size)
+	}
+	if len(src) < 6 {
+		return nil, corruptf("truncated Huffman jump table")
+	}
+	sizes := [4]int{int(src[0]) | int(src[1])<<8, int(src[2]) | int(src[3])<<8, int(src[4]) | int(src[5])<<8}
+	src = src[6:]
+	sizes[3] = len(src) - sizes[0] - sizes[1] - sizes[2]
+	segment := (size + 3) / 4
+	if sizes[3] < 0 || size < 3*segment {
+		return nil, corruptf("Huffman streams overflow the literals section")
+	}
+	var err error
+	for i, n := range sizes {
+		regenerated := segment
+		if i == 3 {
+			regenerated = size - 3*segment
+		}
+		if out, err = t.decodeStream(out, src[:n], regenerated); err != nil {
+			return nil, err
+		}
+		src = src[n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,15 @@
+// Package zstd implements the Zstandard format of RFC 8878, enough for record
+// batches: a complete decoder without dictionary support and a fast encoder.
+package zstd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupt is wrapped by every error about malformed input.
+var ErrCorrupt = errors.New("zstd: corrupt input")
+
+func corruptf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,168 @@
+package zstd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// inputs are the contents round tripped through Compress and Decompress.
+func inputs(t testing.TB) map[string][]byte {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	return map[string][]byte{
+		"empty":      {},
+		"one byte":   {'a'},
+		"short":      []byte("hello, world"),
+		"run":        bytes.Repeat([]byte{'x'}, 200<<10),
+		"random":     random,
+		"text":       opticks,
+		"repeated":   bytes.Repeat(opticks, 20),
+		"mixed":      append(append(append([]byte{}, opticks...), random[:70<<10]...), opticks...),
+		"short runs": []byte(strings.Repeat("abcabcabd", 1000)),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range inputs(t) {
+		compressed := Compress(data)
+		out, err := Decompress(compressed, len(data))
+		if err != nil {
+			t.Errorf("%s: Decompress: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip returned %d bytes, want the %d compressed", name, len(out), len(data))
+		}
+		if len(data) > 0 {
+			if _, err := Decompress(compressed, len(data)-1); err == nil {
+				t.Errorf("%s: Decompress succeeded past its limit", name)
+			}
+		}
+	}
+}
+
+// TestKnownVectors decodes frames written by the reference zstd tool. See
+// testdata/README.
+func TestKnownVectors(t *testing.T) {
+	opticks := readFile(t, "../testdata/Isaac.Newton-Opticks.txt")
+	for _, name := range []string{"opticks.1.zst", "opticks.19.zst", "opticks.stream.zst"} {
+		out, err := Decompress(readFile(t, filepath.Join("testdata", name)), 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(out, opticks) {
+			t.Errorf("%s: decoded %d bytes, want the %d of the text", name, len(out), len(opticks))
+		}
+	}
+
+	// The other frames are named after the leading hex digits of the SHA-256
+	// of their content.
+	hashed, err := filepath.Glob("testdata/????????.*.zst")
+	if err != nil || len(hashed) == 0 {
+		t.Fatalf("no hashed frames in testdata: %v", err)
+	}
+	for _, path := range hashed {
+		out, err := Decompress(readFile(t, path), 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		sum := sha256.Sum256(out)
+		if want := filepath.Base(path)[:8]; hex.EncodeToString(sum[:4]) != want {
+			t.Errorf("%s: decoded content hashes to %x, want %s", path, sum[:4], want)
+		}
+	}
+}
+
+func TestConcatenatedAndSkippableFrames(t *testing.T) {
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic+3)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "abcde"...)
+
+	reference := readFile(t, "testdata/f2a8e35c.helloworld-11000x.zst")
+	content, err := Decompress(reference, 1<<20)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+
+	var src []byte
+	src = append(src, Compress([]byte("first"))...)
+	src = append(src, skippable...)
+	src = append(src, reference...)
+	src = append(src, Compress([]byte("last"))...)
+	out, err := Decompress(src, 1<<20)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	want := append(append([]byte("first"), content...), "last"...)
+	if !bytes.Equal(out, want) {
+		t.Errorf("decoded %d bytes, want the %d of the frames in order", len(out), len(want))
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	frame := readFile(t, "testdata/opticks.19.zst")
+	tests := map[string][]byte{
+		"short header":    frame[:5],
+		"truncated":       frame[:len(frame)/2],
+		"no checksum":     frame[:len(frame)-4],
+		"bad magic":       append([]byte{0x29}, frame[1:]...),
+		"short skippable": binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, skippableFrameMagic), 10),
+	}
+	flipped := bytes.Clone(frame)
+	flipped[len(flipped)-1] ^= 0xFF
+	tests["checksum mismatch"] = flipped
+
+	for name, src := range tests {
+		if _, err := Decompress(src, 1<<20); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Decompress returned %v, want ErrCorrupt", name, err)
+		}
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	paths, _ := filepath.Glob("testdata/*.zst")
+	for _, path := range paths {
+		f.Add(readFile(f, path))
+	}
+	f.Add(Compress([]byte("hello, hello, hello, world")))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		const limit = 1 << 20
+		out, err := Decompress(src, limit)
+		if err == nil && len(out) > limit {
+			t.Errorf("Decompress returned %d bytes, over its limit", len(out))
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("hello, hello, hello, world"))
+	f.Add(bytes.Repeat([]byte("abcd"), 1000))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := Decompress(Compress(data), len(data))
+		if err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("round trip returned %x, want %x", out, data)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	props map[string]string
+}
+
+func New(props map[string]string) *Config {
+	if props == nil {
+		props = map[string]string{}
+	}
+	return &Config{props: props}
+}
+
+// Load parses a server.properties style file. Blank lines and lines starting
+// with # or ! are ignored.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config %s: %w", path, err)
+	}
+	defer f.Close()
+
+	props := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			key, value, _ = strings.Cut(line, ":")
+		}
+		props[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read config %s: %w", path, err)
+	}
+	return New(props), nil
+}
+
+func (c *Config) Set(key, value string) {
+	c.props[key] = value
+}
+
+func (c *Config) String(key, def string) string {
+	if v, ok := c.props[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (c *Config) Int(key string, def int) int {
+	v, ok := c.props[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		malformed(key, v, def)
+		return def
+	}
+	return n
+}
+
+func (c *Config) Int64(key string, def int64) int64 {
+	v, ok := c.props[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		malformed(key, v, def)
+		return def
+	}
+	return n
+}
+
+func (c *Config) Float64(key string, def float64) float64 {
+	v, ok := c.props[key]
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		malformed(key, v, def)
+		return def
+	}
+	return f
+}
+
+func (c *Config) Bool(key string, def bool) bool {
+	v, ok := c.props[key]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		malformed(key, v, def)
+		return def
+	}
+	return b
+}
+
+// malformed reports a value that does not parse, so a typo in the config
+// does not go unnoticed behind the default.
+func malformed(key, value string, def any) {
+	fmt.Printf("Error parsing config %s=%q, using %v\n", key, value, def)
+}
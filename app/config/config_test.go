@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestMalformedValuesFallBackToDefault(t *testing.T) {
+	c := New(map[string]string{
+		"int":   "12x",
+		"int64": "",
+		"float": "one",
+		"bool":  "yes",
+	})
+	if got := c.Int("int", 1); got != 1 {
+		t.Errorf("Int got %d, want the default 1", got)
+	}
+	if got := c.Int64("int64", 2); got != 2 {
+		t.Errorf("Int64 got %d, want the default 2", got)
+	}
+	if got := c.Float64("float", 0.5); got != 0.5 {
+		t.Errorf("Float64 got %v, want the default 0.5", got)
+	}
+	if got := c.Bool("bool", true); !got {
+		t.Errorf("Bool got %t, want the default true", got)
+	}
+
+	c.Set("int", "12")
+	if got := c.Int("int", 1); got != 12 {
+		t.Errorf("Int got %d, want 12", got)
+	}
+}
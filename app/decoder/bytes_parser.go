@@ -68,3 +68,91 @@ func (p *BytesParser) ReadUUID() []byte {
 	p.offset += 16
 	return uuid
 }
+
+func (p *BytesParser) Remaining() int {
+	return p.limit - p.offset
+}
+
+func (p *BytesParser) ReadBytes(n int) []byte {
+	b := make([]byte, n)
+	copy(b, p.data[p.offset:p.offset+n])
+	p.offset += n
+	return b
+}
+
+func (p *BytesParser) ReadUvarint() uint64 {
+	n, size := binary.Uvarint(p.data[p.offset:p.limit])
+	p.offset += size
+	return n
+}
+
+func (p *BytesParser) ReadVarint() int64 {
+	n, size := binary.Varint(p.data[p.offset:p.limit])
+	p.offset += size
+	return n
+}
+
+func (p *BytesParser) ReadString() string {
+	return p.ReadNullableString()
+}
+
+// ReadCompactNullableString returns ok=false for a null string.
+func (p *BytesParser) ReadCompactNullableString() (string, bool) {
+	length := int(p.ReadUvarint()) - 1
+	if length < 0 {
+		return "", false
+	}
+	value := string(p.data[p.offset : p.offset+length])
+	p.offset += length
+	return value, true
+}
+
+// ReadArrayLength reads an INT32 array length, or a COMPACT_ARRAY length when
+// flexible is set. Null arrays are returned as -1.
+func (p *BytesParser) ReadArrayLength(flexible bool) int {
+	if flexible {
+		return int(p.ReadUvarint()) - 1
+	}
+	return int(p.ReadInt32())
+}
+
+// ReadVersionedString reads a COMPACT_STRING when flexible is set and a
+// STRING otherwise.
+func (p *BytesParser) ReadVersionedString(flexible bool) string {
+	if flexible {
+		s, _ := p.ReadCompactNullableString()
+		return s
+	}
+	return p.ReadNullableString()
+}
+
+// ReadTaggedFields reads a tagged field section and returns the raw value of
+// each tag.
+func (p *BytesParser) ReadTaggedFields() map[uint64][]byte {
+	count := p.ReadUvarint()
+	if count == 0 {
+		return nil
+	}
+	fields := make(map[uint64][]byte, count)
+	for range count {
+		tag := p.ReadUvarint()
+		size := int(p.ReadUvarint())
+		fields[tag] = p.ReadBytes(size)
+	}
+	return fields
+}
+
+// ReadNullableBytes reads COMPACT_BYTES when flexible is set and BYTES
+// otherwise. Null is returned as nil.
+func (p *BytesParser) ReadNullableBytes(flexible bool) []byte {
+	length := 0
+	if flexible {
+		length = int(p.ReadUvarint()) - 1
+	} else {
+		length = int(p.ReadInt32())
+	}
+	if length < 0 {
+		return nil
+	}
+	return p.ReadBytes(length)
+}
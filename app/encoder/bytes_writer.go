@@ -0,0 +1,148 @@
+package encoder
+
+import (
+	"encoding/binary"
+)
+
+type BytesWriter struct {
+	data []byte
+	// regions are the file regions written so far, each placed at the
+	// length data had when it was written.
+	regions []placedRegion
+}
+
+type placedRegion struct {
+	offset int
+	region FileRegion
+}
+
+func NewBytesWriter() *BytesWriter {
+	return &BytesWriter{data: make([]byte, 0, 64)}
+}
+
+// Bytes returns the bytes written, leaving out any file regions.
+func (w *BytesWriter) Bytes() []byte {
+	return w.data
+}
+
+// Send returns everything written, file regions included.
+func (w *BytesWriter) Send() *Send {
+	s := &Send{}
+	start := 0
+	for _, placed := range w.regions {
+		s.parts = append(s.parts, sendPart{data: w.data[start:placed.offset]}, sendPart{region: placed.region})
+		start = placed.offset
+	}
+	s.parts = append(s.parts, sendPart{data: w.data[start:]})
+	return s
+}
+
+func (w *BytesWriter) Len() int {
+	return len(w.data)
+}
+
+func (w *BytesWriter) Write(b []byte) {
+	w.data = append(w.data, b...)
+}
+
+func (w *BytesWriter) WriteInt8(n int8) {
+	w.data = append(w.data, byte(n))
+}
+
+func (w *BytesWriter) WriteBool(b bool) {
+	if b {
+		w.WriteInt8(1)
+	} else {
+		w.WriteInt8(0)
+	}
+}
+
+func (w *BytesWriter) WriteInt16(n int16) {
+	w.data = binary.BigEndian.AppendUint16(w.data, uint16(n))
+}
+
+func (w *BytesWriter) WriteInt32(n int32) {
+	w.data = binary.BigEndian.AppendUint32(w.data, uint32(n))
+}
+
+func (w *BytesWriter) WriteInt64(n int64) {
+	w.data = binary.BigEndian.AppendUint64(w.data, uint64(n))
+}
+
+func (w *BytesWriter) WriteUvarint(n uint64) {
+	w.data = binary.AppendUvarint(w.data, n)
+}
+
+func (w *BytesWriter) WriteVarint(n int64) {
+	w.data = binary.AppendVarint(w.data, n)
+}
+
+// WriteArrayLength writes an INT32 array length, or a COMPACT_ARRAY length
+// when flexible is set. A negative n encodes a null array.
+func (w *BytesWriter) WriteArrayLength(n int, flexible bool) {
+	if flexible {
+		w.WriteUvarint(uint64(n + 1))
+	} else {
+		w.WriteInt32(int32(n))
+	}
+}
+
+// WriteString writes a COMPACT_STRING when flexible is set and a STRING
+// otherwise.
+func (w *BytesWriter) WriteString(s string, flexible bool) {
+	if flexible {
+		w.WriteUvarint(uint64(len(s) + 1))
+	} else {
+		w.WriteInt16(int16(len(s)))
+	}
+	w.data = append(w.data, s...)
+}
+
+func (w *BytesWriter) WriteNullableString(s *string, flexible bool) {
+	if s != nil {
+		w.WriteString(*s, flexible)
+	} else if flexible {
+		w.WriteUvarint(0)
+	} else {
+		w.WriteInt16(-1)
+	}
+}
+
+// WriteBytes writes COMPACT_BYTES when flexible is set and BYTES otherwise.
+// A nil slice encodes as null.
+func (w *BytesWriter) WriteBytes(b []byte, flexible bool) {
+	switch {
+	case b == nil && flexible:
+		w.WriteUvarint(0)
+	case b == nil:
+		w.WriteInt32(-1)
+	case flexible:
+		w.WriteUvarint(uint64(len(b) + 1))
+	default:
+		w.WriteInt32(int32(len(b)))
+	}
+	w.data = append(w.data, b...)
+}
+
+// WriteRegion writes the content of a file region, which is only read once
+// the Send is written out.
+func (w *BytesWriter) WriteRegion(r FileRegion) {
+	w.regions = append(w.regions, placedRegion{offset: len(w.data), region: r})
+}
+
+// TaggedField is one entry of a flexible version's tagged field section.
+type TaggedField struct {
+	Tag   uint64
+	Value []byte
+}
+
+// WriteTaggedFields writes the tagged field section. Fields must be sorted by
+// tag.
+func (w *BytesWriter) WriteTaggedFields(fields ...TaggedField) {
+	w.WriteUvarint(uint64(len(fields)))
+	for _, f := range fields {
+		w.WriteUvarint(f.Tag)
+		w.WriteUvarint(uint64(len(f.Value)))
+		w.data = append(w.data, f.Value...)
+	}
+}
@@ -0,0 +1,84 @@
+package encoder
+
+import "io"
+
+// FileRegion is a part of a file written into a message without going
+// through memory. It is closed once the message has been written or dropped.
+type FileRegion interface {
+	io.WriterTo
+	Size() int
+	Close() error
+}
+
+// Send is a serialized message made of bytes and file regions. Regions copy
+// themselves to the writer, which for a TCP connection means sendfile, so the
+// file content never passes through user space.
+type Send struct {
+	parts []sendPart
+}
+
+type sendPart struct {
+	data   []byte
+	region FileRegion
+}
+
+func NewSend(data []byte) *Send {
+	return &Send{parts: []sendPart{{data: data}}}
+}
+
+func (s *Send) Size() int {
+	size := 0
+	for _, part := range s.parts {
+		if part.region != nil {
+			size += part.region.Size()
+		} else {
+			size += len(part.data)
+		}
+	}
+	return size
+}
+
+// Prepend adds data in front of the message, such as its header, merging it
+// with the bytes the message starts with so they go out in one write.
+func (s *Send) Prepend(data []byte) {
+	if len(s.parts) > 0 && s.parts[0].region == nil {
+		s.parts[0].data = append(append(make([]byte, 0, len(data)+len(s.parts[0].data)), data...), s.parts[0].data...)
+		return
+	}
+	s.parts = append([]sendPart{{data: data}}, s.parts...)
+}
+
+// WriteTo writes the whole message to w. It does not close the regions.
+func (s *Send) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for _, part := range s.parts {
+		var n int64
+		var err error
+		if part.region != nil {
+			n, err = part.region.WriteTo(w)
+		} else if len(part.data) > 0 {
+			var m int
+			m, err = w.Write(part.data)
+			n = int64(m)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the file regions of the message.
+func (s *Send) Close() error {
+	var err error
+	for _, part := range s.parts {
+		if part.region == nil {
+			continue
+		}
+		if closeErr := part.region.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
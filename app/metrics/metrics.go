@@ -0,0 +1,122 @@
+// Package metrics keeps the broker's counters and timers, named after the
+// Kafka MBeans they stand in for. Kafka's meters are kept as plain counts: a
+// rate is the difference between two reports.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Counter struct {
+	count atomic.Int64
+}
+
+func (c *Counter) Add(n int64) {
+	c.count.Add(n)
+}
+
+func (c *Counter) Count() int64 {
+	return c.count.Load()
+}
+
+// Timer counts timed events, such as flushes, and keeps their total and
+// longest duration.
+type Timer struct {
+	mu    sync.Mutex
+	count int64
+	total time.Duration
+	max   time.Duration
+}
+
+func (t *Timer) Update(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	t.total += d
+	t.max = max(t.max, d)
+}
+
+// Snapshot returns the number of events and their mean and longest duration.
+func (t *Timer) Snapshot() (count int64, mean time.Duration, longest time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == 0 {
+		return 0, 0, 0
+	}
+	return t.count, t.total / time.Duration(t.count), t.max
+}
+
+var (
+	mu       sync.Mutex
+	counters = map[string]*Counter{}
+	timers   = map[string]*Timer{}
+)
+
+// GetCounter returns the counter called name, registering it on first use.
+func GetCounter(name string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := counters[name]
+	if !ok {
+		c = &Counter{}
+		counters[name] = c
+	}
+	return c
+}
+
+// GetTimer returns the timer called name, registering it on first use.
+func GetTimer(name string) *Timer {
+	mu.Lock()
+	defer mu.Unlock()
+	t, ok := timers[name]
+	if !ok {
+		t = &Timer{}
+		timers[name] = t
+	}
+	return t
+}
+
+// AddBrokerTopic adds n to the BrokerTopicMetrics meter called name, both for
+// topic and for all topics together.
+func AddBrokerTopic(name string, topic string, n int64) {
+	GetCounter("kafka.server:type=BrokerTopicMetrics,name=" + name).Add(n)
+	GetCounter("kafka.server:type=BrokerTopicMetrics,name=" + name + ",topic=" + topic).Add(n)
+}
+
+// Write writes a "name count" line for every counter and a "name count
+// mean-ms max-ms" line for every timer, sorted by name.
+func Write(w io.Writer) error {
+	mu.Lock()
+	lines := make(map[string]func() string, len(counters)+len(timers))
+	for name, c := range counters {
+		lines[name] = func() string { return fmt.Sprintf("%d", c.Count()) }
+	}
+	for name, t := range timers {
+		lines[name] = func() string {
+			count, mean, longest := t.Snapshot()
+			return fmt.Sprintf("%d %.3f %.3f", count, milliseconds(mean), milliseconds(longest))
+		}
+	}
+	mu.Unlock()
+
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %s\n", name, lines[name]()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
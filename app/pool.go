@@ -0,0 +1,78 @@
+package main
+
+import "sync"
+
+// requestPool is the shared set of handler goroutines. Its queue is bounded by
+// queued.max.requests, so connection readers block once it fills up.
+type requestPool struct {
+	jobs chan func()
+	// standIns holds a slot for each stand-in worker started by Blocking.
+	standIns chan struct{}
+	// workers counts the workers and stand-ins, for Close to wait on.
+	workers sync.WaitGroup
+}
+
+func newRequestPool(workers int, maxQueued int) *requestPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxQueued < 1 {
+		maxQueued = 1
+	}
+	p := &requestPool{jobs: make(chan func(), maxQueued), standIns: make(chan struct{}, maxQueued)}
+	p.workers.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+func (p *requestPool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// Close runs the queued jobs and waits for every worker to return. Nothing
+// may be submitted any more.
+func (p *requestPool) Close() {
+	close(p.jobs)
+	p.workers.Wait()
+}
+
+func (p *requestPool) Submit(job func()) {
+	p.jobs <- job
+}
+
+// Blocking runs wait, which may take a long time, on the calling worker while
+// a stand-in worker keeps serving the queue. There are at most as many
+// stand-ins as queued.max.requests; past that, wait holds up its worker like
+// any other request until a stand-in returns.
+func (p *requestPool) Blocking(wait func()) {
+	select {
+	case p.standIns <- struct{}{}:
+	default:
+		wait()
+		return
+	}
+	stop := make(chan struct{})
+	p.workers.Add(1)
+	go func() {
+		defer p.workers.Done()
+		defer func() { <-p.standIns }()
+		for {
+			select {
+			case <-stop:
+				return
+			case job, ok := <-p.jobs:
+				if !ok {
+					return
+				}
+				job()
+			}
+		}
+	}()
+	wait()
+	close(stop)
+}
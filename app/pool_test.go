@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockingBoundsStandIns(t *testing.T) {
+	// One worker and two stand-ins: three requests can wait at once.
+	pool := newRequestPool(1, 2)
+	release := make(chan struct{})
+	var waiting atomic.Int32
+	var done sync.WaitGroup
+	for range 5 {
+		done.Add(1)
+		go pool.Submit(func() {
+			defer done.Done()
+			pool.Blocking(func() {
+				waiting.Add(1)
+				<-release
+			})
+		})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for waiting.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := waiting.Load(); n != 3 {
+		t.Errorf("%d requests waiting at once, want 3", n)
+	}
+	if n := len(pool.standIns); n != 2 {
+		t.Errorf("%d stand-ins running, want 2", n)
+	}
+
+	close(release)
+	done.Wait()
+	if n := waiting.Load(); n != 5 {
+		t.Errorf("%d requests waited, want 5", n)
+	}
+}
@@ -0,0 +1,225 @@
+package purgatory
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// DelayedOperation is a request parked until a condition holds or its
+// timeout expires, whichever comes first.
+type DelayedOperation struct {
+	tryComplete func() bool
+	keys        []any
+	once        sync.Once
+	done        chan struct{}
+	timeout     time.Duration
+	timerMu     sync.Mutex
+	timer       *time.Timer
+	expired     bool
+	cancelled   bool
+}
+
+// NewDelayedOperation creates an operation completed by tryComplete returning
+// true, or forcibly after timeout.
+func NewDelayedOperation(timeout time.Duration, tryComplete func() bool) *DelayedOperation {
+	return &DelayedOperation{tryComplete: tryComplete, done: make(chan struct{}), timeout: timeout}
+}
+
+func (op *DelayedOperation) startTimer() {
+	op.timerMu.Lock()
+	defer op.timerMu.Unlock()
+	if op.isCompleted() {
+		return
+	}
+	op.timer = time.AfterFunc(op.timeout, func() {
+		op.finish(func() { op.expired = true })
+	})
+}
+
+// Done is closed once the operation has completed, expired or been
+// cancelled.
+func (op *DelayedOperation) Done() <-chan struct{} {
+	return op.done
+}
+
+// Expired reports whether the operation completed because of its timeout.
+// Only valid after Done is closed.
+func (op *DelayedOperation) Expired() bool {
+	<-op.done
+	return op.expired
+}
+
+func (op *DelayedOperation) Cancelled() bool {
+	<-op.done
+	return op.cancelled
+}
+
+// Cancel abandons the operation, e.g. because its client disconnected.
+func (op *DelayedOperation) Cancel() {
+	op.finish(func() { op.cancelled = true })
+}
+
+func (op *DelayedOperation) complete() bool {
+	return op.finish(func() {})
+}
+
+// finish runs mark and closes done, unless the operation already finished.
+func (op *DelayedOperation) finish(mark func()) bool {
+	finished := false
+	op.once.Do(func() {
+		finished = true
+		mark()
+		close(op.done)
+		op.timerMu.Lock()
+		if op.timer != nil {
+			op.timer.Stop()
+		}
+		op.timerMu.Unlock()
+	})
+	return finished
+}
+
+func (op *DelayedOperation) isCompleted() bool {
+	select {
+	case <-op.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Purgatory holds delayed operations, indexed by the keys whose changes may
+// let them complete.
+type Purgatory struct {
+	mu       sync.Mutex
+	watchers map[any]map[*DelayedOperation]struct{}
+	// changed holds the keys passed to Changed that the checker has not
+	// retried yet, and wake tells the checker there are some.
+	changed      map[any]struct{}
+	wake         chan struct{}
+	startChecker sync.Once
+}
+
+func New() *Purgatory {
+	return &Purgatory{
+		watchers: map[any]map[*DelayedOperation]struct{}{},
+		changed:  map[any]struct{}{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// TryCompleteElseWatch completes op right away if it can, otherwise parks it
+// under keys. It reports whether op completed immediately.
+func (p *Purgatory) TryCompleteElseWatch(op *DelayedOperation, keys ...any) bool {
+	if op.tryComplete() && op.complete() {
+		return true
+	}
+
+	p.mu.Lock()
+	op.keys = keys
+	for _, key := range keys {
+		if p.watchers[key] == nil {
+			p.watchers[key] = map[*DelayedOperation]struct{}{}
+		}
+		p.watchers[key][op] = struct{}{}
+	}
+	p.mu.Unlock()
+	op.startTimer()
+
+	// Something may have changed while we were registering.
+	if op.tryComplete() && op.complete() {
+		p.remove(op)
+		return true
+	}
+	go func() {
+		<-op.done
+		p.remove(op)
+	}()
+	return false
+}
+
+// CheckAndComplete retries every operation watching key and returns how many
+// completed.
+func (p *Purgatory) CheckAndComplete(key any) int {
+	p.mu.Lock()
+	ops := make([]*DelayedOperation, 0, len(p.watchers[key]))
+	for op := range p.watchers[key] {
+		ops = append(ops, op)
+	}
+	p.mu.Unlock()
+
+	completed := 0
+	for _, op := range ops {
+		if op.isCompleted() {
+			continue
+		}
+		if op.tryComplete() && op.complete() {
+			completed++
+		}
+	}
+	return completed
+}
+
+// Changed has the operations watching key retried on the purgatory's own
+// goroutine, so that the caller, e.g. an append, does not wait for them.
+// A key changed again before it is retried is retried once.
+func (p *Purgatory) Changed(key any) {
+	p.mu.Lock()
+	if len(p.watchers[key]) == 0 {
+		// An operation parked from now on tries again once it is watching.
+		p.mu.Unlock()
+		return
+	}
+	p.changed[key] = struct{}{}
+	p.mu.Unlock()
+
+	p.startChecker.Do(func() { go p.check() })
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Purgatory) check() {
+	for range p.wake {
+		p.mu.Lock()
+		changed := p.changed
+		p.changed = map[any]struct{}{}
+		p.mu.Unlock()
+		for key := range changed {
+			p.checkKey(key)
+		}
+	}
+}
+
+// checkKey retries the operations watching key, recovering from one of them
+// panicking so that the checker goes on serving later changes. The operations
+// the panic skipped still expire.
+func (p *Purgatory) checkKey(key any) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic completing operations watching %v: %v\n%s", key, r, debug.Stack())
+		}
+	}()
+	p.CheckAndComplete(key)
+}
+
+// Watched returns the number of operations parked under key.
+func (p *Purgatory) Watched(key any) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.watchers[key])
+}
+
+func (p *Purgatory) remove(op *DelayedOperation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range op.keys {
+		delete(p.watchers[key], op)
+		if len(p.watchers[key]) == 0 {
+			delete(p.watchers, key)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package purgatory
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitDone fails t unless op finishes within a second.
+func waitDone(t *testing.T, op *DelayedOperation) {
+	t.Helper()
+	select {
+	case <-op.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("operation did not finish")
+	}
+}
+
+func TestCompletesImmediately(t *testing.T) {
+	p := New()
+	op := NewDelayedOperation(time.Minute, func() bool { return true })
+	if !p.TryCompleteElseWatch(op, "a") {
+		t.Fatalf("TryCompleteElseWatch parked an operation that could complete")
+	}
+	if op.Expired() || op.Cancelled() || p.Watched("a") != 0 {
+		t.Errorf("got expired %t, cancelled %t and %d watching, want a completed operation not watched", op.Expired(), op.Cancelled(), p.Watched("a"))
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	p := New()
+	op := NewDelayedOperation(20*time.Millisecond, func() bool { return false })
+	if p.TryCompleteElseWatch(op, "a", "b") {
+		t.Fatalf("TryCompleteElseWatch completed an operation that cannot")
+	}
+	if p.Watched("a") != 1 || p.Watched("b") != 1 {
+		t.Errorf("got %d and %d watching, want the operation under both keys", p.Watched("a"), p.Watched("b"))
+	}
+	waitDone(t, op)
+	if !op.Expired() || op.Cancelled() {
+		t.Errorf("got expired %t and cancelled %t, want an expired operation", op.Expired(), op.Cancelled())
+	}
+	waitUnwatched(t, p, "a")
+	waitUnwatched(t, p, "b")
+}
+
+func TestCancel(t *testing.T) {
+	p := New()
+	op := NewDelayedOperation(time.Minute, func() bool { return false })
+	p.TryCompleteElseWatch(op, "a")
+	op.Cancel()
+	waitDone(t, op)
+	if !op.Cancelled() || op.Expired() {
+		t.Errorf("got cancelled %t and expired %t, want a cancelled operation", op.Cancelled(), op.Expired())
+	}
+	waitUnwatched(t, p, "a")
+
+	// Finishing twice keeps the first outcome.
+	if op.complete() {
+		t.Errorf("a cancelled operation completed")
+	}
+}
+
+func TestCompletesOnChanged(t *testing.T) {
+	p := New()
+	var ready atomic.Bool
+	op := NewDelayedOperation(time.Minute, func() bool { return ready.Load() })
+	other := NewDelayedOperation(time.Minute, func() bool { return ready.Load() })
+	p.TryCompleteElseWatch(op, "a")
+	p.TryCompleteElseWatch(other, "b")
+
+	// A change with the condition still false leaves it parked.
+	p.Changed("a")
+	if n := p.CheckAndComplete("a"); n != 0 || op.isCompleted() {
+		t.Fatalf("completed %d operations before the condition held", n)
+	}
+
+	ready.Store(true)
+	p.Changed("a")
+	waitDone(t, op)
+	if op.Expired() || op.Cancelled() {
+		t.Errorf("got expired %t and cancelled %t, want a completed operation", op.Expired(), op.Cancelled())
+	}
+	if other.isCompleted() {
+		t.Errorf("an operation watching another key completed")
+	}
+	other.Cancel()
+}
+
+// TestRegisterAppendRace has the condition become true, and the key change,
+// after the first try but before the operation is watching. The change finds
+// no watcher, so only the try after registering can complete it.
+func TestRegisterAppendRace(t *testing.T) {
+	p := New()
+	var tries atomic.Int32
+	op := NewDelayedOperation(time.Minute, func() bool {
+		if tries.Add(1) == 1 {
+			p.Changed("a")
+			return false
+		}
+		return true
+	})
+	if !p.TryCompleteElseWatch(op, "a") {
+		t.Fatalf("TryCompleteElseWatch parked an operation whose condition held once watching")
+	}
+	if op.Expired() || p.Watched("a") != 0 {
+		t.Errorf("got expired %t and %d watching, want a completed operation not watched", op.Expired(), p.Watched("a"))
+	}
+}
+
+func TestCheckerSurvivesPanic(t *testing.T) {
+	p := New()
+	var ready, panicked atomic.Bool
+	panicking := NewDelayedOperation(time.Minute, func() bool {
+		if ready.Load() {
+			panicked.Store(true)
+			panic("tryComplete failed")
+		}
+		return false
+	})
+	op := NewDelayedOperation(time.Minute, func() bool { return panicked.Load() })
+	p.TryCompleteElseWatch(panicking, "a")
+	p.TryCompleteElseWatch(op, "b")
+
+	ready.Store(true)
+	p.Changed("a")
+	for deadline := time.Now().Add(time.Second); !panicked.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the checker did not retry the operation")
+		}
+	}
+	p.Changed("b")
+	waitDone(t, op)
+	if op.Expired() {
+		t.Errorf("the operation expired, want it completed by the checker")
+	}
+	panicking.Cancel()
+}
+
+// waitUnwatched fails t unless no operation watches key within a second. An
+// operation is removed from its keys on its own goroutine once finished.
+func waitUnwatched(t *testing.T, p *Purgatory, key any) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); p.Watched(key) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d operations still watching %v", p.Watched(key), key)
+		}
+	}
+}
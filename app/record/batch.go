@@ -0,0 +1,226 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+)
+
+// Offsets of the RecordBatch v2 header fields.
+const (
+	baseOffsetPos           = 0
+	lengthPos               = 8
+	partitionLeaderEpochPos = 12
+	magicPos                = 16
+	crcPos                  = 17
+	attributesPos           = 21
+	lastOffsetDeltaPos      = 23
+	baseTimestampPos        = 27
+	maxTimestampPos         = 35
+	producerIdPos           = 43
+	producerEpochPos        = 51
+	baseSequencePos         = 53
+	recordCountPos          = 57
+
+	// LogOverhead is the size of the BaseOffset and Length fields, which are
+	// not counted in Length.
+	LogOverhead = 12
+	HeaderSize  = 61
+	Magic       = 2
+
+	// maxRecordsSize bounds the decompressed records of a batch, so that a
+	// small compressed batch cannot exhaust memory.
+	maxRecordsSize = 64 << 20
+)
+
+const (
+	compressionMask   = 0x07
+	logAppendTimeFlag = 0x08
+	transactionalFlag = 0x10
+	controlFlag       = 0x20
+)
+
+const (
+	NoProducerId    = -1
+	NoProducerEpoch = -1
+	NoSequence      = -1
+)
+
+var (
+	// ErrCorrupt is wrapped by every error about a batch failing validation.
+	ErrCorrupt = errors.New("corrupt record batch")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// RecordBatch is a decoded RecordBatch v2. Records is only filled in by
+// Decode, not DecodeHeader.
+type RecordBatch struct {
+	BaseOffset           int64
+	PartitionLeaderEpoch int32
+	CRC                  uint32
+	Attributes           int16
+	LastOffsetDelta      int32
+	BaseTimestamp        int64
+	MaxTimestamp         int64
+	ProducerId           int64
+	ProducerEpoch        int16
+	BaseSequence         int32
+	RecordCount          int32
+	Records              []Record
+}
+
+func (b *RecordBatch) Compression() compression.Codec {
+	return compression.Codec(b.Attributes & compressionMask)
+}
+
+// SetCompression sets the codec Encode compresses the records with.
+func (b *RecordBatch) SetCompression(codec compression.Codec) {
+	b.Attributes = b.Attributes&^compressionMask | int16(codec)
+}
+
+// IsLogAppendTime reports whether the broker's append time replaced the
+// record timestamps, which are then all MaxTimestamp.
+func (b *RecordBatch) IsLogAppendTime() bool {
+	return b.Attributes&logAppendTimeFlag != 0
+}
+
+func (b *RecordBatch) IsTransactional() bool {
+	return b.Attributes&transactionalFlag != 0
+}
+
+func (b *RecordBatch) IsControl() bool {
+	return b.Attributes&controlFlag != 0
+}
+
+func (b *RecordBatch) LastOffset() int64 {
+	return b.BaseOffset + int64(b.LastOffsetDelta)
+}
+
+func (b *RecordBatch) Offset(r *Record) int64 {
+	return b.BaseOffset + int64(r.OffsetDelta)
+}
+
+func (b *RecordBatch) Timestamp(r *Record) int64 {
+	if b.IsLogAppendTime() {
+		return b.MaxTimestamp
+	}
+	return b.BaseTimestamp + r.TimestampDelta
+}
+
+// Size returns the total size of the batch whose header starts data, as
+// given by its Length field.
+func Size(data []byte) int {
+	return int(int32(binary.BigEndian.Uint32(data[lengthPos:]))) + LogOverhead
+}
+
+// SetBaseOffset rewrites the base offset of an encoded batch. The CRC does
+// not cover it, so nothing else changes.
+func SetBaseOffset(data []byte, offset int64) {
+	binary.BigEndian.PutUint64(data[baseOffsetPos:], uint64(offset))
+}
+
+// DecodeHeader decodes the header fields of a batch without validating it.
+// data must hold at least HeaderSize bytes.
+func DecodeHeader(data []byte) RecordBatch {
+	return RecordBatch{
+		BaseOffset:           int64(binary.BigEndian.Uint64(data[baseOffsetPos:])),
+		PartitionLeaderEpoch: int32(binary.BigEndian.Uint32(data[partitionLeaderEpochPos:])),
+		CRC:                  binary.BigEndian.Uint32(data[crcPos:]),
+		Attributes:           int16(binary.BigEndian.Uint16(data[attributesPos:])),
+		LastOffsetDelta:      int32(binary.BigEndian.Uint32(data[lastOffsetDeltaPos:])),
+		BaseTimestamp:        int64(binary.BigEndian.Uint64(data[baseTimestampPos:])),
+		MaxTimestamp:         int64(binary.BigEndian.Uint64(data[maxTimestampPos:])),
+		ProducerId:           int64(binary.BigEndian.Uint64(data[producerIdPos:])),
+		ProducerEpoch:        int16(binary.BigEndian.Uint16(data[producerEpochPos:])),
+		BaseSequence:         int32(binary.BigEndian.Uint32(data[baseSequencePos:])),
+		RecordCount:          int32(binary.BigEndian.Uint32(data[recordCountPos:])),
+	}
+}
+
+// Validate checks that data is exactly one v2 batch whose CRC32C, computed
+// from the attributes to the end, matches.
+func Validate(data []byte) error {
+	if len(data) < HeaderSize {
+		return fmt.Errorf("%w: %d bytes is shorter than a batch header", ErrCorrupt, len(data))
+	}
+	if size := Size(data); size != len(data) {
+		return fmt.Errorf("%w: batch length %d does not match its %d bytes", ErrCorrupt, size, len(data))
+	}
+	if magic := int8(data[magicPos]); magic != Magic {
+		return fmt.Errorf("%w: unsupported magic %d", ErrCorrupt, magic)
+	}
+	crc := binary.BigEndian.Uint32(data[crcPos:])
+	if computed := crc32.Checksum(data[attributesPos:], crc32c); computed != crc {
+		return fmt.Errorf("%w: crc %d does not match computed crc %d", ErrCorrupt, crc, computed)
+	}
+	return nil
+}
+
+// Decode validates a batch and decodes it, decompressing the records if
+// needed.
+func Decode(data []byte) (*RecordBatch, error) {
+	if err := Validate(data); err != nil {
+		return nil, err
+	}
+	batch := DecodeHeader(data)
+	if batch.RecordCount < 0 {
+		return nil, fmt.Errorf("%w: negative record count %d", ErrCorrupt, batch.RecordCount)
+	}
+	if codec := batch.Compression(); codec > compression.Zstd {
+		return nil, fmt.Errorf("%w: unknown compression codec %d", ErrCorrupt, codec)
+	}
+	records, err := compression.Decompress(batch.Compression(), data[HeaderSize:], maxRecordsSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompressing %s records: %s", ErrCorrupt, batch.Compression(), err.Error())
+	}
+
+	r := &reader{data: records}
+	batch.Records = make([]Record, 0, min(int(batch.RecordCount), len(r.data)))
+	for i := 0; i < int(batch.RecordCount); i++ {
+		record, err := readRecord(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d at offset %d: %s", ErrCorrupt, i, batch.BaseOffset, err.Error())
+		}
+		batch.Records = append(batch.Records, record)
+	}
+	if len(r.data) > r.offset {
+		return nil, fmt.Errorf("%w: %d bytes after the last record", ErrCorrupt, len(r.data)-r.offset)
+	}
+	return &batch, nil
+}
+
+// Encode serializes the batch, compressing the records with the codec of its
+// attributes and filling in its length, record count and CRC.
+func (b *RecordBatch) Encode() []byte {
+	w := encoder.NewBytesWriter()
+	w.WriteInt64(b.BaseOffset)
+	w.WriteInt32(0) // Length
+	w.WriteInt32(b.PartitionLeaderEpoch)
+	w.WriteInt8(Magic)
+	w.WriteInt32(0) // CRC
+	w.WriteInt16(b.Attributes)
+	w.WriteInt32(b.LastOffsetDelta)
+	w.WriteInt64(b.BaseTimestamp)
+	w.WriteInt64(b.MaxTimestamp)
+	w.WriteInt64(b.ProducerId)
+	w.WriteInt16(b.ProducerEpoch)
+	w.WriteInt32(b.BaseSequence)
+	w.WriteInt32(int32(len(b.Records)))
+	records := encoder.NewBytesWriter()
+	for i := range b.Records {
+		b.Records[i].encode(records)
+	}
+	w.Write(compression.Compress(b.Compression(), records.Bytes()))
+
+	data := w.Bytes()
+	binary.BigEndian.PutUint32(data[lengthPos:], uint32(len(data)-LogOverhead))
+	b.CRC = crc32.Checksum(data[attributesPos:], crc32c)
+	binary.BigEndian.PutUint32(data[crcPos:], b.CRC)
+	b.RecordCount = int32(len(b.Records))
+	return data
+}
@@ -0,0 +1,251 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
+)
+
+func testRecords() []Record {
+	return []Record{
+		{TimestampDelta: 0, OffsetDelta: 0, Key: []byte("key"), Value: []byte("value")},
+		{TimestampDelta: 5, OffsetDelta: 1, Key: nil, Value: []byte("no key")},
+		{TimestampDelta: -3, OffsetDelta: 2, Key: []byte("deleted"), Value: nil},
+		{TimestampDelta: 9, OffsetDelta: 3, Key: []byte{}, Value: []byte{}, Headers: []Header{
+			{Key: "trace", Value: []byte("abc")},
+			{Key: "null", Value: nil},
+		}},
+	}
+}
+
+func testBatch(codec compression.Codec) *RecordBatch {
+	batch := &RecordBatch{
+		BaseOffset:           42,
+		PartitionLeaderEpoch: 7,
+		LastOffsetDelta:      3,
+		BaseTimestamp:        1700000000000,
+		MaxTimestamp:         1700000000009,
+		ProducerId:           1001,
+		ProducerEpoch:        2,
+		BaseSequence:         17,
+		Records:              testRecords(),
+	}
+	batch.SetCompression(codec)
+	return batch
+}
+
+// rawBatch encodes a batch header claiming count records followed by the
+// given records section, with a valid length and CRC.
+func rawBatch(attributes int16, count int32, records []byte) []byte {
+	data := (&RecordBatch{ProducerId: NoProducerId, ProducerEpoch: NoProducerEpoch, BaseSequence: NoSequence}).Encode()
+	data = append(data[:HeaderSize], records...)
+	binary.BigEndian.PutUint16(data[attributesPos:], uint16(attributes))
+	binary.BigEndian.PutUint32(data[recordCountPos:], uint32(count))
+	return fixLengthAndCRC(data)
+}
+
+func fixLengthAndCRC(data []byte) []byte {
+	binary.BigEndian.PutUint32(data[lengthPos:], uint32(len(data)-LogOverhead))
+	binary.BigEndian.PutUint32(data[crcPos:], crc32.Checksum(data[attributesPos:], crc32c))
+	return data
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for _, codec := range []compression.Codec{compression.None, compression.Gzip, compression.Snappy, compression.Lz4, compression.Zstd} {
+		batch := testBatch(codec)
+		data := batch.Encode()
+		if batch.RecordCount != 4 || Size(data) != len(data) {
+			t.Errorf("%s: Encode left record count %d and size %d for %d bytes", codec, batch.RecordCount, Size(data), len(data))
+		}
+
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", codec, err)
+		}
+		if !reflect.DeepEqual(decoded, batch) {
+			t.Errorf("%s: decoded %+v, want %+v", codec, decoded, batch)
+		}
+		if decoded.Compression() != codec || decoded.LastOffset() != 45 {
+			t.Errorf("%s: decoded codec %s and last offset %d, want 45", codec, decoded.Compression(), decoded.LastOffset())
+		}
+		if !decoded.Records[2].IsTombstone() || decoded.Records[0].IsTombstone() {
+			t.Errorf("%s: tombstones not preserved", codec)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	batch := testBatch(compression.Gzip)
+	data := batch.Encode()
+	header := DecodeHeader(data)
+	want := *batch
+	want.Records = nil
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("DecodeHeader returned %+v, want %+v", header, want)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	batch := testBatch(compression.None)
+	if got := batch.Timestamp(&batch.Records[1]); got != batch.BaseTimestamp+5 {
+		t.Errorf("got timestamp %d, want the base timestamp plus 5", got)
+	}
+	if got := batch.Offset(&batch.Records[3]); got != 45 {
+		t.Errorf("got offset %d, want 45", got)
+	}
+	batch.Attributes |= logAppendTimeFlag
+	decoded, err := Decode(batch.Encode())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !decoded.IsLogAppendTime() || decoded.Timestamp(&decoded.Records[1]) != batch.MaxTimestamp {
+		t.Errorf("log append time batch did not report MaxTimestamp for its records")
+	}
+}
+
+func TestSetBaseOffsetKeepsBatchValid(t *testing.T) {
+	data := testBatch(compression.None).Encode()
+	SetBaseOffset(data, 1000)
+	batch, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode after SetBaseOffset: %v", err)
+	}
+	if batch.BaseOffset != 1000 {
+		t.Errorf("got base offset %d, want 1000", batch.BaseOffset)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	valid := testBatch(compression.None).Encode()
+	modified := func(modify func(data []byte)) []byte {
+		data := bytes.Clone(valid)
+		modify(data)
+		return data
+	}
+	tests := map[string][]byte{
+		"short header":    valid[:HeaderSize-1],
+		"truncated":       valid[:len(valid)-1],
+		"trailing bytes":  append(bytes.Clone(valid), 0),
+		"magic 1":         fixLengthAndCRC(modified(func(data []byte) { data[magicPos] = 1 })),
+		"crc mismatch":    modified(func(data []byte) { data[len(data)-1] ^= 0xFF }),
+		"attributes flip": modified(func(data []byte) { data[attributesPos+1] ^= transactionalFlag }),
+		"negative length": modified(func(data []byte) { binary.BigEndian.PutUint32(data[lengthPos:], 0xFFFFFFFF) }),
+	}
+	for name, data := range tests {
+		if err := Validate(data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Validate returned %v, want ErrCorrupt", name, err)
+		}
+		if _, err := Decode(data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Decode returned %v, want ErrCorrupt", name, err)
+		}
+	}
+	if err := Validate(valid); err != nil {
+		t.Errorf("Validate rejected a valid batch: %v", err)
+	}
+}
+
+func TestDecodeRejectsMalformedRecords(t *testing.T) {
+	// A record of a single attributes byte, zero deltas, null key and value
+	// and no headers, prefixed with its varint length.
+	record := []byte{12, 0, 0, 0, 1, 1, 0}
+	tests := map[string][]byte{
+		"negative count":       rawBatch(0, -1, nil),
+		"missing record":       rawBatch(0, 2, record),
+		"trailing bytes":       rawBatch(0, 1, append(bytes.Clone(record), 0)),
+		"truncated varint":     rawBatch(0, 1, []byte{0x80}),
+		"oversized varint":     rawBatch(0, 1, bytes.Repeat([]byte{0xFF}, 11)),
+		"length past records":  rawBatch(0, 1, []byte{40, 0, 0, 0}),
+		"negative length":      rawBatch(0, 1, []byte{3, 0}),
+		"key past record":      rawBatch(0, 1, []byte{8, 0, 0, 0, 20, 1, 0}),
+		"header count":         rawBatch(0, 1, []byte{12, 0, 0, 0, 1, 1, 20}),
+		"null header key":      rawBatch(0, 1, []byte{16, 0, 0, 0, 1, 1, 2, 1, 1}),
+		"length past fields":   rawBatch(0, 1, []byte{14, 0, 0, 0, 1, 1, 0, 0}),
+		"unknown codec":        rawBatch(6, 1, record),
+		"not compressed":       rawBatch(int16(compression.Zstd), 1, record),
+		"truncated attributes": rawBatch(0, 1, []byte{0}),
+	}
+	for name, data := range tests {
+		if _, err := Decode(data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Decode returned %v, want ErrCorrupt", name, err)
+		}
+	}
+
+	batch, err := Decode(rawBatch(0, 1, record))
+	if err != nil {
+		t.Fatalf("Decode of the well formed record: %v", err)
+	}
+	if r := batch.Records[0]; r.Key != nil || r.Value != nil || len(r.Headers) != 0 {
+		t.Errorf("decoded %+v, want a record with null key and value", r)
+	}
+}
+
+func TestDecodeBoundsDecompressedRecords(t *testing.T) {
+	// Zeros compress to a small batch that would decompress past the bound.
+	records := compression.Compress(compression.Gzip, make([]byte, maxRecordsSize+1))
+	if _, err := Decode(rawBatch(int16(compression.Gzip), 1, records)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Decode returned %v for records decompressing past %d bytes, want ErrCorrupt", err, maxRecordsSize)
+	}
+}
+
+func TestControlBatch(t *testing.T) {
+	marker := EndTxnMarker{Type: CommitMarker, CoordinatorEpoch: 12}
+	batch, err := Decode(NewControlBatch(5, 3, 1700000000000, marker).Encode())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !batch.IsControl() || !batch.IsTransactional() || batch.ProducerId != 5 || batch.ProducerEpoch != 3 {
+		t.Errorf("decoded %+v, want a transactional control batch of producer 5 epoch 3", batch)
+	}
+	got, err := batch.ControlRecord()
+	if err != nil || got != marker {
+		t.Errorf("ControlRecord returned %+v and %v, want %+v", got, err, marker)
+	}
+
+	if _, err := testBatch(compression.None).ControlRecord(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("ControlRecord of a data batch returned %v, want ErrCorrupt", err)
+	}
+	short := NewControlBatch(5, 3, 0, marker)
+	short.Records[0].Value = short.Records[0].Value[:4]
+	if _, err := short.ControlRecord(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("ControlRecord of a short marker returned %v, want ErrCorrupt", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, codec := range []compression.Codec{compression.None, compression.Gzip, compression.Snappy, compression.Lz4, compression.Zstd} {
+		f.Add(testBatch(codec).Encode())
+	}
+	f.Add(NewControlBatch(1, 0, 0, EndTxnMarker{Type: AbortMarker}).Encode())
+	f.Add(rawBatch(0, 1, []byte{12, 0, 0, 0, 1, 1, 0}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) >= HeaderSize {
+			DecodeHeader(data)
+		}
+		batch, err := Decode(data)
+		if err != nil {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Decode returned %v, not wrapping ErrCorrupt", err)
+			}
+			return
+		}
+		// A batch that decodes encodes back to one with the same records.
+		again, err := Decode(batch.Encode())
+		if err != nil {
+			t.Fatalf("Decode of the re-encoded batch: %v", err)
+		}
+		if len(again.Records) != len(batch.Records) {
+			t.Fatalf("re-encoded batch has %d records, want %d", len(again.Records), len(batch.Records))
+		}
+		for i := range batch.Records {
+			a, b := batch.Records[i], again.Records[i]
+			if !bytes.Equal(a.Key, b.Key) || !bytes.Equal(a.Value, b.Value) || a.IsTombstone() != b.IsTombstone() || len(a.Headers) != len(b.Headers) {
+				t.Errorf("record %d re-encoded as %+v, want %+v", i, b, a)
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+)
+
+// ControlType is the type of the single record of a control batch, which
+// marks the end of a transaction.
+type ControlType int16
+
+const (
+	AbortMarker  ControlType = 0
+	CommitMarker ControlType = 1
+
+	controlRecordVersion = 0
+	endTxnMarkerVersion  = 0
+)
+
+// EndTxnMarker is the value of an abort or commit control record.
+type EndTxnMarker struct {
+	Type             ControlType
+	CoordinatorEpoch int32
+}
+
+// ControlRecord decodes the marker held by the record of a control batch.
+func (b *RecordBatch) ControlRecord() (EndTxnMarker, error) {
+	if !b.IsControl() || len(b.Records) != 1 {
+		return EndTxnMarker{}, fmt.Errorf("%w: not a control batch", ErrCorrupt)
+	}
+	r := b.Records[0]
+	if len(r.Key) < 4 || len(r.Value) < 6 {
+		return EndTxnMarker{}, fmt.Errorf("%w: control record too short", ErrCorrupt)
+	}
+	return EndTxnMarker{
+		Type:             ControlType(binary.BigEndian.Uint16(r.Key[2:])),
+		CoordinatorEpoch: int32(binary.BigEndian.Uint32(r.Value[2:])),
+	}, nil
+}
+
+// NewControlBatch returns the batch a transaction coordinator writes to end a
+// producer's transaction in a partition.
+func NewControlBatch(producerId int64, producerEpoch int16, timestamp int64, marker EndTxnMarker) *RecordBatch {
+	key := encoder.NewBytesWriter()
+	key.WriteInt16(controlRecordVersion)
+	key.WriteInt16(int16(marker.Type))
+	value := encoder.NewBytesWriter()
+	value.WriteInt16(endTxnMarkerVersion)
+	value.WriteInt32(marker.CoordinatorEpoch)
+
+	return &RecordBatch{
+		PartitionLeaderEpoch: -1,
+		Attributes:           transactionalFlag | controlFlag,
+		BaseTimestamp:        timestamp,
+		MaxTimestamp:         timestamp,
+		ProducerId:           producerId,
+		ProducerEpoch:        producerEpoch,
+		BaseSequence:         NoSequence,
+		Records: []Record{{
+			Key:     key.Bytes(),
+			Value:   value.Bytes(),
+			Headers: []Header{},
+		}},
+	}
+}
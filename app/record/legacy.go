@@ -0,0 +1,278 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+)
+
+// Magic values of the legacy MessageSet formats, which RecordBatch v2
+// replaced. v1 added timestamps.
+const (
+	MagicV0 = 0
+	MagicV1 = 1
+
+	// messageOverhead is the size of the offset and size fields before every
+	// message, and messageHeaderSize the fields up to the timestamp or key.
+	messageOverhead   = 12
+	messageCrcPos     = 12
+	messageMagicPos   = 16
+	messageHeaderSize = 18
+	// minMessageSize counts the crc, magic, attributes and the key and value
+	// lengths.
+	minMessageSize = 14
+
+	legacyTimestampTypeFlag = 0x08
+
+	NoTimestamp = -1
+)
+
+// Message is one message of a legacy MessageSet. Messages read out of a
+// compressed wrapper message have their absolute offset, and are never
+// compressed themselves.
+type Message struct {
+	Offset     int64
+	Magic      int8
+	Attributes int8
+	// Timestamp is NoTimestamp for magic v0.
+	Timestamp int64
+	// Key and Value are nil when null.
+	Key   []byte
+	Value []byte
+}
+
+func (m *Message) Compression() compression.Codec {
+	return compression.Codec(m.Attributes & compressionMask)
+}
+
+// IsLogAppendTime reports whether the timestamp is the broker's append time.
+// Only v1 messages carry the flag.
+func (m *Message) IsLogAppendTime() bool {
+	return m.Magic == MagicV1 && m.Attributes&legacyTimestampTypeFlag != 0
+}
+
+// DecodeMessageSet decodes a v0 or v1 MessageSet, validating the CRC32 of
+// every message and unwrapping compressed ones. It also returns the codec the
+// messages were compressed with, if any. A partial message at the end is
+// ignored, as old brokers cut message sets at the fetch size.
+func DecodeMessageSet(data []byte) ([]Message, compression.Codec, error) {
+	return decodeMessageSet(data, nil)
+}
+
+// decodeMessageSet decodes the messages of data, which are those of wrapper
+// if it is not nil.
+func decodeMessageSet(data []byte, wrapper *Message) ([]Message, compression.Codec, error) {
+	messages := []Message{}
+	codec := compression.None
+	for len(data) >= messageOverhead {
+		size := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if size < minMessageSize {
+			return nil, codec, fmt.Errorf("%w: message size %d too small", ErrCorrupt, size)
+		}
+		if len(data) < messageOverhead+size {
+			break
+		}
+		message, err := decodeMessage(data[:messageOverhead+size])
+		if err != nil {
+			return nil, codec, err
+		}
+		data = data[messageOverhead+size:]
+		if wrapper != nil && (message.Compression() != compression.None || message.Magic != wrapper.Magic) {
+			return nil, codec, fmt.Errorf("%w: v%d %s message inside wrapper at offset %d", ErrCorrupt, message.Magic, message.Compression(), wrapper.Offset)
+		}
+
+		if message.Compression() == compression.None {
+			messages = append(messages, message)
+			continue
+		}
+		inner, err := unwrapMessage(&message)
+		if err != nil {
+			return nil, codec, err
+		}
+		messages = append(messages, inner...)
+		codec = message.Compression()
+	}
+	return messages, codec, nil
+}
+
+func decodeMessage(data []byte) (Message, error) {
+	crc := binary.BigEndian.Uint32(data[messageCrcPos:])
+	if computed := crc32.ChecksumIEEE(data[messageMagicPos:]); computed != crc {
+		return Message{}, fmt.Errorf("%w: message crc %d does not match computed crc %d", ErrCorrupt, crc, computed)
+	}
+	m := Message{
+		Offset:     int64(binary.BigEndian.Uint64(data)),
+		Magic:      int8(data[messageMagicPos]),
+		Attributes: int8(data[messageMagicPos+1]),
+		Timestamp:  NoTimestamp,
+	}
+	r := &reader{data: data, offset: messageHeaderSize}
+	switch m.Magic {
+	case MagicV0:
+	case MagicV1:
+		timestamp, err := r.bytes(8)
+		if err != nil {
+			return Message{}, fmt.Errorf("%w: message at offset %d: %s", ErrCorrupt, m.Offset, err.Error())
+		}
+		m.Timestamp = int64(binary.BigEndian.Uint64(timestamp))
+	default:
+		return Message{}, fmt.Errorf("%w: unsupported message magic %d", ErrCorrupt, m.Magic)
+	}
+	if codec := m.Compression(); codec > compression.Lz4 {
+		return Message{}, fmt.Errorf("%w: compression codec %d in a v%d message", ErrCorrupt, codec, m.Magic)
+	}
+	var err error
+	if m.Key, err = r.int32Bytes(); err == nil {
+		m.Value, err = r.int32Bytes()
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: message at offset %d: %s", ErrCorrupt, m.Offset, err.Error())
+	}
+	if r.offset != len(data) {
+		return Message{}, fmt.Errorf("%w: message size does not match its fields at offset %d", ErrCorrupt, m.Offset)
+	}
+	return m, nil
+}
+
+// unwrapMessage decodes the messages compressed in the value of wrapper. v1
+// inner offsets are relative, the wrapper having the offset of the last one.
+func unwrapMessage(wrapper *Message) ([]Message, error) {
+	set, err := compression.Decompress(wrapper.Compression(), wrapper.Value, maxRecordsSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompressing %s message set: %s", ErrCorrupt, wrapper.Compression(), err.Error())
+	}
+	inner, _, err := decodeMessageSet(set, wrapper)
+	if err != nil {
+		return nil, err
+	}
+	if wrapper.Magic == MagicV1 && len(inner) > 0 {
+		last := inner[len(inner)-1].Offset
+		for i := range inner {
+			inner[i].Offset = wrapper.Offset - last + inner[i].Offset
+			if wrapper.IsLogAppendTime() {
+				inner[i].Timestamp = wrapper.Timestamp
+				inner[i].Attributes |= legacyTimestampTypeFlag
+			}
+		}
+	}
+	return inner, nil
+}
+
+func (r *reader) int32Bytes() ([]byte, error) {
+	length, err := r.bytes(4)
+	if err != nil {
+		return nil, err
+	}
+	if n := int32(binary.BigEndian.Uint32(length)); n != -1 {
+		return r.bytes(int(n))
+	}
+	return nil, nil
+}
+
+// UpConvert returns the messages as one v2 batch compressed with codec, for
+// appending. Their offsets are replaced by consecutive ones, as the log
+// assigns them anyway.
+func UpConvert(messages []Message, codec compression.Codec) *RecordBatch {
+	b := &RecordBatch{
+		PartitionLeaderEpoch: -1,
+		LastOffsetDelta:      int32(len(messages) - 1),
+		BaseTimestamp:        NoTimestamp,
+		MaxTimestamp:         NoTimestamp,
+		ProducerId:           NoProducerId,
+		ProducerEpoch:        NoProducerEpoch,
+		BaseSequence:         NoSequence,
+		Records:              make([]Record, len(messages)),
+	}
+	b.SetCompression(codec)
+	if len(messages) > 0 {
+		b.BaseTimestamp = messages[0].Timestamp
+	}
+	for i, m := range messages {
+		b.MaxTimestamp = max(b.MaxTimestamp, m.Timestamp)
+		b.Records[i] = Record{
+			TimestampDelta: m.Timestamp - b.BaseTimestamp,
+			OffsetDelta:    int32(i),
+			Key:            m.Key,
+			Value:          m.Value,
+			Headers:        []Header{},
+		}
+	}
+	return b
+}
+
+// DownConvert encodes the records of the batch from offset on as a MessageSet
+// of the given legacy magic, for fetchers predating RecordBatch v2. A
+// compressed batch becomes a single wrapper message compressed the same way.
+// Control batches and headers have no legacy form and are dropped. It also
+// returns the number of messages written.
+func (b *RecordBatch) DownConvert(magic int8, offset int64) ([]byte, int) {
+	if b.IsControl() {
+		return nil, 0
+	}
+	codec := b.Compression()
+	var attributes int8
+	if magic == MagicV1 && b.IsLogAppendTime() {
+		attributes = legacyTimestampTypeFlag
+	}
+	w := encoder.NewBytesWriter()
+	count := 0
+	maxTimestamp := int64(NoTimestamp)
+	var lastDelta int32
+	for i := range b.Records {
+		r := &b.Records[i]
+		if b.Offset(r) < offset {
+			continue
+		}
+		m := Message{Offset: b.Offset(r), Magic: magic, Attributes: attributes, Timestamp: b.Timestamp(r), Key: r.Key, Value: r.Value}
+		if codec != compression.None && magic == MagicV1 {
+			// Inner v1 offsets are relative to the wrapper's.
+			m.Offset = int64(r.OffsetDelta)
+		}
+		m.encode(w)
+		count++
+		maxTimestamp = max(maxTimestamp, m.Timestamp)
+		lastDelta = r.OffsetDelta
+	}
+	if count == 0 || codec == compression.None {
+		return w.Bytes(), count
+	}
+
+	wrapper := Message{
+		Offset:     b.BaseOffset + int64(lastDelta),
+		Magic:      magic,
+		Attributes: attributes | int8(codec),
+		Timestamp:  maxTimestamp,
+		Value:      compression.Compress(codec, w.Bytes()),
+	}
+	out := encoder.NewBytesWriter()
+	wrapper.encode(out)
+	return out.Bytes(), count
+}
+
+func (m *Message) encode(w *encoder.BytesWriter) {
+	body := encoder.NewBytesWriter()
+	body.WriteInt8(m.Magic)
+	body.WriteInt8(m.Attributes)
+	if m.Magic == MagicV1 {
+		body.WriteInt64(m.Timestamp)
+	}
+	writeInt32Bytes(body, m.Key)
+	writeInt32Bytes(body, m.Value)
+
+	w.WriteInt64(m.Offset)
+	w.WriteInt32(int32(4 + body.Len()))
+	w.WriteInt32(int32(crc32.ChecksumIEEE(body.Bytes())))
+	w.Write(body.Bytes())
+}
+
+func writeInt32Bytes(w *encoder.BytesWriter, b []byte) {
+	if b == nil {
+		w.WriteInt32(-1)
+		return
+	}
+	w.WriteInt32(int32(len(b)))
+	w.Write(b)
+}
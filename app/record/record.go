@@ -0,0 +1,150 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+)
+
+type Header struct {
+	Key string
+	// Value is nil for a null value.
+	Value []byte
+}
+
+// Record is one varint encoded record of a batch. Its offset and timestamp
+// are deltas from the batch's base offset and base timestamp.
+type Record struct {
+	Attributes     int8
+	TimestampDelta int64
+	OffsetDelta    int32
+	// Key and Value are nil when null. A null value is a tombstone.
+	Key     []byte
+	Value   []byte
+	Headers []Header
+}
+
+func (r *Record) IsTombstone() bool {
+	return r.Value == nil
+}
+
+func (r *Record) encode(w *encoder.BytesWriter) {
+	body := encoder.NewBytesWriter()
+	body.WriteInt8(r.Attributes)
+	body.WriteVarint(r.TimestampDelta)
+	body.WriteVarint(int64(r.OffsetDelta))
+	writeVarintBytes(body, r.Key)
+	writeVarintBytes(body, r.Value)
+	body.WriteVarint(int64(len(r.Headers)))
+	for _, header := range r.Headers {
+		writeVarintBytes(body, []byte(header.Key))
+		writeVarintBytes(body, header.Value)
+	}
+	w.WriteVarint(int64(body.Len()))
+	w.Write(body.Bytes())
+}
+
+func writeVarintBytes(w *encoder.BytesWriter, b []byte) {
+	if b == nil {
+		w.WriteVarint(-1)
+		return
+	}
+	w.WriteVarint(int64(len(b)))
+	w.Write(b)
+}
+
+func readRecord(r *reader) (Record, error) {
+	length, err := r.varint()
+	if err != nil {
+		return Record{}, err
+	}
+	body, err := r.bytes(int(length))
+	if err != nil {
+		return Record{}, err
+	}
+
+	br := &reader{data: body}
+	record := Record{}
+	attributes, err := br.bytes(1)
+	if err != nil {
+		return Record{}, err
+	}
+	record.Attributes = int8(attributes[0])
+	if record.TimestampDelta, err = br.varint(); err != nil {
+		return Record{}, err
+	}
+	offsetDelta, err := br.varint()
+	if err != nil {
+		return Record{}, err
+	}
+	record.OffsetDelta = int32(offsetDelta)
+	if record.Key, err = br.varintBytes(); err != nil {
+		return Record{}, err
+	}
+	if record.Value, err = br.varintBytes(); err != nil {
+		return Record{}, err
+	}
+	count, err := br.varint()
+	if err != nil {
+		return Record{}, err
+	}
+	if count < 0 || count > int64(len(body)) {
+		return Record{}, fmt.Errorf("invalid header count %d", count)
+	}
+	for i := 0; i < int(count); i++ {
+		key, err := br.varintBytes()
+		if err != nil {
+			return Record{}, err
+		}
+		if key == nil {
+			return Record{}, fmt.Errorf("null header key")
+		}
+		value, err := br.varintBytes()
+		if err != nil {
+			return Record{}, err
+		}
+		record.Headers = append(record.Headers, Header{Key: string(key), Value: value})
+	}
+	if br.offset != len(body) {
+		return Record{}, fmt.Errorf("record length %d does not match its fields", length)
+	}
+	return record, nil
+}
+
+// reader is a bounds checked reader over untrusted batch data.
+type reader struct {
+	data   []byte
+	offset int
+}
+
+func (r *reader) varint() (int64, error) {
+	n, size := binary.Varint(r.data[r.offset:])
+	if size <= 0 {
+		return 0, fmt.Errorf("malformed varint at %d", r.offset)
+	}
+	r.offset += size
+	return n, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.offset {
+		return nil, fmt.Errorf("length %d at %d overflows %d bytes", n, r.offset, len(r.data))
+	}
+	b := r.data[r.offset : r.offset+n : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+// varintBytes reads a varint length followed by that many bytes, or nil for
+// a length of -1.
+func (r *reader) varintBytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length == -1 {
+		return nil, nil
+	}
+	return r.bytes(int(length))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+)
+
+// reencryptLogs is the reencrypt-logs tool, run with the broker's
+// server.properties while the broker is stopped:
+//
+//	reencrypt-logs server.properties
+//
+// It rewrites the segments in log.dirs that are not encrypted with the
+// current key of log.encryption.keyfile, to encrypt logs written before
+// encryption was turned on or to retire a rotated key.
+func reencryptLogs(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: reencrypt-logs server.properties")
+	}
+	cfg, err := config.Load(args[0])
+	if err != nil {
+		return err
+	}
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return errors.New("log.encryption.keyfile is not set")
+	}
+	logConfig := storage.NewLogConfig(cfg, nil)
+	logConfig.Keyring = keyring
+	for _, dir := range logDirs(cfg) {
+		n, err := storage.ReencryptLogDir(dir, logConfig)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Re-encrypted %d segments in %s with key %s\n", n, dir, keyring.CurrentKeyId())
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type AlterReplicaLogDirsRequest struct {
+	Dirs []AlterReplicaLogDir
+}
+
+type AlterReplicaLogDir struct {
+	Path   string
+	Topics []AlterReplicaLogDirTopic
+}
+
+type AlterReplicaLogDirTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+type AlterReplicaLogDirsResponse struct {
+	Version        int16
+	ThrottleTimeMs int32
+	Results        []AlterReplicaLogDirTopicResult
+}
+
+type AlterReplicaLogDirTopicResult struct {
+	TopicName  string
+	Partitions []AlterReplicaLogDirPartitionResult
+}
+
+type AlterReplicaLogDirPartitionResult struct {
+	PartitionIndex int32
+	ErrorCode      utils.ErrorCode
+}
+
+func (r *AlterReplicaLogDirsRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 2
+	r.Dirs = make([]AlterReplicaLogDir, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Dirs {
+		dir := &r.Dirs[i]
+		dir.Path = p.ReadVersionedString(flexible)
+		dir.Topics = make([]AlterReplicaLogDirTopic, max(p.ReadArrayLength(flexible), 0))
+		for j := range dir.Topics {
+			topic := &dir.Topics[j]
+			topic.Name = p.ReadVersionedString(flexible)
+			topic.Partitions = make([]int32, max(p.ReadArrayLength(flexible), 0))
+			for k := range topic.Partitions {
+				topic.Partitions[k] = p.ReadInt32()
+			}
+			if flexible {
+				p.ReadTaggedFields()
+			}
+		}
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *AlterReplicaLogDirsResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 2
+	w := encoder.NewBytesWriter()
+	w.WriteInt32(r.ThrottleTimeMs)
+	w.WriteArrayLength(len(r.Results), flexible)
+	for _, result := range r.Results {
+		w.WriteString(result.TopicName, flexible)
+		w.WriteArrayLength(len(result.Partitions), flexible)
+		for _, partition := range result.Partitions {
+			w.WriteInt32(partition.PartitionIndex)
+			w.WriteInt16(int16(partition.ErrorCode))
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.AlterReplicaLogDirs,
+		MinVersion:      0,
+		MaxVersion:      2,
+		FlexibleVersion: 2,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleAlterReplicaLogDirsRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &AlterReplicaLogDirsResponse{Version: header.ApiVersion, Results: []AlterReplicaLogDirTopicResult{}}
+		},
+	})
+}
+
+// HandleAlterReplicaLogDirsRequest starts moving each partition to the log
+// directory it is listed under. The moves finish in the background; their
+// progress shows in DescribeLogDirs as future replicas.
+func HandleAlterReplicaLogDirsRequest(header *request.RequestHeader, p *decoder.BytesParser) (*AlterReplicaLogDirsResponse, error) {
+	req := &AlterReplicaLogDirsRequest{}
+	req.Deserialize(p, header.ApiVersion)
+
+	resp := &AlterReplicaLogDirsResponse{Version: header.ApiVersion, Results: []AlterReplicaLogDirTopicResult{}}
+	topics := map[string]int{}
+	for _, dir := range req.Dirs {
+		for _, topic := range dir.Topics {
+			i, ok := topics[topic.Name]
+			if !ok {
+				i = len(resp.Results)
+				topics[topic.Name] = i
+				resp.Results = append(resp.Results, AlterReplicaLogDirTopicResult{TopicName: topic.Name, Partitions: []AlterReplicaLogDirPartitionResult{}})
+			}
+			for _, partition := range topic.Partitions {
+				resp.Results[i].Partitions = append(resp.Results[i].Partitions, AlterReplicaLogDirPartitionResult{
+					PartitionIndex: partition,
+					ErrorCode:      alterReplicaLogDir(topic.Name, partition, dir.Path),
+				})
+			}
+		}
+	}
+	return resp, nil
+}
+
+func alterReplicaLogDir(topicName string, partitionId int32, path string) utils.ErrorCode {
+	topic, ok := currentMetadata().Topics[topicName]
+	if !ok || !hasPartition(topic, partitionId) {
+		return utils.UNKNOWN_TOPIC_OR_PARTITION
+	}
+	err := logStorage.AlterReplicaLogDir(storage.TopicPartition{Topic: topicName, Partition: partitionId}, path)
+	switch {
+	case err == nil:
+		return utils.NONE
+	case errors.Is(err, storage.ErrLogDirNotFound):
+		return utils.LOG_DIR_NOT_FOUND
+	default:
+		fmt.Printf("Error moving %s-%d to %s: %s\n", topicName, partitionId, path, err.Error())
+		return utils.KAFKA_STORAGE_ERROR
+	}
+}
@@ -1,100 +1,189 @@
 package api
 
 import (
-	"encoding/binary"
-	"fmt"
-
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
 	"github.com/codecrafters-io/kafka-starter-go/app/request"
 	"github.com/codecrafters-io/kafka-starter-go/app/utils"
 )
 
 type ApiVersionsRequest struct {
-	ClientId              string
+	ClientSoftwareName    string
 	ClientSoftwareVersion string
-	TagBuffer             []byte
 }
 
 type ApiVersionsResponse struct {
-	ErrorCode    utils.ErrorCode
-	APIVersions  []APIVersions
-	ThrottleTime int32
-	TagBuffer    []byte
+	Version                int16
+	ErrorCode              utils.ErrorCode
+	APIVersions            []APIVersions
+	ThrottleTime           int32
+	SupportedFeatures      []SupportedFeature
+	FinalizedFeaturesEpoch int64
+	FinalizedFeatures      []FinalizedFeature
+	ZkMigrationReady       bool
 }
 
 type APIVersions struct {
 	ApiKey     int16
 	MinVersion int16
 	MaxVersion int16
-	TagBuffer  []byte
 }
 
-func (r *ApiVersionsRequest) Deserialize(c []byte) error {
-	offset := 0
-	clientIdLength := int(c[offset]) - 1
-	offset += 1
-	r.ClientId = string(c[offset : offset+clientIdLength])
-	offset += clientIdLength
-
-	clientSoftwareVersionLength := int(c[offset]) - 1
-	offset += 1
-	r.ClientSoftwareVersion = string(c[offset : offset+clientSoftwareVersionLength])
-	offset += clientSoftwareVersionLength
-	r.TagBuffer = c[offset:]
+type SupportedFeature struct {
+	Name       string
+	MinVersion int16
+	MaxVersion int16
+}
+
+type FinalizedFeature struct {
+	Name            string
+	MaxVersionLevel int16
+	MinVersionLevel int16
+}
+
+const (
+	apiVersionsTagSupportedFeatures      = 0
+	apiVersionsTagFinalizedFeaturesEpoch = 1
+	apiVersionsTagFinalizedFeatures      = 2
+	apiVersionsTagZkMigrationReady       = 3
+)
+
+// supportedFeatures lists the feature version ranges this broker can run.
+var supportedFeatures = []SupportedFeature{
+	{Name: "metadata.version", MinVersion: 1, MaxVersion: 21},
+	{Name: "kraft.version", MinVersion: 0, MaxVersion: 1},
+}
+
+func (r *ApiVersionsRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	if version >= 3 {
+		r.ClientSoftwareName = p.ReadVersionedString(true)
+		r.ClientSoftwareVersion = p.ReadVersionedString(true)
+		p.ReadTaggedFields()
+	}
 	return nil
 }
 
-func (r *APIVersions) Serialize() ([]byte, error) {
-	res := make([]byte, 0)
-	res = binary.BigEndian.AppendUint16(res, uint16(r.ApiKey))
-	res = binary.BigEndian.AppendUint16(res, uint16(r.MinVersion))
-	res = binary.BigEndian.AppendUint16(res, uint16(r.MaxVersion))
-	res = append(res, r.TagBuffer...)
-	return res, nil
+func (r *APIVersions) Serialize(w *encoder.BytesWriter, flexible bool) {
+	w.WriteInt16(r.ApiKey)
+	w.WriteInt16(r.MinVersion)
+	w.WriteInt16(r.MaxVersion)
+	if flexible {
+		w.WriteTaggedFields()
+	}
 }
 
 func (r *ApiVersionsResponse) Serialize() ([]byte, error) {
-	res := make([]byte, 0)
-	res = binary.BigEndian.AppendUint16(res, uint16(r.ErrorCode))
-	res = append(res, byte(len(r.APIVersions)+1))
+	flexible := r.Version >= 3
+	w := encoder.NewBytesWriter()
+	w.WriteInt16(int16(r.ErrorCode))
+	w.WriteArrayLength(len(r.APIVersions), flexible)
 	for _, apiVersion := range r.APIVersions {
-		apiVersionBytes, _ := apiVersion.Serialize()
-		res = append(res, apiVersionBytes...)
+		apiVersion.Serialize(w, flexible)
+	}
+	if r.Version >= 1 {
+		w.WriteInt32(r.ThrottleTime)
+	}
+	if flexible {
+		w.WriteTaggedFields(r.taggedFields()...)
 	}
-	res = binary.BigEndian.AppendUint32(res, uint32(r.ThrottleTime))
-	res = append(res, r.TagBuffer...)
-	return res, nil
+	return w.Bytes(), nil
 }
 
-func HandleApiVersionsRequest(req *request.RequestHeader) (*ApiVersionsResponse, error) {
-	if req.ApiVersion < 0 || req.ApiVersion > 4 {
-		return &ApiVersionsResponse{
-			ErrorCode: utils.UNSUPPORTED_VERSION,
-		}, fmt.Errorf("unsupported version: %d", req.ApiVersion)
+func (r *ApiVersionsResponse) taggedFields() []encoder.TaggedField {
+	fields := []encoder.TaggedField{}
+	if len(r.SupportedFeatures) > 0 {
+		f := encoder.NewBytesWriter()
+		f.WriteArrayLength(len(r.SupportedFeatures), true)
+		for _, feature := range r.SupportedFeatures {
+			f.WriteString(feature.Name, true)
+			f.WriteInt16(feature.MinVersion)
+			f.WriteInt16(feature.MaxVersion)
+			f.WriteTaggedFields()
+		}
+		fields = append(fields, encoder.TaggedField{Tag: apiVersionsTagSupportedFeatures, Value: f.Bytes()})
 	}
+	if r.FinalizedFeaturesEpoch != -1 {
+		f := encoder.NewBytesWriter()
+		f.WriteInt64(r.FinalizedFeaturesEpoch)
+		fields = append(fields, encoder.TaggedField{Tag: apiVersionsTagFinalizedFeaturesEpoch, Value: f.Bytes()})
+	}
+	if len(r.FinalizedFeatures) > 0 {
+		f := encoder.NewBytesWriter()
+		f.WriteArrayLength(len(r.FinalizedFeatures), true)
+		for _, feature := range r.FinalizedFeatures {
+			f.WriteString(feature.Name, true)
+			f.WriteInt16(feature.MaxVersionLevel)
+			f.WriteInt16(feature.MinVersionLevel)
+			f.WriteTaggedFields()
+		}
+		fields = append(fields, encoder.TaggedField{Tag: apiVersionsTagFinalizedFeatures, Value: f.Bytes()})
+	}
+	if r.ZkMigrationReady {
+		f := encoder.NewBytesWriter()
+		f.WriteBool(true)
+		fields = append(fields, encoder.TaggedField{Tag: apiVersionsTagZkMigrationReady, Value: f.Bytes()})
+	}
+	return fields
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.ApiVersions,
+		MinVersion:      0,
+		MaxVersion:      4,
+		FlexibleVersion: 3,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleApiVersionsRequest(ctx.Header, p)
+		},
+		// Clients send their newest ApiVersions version first. The error is
+		// always encoded as v0 and lists the versions we do support, so the
+		// client can parse it and retry with one of them.
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			h, _ := Lookup(utils.ApiVersions)
+			return &ApiVersionsResponse{
+				Version:   0,
+				ErrorCode: code,
+				APIVersions: []APIVersions{{
+					ApiKey:     int16(h.ApiKey),
+					MinVersion: h.MinVersion,
+					MaxVersion: h.MaxVersion,
+				}},
+				FinalizedFeaturesEpoch: -1,
+			}
+		},
+	})
+}
+
+func HandleApiVersionsRequest(header *request.RequestHeader, p *decoder.BytesParser) (*ApiVersionsResponse, error) {
+	req := &ApiVersionsRequest{}
+	req.Deserialize(p, header.ApiVersion)
 
 	response := &ApiVersionsResponse{
-		ErrorCode:    0,
-		APIVersions:  []APIVersions{},
-		ThrottleTime: 0,
-		TagBuffer:    []byte{0},
+		Version:                header.ApiVersion,
+		ErrorCode:              utils.NONE,
+		APIVersions:            []APIVersions{},
+		ThrottleTime:           0,
+		FinalizedFeaturesEpoch: -1,
+	}
+	for _, h := range Handlers() {
+		response.APIVersions = append(response.APIVersions, APIVersions{
+			ApiKey:     int16(h.ApiKey),
+			MinVersion: h.MinVersion,
+			MaxVersion: h.MaxVersion,
+		})
+	}
+
+	if header.ApiVersion >= 3 {
+		response.SupportedFeatures = supportedFeatures
+		metadata := currentMetadata()
+		response.FinalizedFeaturesEpoch = metadata.FinalizedFeaturesEpoch
+		for _, feature := range metadata.FinalizedFeatures {
+			response.FinalizedFeatures = append(response.FinalizedFeatures, FinalizedFeature{
+				Name:            feature.Name,
+				MaxVersionLevel: feature.Level,
+				MinVersionLevel: feature.Level,
+			})
+		}
 	}
-	response.APIVersions = append(response.APIVersions, APIVersions{
-		ApiKey:     int16(utils.ApiVersions),
-		MinVersion: 0,
-		MaxVersion: 4,
-		TagBuffer:  []byte{0},
-	})
-	response.APIVersions = append(response.APIVersions, APIVersions{
-		ApiKey:     int16(utils.DescribeTopicPartitions),
-		MinVersion: 0,
-		MaxVersion: 0,
-		TagBuffer:  []byte{0},
-	})
-	response.APIVersions = append(response.APIVersions, APIVersions{
-		ApiKey:     int16(utils.Fetch),
-		MinVersion: 0,
-		MaxVersion: 16,
-		TagBuffer:  []byte{0},
-	})
 	return response, nil
 }
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+func apiVersions(t *testing.T, version int16) *ApiVersionsResponse {
+	t.Helper()
+	p := testParser(func(w *encoder.BytesWriter) {
+		if version >= 3 {
+			w.WriteString("test", true)
+			w.WriteString("1.0", true)
+			w.WriteTaggedFields()
+		}
+	})
+	resp, err := HandleApiVersionsRequest(testContext(utils.ApiVersions, version).Header, p)
+	if err != nil {
+		t.Fatalf("HandleApiVersionsRequest: %v", err)
+	}
+	return resp
+}
+
+func TestApiVersionsListsRegisteredHandlers(t *testing.T) {
+	setupStorage(t)
+
+	resp := apiVersions(t, 4)
+	if resp.ErrorCode != utils.NONE {
+		t.Fatalf("got error %d", resp.ErrorCode)
+	}
+	if len(resp.APIVersions) != len(Handlers()) {
+		t.Errorf("advertised %d APIs, want the %d registered", len(resp.APIVersions), len(Handlers()))
+	}
+	for _, v := range resp.APIVersions {
+		h, ok := Lookup(utils.APIKeys(v.ApiKey))
+		if !ok || v.MinVersion != h.MinVersion || v.MaxVersion != h.MaxVersion {
+			t.Errorf("advertised api key %d v%d-%d, which is not registered as such", v.ApiKey, v.MinVersion, v.MaxVersion)
+		}
+	}
+	if len(resp.FinalizedFeatures) != 1 || resp.FinalizedFeatures[0].Name != "metadata.version" || resp.FinalizedFeatures[0].MaxVersionLevel != 21 {
+		t.Errorf("got finalized features %+v, want metadata.version at 21", resp.FinalizedFeatures)
+	}
+	if resp.FinalizedFeaturesEpoch != 0 {
+		t.Errorf("got finalized features epoch %d, want 0", resp.FinalizedFeaturesEpoch)
+	}
+}
+
+func TestApiVersionsEncoding(t *testing.T) {
+	setupStorage(t)
+
+	for version := int16(0); version <= 4; version++ {
+		body, err := apiVersions(t, version).Serialize()
+		if err != nil {
+			t.Fatalf("v%d: Serialize: %v", version, err)
+		}
+		p := decoder.NewBytesParser(body)
+		if code := p.ReadInt16(); code != 0 {
+			t.Errorf("v%d: got error %d", version, code)
+		}
+		if n := p.ReadArrayLength(version >= 3); n != len(Handlers()) {
+			t.Errorf("v%d: got %d APIs, want %d", version, n, len(Handlers()))
+		}
+	}
+
+	// An unsupported version is answered in v0, listing the supported
+	// ApiVersions versions.
+	h, _ := Lookup(utils.ApiVersions)
+	body, _ := h.ErrorResponse(testContext(utils.ApiVersions, 5).Header, nil, utils.UNSUPPORTED_VERSION).Serialize()
+	p := decoder.NewBytesParser(body)
+	if code := utils.ErrorCode(p.ReadInt16()); code != utils.UNSUPPORTED_VERSION {
+		t.Errorf("got error %d, want UNSUPPORTED_VERSION", code)
+	}
+	if n := p.ReadArrayLength(false); n != 1 || p.ReadInt16() != int16(utils.ApiVersions) || p.ReadInt16() != 0 || p.ReadInt16() != 4 {
+		t.Errorf("v0 error response does not list ApiVersions v0-4")
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// testBatch encodes a batch holding one record per value, stamped with the
+// current time.
+func testBatch(values ...[]byte) []byte {
+	now := time.Now().UnixMilli()
+	batch := &record.RecordBatch{
+		LastOffsetDelta: int32(len(values) - 1),
+		BaseTimestamp:   now,
+		MaxTimestamp:    now,
+		ProducerId:      -1,
+		ProducerEpoch:   -1,
+		BaseSequence:    -1,
+	}
+	for i, value := range values {
+		batch.Records = append(batch.Records, record.Record{OffsetDelta: int32(i), Value: value})
+	}
+	return batch.Encode()
+}
+
+// metadataRecord encodes the value of a __cluster_metadata record, fields
+// writing the fields after its header.
+func metadataRecord(recordType MetatdataRecordType, fields func(w *encoder.BytesWriter)) []byte {
+	w := encoder.NewBytesWriter()
+	w.WriteInt8(1) // Frame Version
+	w.WriteInt8(int8(recordType))
+	w.WriteInt8(0) // Version
+	fields(w)
+	w.WriteTaggedFields()
+	return w.Bytes()
+}
+
+func featureLevelRecord(name string, level int16) []byte {
+	return metadataRecord(FeatureLevelRecordType, func(w *encoder.BytesWriter) {
+		w.WriteString(name, true)
+		w.WriteInt16(level)
+	})
+}
+
+func topicRecord(name string, topicId []byte) []byte {
+	return metadataRecord(TopicRecordType, func(w *encoder.BytesWriter) {
+		w.WriteString(name, true)
+		w.Write(topicId)
+	})
+}
+
+func partitionRecord(topicId []byte, partition int32) []byte {
+	return metadataRecord(PartitionRecordType, func(w *encoder.BytesWriter) {
+		w.WriteInt32(partition)
+		w.Write(topicId)
+		w.WriteArrayLength(1, true) // Replicas
+		w.WriteInt32(1)
+		w.WriteArrayLength(1, true) // ISR
+		w.WriteInt32(1)
+		w.WriteArrayLength(0, true) // Removing Replicas
+		w.WriteArrayLength(0, true) // Adding Replicas
+		w.WriteInt32(1)             // Leader
+		w.WriteInt32(0)             // Leader Epoch
+	})
+}
+
+// setupStorage makes the handlers serve a fresh MemoryStorage whose cluster
+// metadata log creates each of topics with a single partition 0.
+func setupStorage(t *testing.T, topics ...string) *storage.MemoryStorage {
+	t.Helper()
+	s := storage.NewMemoryStorage(config.New(nil))
+	t.Cleanup(func() { s.Close() })
+
+	values := [][]byte{featureLevelRecord("metadata.version", 21)}
+	for i, name := range topics {
+		topicId := bytes.Repeat([]byte{byte(i + 1)}, 16)
+		values = append(values, topicRecord(name, topicId), partitionRecord(topicId, 0))
+	}
+	metadata, _ := s.GetOrCreateLog(storage.TopicPartition{Topic: ClusterMetadataTopic, Partition: 0})
+	if _, err := metadata.Append(testBatch(values...)); err != nil {
+		t.Fatalf("appending to the metadata log: %v", err)
+	}
+	SetStorage(s)
+	return s
+}
+
+func testContext(apiKey utils.APIKeys, version int16) *RequestContext {
+	return &RequestContext{
+		Header:     &request.RequestHeader{ApiKey: apiKey, ApiVersion: version, CorrelationId: 1},
+		Principal:  AnonymousPrincipal,
+		ReceivedAt: time.Now(),
+		Closed:     make(chan struct{}),
+	}
+}
+
+// testParser returns a parser over the request body fields writes.
+func testParser(fields func(w *encoder.BytesWriter)) *decoder.BytesParser {
+	w := encoder.NewBytesWriter()
+	fields(w)
+	return decoder.NewBytesParser(w.Bytes())
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type DeleteRecordsRequest struct {
+	Topics    []DeleteRecordsTopic
+	TimeoutMs int32
+}
+
+type DeleteRecordsTopic struct {
+	Name       string
+	Partitions []DeleteRecordsPartition
+}
+
+type DeleteRecordsPartition struct {
+	PartitionIndex int32
+	Offset         int64
+}
+
+type DeleteRecordsResponse struct {
+	Version        int16
+	ThrottleTimeMs int32
+	Topics         []DeleteRecordsTopicResult
+}
+
+type DeleteRecordsTopicResult struct {
+	Name       string
+	Partitions []DeleteRecordsPartitionResult
+}
+
+type DeleteRecordsPartitionResult struct {
+	PartitionIndex int32
+	LowWatermark   int64
+	ErrorCode      utils.ErrorCode
+}
+
+func (r *DeleteRecordsRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 2
+	r.Topics = make([]DeleteRecordsTopic, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Topics {
+		topic := &r.Topics[i]
+		topic.Name = p.ReadVersionedString(flexible)
+		topic.Partitions = make([]DeleteRecordsPartition, max(p.ReadArrayLength(flexible), 0))
+		for j := range topic.Partitions {
+			topic.Partitions[j].PartitionIndex = p.ReadInt32()
+			topic.Partitions[j].Offset = p.ReadInt64()
+			if flexible {
+				p.ReadTaggedFields()
+			}
+		}
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	r.TimeoutMs = p.ReadInt32()
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *DeleteRecordsResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 2
+	w := encoder.NewBytesWriter()
+	w.WriteInt32(r.ThrottleTimeMs)
+	w.WriteArrayLength(len(r.Topics), flexible)
+	for _, topic := range r.Topics {
+		w.WriteString(topic.Name, flexible)
+		w.WriteArrayLength(len(topic.Partitions), flexible)
+		for _, partition := range topic.Partitions {
+			w.WriteInt32(partition.PartitionIndex)
+			w.WriteInt64(partition.LowWatermark)
+			w.WriteInt16(int16(partition.ErrorCode))
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.DeleteRecords,
+		MinVersion:      0,
+		MaxVersion:      2,
+		FlexibleVersion: 2,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleDeleteRecordsRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &DeleteRecordsResponse{Version: header.ApiVersion, Topics: []DeleteRecordsTopicResult{}}
+		},
+	})
+}
+
+// HandleDeleteRecordsRequest deletes the records of each partition below the
+// requested offset, or below the high watermark for an offset of -1, by
+// advancing its log start offset. The new log start offset is returned as the
+// low watermark.
+func HandleDeleteRecordsRequest(header *request.RequestHeader, p *decoder.BytesParser) (*DeleteRecordsResponse, error) {
+	req := &DeleteRecordsRequest{}
+	req.Deserialize(p, header.ApiVersion)
+
+	resp := &DeleteRecordsResponse{Version: header.ApiVersion, Topics: make([]DeleteRecordsTopicResult, len(req.Topics))}
+	for i, topic := range req.Topics {
+		result := DeleteRecordsTopicResult{Name: topic.Name, Partitions: make([]DeleteRecordsPartitionResult, len(topic.Partitions))}
+		for j, partition := range topic.Partitions {
+			lowWatermark, errorCode := deleteRecords(topic.Name, partition.PartitionIndex, partition.Offset)
+			result.Partitions[j] = DeleteRecordsPartitionResult{
+				PartitionIndex: partition.PartitionIndex,
+				LowWatermark:   lowWatermark,
+				ErrorCode:      errorCode,
+			}
+		}
+		resp.Topics[i] = result
+	}
+	return resp, nil
+}
+
+func deleteRecords(topicName string, partitionId int32, offset int64) (int64, utils.ErrorCode) {
+	if _, errorCode := lookupPartitionLog(topicName, partitionId); errorCode != utils.NONE {
+		return -1, errorCode
+	}
+	lowWatermark, err := logStorage.DeleteRecords(storage.TopicPartition{Topic: topicName, Partition: partitionId}, offset)
+	switch {
+	case err == nil:
+		return lowWatermark, utils.NONE
+	case errors.Is(err, storage.ErrOffsetOutOfRange):
+		return -1, utils.OFFSET_OUT_OF_RANGE
+	default:
+		fmt.Printf("Error deleting records of %s-%d: %s\n", topicName, partitionId, err.Error())
+		return -1, utils.KAFKA_STORAGE_ERROR
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+func deleteRecordsBelow(t *testing.T, topic string, offset int64) DeleteRecordsPartitionResult {
+	t.Helper()
+	p := testParser(func(w *encoder.BytesWriter) {
+		w.WriteArrayLength(1, true)
+		w.WriteString(topic, true)
+		w.WriteArrayLength(1, true)
+		w.WriteInt32(0)
+		w.WriteInt64(offset)
+		w.WriteTaggedFields()
+		w.WriteTaggedFields()
+		w.WriteInt32(1000) // Timeout Ms
+		w.WriteTaggedFields()
+	})
+	resp, err := HandleDeleteRecordsRequest(testContext(utils.DeleteRecords, 2).Header, p)
+	if err != nil {
+		t.Fatalf("HandleDeleteRecordsRequest: %v", err)
+	}
+	return resp.Topics[0].Partitions[0]
+}
+
+func TestDeleteRecords(t *testing.T) {
+	setupStorage(t, "orders")
+	for range 3 {
+		produce(t, "orders", testBatch([]byte("a"), []byte("b")))
+	}
+
+	if resp := deleteRecordsBelow(t, "orders", 3); resp.ErrorCode != utils.NONE || resp.LowWatermark != 3 {
+		t.Fatalf("got error %d and low watermark %d, want none and 3", resp.ErrorCode, resp.LowWatermark)
+	}
+	if resp := listOffsets(t, "orders", EarliestTimestamp); resp.Offset != 3 {
+		t.Errorf("earliest offset is %d after deleting, want 3", resp.Offset)
+	}
+	if resp := fetch(t, "orders", 1); resp.ErrorCode != utils.OFFSET_OUT_OF_RANGE || resp.LogStartOffset != 3 {
+		t.Errorf("fetch below the log start offset got error %d and log start offset %d, want OFFSET_OUT_OF_RANGE and 3", resp.ErrorCode, resp.LogStartOffset)
+	}
+
+	if resp := deleteRecordsBelow(t, "orders", 10); resp.ErrorCode != utils.OFFSET_OUT_OF_RANGE {
+		t.Errorf("deleting past the high watermark got error %d, want OFFSET_OUT_OF_RANGE", resp.ErrorCode)
+	}
+	if resp := deleteRecordsBelow(t, "orders", storage.HighWatermarkOffset); resp.ErrorCode != utils.NONE || resp.LowWatermark != 6 {
+		t.Errorf("deleting up to the high watermark got error %d and low watermark %d, want none and 6", resp.ErrorCode, resp.LowWatermark)
+	}
+	if resp := deleteRecordsBelow(t, "unknown", 0); resp.ErrorCode != utils.UNKNOWN_TOPIC_OR_PARTITION {
+		t.Errorf("unknown topic got error %d, want UNKNOWN_TOPIC_OR_PARTITION", resp.ErrorCode)
+	}
+}
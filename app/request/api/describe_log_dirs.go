@@ -0,0 +1,178 @@
+package api
+
+import (
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type DescribeLogDirsRequest struct {
+	// Topics is nil to describe every partition.
+	Topics []DescribableLogDirTopic
+}
+
+type DescribableLogDirTopic struct {
+	Topic      string
+	Partitions []int32
+}
+
+type DescribeLogDirsResponse struct {
+	Version        int16
+	ThrottleTimeMs int32
+	ErrorCode      utils.ErrorCode // v3+
+	Results        []DescribeLogDirsResult
+}
+
+type DescribeLogDirsResult struct {
+	ErrorCode   utils.ErrorCode
+	LogDir      string
+	Topics      []DescribeLogDirsTopic
+	TotalBytes  int64 // v4+
+	UsableBytes int64 // v4+
+}
+
+type DescribeLogDirsTopic struct {
+	Name       string
+	Partitions []DescribeLogDirsPartition
+}
+
+type DescribeLogDirsPartition struct {
+	PartitionIndex int32
+	PartitionSize  int64
+	OffsetLag      int64
+	IsFutureKey    bool
+}
+
+func (r *DescribeLogDirsRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 2
+	n := p.ReadArrayLength(flexible)
+	if n < 0 {
+		return nil
+	}
+	r.Topics = make([]DescribableLogDirTopic, n)
+	for i := range r.Topics {
+		topic := &r.Topics[i]
+		topic.Topic = p.ReadVersionedString(flexible)
+		topic.Partitions = make([]int32, max(p.ReadArrayLength(flexible), 0))
+		for j := range topic.Partitions {
+			topic.Partitions[j] = p.ReadInt32()
+		}
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *DescribeLogDirsResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 2
+	w := encoder.NewBytesWriter()
+	w.WriteInt32(r.ThrottleTimeMs)
+	if r.Version >= 3 {
+		w.WriteInt16(int16(r.ErrorCode))
+	}
+	w.WriteArrayLength(len(r.Results), flexible)
+	for _, result := range r.Results {
+		w.WriteInt16(int16(result.ErrorCode))
+		w.WriteString(result.LogDir, flexible)
+		w.WriteArrayLength(len(result.Topics), flexible)
+		for _, topic := range result.Topics {
+			w.WriteString(topic.Name, flexible)
+			w.WriteArrayLength(len(topic.Partitions), flexible)
+			for _, partition := range topic.Partitions {
+				w.WriteInt32(partition.PartitionIndex)
+				w.WriteInt64(partition.PartitionSize)
+				w.WriteInt64(partition.OffsetLag)
+				w.WriteBool(partition.IsFutureKey)
+				if flexible {
+					w.WriteTaggedFields()
+				}
+			}
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if r.Version >= 4 {
+			w.WriteInt64(result.TotalBytes)
+			w.WriteInt64(result.UsableBytes)
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.DescribeLogDirs,
+		MinVersion:      0,
+		MaxVersion:      4,
+		FlexibleVersion: 2,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleDescribeLogDirsRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &DescribeLogDirsResponse{Version: header.ApiVersion, ErrorCode: code, Results: []DescribeLogDirsResult{}}
+		},
+	})
+}
+
+// HandleDescribeLogDirsRequest reports the size of every requested partition
+// in each log directory, future replicas being moved there included.
+// Offline directories are listed with KAFKA_STORAGE_ERROR and nothing else.
+func HandleDescribeLogDirsRequest(header *request.RequestHeader, p *decoder.BytesParser) (*DescribeLogDirsResponse, error) {
+	req := &DescribeLogDirsRequest{}
+	req.Deserialize(p, header.ApiVersion)
+
+	var wanted map[storage.TopicPartition]bool
+	if req.Topics != nil {
+		wanted = map[storage.TopicPartition]bool{}
+		for _, topic := range req.Topics {
+			for _, partition := range topic.Partitions {
+				wanted[storage.TopicPartition{Topic: topic.Topic, Partition: partition}] = true
+			}
+		}
+	}
+
+	resp := &DescribeLogDirsResponse{Version: header.ApiVersion, Results: []DescribeLogDirsResult{}}
+	for _, dir := range logStorage.DescribeLogDirs() {
+		result := DescribeLogDirsResult{
+			LogDir:      dir.Path,
+			Topics:      []DescribeLogDirsTopic{},
+			TotalBytes:  dir.TotalBytes,
+			UsableBytes: dir.UsableBytes,
+		}
+		if dir.Offline {
+			result.ErrorCode = utils.KAFKA_STORAGE_ERROR
+		}
+		topics := map[string]int{}
+		for _, replica := range dir.Replicas {
+			if wanted != nil && !wanted[replica.Partition] {
+				continue
+			}
+			i, ok := topics[replica.Partition.Topic]
+			if !ok {
+				i = len(result.Topics)
+				topics[replica.Partition.Topic] = i
+				result.Topics = append(result.Topics, DescribeLogDirsTopic{Name: replica.Partition.Topic})
+			}
+			result.Topics[i].Partitions = append(result.Topics[i].Partitions, DescribeLogDirsPartition{
+				PartitionIndex: replica.Partition.Partition,
+				PartitionSize:  replica.Size,
+				OffsetLag:      replica.OffsetLag,
+				IsFutureKey:    replica.IsFuture,
+			})
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
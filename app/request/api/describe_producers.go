@@ -0,0 +1,138 @@
+package api
+
+import (
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type DescribeProducersRequest struct {
+	Topics []DescribeProducersTopic
+}
+
+type DescribeProducersTopic struct {
+	Name             string
+	PartitionIndexes []int32
+}
+
+type DescribeProducersResponse struct {
+	ThrottleTimeMs int32
+	Topics         []DescribeProducersTopicResponse
+}
+
+type DescribeProducersTopicResponse struct {
+	Name       string
+	Partitions []DescribeProducersPartitionResponse
+}
+
+type DescribeProducersPartitionResponse struct {
+	PartitionIndex  int32
+	ErrorCode       utils.ErrorCode
+	ErrorMessage    *string
+	ActiveProducers []ProducerState
+}
+
+type ProducerState struct {
+	ProducerId            int64
+	ProducerEpoch         int32
+	LastSequence          int32
+	LastTimestamp         int64
+	CoordinatorEpoch      int32
+	CurrentTxnStartOffset int64
+}
+
+func (r *DescribeProducersRequest) Deserialize(p *decoder.BytesParser) error {
+	r.Topics = make([]DescribeProducersTopic, max(p.ReadArrayLength(true), 0))
+	for i := range r.Topics {
+		topic := &r.Topics[i]
+		topic.Name = p.ReadVersionedString(true)
+		topic.PartitionIndexes = make([]int32, max(p.ReadArrayLength(true), 0))
+		for j := range topic.PartitionIndexes {
+			topic.PartitionIndexes[j] = p.ReadInt32()
+		}
+		p.ReadTaggedFields()
+	}
+	p.ReadTaggedFields()
+	return nil
+}
+
+func (r *DescribeProducersResponse) Serialize() ([]byte, error) {
+	w := encoder.NewBytesWriter()
+	w.WriteInt32(r.ThrottleTimeMs)
+	w.WriteArrayLength(len(r.Topics), true)
+	for _, topic := range r.Topics {
+		w.WriteString(topic.Name, true)
+		w.WriteArrayLength(len(topic.Partitions), true)
+		for _, partition := range topic.Partitions {
+			w.WriteInt32(partition.PartitionIndex)
+			w.WriteInt16(int16(partition.ErrorCode))
+			w.WriteNullableString(partition.ErrorMessage, true)
+			w.WriteArrayLength(len(partition.ActiveProducers), true)
+			for _, producer := range partition.ActiveProducers {
+				w.WriteInt64(producer.ProducerId)
+				w.WriteInt32(producer.ProducerEpoch)
+				w.WriteInt32(producer.LastSequence)
+				w.WriteInt64(producer.LastTimestamp)
+				w.WriteInt32(producer.CoordinatorEpoch)
+				w.WriteInt64(producer.CurrentTxnStartOffset)
+				w.WriteTaggedFields()
+			}
+			w.WriteTaggedFields()
+		}
+		w.WriteTaggedFields()
+	}
+	w.WriteTaggedFields()
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.DescribeProducers,
+		MinVersion:      0,
+		MaxVersion:      0,
+		FlexibleVersion: 0,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleDescribeProducersRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &DescribeProducersResponse{Topics: []DescribeProducersTopicResponse{}}
+		},
+	})
+}
+
+// HandleDescribeProducersRequest lists the idempotent and transactional
+// producers writing to each partition, from the producer state of its log.
+func HandleDescribeProducersRequest(header *request.RequestHeader, p *decoder.BytesParser) (*DescribeProducersResponse, error) {
+	req := &DescribeProducersRequest{}
+	req.Deserialize(p)
+
+	resp := &DescribeProducersResponse{Topics: make([]DescribeProducersTopicResponse, len(req.Topics))}
+	for i, topic := range req.Topics {
+		resp.Topics[i] = DescribeProducersTopicResponse{Name: topic.Name, Partitions: make([]DescribeProducersPartitionResponse, len(topic.PartitionIndexes))}
+		for j, partitionId := range topic.PartitionIndexes {
+			resp.Topics[i].Partitions[j] = describeProducers(topic.Name, partitionId)
+		}
+	}
+	return resp, nil
+}
+
+func describeProducers(topicName string, partitionId int32) DescribeProducersPartitionResponse {
+	resp := DescribeProducersPartitionResponse{PartitionIndex: partitionId, ActiveProducers: []ProducerState{}}
+	log, errorCode := lookupPartitionLog(topicName, partitionId)
+	if errorCode != utils.NONE {
+		resp.ErrorCode = errorCode
+		return resp
+	}
+	for _, producer := range log.ActiveProducers() {
+		resp.ActiveProducers = append(resp.ActiveProducers, ProducerState{
+			ProducerId:            producer.ProducerId,
+			ProducerEpoch:         int32(producer.ProducerEpoch),
+			LastSequence:          producer.LastSequence,
+			LastTimestamp:         producer.LastTimestamp,
+			CoordinatorEpoch:      producer.CoordinatorEpoch,
+			CurrentTxnStartOffset: producer.CurrentTxnStartOffset,
+		})
+	}
+	return resp
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// producerBatch encodes a batch of count records from an idempotent
+// producer, transactional with the transactional attribute.
+func producerBatch(producerId int64, epoch int16, baseSequence int32, count int, attributes int16) []byte {
+	now := time.Now().UnixMilli()
+	batch := &record.RecordBatch{
+		Attributes:      attributes,
+		LastOffsetDelta: int32(count - 1),
+		BaseTimestamp:   now,
+		MaxTimestamp:    now,
+		ProducerId:      producerId,
+		ProducerEpoch:   epoch,
+		BaseSequence:    baseSequence,
+	}
+	for i := range count {
+		batch.Records = append(batch.Records, record.Record{OffsetDelta: int32(i), Value: []byte("value")})
+	}
+	return batch.Encode()
+}
+
+func describeProducersOf(t *testing.T, topic string) DescribeProducersPartitionResponse {
+	t.Helper()
+	p := testParser(func(w *encoder.BytesWriter) {
+		w.WriteArrayLength(1, true)
+		w.WriteString(topic, true)
+		w.WriteArrayLength(1, true)
+		w.WriteInt32(0)
+		w.WriteTaggedFields()
+		w.WriteTaggedFields()
+	})
+	resp, err := HandleDescribeProducersRequest(testContext(utils.DescribeProducers, 0).Header, p)
+	if err != nil {
+		t.Fatalf("HandleDescribeProducersRequest: %v", err)
+	}
+	return resp.Topics[0].Partitions[0]
+}
+
+func TestDescribeProducers(t *testing.T) {
+	setupStorage(t, "orders")
+	const transactional = 0x10
+
+	produce(t, "orders", testBatch([]byte("plain")))
+	produce(t, "orders", producerBatch(7, 2, 0, 3, 0))
+	produce(t, "orders", producerBatch(7, 2, 3, 2, 0))
+	produce(t, "orders", producerBatch(9, 0, 0, 1, transactional))
+
+	resp := describeProducersOf(t, "orders")
+	if resp.ErrorCode != utils.NONE {
+		t.Fatalf("got error %d", resp.ErrorCode)
+	}
+	if len(resp.ActiveProducers) != 2 {
+		t.Fatalf("got %d producers, want 2", len(resp.ActiveProducers))
+	}
+	idempotent, txn := resp.ActiveProducers[0], resp.ActiveProducers[1]
+	if idempotent.ProducerId != 7 || idempotent.ProducerEpoch != 2 || idempotent.LastSequence != 4 || idempotent.CurrentTxnStartOffset != -1 {
+		t.Errorf("got idempotent producer %+v, want id 7 at epoch 2, last sequence 4 and no transaction", idempotent)
+	}
+	if idempotent.LastTimestamp <= 0 {
+		t.Errorf("got last timestamp %d for producer 7", idempotent.LastTimestamp)
+	}
+	if txn.ProducerId != 9 || txn.CurrentTxnStartOffset != 6 {
+		t.Errorf("got transactional producer %+v, want id 9 with a transaction from offset 6", txn)
+	}
+
+	if resp := describeProducersOf(t, "unknown"); resp.ErrorCode != utils.UNKNOWN_TOPIC_OR_PARTITION {
+		t.Errorf("unknown topic got error %d, want UNKNOWN_TOPIC_OR_PARTITION", resp.ErrorCode)
+	}
+	if _, ok := Lookup(utils.DescribeProducers); !ok {
+		t.Errorf("DescribeProducers is not advertised by ApiVersions")
+	}
+}
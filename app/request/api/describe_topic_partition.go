@@ -3,7 +3,6 @@ package api
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 
 	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
 	"github.com/codecrafters-io/kafka-starter-go/app/request"
@@ -39,13 +38,6 @@ func (r *Cursor) Serialize() ([]byte, error) {
 
 type TopicAuthorizedOperations int32
 
-type MetatdataRecordType int8
-
-const (
-	TopicRecordType     MetatdataRecordType = 2
-	PartitionRecordType MetatdataRecordType = 3
-)
-
 const (
 	READ             TopicAuthorizedOperations = 1 << 3
 	WRITE            TopicAuthorizedOperations = 1 << 4
@@ -105,106 +97,6 @@ type Partition struct {
 	TaggedBuffer                          []byte
 }
 
-func ParseMetadataLogFile() (map[string]Topic, error) {
-	buffer, err := utils.ReadFile("/tmp/kraft-combined-logs/__cluster_metadata-0/00000000000000000000.log")
-	if err != nil {
-		fmt.Printf("Error reading metadata log file: %s\n", err.Error())
-	}
-
-	topics := map[string]*Topic{}
-
-	for {
-		// BaseOffset: (8 bytes)
-		// BatchLength: (4 bytes)
-		// PartitionLeaderEpoch: (4 bytes)
-		// MagicByte: (1 byte)
-		// CRC: (4 bytes)
-		// Attribute: (2 bytes)
-		// LastOffSetDelta: (4 bytes)
-		// BaseTimestamp: (8 bytes)
-		// MaxTimestamp: (8 bytes)
-		// ProducerID: (8 bytes)
-		// ProducerEpoch: (2 bytes)
-		// BaseSequence: (4 bytes)
-		buffer.Next(8 + 4 + 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4)
-		if buffer.Len() == 0 {
-			break
-		}
-
-		recordsLength := int32(binary.BigEndian.Uint32(buffer.Next(4)))
-		for range recordsLength {
-			length, _ := binary.ReadVarint(buffer)
-
-			recordBuffer := bytes.NewBuffer(buffer.Next(int(length)))
-			recordBuffer.Next(1)            // Attributes
-			binary.ReadVarint(recordBuffer) // Timestamp Delta
-			binary.ReadVarint(recordBuffer) // Offset Delta
-			keyLength, _ := binary.ReadVarint(recordBuffer)
-
-			if keyLength > 0 {
-				recordBuffer.Next(int(keyLength))
-			}
-			valueLength, _ := binary.ReadVarint(recordBuffer)
-			valueBuffer := bytes.NewBuffer(recordBuffer.Next(int(valueLength)))
-			_ = valueBuffer.Next(1) // Frame Version
-			var recordType MetatdataRecordType
-			binary.Read(valueBuffer, binary.BigEndian, &recordType)
-			valueBuffer.Next(1) // Version
-
-			switch recordType {
-			case TopicRecordType:
-				nameLength, _ := binary.ReadUvarint(valueBuffer)
-				topicName, topicId := make([]byte, nameLength-1), make([]byte, 16)
-				binary.Read(valueBuffer, binary.BigEndian, &topicName)
-				binary.Read(valueBuffer, binary.BigEndian, &topicId)
-
-				topic := &Topic{
-					TopicName: string(topicName),
-					TopicId:   string(topicId),
-				}
-
-				topics[topic.TopicId] = topic
-
-			case PartitionRecordType:
-				partition := Partition{
-					ErrorCode:                             utils.NONE,
-					EligibleLeaderReplicaNodeIds:          []int32{},
-					LastKnownEligibleLeaderReplicaNodeIds: []int32{},
-					OfflineReplicaNodeIds:                 []int32{},
-				}
-				binary.Read(valueBuffer, binary.BigEndian, &partition.PartitionIndex)
-				topicId := make([]byte, 16)
-				binary.Read(valueBuffer, binary.BigEndian, &topicId)
-
-				replicaLength, _ := binary.ReadUvarint(valueBuffer)
-				partition.ReplicaNodeIds = make([]int32, replicaLength-1)
-				for i := range replicaLength - 1 {
-					binary.Read(valueBuffer, binary.BigEndian, &partition.ReplicaNodeIds[i])
-				}
-
-				isrLength, _ := binary.ReadUvarint(valueBuffer)
-				partition.IsrNodeIds = make([]int32, isrLength-1)
-				for i := range isrLength - 1 {
-					binary.Read(valueBuffer, binary.BigEndian, &partition.IsrNodeIds[i])
-				}
-
-				binary.ReadUvarint(valueBuffer) // Length of Removing Replicas array
-				binary.ReadUvarint(valueBuffer) // Length of Adding Replicas array
-				binary.Read(valueBuffer, binary.BigEndian, &partition.LeaderId)
-				binary.Read(valueBuffer, binary.BigEndian, &partition.LeaderEpoch)
-
-				topics[string(topicId)].Partitions = append(topics[string(topicId)].Partitions, partition)
-			}
-		}
-	}
-	topicsList := make(map[string]Topic, len(topics))
-	for _, topic := range topics {
-		topicsList[topic.TopicName] = *topic
-	}
-
-	return topicsList, nil
-}
-
 func (r *DescribeTopicPartitionsRequest) Deserialize(p *decoder.BytesParser) error {
 	arrayLength := p.ReadInt8() - 1
 
@@ -264,7 +156,6 @@ func (r *Partition) Serialize() ([]byte, error) {
 
 func (r *DescribeTopicPartitionsResponse) Serialize() ([]byte, error) {
 	b := new(bytes.Buffer)
-	b.Write([]byte{0}) // Tag Buffer
 	binary.Write(b, binary.BigEndian, r.ThrottleTime)
 	binary.Write(b, binary.BigEndian, int8(len(r.Topics)+1))
 	for _, topic := range r.Topics {
@@ -276,6 +167,21 @@ func (r *DescribeTopicPartitionsResponse) Serialize() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.DescribeTopicPartitions,
+		MinVersion:      0,
+		MaxVersion:      0,
+		FlexibleVersion: 0,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleDescribeTopicPartitionsRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &DescribeTopicPartitionsResponse{Topics: []Topic{}}
+		},
+	})
+}
+
 func HandleDescribeTopicPartitionsRequest(req *request.RequestHeader, p *decoder.BytesParser) (*DescribeTopicPartitionsResponse, error) {
 	request := &DescribeTopicPartitionsRequest{}
 	request.Deserialize(p)
@@ -288,10 +194,7 @@ func HandleDescribeTopicPartitionsRequest(req *request.RequestHeader, p *decoder
 			Partitionindex: request.Cursor.Partitionindex,
 		},
 	}
-	topics, err := ParseMetadataLogFile()
-	if err != nil {
-		return nil, err
-	}
+	topics := currentMetadata().Topics
 	for _, topicName := range request.TopicNames {
 		curTopic, ok := topics[topicName]
 		errorCode := utils.UNKNOWN_TOPIC_OR_PARTITION
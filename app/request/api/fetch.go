@@ -2,15 +2,32 @@ package api
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
+	"time"
 
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
 	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/metrics"
+	"github.com/codecrafters-io/kafka-starter-go/app/purgatory"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
 	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
 	"github.com/codecrafters-io/kafka-starter-go/app/utils"
 )
 
+// Isolation levels of Fetch and ListOffsets: read_committed consumers only
+// see records below the last stable offset.
+const (
+	ReadUncommitted int8 = 0
+	ReadCommitted   int8 = 1
+)
+
 type FetchRequest struct {
+	Version             int16
+	ClusterId           *string
+	ReplicaId           int32
+	ReplicaState        ReplicaState
 	MaxWaitMs           int32
 	MinBytes            int32
 	MaxBytes            int32
@@ -22,13 +39,22 @@ type FetchRequest struct {
 	RackId              string
 }
 
+// ReplicaState replaces the top-level ReplicaId from v15 on, where it is sent
+// as a tagged field.
+type ReplicaState struct {
+	ReplicaId    int32
+	ReplicaEpoch int64
+}
+
 type FetchTopic struct {
-	TopicId    string
+	TopicName  string // v0-12
+	TopicId    string // v13+
 	Partitions []FetchPartition
 }
 
 type ForgottenTopicData struct {
-	TopicId    string
+	TopicName  string // v7-12
+	TopicId    string // v13+
 	Partitions []int32
 }
 
@@ -42,14 +68,17 @@ type FetchPartition struct {
 }
 
 type FetchResponse struct {
+	Version        int16
 	ThrottleTimeMs int32
 	ErrorCode      utils.ErrorCode
 	SessionId      int32
 	Responses      []FetchResponseTopic
+	NodeEndpoints  []NodeEndpoint
 }
 
 type FetchResponseTopic struct {
-	TopicId    string
+	TopicName  string // v0-12
+	TopicId    string // v13+
 	Partitions []FetchPartitionResponse
 }
 
@@ -59,14 +88,49 @@ type FetchPartitionResponse struct {
 	HighWatermark        int64
 	LastStableOffset     int64
 	LogStartOffset       int64
+	DivergingEpoch       *EpochEndOffset
+	CurrentLeader        *LeaderIdAndEpoch
+	SnapshotId           *SnapshotId
 	AbortedTransactions  []AbortedTransaction
 	PreferredReadReplica int32
-	Records              []Record
+	Records              []Records
+}
+
+type EpochEndOffset struct {
+	Epoch     int32
+	EndOffset int64
 }
 
-type Record struct {
-	BatchLength int32
-	RecordBatch []byte
+type LeaderIdAndEpoch struct {
+	LeaderId    int32
+	LeaderEpoch int32
+}
+
+type SnapshotId struct {
+	EndOffset int64
+	Epoch     int32
+}
+
+type NodeEndpoint struct {
+	NodeId int32
+	Host   string
+	Port   int32
+	Rack   *string
+}
+
+// Records is record data of a partition: batches sent as they are stored,
+// straight from a segment file for a LogManager, or message sets
+// down-converted in memory.
+type Records struct {
+	Region storage.Records
+	Data   []byte
+}
+
+func (r *Records) Size() int {
+	if r.Region != nil {
+		return r.Region.Size()
+	}
+	return len(r.Data)
 }
 
 type AbortedTransaction struct {
@@ -74,170 +138,614 @@ type AbortedTransaction struct {
 	FirstOffset int64
 }
 
-func (r *FetchPartition) Deserialize(p *decoder.BytesParser) error {
+const (
+	fetchTagClusterId    = 0
+	fetchTagReplicaState = 1
+
+	fetchPartitionTagDivergingEpoch = 0
+	fetchPartitionTagCurrentLeader  = 1
+	fetchPartitionTagSnapshotId     = 2
+
+	fetchTagNodeEndpoints = 0
+)
+
+func (r *FetchPartition) Deserialize(p *decoder.BytesParser, version int16) error {
 	r.PartitionId = p.ReadInt32()
-	r.CurrentLeaderEpoch = p.ReadInt32()
+	r.CurrentLeaderEpoch = -1
+	if version >= 9 {
+		r.CurrentLeaderEpoch = p.ReadInt32()
+	}
 	r.FetchOffset = p.ReadInt64()
-	r.LastFetchedEpoch = p.ReadInt32()
-	r.LogStartOffset = p.ReadInt64()
+	r.LastFetchedEpoch = -1
+	if version >= 12 {
+		r.LastFetchedEpoch = p.ReadInt32()
+	}
+	r.LogStartOffset = -1
+	if version >= 5 {
+		r.LogStartOffset = p.ReadInt64()
+	}
 	r.PartitionMaxBytes = p.ReadInt32()
-	p.ReadInt8() // Tag Buffer
+	if version >= 12 {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *FetchTopic) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 12
+	if version >= 13 {
+		r.TopicId = string(p.ReadUUID())
+	} else {
+		r.TopicName = p.ReadVersionedString(flexible)
+	}
+	r.Partitions = make([]FetchPartition, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Partitions {
+		r.Partitions[i].Deserialize(p, version)
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
 	return nil
 }
 
-func (r *FetchTopic) Deserialize(p *decoder.BytesParser) error {
-	r.TopicId = string(p.ReadUUID())
-	r.Partitions = make([]FetchPartition, p.ReadInt8()-1)
+func (r *ForgottenTopicData) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 12
+	if version >= 13 {
+		r.TopicId = string(p.ReadUUID())
+	} else {
+		r.TopicName = p.ReadVersionedString(flexible)
+	}
+	r.Partitions = make([]int32, max(p.ReadArrayLength(flexible), 0))
 	for i := range r.Partitions {
-		parts := FetchPartition{}
-		parts.Deserialize(p)
-		r.Partitions[i] = parts
-		p.ReadInt8() // Tag Buffer
+		r.Partitions[i] = p.ReadInt32()
+	}
+	if flexible {
+		p.ReadTaggedFields()
 	}
 	return nil
 }
 
-func (r *FetchRequest) Deserialize(p *decoder.BytesParser) error {
+func (r *FetchRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 12
+	r.Version = version
+	r.ReplicaId = -1
+	r.ReplicaState = ReplicaState{ReplicaId: -1, ReplicaEpoch: -1}
+	if version < 15 {
+		r.ReplicaId = p.ReadInt32()
+		r.ReplicaState.ReplicaId = r.ReplicaId
+	}
 	r.MaxWaitMs = p.ReadInt32()
 	r.MinBytes = p.ReadInt32()
-	r.MaxBytes = p.ReadInt32()
-	r.IsolationLevel = p.ReadInt8()
-	r.SessionId = p.ReadInt32()
-	r.SessionEpoch = p.ReadInt32()
-	r.Topics = make([]FetchTopic, p.ReadInt8()-1)
+	r.MaxBytes = 0x7fffffff
+	if version >= 3 {
+		r.MaxBytes = p.ReadInt32()
+	}
+	if version >= 4 {
+		r.IsolationLevel = p.ReadInt8()
+	}
+	r.SessionId = 0
+	r.SessionEpoch = -1
+	if version >= 7 {
+		r.SessionId = p.ReadInt32()
+		r.SessionEpoch = p.ReadInt32()
+	}
 
+	r.Topics = make([]FetchTopic, max(p.ReadArrayLength(flexible), 0))
 	for i := range r.Topics {
-		topic := FetchTopic{}
-		topic.Deserialize(p)
-		r.Topics[i] = topic
+		r.Topics[i].Deserialize(p, version)
 	}
 
-	r.ForgottenTopicsData = make([]ForgottenTopicData, p.ReadInt8()-1)
-	for i := range r.ForgottenTopicsData {
-		r.ForgottenTopicsData[i].TopicId = string(p.ReadUUID())
-		r.ForgottenTopicsData[i].Partitions = make([]int32, p.ReadInt8())
-		for j := range r.ForgottenTopicsData[i].Partitions {
-			r.ForgottenTopicsData[i].Partitions[j] = p.ReadInt32()
+	if version >= 7 {
+		r.ForgottenTopicsData = make([]ForgottenTopicData, max(p.ReadArrayLength(flexible), 0))
+		for i := range r.ForgottenTopicsData {
+			r.ForgottenTopicsData[i].Deserialize(p, version)
+		}
+	}
+	if version >= 11 {
+		r.RackId = p.ReadVersionedString(flexible)
+	}
+
+	if flexible {
+		for tag, value := range p.ReadTaggedFields() {
+			fields := decoder.NewBytesParser(value)
+			switch tag {
+			case fetchTagClusterId:
+				if clusterId, ok := fields.ReadCompactNullableString(); ok {
+					r.ClusterId = &clusterId
+				}
+			case fetchTagReplicaState:
+				if version >= 15 {
+					r.ReplicaState.ReplicaId = fields.ReadInt32()
+					r.ReplicaState.ReplicaEpoch = fields.ReadInt64()
+					fields.ReadTaggedFields()
+					r.ReplicaId = r.ReplicaState.ReplicaId
+				}
+			}
 		}
-		p.ReadInt8() // Tag Buffer
 	}
-	r.RackId = p.ReadCompactString()
-	p.ReadInt8() // Tag Buffer
 	return nil
 }
 
+func (r *FetchPartitionResponse) Serialize(w *encoder.BytesWriter, version int16) {
+	flexible := version >= 12
+	w.WriteInt32(r.PartitionIndex)
+	w.WriteInt16(int16(r.ErrorCode))
+	w.WriteInt64(r.HighWatermark)
+	if version >= 4 {
+		w.WriteInt64(r.LastStableOffset)
+	}
+	if version >= 5 {
+		w.WriteInt64(r.LogStartOffset)
+	}
+	if version >= 4 {
+		if r.AbortedTransactions == nil {
+			w.WriteArrayLength(-1, flexible)
+		} else {
+			w.WriteArrayLength(len(r.AbortedTransactions), flexible)
+		}
+		for _, at := range r.AbortedTransactions {
+			w.WriteInt64(at.ProducerId)
+			w.WriteInt64(at.FirstOffset)
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+	}
+	if version >= 11 {
+		w.WriteInt32(r.PreferredReadReplica)
+	}
+
+	size := 0
+	for i := range r.Records {
+		size += r.Records[i].Size()
+	}
+	if flexible {
+		w.WriteUvarint(uint64(size + 1))
+	} else {
+		w.WriteInt32(int32(size))
+	}
+	for _, records := range r.Records {
+		if records.Region != nil {
+			w.WriteRegion(records.Region)
+		} else {
+			w.Write(records.Data)
+		}
+	}
+
+	if flexible {
+		fields := []encoder.TaggedField{}
+		if r.DivergingEpoch != nil {
+			f := encoder.NewBytesWriter()
+			f.WriteInt32(r.DivergingEpoch.Epoch)
+			f.WriteInt64(r.DivergingEpoch.EndOffset)
+			f.WriteTaggedFields()
+			fields = append(fields, encoder.TaggedField{Tag: fetchPartitionTagDivergingEpoch, Value: f.Bytes()})
+		}
+		if r.CurrentLeader != nil {
+			f := encoder.NewBytesWriter()
+			f.WriteInt32(r.CurrentLeader.LeaderId)
+			f.WriteInt32(r.CurrentLeader.LeaderEpoch)
+			f.WriteTaggedFields()
+			fields = append(fields, encoder.TaggedField{Tag: fetchPartitionTagCurrentLeader, Value: f.Bytes()})
+		}
+		if r.SnapshotId != nil {
+			f := encoder.NewBytesWriter()
+			f.WriteInt64(r.SnapshotId.EndOffset)
+			f.WriteInt32(r.SnapshotId.Epoch)
+			f.WriteTaggedFields()
+			fields = append(fields, encoder.TaggedField{Tag: fetchPartitionTagSnapshotId, Value: f.Bytes()})
+		}
+		w.WriteTaggedFields(fields...)
+	}
+}
+
+// Serialize reads the records into memory. Responses are written with Send,
+// which leaves them in their segment files.
 func (r *FetchResponse) Serialize() ([]byte, error) {
-	b := new(bytes.Buffer)
-	b.Write([]byte{0}) // Tag Buffer
-	binary.Write(b, binary.BigEndian, r.ThrottleTimeMs)
-	binary.Write(b, binary.BigEndian, r.ErrorCode)
-	binary.Write(b, binary.BigEndian, r.SessionId)
-
-	// Responses
-	binary.Write(b, binary.BigEndian, int8(len(r.Responses)+1))
-	for _, response := range r.Responses {
-		binary.Write(b, binary.BigEndian, []byte(response.TopicId))
-		binary.Write(b, binary.BigEndian, int8(len(response.Partitions)+1))
+	send, err := r.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer send.Close()
+	var buf bytes.Buffer
+	if _, err := send.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *FetchResponse) Send() (*encoder.Send, error) {
+	flexible := r.Version >= 12
+	w := encoder.NewBytesWriter()
+	if r.Version >= 1 {
+		w.WriteInt32(r.ThrottleTimeMs)
+	}
+	if r.Version >= 7 {
+		w.WriteInt16(int16(r.ErrorCode))
+		w.WriteInt32(r.SessionId)
+	}
 
-		// Partitions
+	w.WriteArrayLength(len(r.Responses), flexible)
+	for _, response := range r.Responses {
+		if r.Version >= 13 {
+			w.Write([]byte(response.TopicId))
+		} else {
+			w.WriteString(response.TopicName, flexible)
+		}
+		w.WriteArrayLength(len(response.Partitions), flexible)
 		for _, partition := range response.Partitions {
-			binary.Write(b, binary.BigEndian, partition.PartitionIndex)
-			binary.Write(b, binary.BigEndian, partition.ErrorCode)
-			binary.Write(b, binary.BigEndian, partition.HighWatermark)
-			binary.Write(b, binary.BigEndian, partition.LastStableOffset)
-			binary.Write(b, binary.BigEndian, partition.LogStartOffset)
-			binary.Write(b, binary.BigEndian, int8(len(partition.AbortedTransactions)+1))
-
-			for _, at := range partition.AbortedTransactions {
-				binary.Write(b, binary.BigEndian, at.ProducerId)
-				binary.Write(b, binary.BigEndian, at.FirstOffset)
-				b.Write([]byte{0}) // Tag Buffer
+			partition.Serialize(w, r.Version)
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+
+	if flexible {
+		fields := []encoder.TaggedField{}
+		if r.Version >= 16 && len(r.NodeEndpoints) > 0 {
+			f := encoder.NewBytesWriter()
+			f.WriteArrayLength(len(r.NodeEndpoints), true)
+			for _, node := range r.NodeEndpoints {
+				f.WriteInt32(node.NodeId)
+				f.WriteString(node.Host, true)
+				f.WriteInt32(node.Port)
+				f.WriteNullableString(node.Rack, true)
+				f.WriteTaggedFields()
 			}
-			binary.Write(b, binary.BigEndian, partition.PreferredReadReplica)
-			binary.Write(b, binary.BigEndian, int8(len(partition.Records)+1))
-			for _, record := range partition.Records {
-				b.Write(record.RecordBatch)
+			fields = append(fields, encoder.TaggedField{Tag: fetchTagNodeEndpoints, Value: f.Bytes()})
+		}
+		w.WriteTaggedFields(fields...)
+	}
+	return w.Send(), nil
+}
+
+// close releases the segment files of a response that will not be sent.
+func (r *FetchResponse) close() {
+	for _, topic := range r.Responses {
+		for _, partition := range topic.Partitions {
+			for _, records := range partition.Records {
+				if records.Region != nil {
+					records.Region.Close()
+				}
 			}
-			b.Write([]byte{0}) // Tag Buffer
 		}
-		b.Write([]byte{0}) // Tag Buffer
 	}
-	b.Write([]byte{0}) // Tag Buffer
-	return b.Bytes(), nil
 }
 
-var metadataTopics, _ = ParseMetadataLogFile()
+// fetchPurgatory holds fetches waiting for MinBytes, keyed by
+// storage.TopicPartition.
+var fetchPurgatory = purgatory.New()
 
-func HandleFetchRequest(header *request.RequestHeader, p *decoder.BytesParser) (*FetchResponse, error) {
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.Fetch,
+		MinVersion:      0,
+		MaxVersion:      16,
+		FlexibleVersion: 12,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleFetchRequest(ctx, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &FetchResponse{Version: header.ApiVersion, ErrorCode: code}
+		},
+	})
+}
+
+func HandleFetchRequest(ctx *RequestContext, p *decoder.BytesParser) (*FetchResponse, error) {
 	req := &FetchRequest{}
-	req.Deserialize(p)
+	req.Deserialize(p, ctx.Header.ApiVersion)
+
+	session, errorCode := fetchSessions.begin(req)
+	if errorCode != utils.NONE {
+		return &FetchResponse{Version: req.Version, ErrorCode: errorCode, Responses: []FetchResponseTopic{}}, nil
+	}
+
+	resp, result := readFetch(req)
+	if req.MaxWaitMs <= 0 || result.bytes >= int(req.MinBytes) || result.failed || len(result.partitions) == 0 {
+		fetchSessions.complete(session, req, resp)
+		return resp, nil
+	}
+
+	// Not enough data yet: park the fetch until an append to one of its
+	// partitions brings it to MinBytes, or MaxWaitMs passes. The bytes are
+	// estimated from segment positions rather than read on every append.
+	for i := range result.partitions {
+		result.partitions[i].locate()
+	}
+	op := purgatory.NewDelayedOperation(time.Duration(req.MaxWaitMs)*time.Millisecond, func() bool {
+		return fetchSatisfied(result.partitions, req.IsolationLevel, int(req.MinBytes))
+	})
+	keys := make([]any, len(result.partitions))
+	for i, partition := range result.partitions {
+		keys[i] = partition.tp
+	}
+	if !fetchPurgatory.TryCompleteElseWatch(op, keys...) {
+		ctx.Wait(func() {
+			select {
+			case <-op.Done():
+			case <-ctx.Closed:
+				op.Cancel()
+			}
+		})
+		if op.Cancelled() {
+			fetchSessions.abort(session)
+			return resp, nil
+		}
+	}
+
+	resp.close()
+	resp, _ = readFetch(req)
+	fetchSessions.complete(session, req, resp)
+	return resp, nil
+}
+
+type fetchResult struct {
+	bytes      int
+	failed     bool
+	partitions []fetchStatus
+}
 
-	isTopicValid := map[string]string{}
+// fetchStatus is a partition a parked fetch waits on, with where its fetch
+// starts, located once when the fetch is parked.
+type fetchStatus struct {
+	tp          storage.TopicPartition
+	fetchOffset storage.LogOffsetMetadata
+	located     bool
+	maxBytes    int
+}
+
+func (s *fetchStatus) locate() {
+	log, errorCode := lookupPartitionLog(s.tp.Topic, s.tp.Partition)
+	if errorCode != utils.NONE {
+		return
+	}
+	metadata, err := log.OffsetMetadata(s.fetchOffset.Offset)
+	if err != nil {
+		return
+	}
+	s.fetchOffset, s.located = metadata, true
+}
+
+// fetchSatisfied tells whether a parked fetch can be answered, as Kafka's
+// DelayedFetch does: once the bytes between each fetch offset and the end of
+// what it may read add up to minBytes, or a partition changed in a way
+// positions cannot measure, that is it failed, rolled a segment, was
+// truncated or its fetch offset could not be located.
+func fetchSatisfied(partitions []fetchStatus, isolationLevel int8, minBytes int) bool {
+	accumulated := 0
+	for _, partition := range partitions {
+		log, errorCode := lookupPartitionLog(partition.tp.Topic, partition.tp.Partition)
+		if errorCode != utils.NONE {
+			return true
+		}
+		endOffset := log.HighWatermark()
+		if isolationLevel == ReadCommitted {
+			endOffset = log.LastStableOffset()
+		}
+		if endOffset == partition.fetchOffset.Offset {
+			continue
+		}
+		if !partition.located || endOffset < partition.fetchOffset.Offset {
+			return true
+		}
+		end, err := log.OffsetMetadata(endOffset)
+		if err != nil || end.SegmentBaseOffset != partition.fetchOffset.SegmentBaseOffset {
+			return true
+		}
+		accumulated += min(int(end.Position-partition.fetchOffset.Position), partition.maxBytes)
+	}
+	return accumulated >= minBytes
+}
 
+// readFetch builds the response to req from the data currently in the logs.
+func readFetch(req *FetchRequest) (*FetchResponse, fetchResult) {
 	resp := &FetchResponse{
+		Version:        req.Version,
 		ThrottleTimeMs: 0,
 		ErrorCode:      utils.NONE,
 		SessionId:      req.SessionId,
 		Responses:      make([]FetchResponseTopic, len(req.Topics)),
 	}
+	result := fetchResult{}
 
+	// MaxBytes is shared by every partition in the response, on top of each
+	// partition's own PartitionMaxBytes.
+	remainingBytes := int(req.MaxBytes)
 	for i, topic := range req.Topics {
-		for topicName, metadataTopic := range metadataTopics {
-			if topic.TopicId == metadataTopic.TopicId {
-				isTopicValid[topic.TopicId] = topicName
-			}
-		}
+		topicName, unknownTopicError := resolveFetchTopic(&topic, req.Version)
 
 		resp.Responses[i].TopicId = topic.TopicId
+		resp.Responses[i].TopicName = topic.TopicName
 		resp.Responses[i].Partitions = make([]FetchPartitionResponse, len(topic.Partitions))
 
-		errorCode := utils.NONE
-		records := []Record{}
 		for j, partition := range topic.Partitions {
-			if isTopicValid[topic.TopicId] == "" {
-				errorCode = utils.UNKNOWN_TOPIC_ID
+			partitionResp := FetchPartitionResponse{
+				PartitionIndex:       partition.PartitionId,
+				ErrorCode:            utils.NONE,
+				HighWatermark:        -1,
+				LastStableOffset:     -1,
+				LogStartOffset:       -1,
+				AbortedTransactions:  []AbortedTransaction{},
+				PreferredReadReplica: -1,
+				Records:              []Records{},
+			}
+			if topicName == "" {
+				partitionResp.ErrorCode = unknownTopicError
 			} else {
-				records_batch, err := ReadLogFile(isTopicValid[topic.TopicId], partition.PartitionId)
-				if err != nil {
-					return nil, err
+				// Only the first partition returning data may exceed the limits
+				// with a single oversized batch.
+				minOneBatch := remainingBytes == int(req.MaxBytes)
+				fetchPartition(topicName, partition, req.Version, req.IsolationLevel, min(int(partition.PartitionMaxBytes), remainingBytes), minOneBatch, &partitionResp)
+				for i := range partitionResp.Records {
+					remainingBytes -= partitionResp.Records[i].Size()
+					result.bytes += partitionResp.Records[i].Size()
 				}
-				records = records_batch
+				remainingBytes = max(remainingBytes, 0)
+				result.partitions = append(result.partitions, fetchStatus{
+					tp:          storage.TopicPartition{Topic: topicName, Partition: partition.PartitionId},
+					fetchOffset: storage.LogOffsetMetadata{Offset: partition.FetchOffset},
+					maxBytes:    int(partition.PartitionMaxBytes),
+				})
 			}
-			resp.Responses[i].Partitions[j] = FetchPartitionResponse{
-				PartitionIndex:       partition.PartitionId,
-				ErrorCode:            errorCode,
-				HighWatermark:        0,
-				LastStableOffset:     0,
-				LogStartOffset:       0,
-				AbortedTransactions:  []AbortedTransaction{},
-				PreferredReadReplica: 0,
-				Records:              records,
+			if partitionResp.ErrorCode != utils.NONE {
+				result.failed = true
 			}
+			resp.Responses[i].Partitions[j] = partitionResp
 		}
 	}
-	return resp, nil
+	return resp, result
 }
 
-func ReadLogFile(topicName string, partitionId int32) ([]Record, error) {
-	filePath := fmt.Sprintf("/tmp/kraft-combined-logs/%s-%d/00000000000000000000.log", topicName, partitionId)
-	buffer, err := utils.ReadFile(filePath)
+// fetchPartition fills resp with the batches starting at the one holding
+// FetchOffset, up to maxBytes. They are left in their segment files until the
+// response is written. read_committed fetches stop at the last stable offset
+// and get the aborted transactions among the batches.
+func fetchPartition(topicName string, partition FetchPartition, version int16, isolationLevel int8, maxBytes int, minOneBatch bool, resp *FetchPartitionResponse) {
+	log, errorCode := lookupPartitionLog(topicName, partition.PartitionId)
+	if errorCode != utils.NONE {
+		resp.ErrorCode = errorCode
+		return
+	}
+
+	logStartOffset, highWatermark, lastStableOffset := log.LogStartOffset(), log.HighWatermark(), log.LastStableOffset()
+	resp.HighWatermark = highWatermark
+	resp.LastStableOffset = lastStableOffset
+	resp.LogStartOffset = logStartOffset
+	if partition.FetchOffset < logStartOffset || partition.FetchOffset > highWatermark {
+		resp.ErrorCode = utils.OFFSET_OUT_OF_RANGE
+		return
+	}
+
+	// Fetchers learnt RecordBatch v2 in v4, and v1 messages in v2. They get
+	// the older of their format and the log's message.format.version, only
+	// the former needing message.downconversion.enable.
+	var fetcherMagic int8 = record.Magic
+	if version < 2 {
+		fetcherMagic = record.MagicV0
+	} else if version < 4 {
+		fetcherMagic = record.MagicV1
+	}
+	if config := log.Config(); fetcherMagic < record.Magic || config.MessageFormat < record.Magic {
+		if fetcherMagic < config.MessageFormat && !config.MessageDownConversion {
+			resp.ErrorCode = utils.UNSUPPORTED_VERSION
+			return
+		}
+		fetchConverted(topicName, log, partition, min(fetcherMagic, config.MessageFormat), maxBytes, minOneBatch, resp)
+		return
+	}
+
+	upperOffset := highWatermark
+	if isolationLevel == ReadCommitted {
+		upperOffset = lastStableOffset
+	}
+	unsupported := false
+	records, err := log.ReadRecords(partition.FetchOffset, maxBytes, minOneBatch, func(header storage.Batch) bool {
+		if header.BaseOffset >= upperOffset {
+			return false
+		}
+		// Fetchers learnt zstd in v10.
+		if batch := record.DecodeHeader(header.Data); version < 10 && batch.Compression() == compression.Zstd {
+			unsupported = true
+			return false
+		}
+		return true
+	})
 	if err != nil {
-		return nil, err
+		fmt.Printf("Error reading %s-%d: %s\n", topicName, partition.PartitionId, err.Error())
+		resp.ErrorCode = utils.KAFKA_STORAGE_ERROR
+		return
+	}
+	for _, r := range records {
+		resp.Records = append(resp.Records, Records{Region: r})
+	}
+	if unsupported && len(records) == 0 {
+		resp.ErrorCode = utils.UNSUPPORTED_COMPRESSION_TYPE
+	}
+	if isolationLevel != ReadCommitted || len(records) == 0 {
+		return
+	}
+	aborted, err := log.AbortedTransactions(partition.FetchOffset, upperOffset)
+	if err != nil {
+		fmt.Printf("Error reading aborted transactions of %s-%d: %s\n", topicName, partition.PartitionId, err.Error())
+		resp.ErrorCode = utils.KAFKA_STORAGE_ERROR
+		for _, r := range records {
+			r.Close()
+		}
+		resp.Records = []Records{}
+		return
 	}
+	for _, txn := range aborted {
+		resp.AbortedTransactions = append(resp.AbortedTransactions, AbortedTransaction{ProducerId: txn.ProducerId, FirstOffset: txn.FirstOffset})
+	}
+}
 
-	message_content := buffer.Bytes()
-	records := make([]Record, 0)
+// fetchConverted fills resp with the batches converted to the legacy message
+// format magic. The converted message sets are held in memory, so they are
+// bounded by maxBytes too, their legacy form being possibly larger than the
+// batches.
+func fetchConverted(topicName string, log storage.PartitionLog, partition FetchPartition, magic int8, maxBytes int, minOneBatch bool, resp *FetchPartitionResponse) {
+	batches, err := log.Read(partition.FetchOffset, maxBytes, minOneBatch)
+	if err != nil {
+		fmt.Printf("Error reading %s-%d: %s\n", topicName, partition.PartitionId, err.Error())
+		resp.ErrorCode = utils.KAFKA_STORAGE_ERROR
+		return
+	}
+	convertedBytes := 0
+	for _, batch := range batches {
+		if batch.BaseOffset >= resp.HighWatermark {
+			break
+		}
+		if header := record.DecodeHeader(batch.Data); header.Compression() == compression.Zstd {
+			if len(resp.Records) == 0 {
+				resp.ErrorCode = utils.UNSUPPORTED_COMPRESSION_TYPE
+			}
+			break
+		}
+		decoded, err := record.Decode(batch.Data)
+		if err != nil {
+			fmt.Printf("Error reading %s-%d at offset %d: %s\n", topicName, partition.PartitionId, batch.BaseOffset, err.Error())
+			if len(resp.Records) == 0 {
+				resp.ErrorCode = utils.CORRUPT_MESSAGE
+			}
+			break
+		}
+		messageSet, count := decoded.DownConvert(magic, partition.FetchOffset)
+		if count == 0 {
+			continue
+		}
+		if convertedBytes+len(messageSet) > maxBytes && (convertedBytes > 0 || !minOneBatch) {
+			break
+		}
+		convertedBytes += len(messageSet)
+		metrics.AddBrokerTopic("FetchMessageConversionsPerSec", topicName, int64(count))
+		resp.Records = append(resp.Records, Records{Data: messageSet})
+	}
+}
 
-	offset := 0
-	for offset <= len(message_content)-1 {
-		batch_length := int32(binary.BigEndian.Uint32(message_content[offset+8 : offset+12]))
-		batch := message_content[offset : offset+int(batch_length)+12]
-		offset += int(batch_length) + 12
-		records = append(records, Record{
-			BatchLength: batch_length,
-			RecordBatch: batch,
-		})
+func hasPartition(topic Topic, partitionId int32) bool {
+	for _, partition := range topic.Partitions {
+		if partition.PartitionIndex == partitionId {
+			return true
+		}
 	}
+	return false
+}
 
-	return records, nil
+// resolveFetchTopic returns the topic name a fetch refers to, looking it up
+// by id from v13 on. An empty name comes with the error code to report.
+func resolveFetchTopic(topic *FetchTopic, version int16) (string, utils.ErrorCode) {
+	topics := currentMetadata().Topics
+	if version < 13 {
+		if _, ok := topics[topic.TopicName]; ok {
+			return topic.TopicName, utils.NONE
+		}
+		return "", utils.UNKNOWN_TOPIC_OR_PARTITION
+	}
+	for topicName, metadataTopic := range topics {
+		if topic.TopicId == metadataTopic.TopicId {
+			return topicName, utils.NONE
+		}
+	}
+	return "", utils.UNKNOWN_TOPIC_ID
 }
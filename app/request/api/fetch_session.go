@@ -0,0 +1,313 @@
+package api
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// Special fetch session epochs from KIP-227.
+const (
+	InitialFetchSessionEpoch int32 = 0
+	FinalFetchSessionEpoch   int32 = -1
+)
+
+// nextFetchSessionEpoch follows epoch, wrapping past MaxInt32 to 1 as 0 and
+// -1 are taken.
+func nextFetchSessionEpoch(epoch int32) int32 {
+	if epoch == math.MaxInt32 {
+		return 1
+	}
+	return epoch + 1
+}
+
+type fetchSessionKey struct {
+	Topic     string // TopicId from v13, TopicName before
+	Partition int32
+}
+
+// fetchSessionPartition is what a session remembers about one partition:
+// the fetch parameters last sent by the client and the offsets last returned.
+type fetchSessionPartition struct {
+	topicName        string
+	topicId          string
+	fetch            FetchPartition
+	highWatermark    int64
+	lastStableOffset int64
+	logStartOffset   int64
+}
+
+type FetchSession struct {
+	Id         int32
+	epoch      int32
+	partitions []*fetchSessionPartition
+	index      map[fetchSessionKey]*fetchSessionPartition
+	lastUsed   time.Time
+}
+
+func newFetchSession(id int32) *FetchSession {
+	return &FetchSession{Id: id, epoch: 1, index: map[fetchSessionKey]*fetchSessionPartition{}, lastUsed: time.Now()}
+}
+
+func (s *FetchSession) key(topicName, topicId string, partition int32, version int16) fetchSessionKey {
+	if version >= 13 {
+		return fetchSessionKey{Topic: topicId, Partition: partition}
+	}
+	return fetchSessionKey{Topic: topicName, Partition: partition}
+}
+
+// update adds or refreshes the partitions of req and drops the forgotten
+// ones.
+func (s *FetchSession) update(req *FetchRequest) {
+	for _, topic := range req.Topics {
+		for _, partition := range topic.Partitions {
+			key := s.key(topic.TopicName, topic.TopicId, partition.PartitionId, req.Version)
+			if cached, ok := s.index[key]; ok {
+				cached.fetch = partition
+				continue
+			}
+			cached := &fetchSessionPartition{
+				topicName:        topic.TopicName,
+				topicId:          topic.TopicId,
+				fetch:            partition,
+				highWatermark:    -1,
+				lastStableOffset: -1,
+				logStartOffset:   -1,
+			}
+			s.index[key] = cached
+			s.partitions = append(s.partitions, cached)
+		}
+	}
+	for _, forgotten := range req.ForgottenTopicsData {
+		for _, partition := range forgotten.Partitions {
+			delete(s.index, s.key(forgotten.TopicName, forgotten.TopicId, partition, req.Version))
+		}
+	}
+	kept := s.partitions[:0]
+	for _, cached := range s.partitions {
+		if s.index[s.key(cached.topicName, cached.topicId, cached.fetch.PartitionId, req.Version)] == cached {
+			kept = append(kept, cached)
+		}
+	}
+	s.partitions = kept
+}
+
+// topics returns every partition of the session in fetch request form.
+func (s *FetchSession) topics() []FetchTopic {
+	topics := []FetchTopic{}
+	for _, cached := range s.partitions {
+		n := len(topics)
+		if n == 0 || topics[n-1].TopicName != cached.topicName || topics[n-1].TopicId != cached.topicId {
+			topics = append(topics, FetchTopic{TopicName: cached.topicName, TopicId: cached.topicId})
+			n++
+		}
+		topics[n-1].Partitions = append(topics[n-1].Partitions, cached.fetch)
+	}
+	return topics
+}
+
+// FetchSessionCache holds the incremental fetch sessions of all clients. It
+// is bounded by maxSlots partitions' worth of sessions; when full, sessions
+// idle for longer than evictionMs make room first, then sessions smaller than
+// the one being created.
+type FetchSessionCache struct {
+	mu         sync.Mutex
+	sessions   map[int32]*FetchSession
+	maxSlots   int
+	evictionMs int64
+}
+
+func NewFetchSessionCache(maxSlots int, evictionMs int64) *FetchSessionCache {
+	return &FetchSessionCache{sessions: map[int32]*FetchSession{}, maxSlots: maxSlots, evictionMs: evictionMs}
+}
+
+var fetchSessions = NewFetchSessionCache(1000, 120000)
+
+// ConfigureFetchSessions sizes the fetch session cache from the broker
+// config.
+func ConfigureFetchSessions(cfg *config.Config) {
+	fetchSessions = NewFetchSessionCache(
+		cfg.Int("max.incremental.fetch.session.cache.slots", 1000),
+		cfg.Int64("min.incremental.fetch.session.eviction.ms", 120000),
+	)
+}
+
+// fetchContext is the session state a single Fetch request runs against.
+type fetchContext struct {
+	session     *FetchSession
+	incremental bool
+	// epoch is the one begin moved the session to.
+	epoch int32
+}
+
+// begin resolves the session a request refers to and rewrites req.Topics to
+// the full set of partitions to read. The error code is returned as the
+// top-level response error.
+func (c *FetchSessionCache) begin(req *FetchRequest) (*fetchContext, utils.ErrorCode) {
+	if req.Version < 7 {
+		return &fetchContext{}, utils.NONE
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case req.SessionEpoch == FinalFetchSessionEpoch:
+		// A full fetch without a session; also closes the session if any.
+		delete(c.sessions, req.SessionId)
+		return &fetchContext{}, utils.NONE
+
+	case req.SessionEpoch == InitialFetchSessionEpoch:
+		delete(c.sessions, req.SessionId)
+		session := newFetchSession(c.newSessionId())
+		session.update(req)
+		if !c.tryInsert(session) {
+			return &fetchContext{}, utils.NONE
+		}
+		return &fetchContext{session: session}, utils.NONE
+
+	default:
+		session, ok := c.sessions[req.SessionId]
+		if !ok {
+			return nil, utils.FETCH_SESSION_ID_NOT_FOUND
+		}
+		if session.epoch != req.SessionEpoch {
+			return nil, utils.INVALID_FETCH_SESSION_EPOCH
+		}
+		session.epoch = nextFetchSessionEpoch(session.epoch)
+		session.lastUsed = time.Now()
+		session.update(req)
+		req.Topics = session.topics()
+		return &fetchContext{session: session, incremental: true, epoch: session.epoch}, utils.NONE
+	}
+}
+
+func (c *FetchSessionCache) newSessionId() int32 {
+	for {
+		id := rand.Int31()
+		if _, ok := c.sessions[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+func (c *FetchSessionCache) size() int {
+	n := 0
+	for _, session := range c.sessions {
+		n += len(session.partitions)
+	}
+	return n
+}
+
+// tryInsert adds session to the cache, evicting others if it is full. It
+// returns false if no room could be made.
+func (c *FetchSessionCache) tryInsert(session *FetchSession) bool {
+	needed := max(len(session.partitions), 1)
+	if needed > c.maxSlots {
+		return false
+	}
+
+	now := time.Now()
+	candidates := make([]*FetchSession, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		candidates = append(candidates, s)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed.Before(candidates[j].lastUsed) })
+
+	size := c.size()
+	for _, s := range candidates {
+		if size+needed <= c.maxSlots {
+			break
+		}
+		if now.Sub(s.lastUsed).Milliseconds() > c.evictionMs {
+			delete(c.sessions, s.Id)
+			size -= len(s.partitions)
+		}
+	}
+	for _, s := range candidates {
+		if size+needed <= c.maxSlots {
+			break
+		}
+		if _, ok := c.sessions[s.Id]; ok && len(s.partitions) < len(session.partitions) {
+			delete(c.sessions, s.Id)
+			size -= len(s.partitions)
+		}
+	}
+	if size+needed > c.maxSlots {
+		return false
+	}
+	c.sessions[session.Id] = session
+	return true
+}
+
+// abort undoes begin for a fetch whose response is never sent, e.g. because
+// its client disconnected while it waited: the client retries with the same
+// epoch, and must be told again what the response would have. A session
+// created by the fetch is dropped, the client never having learnt its id.
+func (c *FetchSessionCache) abort(ctx *fetchContext) {
+	if ctx.session == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !ctx.incremental {
+		if c.sessions[ctx.session.Id] == ctx.session {
+			delete(c.sessions, ctx.session.Id)
+		}
+		return
+	}
+	if ctx.session.epoch == ctx.epoch {
+		if ctx.epoch == 1 {
+			ctx.session.epoch = math.MaxInt32
+		} else {
+			ctx.session.epoch--
+		}
+	}
+}
+
+// complete records what resp tells the client and, for incremental fetches,
+// drops the partitions that have nothing new to report.
+func (c *FetchSessionCache) complete(ctx *fetchContext, req *FetchRequest, resp *FetchResponse) {
+	if ctx.session == nil {
+		resp.SessionId = 0
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp.SessionId = ctx.session.Id
+	topics := resp.Responses[:0]
+	for _, topic := range resp.Responses {
+		partitions := topic.Partitions[:0]
+		for _, partition := range topic.Partitions {
+			cached := ctx.session.index[ctx.session.key(topic.TopicName, topic.TopicId, partition.PartitionIndex, req.Version)]
+			changed := cached == nil ||
+				len(partition.Records) > 0 ||
+				partition.ErrorCode != utils.NONE ||
+				partition.HighWatermark != cached.highWatermark ||
+				partition.LastStableOffset != cached.lastStableOffset ||
+				partition.LogStartOffset != cached.logStartOffset
+			if cached != nil {
+				cached.highWatermark = partition.HighWatermark
+				cached.lastStableOffset = partition.LastStableOffset
+				cached.logStartOffset = partition.LogStartOffset
+			}
+			if changed || !ctx.incremental {
+				partitions = append(partitions, partition)
+			}
+		}
+		if len(partitions) > 0 || !ctx.incremental {
+			topic.Partitions = partitions
+			topics = append(topics, topic)
+		}
+	}
+	resp.Responses = topics
+}
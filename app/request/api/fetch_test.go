@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// fetchRequest encodes a sessionless Fetch v11 request for partition 0 of
+// topic from offset on, waiting up to maxWaitMs for a byte.
+func fetchRequest(topic string, offset int64, maxWaitMs int32) func(w *encoder.BytesWriter) {
+	return func(w *encoder.BytesWriter) {
+		w.WriteInt32(-1) // Replica Id
+		w.WriteInt32(maxWaitMs)
+		w.WriteInt32(1) // Min Bytes
+		w.WriteInt32(1 << 20)
+		w.WriteInt8(ReadUncommitted)
+		w.WriteInt32(0)  // Session Id
+		w.WriteInt32(-1) // Session Epoch
+		w.WriteArrayLength(1, false)
+		w.WriteString(topic, false)
+		w.WriteArrayLength(1, false)
+		w.WriteInt32(0)
+		w.WriteInt32(-1) // Current Leader Epoch
+		w.WriteInt64(offset)
+		w.WriteInt64(-1) // Log Start Offset
+		w.WriteInt32(1 << 20)
+		w.WriteArrayLength(0, false) // Forgotten Topics
+		w.WriteString("", false)     // Rack Id
+	}
+}
+
+func fetch(t *testing.T, topic string, offset int64) FetchPartitionResponse {
+	t.Helper()
+	resp, err := HandleFetchRequest(testContext(utils.Fetch, 11), testParser(fetchRequest(topic, offset, 0)))
+	if err != nil {
+		t.Fatalf("HandleFetchRequest: %v", err)
+	}
+	t.Cleanup(resp.close)
+	return resp.Responses[0].Partitions[0]
+}
+
+// fetchedRecords decodes the batches of a fetch response.
+func fetchedRecords(t *testing.T, resp FetchPartitionResponse) []*record.RecordBatch {
+	t.Helper()
+	var data bytes.Buffer
+	for _, records := range resp.Records {
+		if _, err := records.Region.WriteTo(&data); err != nil {
+			t.Fatalf("writing fetched records: %v", err)
+		}
+	}
+	batches := []*record.RecordBatch{}
+	for b := data.Bytes(); len(b) > 0; b = b[record.Size(b):] {
+		batch, err := record.Decode(b[:record.Size(b)])
+		if err != nil {
+			t.Fatalf("decoding fetched batch: %v", err)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func TestProduceFetchRoundTrip(t *testing.T) {
+	setupStorage(t, "orders")
+	produce(t, "orders", testBatch([]byte("a"), []byte("b")))
+	produce(t, "orders", testBatch([]byte("c")))
+
+	resp := fetch(t, "orders", 0)
+	if resp.ErrorCode != utils.NONE {
+		t.Fatalf("fetch got error %d", resp.ErrorCode)
+	}
+	if resp.HighWatermark != 3 || resp.LastStableOffset != 3 || resp.LogStartOffset != 0 {
+		t.Errorf("got high watermark %d, last stable offset %d, log start offset %d, want 3, 3, 0", resp.HighWatermark, resp.LastStableOffset, resp.LogStartOffset)
+	}
+	values := []string{}
+	for _, batch := range fetchedRecords(t, resp) {
+		for i := range batch.Records {
+			if offset := batch.Offset(&batch.Records[i]); offset != int64(len(values)) {
+				t.Errorf("record %q at offset %d, want %d", batch.Records[i].Value, offset, len(values))
+			}
+			values = append(values, string(batch.Records[i].Value))
+		}
+	}
+	if len(values) != 3 || values[0] != "a" || values[1] != "b" || values[2] != "c" {
+		t.Errorf("fetched values %q, want [a b c]", values)
+	}
+
+	// A fetch from the middle of the log starts at the batch holding the
+	// offset.
+	if batches := fetchedRecords(t, fetch(t, "orders", 2)); len(batches) != 1 || batches[0].BaseOffset != 2 {
+		t.Errorf("fetch from offset 2 returned %d batches, want the batch at offset 2", len(batches))
+	}
+	if resp := fetch(t, "orders", 3); resp.ErrorCode != utils.NONE || len(resp.Records) != 0 {
+		t.Errorf("fetch at the high watermark got error %d and %d records, want none", resp.ErrorCode, len(resp.Records))
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	setupStorage(t, "orders")
+	produce(t, "orders", testBatch([]byte("a")))
+
+	if resp := fetch(t, "orders", 5); resp.ErrorCode != utils.OFFSET_OUT_OF_RANGE {
+		t.Errorf("fetch past the high watermark got error %d, want OFFSET_OUT_OF_RANGE", resp.ErrorCode)
+	}
+	if resp := fetch(t, "unknown", 0); resp.ErrorCode != utils.UNKNOWN_TOPIC_OR_PARTITION {
+		t.Errorf("fetch of an unknown topic got error %d, want UNKNOWN_TOPIC_OR_PARTITION", resp.ErrorCode)
+	}
+}
+
+func TestFetchWaitsForAppend(t *testing.T) {
+	setupStorage(t, "orders")
+
+	done := make(chan *FetchResponse)
+	go func() {
+		resp, _ := HandleFetchRequest(testContext(utils.Fetch, 11), testParser(fetchRequest("orders", 0, 10000)))
+		done <- resp
+	}()
+	for fetchPurgatory.Watched(storage.TopicPartition{Topic: "orders", Partition: 0}) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	produce(t, "orders", testBatch([]byte("a")))
+
+	select {
+	case resp := <-done:
+		defer resp.close()
+		if batches := fetchedRecords(t, resp.Responses[0].Partitions[0]); len(batches) != 1 {
+			t.Errorf("waiting fetch returned %d batches, want the one appended", len(batches))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting fetch not completed by the append")
+	}
+}
+
+func TestFetchSatisfiedEstimatesFromPositions(t *testing.T) {
+	setupStorage(t, "orders")
+	tp := storage.TopicPartition{Topic: "orders", Partition: 0}
+	status := []fetchStatus{{tp: tp, fetchOffset: storage.LogOffsetMetadata{Offset: 0}, maxBytes: 1 << 20}}
+	status[0].locate()
+	if !status[0].located || fetchSatisfied(status, ReadUncommitted, 1) {
+		t.Fatalf("a fetch from the end of an empty log was located %t and satisfied", status[0].located)
+	}
+
+	batch := testBatch([]byte("a"))
+	produce(t, "orders", batch)
+	if !fetchSatisfied(status, ReadUncommitted, len(batch)) || fetchSatisfied(status, ReadUncommitted, len(batch)+1) {
+		t.Errorf("want a fetch satisfied by the %d bytes appended and no more", len(batch))
+	}
+	status[0].maxBytes = 10
+	if fetchSatisfied(status, ReadUncommitted, 11) {
+		t.Errorf("the estimate exceeded the partition's max bytes")
+	}
+
+	unknown := []fetchStatus{{tp: storage.TopicPartition{Topic: "unknown", Partition: 0}, maxBytes: 1 << 20}}
+	if !fetchSatisfied(unknown, ReadUncommitted, 1<<20) {
+		t.Errorf("a fetch of a partition gone unknown was not answered")
+	}
+}
+
+func TestFetchSessionAbortRollsBackEpoch(t *testing.T) {
+	c := NewFetchSessionCache(10, 60000)
+	topics := []FetchTopic{{TopicName: "orders", Partitions: []FetchPartition{{PartitionId: 0}}}}
+	initial, _ := c.begin(&FetchRequest{Version: 11, SessionEpoch: InitialFetchSessionEpoch, Topics: topics})
+	id := initial.session.Id
+
+	incremental := func() utils.ErrorCode {
+		ctx, errorCode := c.begin(&FetchRequest{Version: 11, SessionId: id, SessionEpoch: 1})
+		if errorCode == utils.NONE {
+			c.abort(ctx)
+		}
+		return errorCode
+	}
+	for range 2 {
+		if errorCode := incremental(); errorCode != utils.NONE {
+			t.Fatalf("retrying epoch 1 after an aborted fetch got error %d", errorCode)
+		}
+	}
+
+	c.abort(initial)
+	if errorCode := incremental(); errorCode != utils.FETCH_SESSION_ID_NOT_FOUND {
+		t.Errorf("a session whose creating fetch was aborted got error %d, want FETCH_SESSION_ID_NOT_FOUND", errorCode)
+	}
+}
+
+func TestFetchSessionEpochWraps(t *testing.T) {
+	c := NewFetchSessionCache(10, 60000)
+	topics := []FetchTopic{{TopicName: "orders", Partitions: []FetchPartition{{PartitionId: 0}}}}
+	initial, _ := c.begin(&FetchRequest{Version: 11, SessionEpoch: InitialFetchSessionEpoch, Topics: topics})
+	initial.session.epoch = math.MaxInt32
+
+	ctx, errorCode := c.begin(&FetchRequest{Version: 11, SessionId: initial.session.Id, SessionEpoch: math.MaxInt32})
+	if errorCode != utils.NONE || ctx.epoch != 1 {
+		t.Fatalf("got error %d and epoch %d after MaxInt32, want epoch 1", errorCode, ctx.epoch)
+	}
+	c.abort(ctx)
+	if initial.session.epoch != math.MaxInt32 {
+		t.Errorf("aborting the fetch rolled the epoch back to %d, want MaxInt32", initial.session.epoch)
+	}
+}
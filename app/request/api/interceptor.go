@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+const AnonymousPrincipal = "User:ANONYMOUS"
+
+// RequestContext carries everything an interceptor may inspect about a
+// request. Response and Err are filled in once the inner chain has run.
+type RequestContext struct {
+	Header     *request.RequestHeader
+	Principal  string
+	ClientAddr net.Addr
+	LocalAddr  net.Addr
+	ReceivedAt time.Time
+	// Closed is closed once the client connection has gone away.
+	Closed <-chan struct{}
+	// Blocking, when set, runs a long wait without tying up a handler
+	// worker.
+	Blocking func(wait func())
+	// NoResponse is set by handlers of requests the client expects no
+	// response to, such as a Produce with acks=0.
+	NoResponse bool
+	Response   *encoder.Send
+	Err        error
+}
+
+func (ctx *RequestContext) Elapsed() time.Duration {
+	return time.Since(ctx.ReceivedAt)
+}
+
+// Wait runs wait through Blocking if the server provided it.
+func (ctx *RequestContext) Wait(wait func()) {
+	if ctx.Blocking != nil {
+		ctx.Blocking(wait)
+	} else {
+		wait()
+	}
+}
+
+// RequestHandler produces the response body for a request.
+type RequestHandler func(ctx *RequestContext, p *decoder.BytesParser) (*encoder.Send, error)
+
+// Interceptor wraps request handling. It may inspect or replace the response
+// returned by next, or skip next entirely to short-circuit the request.
+type Interceptor func(ctx *RequestContext, p *decoder.BytesParser, next RequestHandler) (*encoder.Send, error)
+
+// Chain builds a RequestHandler that runs interceptors in order around
+// Dispatch. The first interceptor is the outermost one.
+func Chain(interceptors ...Interceptor) RequestHandler {
+	handler := RequestHandler(func(ctx *RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+		return Dispatch(ctx, p)
+	})
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx *RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+			resp, err := interceptor(ctx, p, next)
+			ctx.Response, ctx.Err = resp, err
+			return resp, err
+		}
+	}
+	return handler
+}
+
+// Reject builds the error response an interceptor returns to short-circuit a
+// request, whose body p it has not read.
+func Reject(ctx *RequestContext, p *decoder.BytesParser, code utils.ErrorCode, err error) (*encoder.Send, error) {
+	h, ok := Lookup(ctx.Header.ApiKey)
+	if !ok {
+		return nil, err
+	}
+	body, _ := serialize(h.ErrorResponse(ctx.Header, p, code))
+	return body, err
+}
+
+func LogErrors(ctx *RequestContext, p *decoder.BytesParser, next RequestHandler) (*encoder.Send, error) {
+	resp, err := next(ctx, p)
+	if err != nil {
+		fmt.Printf("Error handling request (api key %d, version %d) from %s: %s\n", ctx.Header.ApiKey, ctx.Header.ApiVersion, ctx.ClientAddr, err.Error())
+	}
+	return resp, err
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// Special ListOffsets timestamps.
+const (
+	LatestTimestamp        int64 = -1
+	EarliestTimestamp      int64 = -2
+	MaxTimestamp           int64 = -3
+	EarliestLocalTimestamp int64 = -4
+	LatestTieredTimestamp  int64 = -5
+)
+
+type ListOffsetsRequest struct {
+	ReplicaId      int32
+	IsolationLevel int8
+	Topics         []ListOffsetsTopic
+}
+
+type ListOffsetsTopic struct {
+	Name       string
+	Partitions []ListOffsetsPartition
+}
+
+type ListOffsetsPartition struct {
+	PartitionIndex     int32
+	CurrentLeaderEpoch int32
+	Timestamp          int64
+	MaxNumOffsets      int32 // v0
+}
+
+type ListOffsetsResponse struct {
+	Version        int16
+	ThrottleTimeMs int32
+	Topics         []ListOffsetsTopicResponse
+}
+
+type ListOffsetsTopicResponse struct {
+	Name       string
+	Partitions []ListOffsetsPartitionResponse
+}
+
+type ListOffsetsPartitionResponse struct {
+	PartitionIndex  int32
+	ErrorCode       utils.ErrorCode
+	OldStyleOffsets []int64 // v0
+	Timestamp       int64
+	Offset          int64
+	LeaderEpoch     int32
+}
+
+func (r *ListOffsetsRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 6
+	r.ReplicaId = p.ReadInt32()
+	if version >= 2 {
+		r.IsolationLevel = p.ReadInt8()
+	}
+	r.Topics = make([]ListOffsetsTopic, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Topics {
+		topic := &r.Topics[i]
+		topic.Name = p.ReadVersionedString(flexible)
+		topic.Partitions = make([]ListOffsetsPartition, max(p.ReadArrayLength(flexible), 0))
+		for j := range topic.Partitions {
+			partition := &topic.Partitions[j]
+			partition.PartitionIndex = p.ReadInt32()
+			partition.CurrentLeaderEpoch = -1
+			if version >= 4 {
+				partition.CurrentLeaderEpoch = p.ReadInt32()
+			}
+			partition.Timestamp = p.ReadInt64()
+			if version == 0 {
+				partition.MaxNumOffsets = p.ReadInt32()
+			}
+			if flexible {
+				p.ReadTaggedFields()
+			}
+		}
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *ListOffsetsResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 6
+	w := encoder.NewBytesWriter()
+	if r.Version >= 2 {
+		w.WriteInt32(r.ThrottleTimeMs)
+	}
+	w.WriteArrayLength(len(r.Topics), flexible)
+	for _, topic := range r.Topics {
+		w.WriteString(topic.Name, flexible)
+		w.WriteArrayLength(len(topic.Partitions), flexible)
+		for _, partition := range topic.Partitions {
+			w.WriteInt32(partition.PartitionIndex)
+			w.WriteInt16(int16(partition.ErrorCode))
+			if r.Version == 0 {
+				w.WriteArrayLength(len(partition.OldStyleOffsets), false)
+				for _, offset := range partition.OldStyleOffsets {
+					w.WriteInt64(offset)
+				}
+			} else {
+				w.WriteInt64(partition.Timestamp)
+				w.WriteInt64(partition.Offset)
+			}
+			if r.Version >= 4 {
+				w.WriteInt32(partition.LeaderEpoch)
+			}
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.ListOffsets,
+		MinVersion:      0,
+		MaxVersion:      9,
+		FlexibleVersion: 6,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleListOffsetsRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &ListOffsetsResponse{Version: header.ApiVersion, Topics: []ListOffsetsTopicResponse{}}
+		},
+	})
+}
+
+func HandleListOffsetsRequest(header *request.RequestHeader, p *decoder.BytesParser) (*ListOffsetsResponse, error) {
+	req := &ListOffsetsRequest{}
+	req.Deserialize(p, header.ApiVersion)
+
+	resp := &ListOffsetsResponse{
+		Version: header.ApiVersion,
+		Topics:  make([]ListOffsetsTopicResponse, len(req.Topics)),
+	}
+	for i, topic := range req.Topics {
+		resp.Topics[i].Name = topic.Name
+		resp.Topics[i].Partitions = make([]ListOffsetsPartitionResponse, len(topic.Partitions))
+		for j, partition := range topic.Partitions {
+			resp.Topics[i].Partitions[j] = listOffset(topic.Name, partition, header.ApiVersion, req.IsolationLevel)
+		}
+	}
+	return resp, nil
+}
+
+func listOffset(topicName string, partition ListOffsetsPartition, version int16, isolationLevel int8) ListOffsetsPartitionResponse {
+	resp := ListOffsetsPartitionResponse{
+		PartitionIndex:  partition.PartitionIndex,
+		OldStyleOffsets: []int64{},
+		Timestamp:       -1,
+		Offset:          -1,
+		LeaderEpoch:     -1,
+	}
+
+	log, errorCode := lookupPartitionLog(topicName, partition.PartitionIndex)
+	if errorCode != utils.NONE {
+		resp.ErrorCode = errorCode
+		return resp
+	}
+	for _, p := range currentMetadata().Topics[topicName].Partitions {
+		if p.PartitionIndex == partition.PartitionIndex {
+			resp.LeaderEpoch = p.LeaderEpoch
+		}
+	}
+
+	switch partition.Timestamp {
+	case LatestTimestamp:
+		resp.Offset = log.HighWatermark()
+		if isolationLevel == ReadCommitted {
+			resp.Offset = log.LastStableOffset()
+		}
+	case EarliestTimestamp:
+		resp.Offset = log.LogStartOffset()
+	case EarliestLocalTimestamp:
+		resp.Offset = log.LocalLogStartOffset()
+	case LatestTieredTimestamp:
+		resp.Offset = log.HighestOffsetInRemoteStorage()
+	case MaxTimestamp:
+		resp.Timestamp, resp.Offset = log.MaxTimestamp()
+	default:
+		offset, timestamp, ok, err := log.FindOffsetByTimestamp(partition.Timestamp)
+		if err != nil {
+			fmt.Printf("Error searching %s-%d by timestamp: %s\n", topicName, partition.PartitionIndex, err.Error())
+			resp.ErrorCode = utils.KAFKA_STORAGE_ERROR
+			return resp
+		}
+		if ok {
+			resp.Timestamp, resp.Offset = timestamp, offset
+		}
+	}
+
+	if version == 0 && resp.Offset >= 0 && partition.MaxNumOffsets > 0 {
+		resp.OldStyleOffsets = []int64{resp.Offset}
+	}
+	return resp
+}
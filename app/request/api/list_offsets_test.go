@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+func listOffsets(t *testing.T, topic string, timestamp int64) ListOffsetsPartitionResponse {
+	t.Helper()
+	p := testParser(func(w *encoder.BytesWriter) {
+		w.WriteInt32(-1) // Replica Id
+		w.WriteInt8(ReadUncommitted)
+		w.WriteArrayLength(1, false)
+		w.WriteString(topic, false)
+		w.WriteArrayLength(1, false)
+		w.WriteInt32(0)
+		w.WriteInt32(-1) // Current Leader Epoch
+		w.WriteInt64(timestamp)
+	})
+	resp, err := HandleListOffsetsRequest(testContext(utils.ListOffsets, 5).Header, p)
+	if err != nil {
+		t.Fatalf("HandleListOffsetsRequest: %v", err)
+	}
+	return resp.Topics[0].Partitions[0]
+}
+
+func TestListOffsets(t *testing.T) {
+	setupStorage(t, "orders")
+	before := time.Now().UnixMilli()
+	produce(t, "orders", testBatch([]byte("a"), []byte("b")))
+	produce(t, "orders", testBatch([]byte("c")))
+
+	if resp := listOffsets(t, "orders", EarliestTimestamp); resp.ErrorCode != utils.NONE || resp.Offset != 0 {
+		t.Errorf("earliest got error %d and offset %d, want none and 0", resp.ErrorCode, resp.Offset)
+	}
+	if resp := listOffsets(t, "orders", LatestTimestamp); resp.Offset != 3 {
+		t.Errorf("latest got offset %d, want 3", resp.Offset)
+	}
+	if resp := listOffsets(t, "orders", MaxTimestamp); resp.Offset < 0 || resp.Timestamp < before {
+		t.Errorf("max timestamp got offset %d at %d, want a record at or after %d", resp.Offset, resp.Timestamp, before)
+	}
+	if resp := listOffsets(t, "orders", before); resp.Offset != 0 {
+		t.Errorf("lookup by timestamp got offset %d, want 0", resp.Offset)
+	}
+	if resp := listOffsets(t, "orders", time.Now().Add(time.Hour).UnixMilli()); resp.ErrorCode != utils.NONE || resp.Offset != -1 {
+		t.Errorf("lookup past the last timestamp got error %d and offset %d, want none and -1", resp.ErrorCode, resp.Offset)
+	}
+	if resp := listOffsets(t, "unknown", LatestTimestamp); resp.ErrorCode != utils.UNKNOWN_TOPIC_OR_PARTITION {
+		t.Errorf("unknown topic got error %d, want UNKNOWN_TOPIC_OR_PARTITION", resp.ErrorCode)
+	}
+}
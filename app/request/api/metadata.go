@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type MetatdataRecordType int8
+
+const (
+	TopicRecordType        MetatdataRecordType = 2
+	PartitionRecordType    MetatdataRecordType = 3
+	ConfigRecordType       MetatdataRecordType = 4
+	FeatureLevelRecordType MetatdataRecordType = 12
+)
+
+const (
+	ClusterMetadataTopic = "__cluster_metadata"
+
+	topicResourceType = 2
+)
+
+// logStorage is nil until SetStorage, so that importing the package opens no
+// log directory.
+var logStorage storage.Storage
+
+// SetStorage makes the handlers serve partitions from s and loads the
+// cluster metadata through it.
+func SetStorage(s storage.Storage) {
+	logStorage = s
+	clusterMetadata.Store(nil)
+	reloadMetadata()
+	s.SetAppendListener(func(tp storage.TopicPartition) {
+		if tp.Topic == ClusterMetadataTopic {
+			reloadMetadata()
+		}
+		fetchPurgatory.Changed(tp)
+	})
+}
+
+type FeatureLevel struct {
+	Name  string
+	Level int16
+}
+
+// ClusterMetadata is the state replayed from the __cluster_metadata log.
+type ClusterMetadata struct {
+	Topics map[string]Topic
+	// TopicConfigs holds the dynamic config overrides of each topic.
+	TopicConfigs map[string]map[string]string
+	// FinalizedFeatures holds the latest FeatureLevelRecord per feature and
+	// FinalizedFeaturesEpoch the offset it was written at, or -1 if none.
+	FinalizedFeatures      []FeatureLevel
+	FinalizedFeaturesEpoch int64
+}
+
+var (
+	// clusterMetadata caches the replayed __cluster_metadata log. It is
+	// loaded by SetStorage and reloaded after every append to the log, so
+	// that requests never replay it.
+	clusterMetadata atomic.Pointer[ClusterMetadata]
+	reloadMu        sync.Mutex
+)
+
+// currentMetadata returns the cached cluster metadata, which is empty until
+// SetStorage.
+func currentMetadata() *ClusterMetadata {
+	if metadata := clusterMetadata.Load(); metadata != nil {
+		return metadata
+	}
+	return &ClusterMetadata{Topics: map[string]Topic{}, TopicConfigs: map[string]map[string]string{}, FinalizedFeaturesEpoch: -1}
+}
+
+// reloadMetadata replays the cluster metadata log into the cache and applies
+// the topic config overrides that changed.
+func reloadMetadata() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	metadata, err := LoadClusterMetadata()
+	if err != nil {
+		fmt.Printf("Error loading cluster metadata: %s\n", err.Error())
+		return
+	}
+	previous := currentMetadata()
+	for topic, overrides := range metadata.TopicConfigs {
+		if _, ok := previous.TopicConfigs[topic]; !ok || !maps.Equal(previous.TopicConfigs[topic], overrides) {
+			logStorage.SetTopicConfig(topic, overrides)
+		}
+	}
+	clusterMetadata.Store(metadata)
+}
+
+// LoadClusterMetadata replays the __cluster_metadata log.
+func LoadClusterMetadata() (*ClusterMetadata, error) {
+	batches, err := readPartitionLog(ClusterMetadataTopic, 0)
+	if err != nil {
+		fmt.Printf("Error reading metadata log file: %s\n", err.Error())
+	}
+
+	topics := map[string]*Topic{}
+	topicConfigs := map[string]map[string]string{}
+	features := map[string]int16{}
+	featureNames := []string{}
+	featuresEpoch := int64(-1)
+
+	for _, data := range batches {
+		batch, err := record.Decode(data.Data)
+		if err != nil {
+			fmt.Printf("Error decoding metadata batch at offset %d: %s\n", data.BaseOffset, err.Error())
+			break
+		}
+		if batch.IsControl() {
+			continue
+		}
+
+		for i := range batch.Records {
+			valueBuffer := bytes.NewBuffer(batch.Records[i].Value)
+			_ = valueBuffer.Next(1) // Frame Version
+			var recordType MetatdataRecordType
+			binary.Read(valueBuffer, binary.BigEndian, &recordType)
+			valueBuffer.Next(1) // Version
+
+			switch recordType {
+			case ConfigRecordType:
+				var resourceType int8
+				binary.Read(valueBuffer, binary.BigEndian, &resourceType)
+				resourceName, resourceOk := readCompactString(valueBuffer)
+				name, nameOk := readCompactString(valueBuffer)
+				valueLength, valueOk := readCompactLength(valueBuffer, 1)
+				if !resourceOk || !nameOk || !valueOk {
+					skipMalformed(batch, i, "config")
+					continue
+				}
+
+				if resourceType != topicResourceType {
+					continue
+				}
+				if topicConfigs[resourceName] == nil {
+					topicConfigs[resourceName] = map[string]string{}
+				}
+				if valueLength < 0 {
+					delete(topicConfigs[resourceName], name)
+				} else {
+					topicConfigs[resourceName][name] = string(valueBuffer.Next(valueLength))
+				}
+
+			case FeatureLevelRecordType:
+				nameLength, ok := readCompactLength(valueBuffer, 1)
+				if !ok || nameLength < 0 {
+					skipMalformed(batch, i, "feature level")
+					continue
+				}
+				name := string(valueBuffer.Next(nameLength))
+				var level int16
+				binary.Read(valueBuffer, binary.BigEndian, &level)
+
+				if _, ok := features[name]; !ok {
+					featureNames = append(featureNames, name)
+				}
+				features[name] = level
+				featuresEpoch = batch.Offset(&batch.Records[i])
+
+			case TopicRecordType:
+				nameLength, ok := readCompactLength(valueBuffer, 1)
+				if !ok || nameLength < 0 {
+					skipMalformed(batch, i, "topic")
+					continue
+				}
+				topicName, topicId := make([]byte, nameLength), make([]byte, 16)
+				binary.Read(valueBuffer, binary.BigEndian, &topicName)
+				binary.Read(valueBuffer, binary.BigEndian, &topicId)
+
+				topic := &Topic{
+					TopicName: string(topicName),
+					TopicId:   string(topicId),
+				}
+
+				topics[topic.TopicId] = topic
+
+			case PartitionRecordType:
+				partition := Partition{
+					ErrorCode:                             utils.NONE,
+					EligibleLeaderReplicaNodeIds:          []int32{},
+					LastKnownEligibleLeaderReplicaNodeIds: []int32{},
+					OfflineReplicaNodeIds:                 []int32{},
+				}
+				binary.Read(valueBuffer, binary.BigEndian, &partition.PartitionIndex)
+				topicId := make([]byte, 16)
+				binary.Read(valueBuffer, binary.BigEndian, &topicId)
+
+				replicaLength, ok := readCompactLength(valueBuffer, 4)
+				if !ok || replicaLength < 0 {
+					skipMalformed(batch, i, "partition")
+					continue
+				}
+				partition.ReplicaNodeIds = make([]int32, replicaLength)
+				binary.Read(valueBuffer, binary.BigEndian, partition.ReplicaNodeIds)
+
+				isrLength, ok := readCompactLength(valueBuffer, 4)
+				if !ok || isrLength < 0 {
+					skipMalformed(batch, i, "partition")
+					continue
+				}
+				partition.IsrNodeIds = make([]int32, isrLength)
+				binary.Read(valueBuffer, binary.BigEndian, partition.IsrNodeIds)
+
+				// Removing and Adding Replicas
+				removingLength, removingOk := readCompactLength(valueBuffer, 4)
+				valueBuffer.Next(4 * max(removingLength, 0))
+				addingLength, addingOk := readCompactLength(valueBuffer, 4)
+				valueBuffer.Next(4 * max(addingLength, 0))
+				if !removingOk || !addingOk {
+					skipMalformed(batch, i, "partition")
+					continue
+				}
+				binary.Read(valueBuffer, binary.BigEndian, &partition.LeaderId)
+				binary.Read(valueBuffer, binary.BigEndian, &partition.LeaderEpoch)
+
+				topic, ok := topics[string(topicId)]
+				if !ok {
+					fmt.Printf("Skipping metadata record at offset %d: partition %d of unknown topic id %x\n", batch.Offset(&batch.Records[i]), partition.PartitionIndex, topicId)
+					continue
+				}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+		}
+	}
+	metadata := &ClusterMetadata{
+		Topics:                 make(map[string]Topic, len(topics)),
+		TopicConfigs:           topicConfigs,
+		FinalizedFeatures:      make([]FeatureLevel, 0, len(featureNames)),
+		FinalizedFeaturesEpoch: featuresEpoch,
+	}
+	for _, topic := range topics {
+		metadata.Topics[topic.TopicName] = *topic
+	}
+	for _, name := range featureNames {
+		// A level of 0 removes the feature.
+		if features[name] > 0 {
+			metadata.FinalizedFeatures = append(metadata.FinalizedFeatures, FeatureLevel{Name: name, Level: features[name]})
+		}
+	}
+
+	return metadata, nil
+}
+
+// readCompactLength reads the length of a compact string or array whose
+// elements take size bytes, -1 if it is null. It reports false if the length
+// is malformed or runs past the end of b.
+func readCompactLength(b *bytes.Buffer, size int) (int, bool) {
+	length, err := binary.ReadUvarint(b)
+	if err != nil || length > uint64(b.Len()/size)+1 {
+		return 0, false
+	}
+	return int(length) - 1, true
+}
+
+// readCompactString reads a compact string, empty if it is null.
+func readCompactString(b *bytes.Buffer) (string, bool) {
+	length, ok := readCompactLength(b, 1)
+	if !ok || length < 0 {
+		return "", ok
+	}
+	return string(b.Next(length)), true
+}
+
+// skipMalformed logs the skipping of record i of batch, a recordType record
+// whose lengths do not fit in its value.
+func skipMalformed(batch *record.RecordBatch, i int, recordType string) {
+	fmt.Printf("Skipping metadata record at offset %d: malformed %s record\n", batch.Offset(&batch.Records[i]), recordType)
+}
+
+// lookupPartitionLog returns the log of a partition known to the cluster
+// metadata, or the error code to report for it.
+func lookupPartitionLog(topicName string, partitionId int32) (storage.PartitionLog, utils.ErrorCode) {
+	topic, ok := currentMetadata().Topics[topicName]
+	if !ok || !hasPartition(topic, partitionId) {
+		return nil, utils.UNKNOWN_TOPIC_OR_PARTITION
+	}
+	log, err := logStorage.GetOrCreateLog(storage.TopicPartition{Topic: topicName, Partition: partitionId})
+	if err != nil {
+		fmt.Printf("Error opening log of %s-%d: %s\n", topicName, partitionId, err.Error())
+		return nil, utils.KAFKA_STORAGE_ERROR
+	}
+	return log, utils.NONE
+}
+
+// readPartitionLog returns the record batches of a partition across all of
+// its segments.
+func readPartitionLog(topicName string, partitionId int32) ([]storage.Batch, error) {
+	log, err := logStorage.GetLog(storage.TopicPartition{Topic: topicName, Partition: partitionId})
+	if err != nil {
+		return nil, err
+	}
+	return log.Read(0, math.MaxInt, true)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+)
+
+func TestMetadataReloadsOnAppend(t *testing.T) {
+	s := setupStorage(t, "orders")
+	if _, ok := currentMetadata().Topics["payments"]; ok {
+		t.Fatalf("payments is known before it is created")
+	}
+
+	topicId := bytes.Repeat([]byte{0xaa}, 16)
+	metadata, _ := s.GetLog(storage.TopicPartition{Topic: ClusterMetadataTopic, Partition: 0})
+	if _, err := metadata.Append(testBatch(topicRecord("payments", topicId), partitionRecord(topicId, 0))); err != nil {
+		t.Fatalf("appending to the metadata log: %v", err)
+	}
+	topic, ok := currentMetadata().Topics["payments"]
+	if !ok || len(topic.Partitions) != 1 {
+		t.Fatalf("payments not loaded after the append to the metadata log")
+	}
+	if _, ok := currentMetadata().Topics["orders"]; !ok {
+		t.Errorf("orders lost after the append to the metadata log")
+	}
+}
+
+func TestMetadataSkipsPartitionOfUnknownTopic(t *testing.T) {
+	s := setupStorage(t, "orders")
+
+	metadata, _ := s.GetLog(storage.TopicPartition{Topic: ClusterMetadataTopic, Partition: 0})
+	if _, err := metadata.Append(testBatch(partitionRecord(bytes.Repeat([]byte{0xbb}, 16), 0))); err != nil {
+		t.Fatalf("appending to the metadata log: %v", err)
+	}
+	if topics := currentMetadata().Topics; len(topics) != 1 || len(topics["orders"].Partitions) != 1 {
+		t.Errorf("got topics %v, want orders with its single partition", topics)
+	}
+}
+
+func TestMetadataSkipsMalformedRecords(t *testing.T) {
+	s := setupStorage(t, "orders")
+
+	topicId := bytes.Repeat([]byte{0xcc}, 16)
+	malformed := [][]byte{
+		// A topic name of length 0, and one longer than the record.
+		metadataRecord(TopicRecordType, func(w *encoder.BytesWriter) { w.WriteUvarint(0) }),
+		metadataRecord(TopicRecordType, func(w *encoder.BytesWriter) { w.WriteUvarint(1 << 40) }),
+		metadataRecord(FeatureLevelRecordType, func(w *encoder.BytesWriter) { w.WriteUvarint(1 << 63) }),
+		metadataRecord(ConfigRecordType, func(w *encoder.BytesWriter) {
+			w.WriteInt8(topicResourceType)
+			w.WriteString("orders", true)
+			w.WriteString("retention.ms", true)
+			w.WriteUvarint(1000)
+		}),
+		topicRecord("payments", topicId),
+		metadataRecord(PartitionRecordType, func(w *encoder.BytesWriter) {
+			w.WriteInt32(0)
+			w.Write(topicId)
+			w.WriteUvarint(1 << 20) // Replicas
+		}),
+	}
+	metadata, _ := s.GetLog(storage.TopicPartition{Topic: ClusterMetadataTopic, Partition: 0})
+	if _, err := metadata.Append(testBatch(malformed...)); err != nil {
+		t.Fatalf("appending to the metadata log: %v", err)
+	}
+
+	loaded := currentMetadata()
+	if len(loaded.Topics) != 2 || len(loaded.Topics["orders"].Partitions) != 1 || len(loaded.Topics["payments"].Partitions) != 0 {
+		t.Errorf("got topics %v, want orders with its partition and payments with none", loaded.Topics)
+	}
+	if configs := loaded.TopicConfigs["orders"]; len(configs) != 0 {
+		t.Errorf("got orders configs %v, want none", configs)
+	}
+}
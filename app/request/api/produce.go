@@ -0,0 +1,325 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/metrics"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type ProduceRequest struct {
+	TransactionalId *string
+	Acks            int16
+	TimeoutMs       int32
+	Topics          []ProduceTopic
+}
+
+type ProduceTopic struct {
+	Name       string
+	Partitions []ProducePartition
+}
+
+type ProducePartition struct {
+	Index   int32
+	Records []byte
+}
+
+type ProduceResponse struct {
+	Version        int16
+	Responses      []ProduceTopicResponse
+	ThrottleTimeMs int32
+}
+
+type ProduceTopicResponse struct {
+	Name       string
+	Partitions []ProducePartitionResponse
+}
+
+type ProducePartitionResponse struct {
+	Index           int32
+	ErrorCode       utils.ErrorCode
+	BaseOffset      int64
+	LogAppendTimeMs int64
+	LogStartOffset  int64
+	ErrorMessage    *string
+}
+
+func (r *ProduceRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 9
+	if flexible {
+		if id, ok := p.ReadCompactNullableString(); ok {
+			r.TransactionalId = &id
+		}
+	} else if version >= 3 {
+		if length := p.ReadInt16(); length >= 0 {
+			id := string(p.ReadBytes(int(length)))
+			r.TransactionalId = &id
+		}
+	}
+	r.Acks = p.ReadInt16()
+	r.TimeoutMs = p.ReadInt32()
+	r.Topics = make([]ProduceTopic, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Topics {
+		topic := &r.Topics[i]
+		topic.Name = p.ReadVersionedString(flexible)
+		topic.Partitions = make([]ProducePartition, max(p.ReadArrayLength(flexible), 0))
+		for j := range topic.Partitions {
+			topic.Partitions[j].Index = p.ReadInt32()
+			topic.Partitions[j].Records = p.ReadNullableBytes(flexible)
+			if flexible {
+				p.ReadTaggedFields()
+			}
+		}
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *ProduceResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 9
+	w := encoder.NewBytesWriter()
+	w.WriteArrayLength(len(r.Responses), flexible)
+	for _, topic := range r.Responses {
+		w.WriteString(topic.Name, flexible)
+		w.WriteArrayLength(len(topic.Partitions), flexible)
+		for _, partition := range topic.Partitions {
+			w.WriteInt32(partition.Index)
+			w.WriteInt16(int16(partition.ErrorCode))
+			w.WriteInt64(partition.BaseOffset)
+			if r.Version >= 2 {
+				w.WriteInt64(partition.LogAppendTimeMs)
+			}
+			if r.Version >= 5 {
+				w.WriteInt64(partition.LogStartOffset)
+			}
+			if r.Version >= 8 {
+				w.WriteArrayLength(0, flexible) // RecordErrors
+				w.WriteNullableString(partition.ErrorMessage, flexible)
+			}
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if r.Version >= 1 {
+		w.WriteInt32(r.ThrottleTimeMs)
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.Produce,
+		MinVersion:      0,
+		MaxVersion:      11,
+		FlexibleVersion: 9,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleProduceRequest(ctx, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return produceErrorResponse(header.ApiVersion, p, code)
+		},
+	})
+}
+
+// HandleProduceRequest appends the batch of each partition to its log. Every
+// batch is decompressed to validate its records and is recompressed when the
+// topic's compression.type asks for another codec; legacy message sets from
+// producers before v3 are up-converted to batches first. Offsets are assigned
+// by the log.
+func HandleProduceRequest(ctx *RequestContext, p *decoder.BytesParser) (*ProduceResponse, error) {
+	req := &ProduceRequest{}
+	req.Deserialize(p, ctx.Header.ApiVersion)
+
+	resp := &ProduceResponse{
+		Version:   ctx.Header.ApiVersion,
+		Responses: make([]ProduceTopicResponse, len(req.Topics)),
+	}
+	for i, topic := range req.Topics {
+		resp.Responses[i].Name = topic.Name
+		resp.Responses[i].Partitions = make([]ProducePartitionResponse, len(topic.Partitions))
+		for j, partition := range topic.Partitions {
+			partitionResp := ProducePartitionResponse{
+				Index:           partition.Index,
+				BaseOffset:      -1,
+				LogAppendTimeMs: -1,
+				LogStartOffset:  -1,
+			}
+			if req.Acks != 0 && req.Acks != 1 && req.Acks != -1 {
+				partitionResp.ErrorCode = utils.INVALID_REQUIRED_ACKS
+			} else {
+				produceToPartition(topic.Name, partition, ctx.Header.ApiVersion, &partitionResp)
+			}
+			resp.Responses[i].Partitions[j] = partitionResp
+		}
+	}
+
+	// There is no replication, so acks=-1 is answered like acks=1, and
+	// acks=0 not at all.
+	ctx.NoResponse = req.Acks == 0
+	return resp, nil
+}
+
+// produceErrorResponse fails every partition of the request with code, as
+// producers look for their partitions in the response. The body of an
+// unsupported version cannot be parsed, so that response lists none.
+func produceErrorResponse(version int16, p *decoder.BytesParser, code utils.ErrorCode) *ProduceResponse {
+	resp := &ProduceResponse{Version: version, Responses: []ProduceTopicResponse{}}
+	if p == nil {
+		return resp
+	}
+	req := &ProduceRequest{}
+	req.Deserialize(p, version)
+	for _, topic := range req.Topics {
+		topicResp := ProduceTopicResponse{Name: topic.Name, Partitions: make([]ProducePartitionResponse, len(topic.Partitions))}
+		for i, partition := range topic.Partitions {
+			topicResp.Partitions[i] = ProducePartitionResponse{
+				Index:           partition.Index,
+				ErrorCode:       code,
+				BaseOffset:      -1,
+				LogAppendTimeMs: -1,
+				LogStartOffset:  -1,
+			}
+		}
+		resp.Responses = append(resp.Responses, topicResp)
+	}
+	return resp
+}
+
+// produceToPartition appends the batch of one partition and fills resp with
+// where it went.
+func produceToPartition(topicName string, partition ProducePartition, version int16, resp *ProducePartitionResponse) {
+	log, errorCode := lookupPartitionLog(topicName, partition.Index)
+	if errorCode != utils.NONE {
+		resp.ErrorCode = errorCode
+		return
+	}
+
+	data, errorCode, err := prepareBatch(partition.Records, log.Config(), version)
+	if errorCode != utils.NONE {
+		fmt.Printf("Rejected batch produced to %s-%d: %s\n", topicName, partition.Index, err.Error())
+		message := err.Error()
+		resp.ErrorCode, resp.ErrorMessage = errorCode, &message
+		return
+	}
+	batch, err := log.Append(data)
+	if err != nil {
+		resp.ErrorCode = appendErrorCode(err)
+		if resp.ErrorCode == utils.KAFKA_STORAGE_ERROR {
+			fmt.Printf("Error appending to %s-%d: %s\n", topicName, partition.Index, err.Error())
+		} else {
+			fmt.Printf("Rejected batch produced to %s-%d: %s\n", topicName, partition.Index, err.Error())
+		}
+		return
+	}
+	if producedFormat(version) != log.Config().MessageFormat {
+		metrics.AddBrokerTopic("ProduceMessageConversionsPerSec", topicName, int64(record.DecodeHeader(data).RecordCount))
+	}
+	resp.BaseOffset = batch.BaseOffset
+	resp.LogStartOffset = log.LogStartOffset()
+}
+
+// appendErrorCode maps an error appending to a log to its error code: the
+// producer state rejects batches out of sequence or from fenced producers, and
+// anything else is a storage failure.
+func appendErrorCode(err error) utils.ErrorCode {
+	switch {
+	case errors.Is(err, storage.ErrOutOfOrderSequence):
+		return utils.OUT_OF_ORDER_SEQUENCE_NUMBER
+	case errors.Is(err, storage.ErrInvalidProducerEpoch):
+		return utils.INVALID_PRODUCER_EPOCH
+	case errors.Is(err, storage.ErrInvalidTxnState):
+		return utils.INVALID_TXN_STATE
+	case errors.Is(err, storage.ErrTransactionCoordinatorFenced):
+		return utils.TRANSACTION_COORDINATOR_FENCED
+	default:
+		return utils.KAFKA_STORAGE_ERROR
+	}
+}
+
+// producedFormat is the message format producers send at version: a legacy
+// MessageSet before v3, v1 messages from v2.
+func producedFormat(version int16) int8 {
+	switch {
+	case version >= 3:
+		return record.Magic
+	case version == 2:
+		return record.MagicV1
+	}
+	return record.MagicV0
+}
+
+// prepareBatch validates a produced batch, decompressing it to check every
+// record, and returns it as it should be appended: recompressed when the
+// topic's compression.type names a codec other than the producer's. Before
+// v3, producers send a legacy MessageSet, which is converted to a batch.
+func prepareBatch(data []byte, config storage.LogConfig, version int16) ([]byte, utils.ErrorCode, error) {
+	if data == nil {
+		return nil, utils.INVALID_RECORD, fmt.Errorf("no record batch")
+	}
+	var batch *record.RecordBatch
+	if version < 3 {
+		messages, codec, err := record.DecodeMessageSet(data)
+		if err != nil {
+			return nil, utils.CORRUPT_MESSAGE, err
+		}
+		batch, data = record.UpConvert(messages, codec), nil
+	} else {
+		var err error
+		if batch, err = record.Decode(data); err != nil {
+			return nil, utils.CORRUPT_MESSAGE, err
+		}
+	}
+	if batch.Compression() == compression.Zstd && version < 7 {
+		return nil, utils.UNSUPPORTED_COMPRESSION_TYPE, fmt.Errorf("zstd requires produce v7 or later, got v%d", version)
+	}
+	if batch.IsControl() {
+		return nil, utils.INVALID_RECORD, fmt.Errorf("clients may not write control batches")
+	}
+	if len(batch.Records) == 0 || int(batch.LastOffsetDelta) != len(batch.Records)-1 {
+		return nil, utils.INVALID_RECORD, fmt.Errorf("last offset delta %d does not match %d records", batch.LastOffsetDelta, len(batch.Records))
+	}
+	for i := range batch.Records {
+		if batch.Records[i].OffsetDelta != int32(i) {
+			return nil, utils.INVALID_RECORD, fmt.Errorf("record %d has offset delta %d", i, batch.Records[i].OffsetDelta)
+		}
+	}
+	// Legacy message formats have no producer ids, sequences or headers.
+	if config.MessageFormat < record.Magic {
+		if batch.ProducerId >= 0 {
+			return nil, utils.UNSUPPORTED_FOR_MESSAGE_FORMAT, fmt.Errorf("idempotent and transactional batches need message format v2, the topic's is v%d", config.MessageFormat)
+		}
+		for i := range batch.Records {
+			if len(batch.Records[i].Headers) > 0 {
+				return nil, utils.UNSUPPORTED_FOR_MESSAGE_FORMAT, fmt.Errorf("record headers need message format v2, the topic's is v%d", config.MessageFormat)
+			}
+		}
+	}
+
+	if codec, ok := config.Codec(); ok && codec != batch.Compression() {
+		batch.SetCompression(codec)
+		data = nil
+	}
+	if data == nil {
+		data = batch.Encode()
+	}
+	return data, utils.NONE, nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// produceRequest encodes a Produce v8 request with acks=1 sending batch to
+// partition 0 of topic.
+func produceRequest(topic string, batch []byte) func(w *encoder.BytesWriter) {
+	return func(w *encoder.BytesWriter) {
+		w.WriteInt16(-1) // Transactional Id
+		w.WriteInt16(1)  // Acks
+		w.WriteInt32(1000)
+		w.WriteArrayLength(1, false)
+		w.WriteString(topic, false)
+		w.WriteArrayLength(1, false)
+		w.WriteInt32(0)
+		w.WriteBytes(batch, false)
+	}
+}
+
+func produce(t *testing.T, topic string, batch []byte) ProducePartitionResponse {
+	t.Helper()
+	resp, err := HandleProduceRequest(testContext(utils.Produce, 8), testParser(produceRequest(topic, batch)))
+	if err != nil {
+		t.Fatalf("HandleProduceRequest: %v", err)
+	}
+	return resp.Responses[0].Partitions[0]
+}
+
+func TestProduceAssignsOffsets(t *testing.T) {
+	setupStorage(t, "orders")
+
+	first := produce(t, "orders", testBatch([]byte("a"), []byte("b")))
+	if first.ErrorCode != utils.NONE || first.BaseOffset != 0 {
+		t.Fatalf("first produce got error %d at offset %d, want none at 0", first.ErrorCode, first.BaseOffset)
+	}
+	second := produce(t, "orders", testBatch([]byte("c")))
+	if second.ErrorCode != utils.NONE || second.BaseOffset != 2 {
+		t.Errorf("second produce got error %d at offset %d, want none at 2", second.ErrorCode, second.BaseOffset)
+	}
+	if second.LogStartOffset != 0 {
+		t.Errorf("got log start offset %d, want 0", second.LogStartOffset)
+	}
+}
+
+func TestProduceRejects(t *testing.T) {
+	setupStorage(t, "orders")
+
+	if resp := produce(t, "unknown", testBatch([]byte("a"))); resp.ErrorCode != utils.UNKNOWN_TOPIC_OR_PARTITION {
+		t.Errorf("produce to an unknown topic got error %d, want UNKNOWN_TOPIC_OR_PARTITION", resp.ErrorCode)
+	}
+	corrupt := testBatch([]byte("a"))
+	corrupt[len(corrupt)-1] ^= 0xff
+	if resp := produce(t, "orders", corrupt); resp.ErrorCode != utils.CORRUPT_MESSAGE {
+		t.Errorf("produce of a corrupt batch got error %d, want CORRUPT_MESSAGE", resp.ErrorCode)
+	}
+}
+
+func TestProduceErrorResponseEchoesPartitions(t *testing.T) {
+	h, _ := Lookup(utils.Produce)
+	header := testContext(utils.Produce, 8).Header
+	resp := h.ErrorResponse(header, testParser(produceRequest("orders", testBatch([]byte("a")))), utils.KAFKA_STORAGE_ERROR).(*ProduceResponse)
+	if len(resp.Responses) != 1 || resp.Responses[0].Name != "orders" || len(resp.Responses[0].Partitions) != 1 {
+		t.Fatalf("got responses %+v, want partition 0 of orders", resp.Responses)
+	}
+	if partition := resp.Responses[0].Partitions[0]; partition.ErrorCode != utils.KAFKA_STORAGE_ERROR || partition.BaseOffset != -1 {
+		t.Errorf("got error %d at offset %d, want KAFKA_STORAGE_ERROR at -1", partition.ErrorCode, partition.BaseOffset)
+	}
+
+	if resp := h.ErrorResponse(header, nil, utils.UNSUPPORTED_VERSION).(*ProduceResponse); len(resp.Responses) != 0 {
+		t.Errorf("got responses %+v for an unparsed body, want none", resp.Responses)
+	}
+}
+
+func TestPrepareBatchRejectsWhatTheMessageFormatCannotHold(t *testing.T) {
+	legacy := storage.LogConfig{CompressionType: "producer", MessageFormat: record.MagicV1}
+	if _, errorCode, err := prepareBatch(testBatch([]byte("a")), legacy, 8); errorCode != utils.NONE {
+		t.Fatalf("a plain batch for message format v1 got error %d: %v", errorCode, err)
+	}
+
+	idempotent, _ := record.Decode(testBatch([]byte("a")))
+	idempotent.ProducerId, idempotent.ProducerEpoch, idempotent.BaseSequence = 1, 0, 0
+	withHeaders, _ := record.Decode(testBatch([]byte("a")))
+	withHeaders.Records[0].Headers = []record.Header{{Key: "k", Value: []byte("v")}}
+	for name, batch := range map[string]*record.RecordBatch{"idempotent": idempotent, "with headers": withHeaders} {
+		if _, errorCode, _ := prepareBatch(batch.Encode(), legacy, 8); errorCode != utils.UNSUPPORTED_FOR_MESSAGE_FORMAT {
+			t.Errorf("a batch %s for message format v1 got error %d, want UNSUPPORTED_FOR_MESSAGE_FORMAT", name, errorCode)
+		}
+		legacy.MessageFormat = record.Magic
+		if _, errorCode, err := prepareBatch(batch.Encode(), legacy, 8); errorCode != utils.NONE {
+			t.Errorf("a batch %s for message format v2 got error %d: %v", name, errorCode, err)
+		}
+		legacy.MessageFormat = record.MagicV1
+	}
+}
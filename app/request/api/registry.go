@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// ErrUnknownApiKey is returned by Dispatch for a request whose api key no
+// handler is registered for.
+var ErrUnknownApiKey = errors.New("unknown api key")
+
+type Response interface {
+	Serialize() ([]byte, error)
+}
+
+// Sender is implemented by responses carrying file regions, which Serialize
+// would have to read into memory.
+type Sender interface {
+	Send() (*encoder.Send, error)
+}
+
+func serialize(resp Response) (*encoder.Send, error) {
+	if sender, ok := resp.(Sender); ok {
+		return sender.Send()
+	}
+	body, err := resp.Serialize()
+	return encoder.NewSend(body), err
+}
+
+// Handler describes one API the broker serves. Handlers register themselves
+// from init, and the registry is the single source of truth for dispatch and
+// for the versions advertised by ApiVersions.
+type Handler struct {
+	ApiKey     utils.APIKeys
+	MinVersion int16
+	MaxVersion int16
+	// FlexibleVersion is the first version using compact encodings and
+	// tagged fields, or -1 if the API has none.
+	FlexibleVersion int16
+	Handle          func(ctx *RequestContext, p *decoder.BytesParser) (Response, error)
+	// ErrorResponse builds the body sent back when the request is rejected
+	// or Handle fails. p is the request body, from which responses listing
+	// the requested resources echo them, or nil for an unsupported version,
+	// whose body cannot be parsed.
+	ErrorResponse func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response
+}
+
+func (h *Handler) Supports(version int16) bool {
+	return version >= h.MinVersion && version <= h.MaxVersion
+}
+
+func (h *Handler) IsFlexible(version int16) bool {
+	return h.FlexibleVersion >= 0 && version >= h.FlexibleVersion
+}
+
+// HeaderFlexibility reports whether the request and response headers of a
+// request carry tag buffers. ApiVersions responses always use header v0 so
+// that clients can parse them before knowing what the broker supports.
+func HeaderFlexibility(header *request.RequestHeader) (requestFlexible bool, responseFlexible bool) {
+	h, ok := Lookup(header.ApiKey)
+	if !ok {
+		return false, false
+	}
+	flexible := h.IsFlexible(header.ApiVersion)
+	return flexible, flexible && header.ApiKey != utils.ApiVersions
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[utils.APIKeys]*Handler{}
+)
+
+func Register(h *Handler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[h.ApiKey]; ok {
+		panic(fmt.Sprintf("api: handler for key %d registered twice", h.ApiKey))
+	}
+	registry[h.ApiKey] = h
+}
+
+func Lookup(key utils.APIKeys) (*Handler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	h, ok := registry[key]
+	return h, ok
+}
+
+// Handlers returns every registered handler ordered by ApiKey.
+func Handlers() []*Handler {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	handlers := make([]*Handler, 0, len(registry))
+	for _, h := range registry {
+		handlers = append(handlers, h)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].ApiKey < handlers[j].ApiKey })
+	return handlers
+}
+
+// Dispatch routes a request to its registered handler and returns the
+// serialized response body. Versions outside the handler's declared range are
+// rejected with UNSUPPORTED_VERSION without calling the handler. A request
+// with an unknown api key has no response format to answer in, so it gets
+// ErrUnknownApiKey and the connection is closed.
+func Dispatch(ctx *RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+	header := ctx.Header
+	h, ok := Lookup(header.ApiKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownApiKey, header.ApiKey)
+	}
+
+	if !h.Supports(header.ApiVersion) {
+		body, _ := serialize(h.ErrorResponse(header, nil, utils.UNSUPPORTED_VERSION))
+		if header.ApiKey == utils.ApiVersions {
+			// Part of the normal version negotiation, not a failure.
+			return body, nil
+		}
+		return body, fmt.Errorf("unsupported version %d for api key %d", header.ApiVersion, header.ApiKey)
+	}
+
+	unread := *p
+	resp, err := h.Handle(ctx, p)
+	if err != nil {
+		body, _ := serialize(h.ErrorResponse(header, &unread, utils.UNKNOWN_SERVER_ERROR))
+		return body, err
+	}
+	return serialize(resp)
+}
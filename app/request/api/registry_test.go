@@ -0,0 +1,36 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+func TestDispatchUnknownApiKey(t *testing.T) {
+	header := &request.RequestHeader{ApiKey: utils.APIKeys(999), CorrelationId: 1}
+	resp, err := Dispatch(&RequestContext{Header: header}, decoder.NewBytesParser(nil))
+	if resp != nil || !errors.Is(err, ErrUnknownApiKey) {
+		t.Errorf("Dispatch returned a response and %v for an unknown api key, want ErrUnknownApiKey", err)
+	}
+}
+
+func TestDispatchRejectsUnsupportedVersion(t *testing.T) {
+	header := &request.RequestHeader{ApiKey: utils.Fetch, ApiVersion: 99, CorrelationId: 1}
+	resp, err := Dispatch(&RequestContext{Header: header}, decoder.NewBytesParser(nil))
+	if err == nil || resp == nil || errors.Is(err, ErrUnknownApiKey) {
+		t.Fatalf("Dispatch accepted Fetch v99")
+	}
+	defer resp.Close()
+
+	var body bytes.Buffer
+	resp.WriteTo(&body)
+	h, _ := Lookup(utils.Fetch)
+	want, _ := h.ErrorResponse(header, nil, utils.UNSUPPORTED_VERSION).Serialize()
+	if !bytes.Equal(body.Bytes(), want) {
+		t.Errorf("got response %x, want the Fetch error response %x", body.Bytes(), want)
+	}
+}
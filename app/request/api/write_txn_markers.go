@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+	"github.com/codecrafters-io/kafka-starter-go/app/request"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+type WriteTxnMarkersRequest struct {
+	Markers []WritableTxnMarker
+}
+
+type WritableTxnMarker struct {
+	ProducerId    int64
+	ProducerEpoch int16
+	// TransactionResult is true for a commit and false for an abort.
+	TransactionResult bool
+	Topics            []WritableTxnMarkerTopic
+	CoordinatorEpoch  int32
+}
+
+type WritableTxnMarkerTopic struct {
+	Name             string
+	PartitionIndexes []int32
+}
+
+type WriteTxnMarkersResponse struct {
+	Version int16
+	Markers []WritableTxnMarkerResult
+}
+
+type WritableTxnMarkerResult struct {
+	ProducerId int64
+	Topics     []WritableTxnMarkerTopicResult
+}
+
+type WritableTxnMarkerTopicResult struct {
+	Name       string
+	Partitions []WritableTxnMarkerPartitionResult
+}
+
+type WritableTxnMarkerPartitionResult struct {
+	PartitionIndex int32
+	ErrorCode      utils.ErrorCode
+}
+
+func (r *WriteTxnMarkersRequest) Deserialize(p *decoder.BytesParser, version int16) error {
+	flexible := version >= 1
+	r.Markers = make([]WritableTxnMarker, max(p.ReadArrayLength(flexible), 0))
+	for i := range r.Markers {
+		marker := &r.Markers[i]
+		marker.ProducerId = p.ReadInt64()
+		marker.ProducerEpoch = p.ReadInt16()
+		marker.TransactionResult = p.ReadInt8() != 0
+		marker.Topics = make([]WritableTxnMarkerTopic, max(p.ReadArrayLength(flexible), 0))
+		for j := range marker.Topics {
+			topic := &marker.Topics[j]
+			topic.Name = p.ReadVersionedString(flexible)
+			topic.PartitionIndexes = make([]int32, max(p.ReadArrayLength(flexible), 0))
+			for k := range topic.PartitionIndexes {
+				topic.PartitionIndexes[k] = p.ReadInt32()
+			}
+			if flexible {
+				p.ReadTaggedFields()
+			}
+		}
+		marker.CoordinatorEpoch = p.ReadInt32()
+		if flexible {
+			p.ReadTaggedFields()
+		}
+	}
+	if flexible {
+		p.ReadTaggedFields()
+	}
+	return nil
+}
+
+func (r *WriteTxnMarkersResponse) Serialize() ([]byte, error) {
+	flexible := r.Version >= 1
+	w := encoder.NewBytesWriter()
+	w.WriteArrayLength(len(r.Markers), flexible)
+	for _, marker := range r.Markers {
+		w.WriteInt64(marker.ProducerId)
+		w.WriteArrayLength(len(marker.Topics), flexible)
+		for _, topic := range marker.Topics {
+			w.WriteString(topic.Name, flexible)
+			w.WriteArrayLength(len(topic.Partitions), flexible)
+			for _, partition := range topic.Partitions {
+				w.WriteInt32(partition.PartitionIndex)
+				w.WriteInt16(int16(partition.ErrorCode))
+				if flexible {
+					w.WriteTaggedFields()
+				}
+			}
+			if flexible {
+				w.WriteTaggedFields()
+			}
+		}
+		if flexible {
+			w.WriteTaggedFields()
+		}
+	}
+	if flexible {
+		w.WriteTaggedFields()
+	}
+	return w.Bytes(), nil
+}
+
+func init() {
+	Register(&Handler{
+		ApiKey:          utils.WriteTxnMarkers,
+		MinVersion:      0,
+		MaxVersion:      1,
+		FlexibleVersion: 1,
+		Handle: func(ctx *RequestContext, p *decoder.BytesParser) (Response, error) {
+			return HandleWriteTxnMarkersRequest(ctx.Header, p)
+		},
+		ErrorResponse: func(header *request.RequestHeader, p *decoder.BytesParser, code utils.ErrorCode) Response {
+			return &WriteTxnMarkersResponse{Version: header.ApiVersion, Markers: []WritableTxnMarkerResult{}}
+		},
+	})
+}
+
+// HandleWriteTxnMarkersRequest ends transactions: a transaction coordinator
+// sends it to write a commit or abort marker to every partition a producer's
+// transaction wrote to. Once the marker is written the transaction no longer
+// holds back the last stable offset, and an aborted one is listed to
+// read_committed fetches.
+func HandleWriteTxnMarkersRequest(header *request.RequestHeader, p *decoder.BytesParser) (*WriteTxnMarkersResponse, error) {
+	req := &WriteTxnMarkersRequest{}
+	req.Deserialize(p, header.ApiVersion)
+
+	resp := &WriteTxnMarkersResponse{Version: header.ApiVersion, Markers: make([]WritableTxnMarkerResult, len(req.Markers))}
+	for i, marker := range req.Markers {
+		resp.Markers[i] = WritableTxnMarkerResult{ProducerId: marker.ProducerId, Topics: make([]WritableTxnMarkerTopicResult, len(marker.Topics))}
+		for j, topic := range marker.Topics {
+			result := WritableTxnMarkerTopicResult{Name: topic.Name, Partitions: make([]WritableTxnMarkerPartitionResult, len(topic.PartitionIndexes))}
+			for k, partition := range topic.PartitionIndexes {
+				result.Partitions[k] = WritableTxnMarkerPartitionResult{
+					PartitionIndex: partition,
+					ErrorCode:      writeTxnMarker(topic.Name, partition, marker),
+				}
+			}
+			resp.Markers[i].Topics[j] = result
+		}
+	}
+	return resp, nil
+}
+
+func writeTxnMarker(topicName string, partitionId int32, marker WritableTxnMarker) utils.ErrorCode {
+	log, errorCode := lookupPartitionLog(topicName, partitionId)
+	if errorCode != utils.NONE {
+		return errorCode
+	}
+	controlType := record.AbortMarker
+	if marker.TransactionResult {
+		controlType = record.CommitMarker
+	}
+	batch := record.NewControlBatch(marker.ProducerId, marker.ProducerEpoch, time.Now().UnixMilli(), record.EndTxnMarker{
+		Type:             controlType,
+		CoordinatorEpoch: marker.CoordinatorEpoch,
+	})
+	if _, err := log.Append(batch.Encode()); err != nil {
+		errorCode = appendErrorCode(err)
+		if errorCode == utils.KAFKA_STORAGE_ERROR {
+			fmt.Printf("Error writing transaction marker to %s-%d: %s\n", topicName, partitionId, err.Error())
+		} else {
+			fmt.Printf("Rejected transaction marker for %s-%d: %s\n", topicName, partitionId, err.Error())
+		}
+		return errorCode
+	}
+	return utils.NONE
+}
@@ -13,15 +13,21 @@ type RequestHeader struct {
 	ApiVersion    int16
 	CorrelationId int32
 	ClientId      string
+	TaggedFields  map[uint64][]byte
 }
 
 type ResponseHeader struct {
 	CorrelationId int32
+	// Flexible selects response header v1, which carries a tag buffer.
+	Flexible bool
 }
 
 func (r *ResponseHeader) Serialize() ([]byte, error) {
 	res := make([]byte, 4)
 	binary.BigEndian.PutUint32(res, uint32(r.CorrelationId))
+	if r.Flexible {
+		res = append(res, 0) // Tag Buffer
+	}
 
 	return res, nil
 }
@@ -31,6 +37,12 @@ func (r *RequestHeader) Deserialize(p *decoder.BytesParser) error {
 	r.ApiVersion = int16(p.ReadInt16())
 	r.CorrelationId = int32(p.ReadInt32())
 	r.ClientId = p.ReadNullableString()
-	p.ReadInt8() // Tag Buffer
+	return nil
+}
+
+// DeserializeTaggedFields reads the tag buffer that request header v2 adds
+// after the client id.
+func (r *RequestHeader) DeserializeTaggedFields(p *decoder.BytesParser) error {
+	r.TaggedFields = p.ReadTaggedFields()
 	return nil
 }
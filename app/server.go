@@ -2,14 +2,28 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
 	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/metrics"
 	"github.com/codecrafters-io/kafka-starter-go/app/request"
 	"github.com/codecrafters-io/kafka-starter-go/app/request/api"
-	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
 )
 
 func Receive(c net.Conn) ([]byte, error) {
@@ -20,7 +34,7 @@ func Receive(c net.Conn) ([]byte, error) {
 	}
 
 	data := make([]byte, message_size)
-	_, err = c.Read(data)
+	_, err = io.ReadFull(c, data)
 	if err != nil {
 		return nil, err
 	}
@@ -28,76 +42,349 @@ func Receive(c net.Conn) ([]byte, error) {
 	return data, nil
 }
 
-func Send(c net.Conn, b []byte) error {
-	binary.Write(c, binary.BigEndian, int32(len(b)))
-	binary.Write(c, binary.BigEndian, b)
+// Send writes a size delimited response. Its file regions go from the file
+// to the socket with sendfile.
+func Send(c net.Conn, s *encoder.Send) error {
+	s.Prepend(binary.BigEndian.AppendUint32(nil, uint32(s.Size())))
+	_, err := s.WriteTo(c)
+	return err
+}
 
-	return nil
+type inflightRequest struct {
+	data     []byte
+	response chan *encoder.Send
+	// closeConnection is set before response is sent when the connection
+	// is to be closed rather than answered.
+	closeConnection bool
 }
 
-func handleConnection(c net.Conn) {
+// handleConnection reads requests off the socket and hands them to the shared
+// pool, so several requests from one client can be processed at once.
+// Responses are written back by writeResponses in the order the requests
+// arrived. Once maxInflight requests await their response, reading stops.
+func handleConnection(c net.Conn, pool *requestPool, handler api.RequestHandler, maxInflight int) {
 	defer c.Close()
 
+	// writeResponses holds the oldest request while it awaits its response,
+	// so the queue takes one fewer.
+	pending := make(chan *inflightRequest, maxInflight-1)
+	done := make(chan struct{})
+	closed := make(chan struct{})
+	go writeResponses(c, pending, done)
+
 	for {
 		data, err := Receive(c)
 		if err != nil {
-			fmt.Printf("Error receiving data: %s\n", err.Error())
-			os.Exit(1)
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Error receiving data: %s\n", err.Error())
+			}
+			break
 		}
 
-		reqHeader := &request.RequestHeader{}
-		parser := decoder.NewBytesParser(data)
-		reqHeader.Deserialize(parser)
-
-		respHeader := &request.ResponseHeader{
-			CorrelationId: reqHeader.CorrelationId,
+		req := &inflightRequest{data: data, response: make(chan *encoder.Send, 1)}
+		ctx := &api.RequestContext{
+			Principal:  api.AnonymousPrincipal,
+			ClientAddr: c.RemoteAddr(),
+			LocalAddr:  c.LocalAddr(),
+			ReceivedAt: time.Now(),
+			Closed:     closed,
+			Blocking:   pool.Blocking,
 		}
+		pending <- req
+		pool.Submit(func() {
+			serve(ctx, handler, req)
+		})
+	}
+	close(closed)
+	close(pending)
+	<-done
+}
 
-		respHeaderData, _ := respHeader.Serialize()
-		var respBodyData []byte
+func writeResponses(c net.Conn, pending <-chan *inflightRequest, done chan<- struct{}) {
+	defer close(done)
 
-		switch reqHeader.ApiKey {
-		case utils.ApiVersions:
-			respBody, err := api.HandleApiVersionsRequest(reqHeader)
-			if err != nil {
-				fmt.Printf("Error handling ApiVersions request: %s\n", err.Error())
+	failed := false
+	for req := range pending {
+		resp := <-req.response
+		if req.closeConnection && !failed {
+			failed = true
+			c.Close()
+		}
+		if failed || resp == nil {
+			if resp != nil {
+				resp.Close()
 			}
-			respBodyData, _ = respBody.Serialize()
+			continue
+		}
+		if err := Send(c, resp); err != nil {
+			fmt.Printf("Error sending response: %s\n", err.Error())
+			failed = true
+			c.Close()
+		}
+		resp.Close()
+	}
+}
 
-		case utils.DescribeTopicPartitions:
-			respBody, err := api.HandleDescribeTopicPartitionsRequest(reqHeader, parser)
-			if err != nil {
-				fmt.Printf("Error handling DescribeTopicPartitions request: %s\n", err.Error())
-				os.Exit(1)
-			}
-			respBodyData, _ = respBody.Serialize()
-		
-		case utils.Fetch:
-			respBody, err := api.HandleFetchRequest(reqHeader, parser)
-			if err != nil {
-				fmt.Printf("Error handling Fetch request: %s\n", err.Error())
-				os.Exit(1)
-			}
-			respBodyData, _ = respBody.Serialize()
+// serve handles req on a pool worker. A handler that panics is logged and
+// closes its own connection, leaving the worker and the broker running.
+func serve(ctx *api.RequestContext, handler api.RequestHandler, req *inflightRequest) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic handling request from %s: %v\n%s", ctx.ClientAddr, r, debug.Stack())
+			req.closeConnection = true
+			req.response <- nil
+		}
+	}()
+	resp, closeConnection := handleRequest(ctx, handler, req.data)
+	req.closeConnection = closeConnection
+	req.response <- resp
+}
+
+// handleRequest returns the response to a request, nil if it gets none, and
+// whether the connection is to be closed instead.
+func handleRequest(ctx *api.RequestContext, handler api.RequestHandler, data []byte) (*encoder.Send, bool) {
+	reqHeader := &request.RequestHeader{}
+	parser := decoder.NewBytesParser(data)
+	reqHeader.Deserialize(parser)
+	requestFlexible, responseFlexible := api.HeaderFlexibility(reqHeader)
+	if requestFlexible {
+		reqHeader.DeserializeTaggedFields(parser)
+	}
+
+	respHeader := &request.ResponseHeader{
+		CorrelationId: reqHeader.CorrelationId,
+		Flexible:      responseFlexible,
+	}
+
+	respHeaderData, _ := respHeader.Serialize()
+	ctx.Header = reqHeader
+	resp, err := handler(ctx, parser)
+	closeConnection := errors.Is(err, api.ErrUnknownApiKey)
+	if closeConnection || ctx.NoResponse {
+		if resp != nil {
+			resp.Close()
+		}
+		return nil, closeConnection
+	}
+	if resp == nil {
+		resp = encoder.NewSend(nil)
+	}
+	resp.Prepend(respHeaderData)
+	return resp, false
+}
+
+// connections tracks the open client connections, so that shutdown can stop
+// reading requests from them and wait for the responses in flight.
+type connections struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	done    sync.WaitGroup
+}
+
+func newConnections() *connections {
+	return &connections{conns: map[net.Conn]struct{}{}}
+}
+
+// serve runs handleConnection for c, unless the connections are draining.
+func (cs *connections) serve(c net.Conn, pool *requestPool, handler api.RequestHandler, maxInflight int) {
+	cs.mu.Lock()
+	if cs.closing {
+		cs.mu.Unlock()
+		c.Close()
+		return
+	}
+	cs.conns[c] = struct{}{}
+	cs.done.Add(1)
+	cs.mu.Unlock()
+
+	go func() {
+		defer cs.done.Done()
+		handleConnection(c, pool, handler, maxInflight)
+		cs.mu.Lock()
+		delete(cs.conns, c)
+		cs.mu.Unlock()
+	}()
+}
+
+// drain stops reading requests from every connection and waits until the
+// requests already read have been answered and the connections closed.
+// Parked requests, such as fetches waiting for data, see their connection
+// closed and return early.
+func (cs *connections) drain() {
+	cs.mu.Lock()
+	cs.closing = true
+	for c := range cs.conns {
+		if tcp, ok := c.(interface{ CloseRead() error }); ok {
+			tcp.CloseRead()
+		} else {
+			c.Close()
 		}
-		Send(c, append(respHeaderData, respBodyData...))
+	}
+	cs.mu.Unlock()
+	cs.done.Wait()
+}
+
+// shutdownOnSignal closes the listener on SIGINT or SIGTERM, which ends the
+// accept loop in main.
+func shutdownOnSignal(l net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	l.Close()
+}
+
+// shutdown answers the requests already read and drains the pool before
+// flushing the logs and writing the checkpoints and the clean shutdown
+// marker, so that no handler still appends to a closed log.
+func shutdown(conns *connections, pool *requestPool, logs storage.Storage) error {
+	conns.drain()
+	pool.Close()
+	return logs.Close()
+}
+
+// logMetrics writes every metric to stdout at each interval.
+func logMetrics(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := metrics.Write(os.Stdout); err != nil {
+			fmt.Printf("Error writing metrics: %s\n", err.Error())
+		}
+	}
+}
+
+// logDirs returns the comma separated log.dirs, which takes precedence over
+// log.dir.
+func logDirs(cfg *config.Config) []string {
+	dirs := []string{}
+	for _, dir := range strings.Split(cfg.String("log.dirs", cfg.String("log.dir", storage.DefaultLogDir)), ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return []string{storage.DefaultLogDir}
+	}
+	return dirs
+}
+
+// loadKeyring loads the keys of log.encryption.keyfile, with
+// log.encryption.key.id as the current one. It returns nil if no keyfile is
+// set.
+func loadKeyring(cfg *config.Config) (*storage.Keyring, error) {
+	path := cfg.String("log.encryption.keyfile", "")
+	if path == "" {
+		return nil, nil
+	}
+	return storage.LoadKeyring(path, cfg.String("log.encryption.key.id", ""))
+}
+
+// openStorage opens the backend named by log.storage.backend: "file" keeps
+// the logs in log.dirs, and "memory" in memory, starting from the cluster
+// metadata log in metadata.log.dir if there is one. With
+// remote.log.storage.system.enable the file backend tiers the topics that ask
+// for it to remote.log.storage.dir, and with log.encryption.keyfile it
+// encrypts the segments it writes.
+func openStorage(cfg *config.Config) (storage.Storage, error) {
+	switch backend := cfg.String("log.storage.backend", "file"); backend {
+	case "file":
+		keyring, err := loadKeyring(cfg)
+		if err != nil {
+			return nil, err
+		}
+		logs := storage.NewLogManager(logDirs(cfg), cfg)
+		logs.SetKeyring(keyring)
+		if cfg.Bool("remote.log.storage.system.enable", false) {
+			// The remote tier and its metadata share a directory.
+			dir := cfg.String("remote.log.storage.dir", storage.DefaultRemoteLogDir)
+			logs.SetRemoteLogManager(storage.NewRemoteLogManager(storage.NewLocalTieredStorage(dir), storage.NewFileRemoteLogMetadataManager(dir)))
+			logs.StartRemoteLogManager(time.Duration(cfg.Int64("remote.log.manager.task.interval.ms", 30000)) * time.Millisecond)
+		}
+		if err := logs.LoadLogs(); err != nil {
+			fmt.Printf("Error loading logs: %s\n", err.Error())
+		}
+		logs.StartCheckpointing(time.Duration(cfg.Int64("log.flush.offset.checkpoint.interval.ms", 60000)) * time.Millisecond)
+		// Unless log.flush.scheduler.interval.ms is set, flush.ms is only
+		// checked on appends.
+		if interval := cfg.Int64("log.flush.scheduler.interval.ms", 0); interval > 0 {
+			logs.StartFlusher(time.Duration(interval) * time.Millisecond)
+		}
+		if cfg.Bool("log.cleaner.enable", true) {
+			logs.StartCleaner(time.Duration(cfg.Int64("log.cleaner.backoff.ms", 15000))*time.Millisecond, cfg.Float64("log.cleaner.io.max.bytes.per.second", math.MaxFloat64))
+		}
+		return logs, nil
+	case "memory":
+		logs := storage.NewMemoryStorage(cfg)
+		metadata := storage.TopicPartition{Topic: api.ClusterMetadataTopic, Partition: 0}
+		dir := filepath.Join(cfg.String("metadata.log.dir", logDirs(cfg)[0]), metadata.String())
+		if err := logs.LoadLog(metadata, dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return logs, nil
+	default:
+		return nil, fmt.Errorf("unknown log.storage.backend %q", backend)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt-logs" {
+		if err := reencryptLogs(os.Args[2:]); err != nil {
+			fmt.Printf("Error re-encrypting logs: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg := config.New(nil)
+	if len(os.Args) > 1 {
+		loaded, err := config.Load(os.Args[1])
+		if err != nil {
+			fmt.Printf("Error loading config: %s\n", err.Error())
+			os.Exit(1)
+		}
+		cfg = loaded
+	}
+
+	logs, err := openStorage(cfg)
+	if err != nil {
+		fmt.Printf("Error opening storage: %s\n", err.Error())
+		os.Exit(1)
+	}
+	api.SetStorage(logs)
+	api.ConfigureFetchSessions(cfg)
+	logs.StartRetention(time.Duration(cfg.Int64("log.retention.check.interval.ms", 300000)) * time.Millisecond)
+	if interval := cfg.Int64("metrics.log.interval.ms", 0); interval > 0 {
+		go logMetrics(time.Duration(interval) * time.Millisecond)
+	}
+
+	pool := newRequestPool(cfg.Int("num.io.threads", 8), cfg.Int("queued.max.requests", 500))
+	// The requests of one connection in the pool at once, so a single client
+	// cannot take up all of queued.max.requests.
+	maxInflight := max(cfg.Int("queued.max.requests.per.connection", 100), 1)
+	handler := api.Chain(api.LogErrors)
+
 	l, err := net.Listen("tcp", "0.0.0.0:9092")
 	if err != nil {
 		fmt.Println("Failed to bind to port 9092")
 		os.Exit(1)
 	}
+	go shutdownOnSignal(l)
 
+	conns := newConnections()
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			fmt.Println("Error accepting connection: ", err.Error())
 			os.Exit(1)
 		}
 
-		go handleConnection(conn)
+		conns.serve(conn, pool, handler, maxInflight)
+	}
+
+	if err := shutdown(conns, pool, logs); err != nil {
+		fmt.Printf("Error closing logs: %s\n", err.Error())
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/decoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/encoder"
+	"github.com/codecrafters-io/kafka-starter-go/app/request/api"
+	"github.com/codecrafters-io/kafka-starter-go/app/storage"
+	"github.com/codecrafters-io/kafka-starter-go/app/utils"
+)
+
+// sendRequest writes a size delimited request with a v2 header.
+func sendRequest(t *testing.T, c net.Conn, apiKey utils.APIKeys, correlationId int32) {
+	t.Helper()
+	data := binary.BigEndian.AppendUint32(nil, 11)
+	data = binary.BigEndian.AppendUint16(data, uint16(apiKey))
+	data = binary.BigEndian.AppendUint16(data, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(correlationId))
+	data = binary.BigEndian.AppendUint16(data, 0xffff) // Client Id
+	data = append(data, 0)                             // Tag Buffer
+	if _, err := c.Write(data); err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+}
+
+func TestPanickingHandlerClosesOnlyItsConnection(t *testing.T) {
+	pool := newRequestPool(1, 10)
+	handler := api.RequestHandler(func(ctx *api.RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+		if ctx.Header.CorrelationId == 1 {
+			panic("handler bug")
+		}
+		return encoder.NewSend([]byte{0, 0}), nil
+	})
+
+	panicking, server := net.Pipe()
+	defer panicking.Close()
+	go handleConnection(server, pool, handler, 10)
+	sendRequest(t, panicking, utils.ApiVersions, 1)
+	panicking.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := panicking.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read on the connection of the panicking request returned %v, want EOF", err)
+	}
+
+	healthy, server := net.Pipe()
+	defer healthy.Close()
+	go handleConnection(server, pool, handler, 10)
+	sendRequest(t, healthy, utils.ApiVersions, 2)
+	healthy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := Receive(healthy)
+	if err != nil {
+		t.Fatalf("no response after another request panicked: %v", err)
+	}
+	if correlationId := int32(binary.BigEndian.Uint32(resp)); correlationId != 2 {
+		t.Errorf("got correlation id %d, want 2", correlationId)
+	}
+}
+
+func TestConnectionStopsReadingAtMaxInflight(t *testing.T) {
+	pool := newRequestPool(4, 10)
+	defer pool.Close()
+	var started atomic.Int32
+	release := make(chan struct{})
+	handler := api.RequestHandler(func(ctx *api.RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+		started.Add(1)
+		<-release
+		return encoder.NewSend([]byte{0, 0}), nil
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, pool, handler, 2)
+	// The third request is read off the socket, but held back from the pool
+	// until the first is answered.
+	for correlationId := range int32(3) {
+		sendRequest(t, client, utils.ApiVersions, correlationId)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := started.Load(); n != 2 {
+		t.Errorf("got %d requests handled at once, want 2", n)
+	}
+
+	close(release)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for want := range int32(3) {
+		resp, err := Receive(client)
+		if err != nil {
+			t.Fatalf("receiving response %d: %v", want, err)
+		}
+		if correlationId := int32(binary.BigEndian.Uint32(resp)); correlationId != want {
+			t.Errorf("got correlation id %d, want %d", correlationId, want)
+		}
+	}
+}
+
+// closeRecordingStorage notes when it is closed.
+type closeRecordingStorage struct {
+	storage.Storage
+	closed atomic.Bool
+}
+
+func (s *closeRecordingStorage) Close() error {
+	s.closed.Store(true)
+	return s.Storage.Close()
+}
+
+func TestShutdownAnswersInflightRequestsBeforeClosingLogs(t *testing.T) {
+	logs := &closeRecordingStorage{Storage: storage.NewMemoryStorage(config.New(nil))}
+	pool := newRequestPool(1, 10)
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := api.RequestHandler(func(ctx *api.RequestContext, p *decoder.BytesParser) (*encoder.Send, error) {
+		close(started)
+		<-release
+		if logs.closed.Load() {
+			t.Errorf("logs closed before the request in flight was answered")
+		}
+		return encoder.NewSend([]byte{0, 0}), nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conns := newConnections()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conns.serve(conn, pool, handler, 10)
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sendRequest(t, client, utils.ApiVersions, 1)
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- shutdown(conns, pool, logs) }()
+	select {
+	case <-shutdownErr:
+		t.Fatalf("shutdown returned while a request was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := Receive(client); err != nil {
+		t.Fatalf("no response to the request in flight at shutdown: %v", err)
+	}
+	if _, err := Receive(client); err != io.EOF {
+		t.Errorf("read after the last response returned %v, want EOF", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package storage
+
+import "github.com/codecrafters-io/kafka-starter-go/app/record"
+
+// Batch is an encoded record batch as stored in a segment, with the header
+// fields the log needs to find it.
+type Batch struct {
+	BaseOffset   int64
+	LastOffset   int64
+	MaxTimestamp int64
+	Data         []byte
+}
+
+func (b *Batch) Size() int {
+	return len(b.Data)
+}
+
+func parseBatchHeader(data []byte) Batch {
+	header := record.DecodeHeader(data)
+	return Batch{
+		BaseOffset:   header.BaseOffset,
+		LastOffset:   header.LastOffset(),
+		MaxTimestamp: header.MaxTimestamp,
+		Data:         data,
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RecoveryPointCheckpointFile  = "recovery-point-offset-checkpoint"
+	LogStartOffsetCheckpointFile = "log-start-offset-checkpoint"
+	HighWatermarkCheckpointFile  = "replication-offset-checkpoint"
+
+	checkpointVersion = 0
+)
+
+// OffsetCheckpoint is a per log directory file mapping partitions to an
+// offset, in Kafka's text format: a version line, an entry count line and
+// one "topic partition offset" line per entry.
+type OffsetCheckpoint struct {
+	Path string
+}
+
+func NewOffsetCheckpoint(dir string, name string) *OffsetCheckpoint {
+	return &OffsetCheckpoint{Path: filepath.Join(dir, name)}
+}
+
+// Read returns the checkpointed offsets, or an empty map if the file does not
+// exist yet.
+func (c *OffsetCheckpoint) Read() (map[TopicPartition]int64, error) {
+	offsets := map[TopicPartition]int64{}
+	f, err := os.Open(c.Path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open checkpoint %s: %w", c.Path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read checkpoint %s: %w", c.Path, err)
+	}
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("malformed checkpoint %s: missing header", c.Path)
+	}
+	if version, err := strconv.Atoi(lines[0]); err != nil || version != checkpointVersion {
+		return nil, fmt.Errorf("malformed checkpoint %s: unsupported version %q", c.Path, lines[0])
+	}
+	count, err := strconv.Atoi(lines[1])
+	if err != nil || count != len(lines)-2 {
+		return nil, fmt.Errorf("malformed checkpoint %s: expected %s entries, found %d", c.Path, lines[1], len(lines)-2)
+	}
+
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed checkpoint %s: bad entry %q", c.Path, line)
+		}
+		partition, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checkpoint %s: bad entry %q", c.Path, line)
+		}
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checkpoint %s: bad entry %q", c.Path, line)
+		}
+		offsets[TopicPartition{Topic: fields[0], Partition: int32(partition)}] = offset
+	}
+	return offsets, nil
+}
+
+// Write replaces the checkpoint atomically: the new content is synced to a
+// temporary file which is then renamed over the old one.
+func (c *OffsetCheckpoint) Write(offsets map[TopicPartition]int64) error {
+	partitions := make([]TopicPartition, 0, len(offsets))
+	for tp := range offsets {
+		partitions = append(partitions, tp)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Topic != partitions[j].Topic {
+			return partitions[i].Topic < partitions[j].Topic
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n%d\n", checkpointVersion, len(partitions))
+	for _, tp := range partitions {
+		fmt.Fprintf(&b, "%s %d %d\n", tp.Topic, tp.Partition, offsets[tp])
+	}
+	return writeFileAtomically(c.Path, []byte(b.String()))
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write %s: %w", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync %s: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to rename %s: %w", tmp, err)
+	}
+	return nil
+}
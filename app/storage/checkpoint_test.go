@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOffsetCheckpointRoundTrip(t *testing.T) {
+	c := NewOffsetCheckpoint(t.TempDir(), RecoveryPointCheckpointFile)
+	offsets := map[TopicPartition]int64{
+		{Topic: "orders", Partition: 1}:     7,
+		{Topic: "orders", Partition: 0}:     12,
+		{Topic: "with-dash", Partition: 10}: 0,
+	}
+	if err := c.Write(offsets); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0\n3\norders 0 12\norders 1 7\nwith-dash 10 0\n"; string(data) != want {
+		t.Errorf("wrote %q, want %q", data, want)
+	}
+	read, err := c.Read()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !maps.Equal(read, offsets) {
+		t.Errorf("read %v, want %v", read, offsets)
+	}
+	if _, err := os.Stat(c.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left behind: %v", err)
+	}
+}
+
+func TestOffsetCheckpointMissingIsEmpty(t *testing.T) {
+	offsets, err := NewOffsetCheckpoint(t.TempDir(), HighWatermarkCheckpointFile).Read()
+	if err != nil || len(offsets) != 0 {
+		t.Errorf("Read of a missing checkpoint returned %v and %v, want no offsets", offsets, err)
+	}
+}
+
+func TestOffsetCheckpointRejectsMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":             "",
+		"no count":          "0\n",
+		"unknown version":   "1\n0\n",
+		"count too high":    "0\n2\norders 0 1\n",
+		"count too low":     "0\n0\norders 0 1\n",
+		"missing offset":    "0\n1\norders 0\n",
+		"bad partition":     "0\n1\norders x 1\n",
+		"partition too big": "0\n1\norders 4294967296 1\n",
+		"bad offset":        "0\n1\norders 0 x\n",
+	}
+	dir := t.TempDir()
+	for name, content := range tests {
+		path := filepath.Join(dir, LogStartOffsetCheckpointFile)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewOffsetCheckpoint(dir, LogStartOffsetCheckpointFile).Read(); err == nil {
+			t.Errorf("%s: Read accepted %q", name, content)
+		}
+	}
+}
+
+func TestLogManagerCheckpointsOffsets(t *testing.T) {
+	dir := t.TempDir()
+	m, log := openTestLog(t, dir, nil)
+	batch := testBatch(2, time.Now().UnixMilli())
+	appendBatches(t, log, batch, batch, batch)
+	if _, err := m.DeleteRecords(log.Partition, 3); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := map[string]int64{
+		RecoveryPointCheckpointFile:  6,
+		LogStartOffsetCheckpointFile: 3,
+		HighWatermarkCheckpointFile:  6,
+	}
+	for name, offset := range want {
+		offsets, err := NewOffsetCheckpoint(dir, name).Read()
+		if err != nil {
+			t.Fatalf("%s: Read: %v", name, err)
+		}
+		if got := offsets[log.Partition]; got != offset || len(offsets) != 1 {
+			t.Errorf("%s: got %v, want %s at %d", name, offsets, log.Partition, offset)
+		}
+	}
+
+	m, log = openTestLog(t, dir, nil)
+	defer m.Close()
+	got := log.CheckpointedOffsets()
+	if got != (CheckpointedOffsets{LogStartOffset: 3, RecoveryPoint: 6, HighWatermark: 6}) {
+		t.Errorf("reopened log has offsets %+v, want them as checkpointed", got)
+	}
+}
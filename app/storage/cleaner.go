@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+const (
+	CleanerOffsetCheckpointFile = "cleaner-offset-checkpoint"
+
+	// cleanedDirName is the directory inside a partition directory where the
+	// cleaner writes a segment's compacted copy before swapping it in.
+	cleanedDirName = "cleaned"
+)
+
+var (
+	errCleanerStopped = errors.New("log cleaner stopped")
+	// errSegmentDeleted is returned when retention or DeleteRecords deleted
+	// a segment while the cleaner was reading it. It is no I/O error: the
+	// log is cleaned again on the next pass.
+	errSegmentDeleted = errors.New("segment deleted while cleaning")
+	// errStopScan stops dropsRecords at the first dropped record.
+	errStopScan = errors.New("stop scan")
+)
+
+// LogCleaner compacts the non-active segments of logs whose cleanup.policy
+// includes compact, keeping only the newest record of every key. The offset
+// up to which each partition has been cleaned, its first dirty offset, is
+// kept in the cleaner-offset-checkpoint file of its log directory so a
+// restart resumes where the previous run stopped.
+type LogCleaner struct {
+	manager    *LogManager
+	throttler  *throttler
+	firstDirty map[TopicPartition]int64
+}
+
+func newLogCleaner(m *LogManager, ioMaxBytesPerSecond float64) *LogCleaner {
+	c := &LogCleaner{
+		manager:    m,
+		throttler:  &throttler{bytesPerSecond: ioMaxBytesPerSecond, stop: m.stop},
+		firstDirty: map[TopicPartition]int64{},
+	}
+	for _, d := range m.Dirs {
+		offsets, err := NewOffsetCheckpoint(d.Path, CleanerOffsetCheckpointFile).Read()
+		if err != nil {
+			fmt.Printf("Error loading cleaner checkpoint, ignoring it: %s\n", err.Error())
+			continue
+		}
+		for tp, offset := range offsets {
+			c.firstDirty[tp] = offset
+		}
+	}
+	return c
+}
+
+// StartCleaner compacts the logs every backoff until Close, reading and
+// writing at most ioMaxBytesPerSecond.
+func (m *LogManager) StartCleaner(backoff time.Duration, ioMaxBytesPerSecond float64) {
+	cleaner := newLogCleaner(m, ioMaxBytesPerSecond)
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(backoff)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				cleaner.cleanLogs()
+			}
+		}
+	}()
+}
+
+func (c *LogCleaner) cleanLogs() {
+	c.throttler.reset()
+	for _, log := range c.manager.openLogs() {
+		// A log being moved is cleaned once it has settled in its new
+		// directory.
+		if !log.Config().Compacts() || !log.maintenance.TryLock() {
+			continue
+		}
+		firstDirty, err := c.clean(log, time.Now())
+		log.maintenance.Unlock()
+		if errors.Is(err, errCleanerStopped) {
+			break
+		}
+		if errors.Is(err, errSegmentDeleted) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error cleaning %s: %s\n", log.Partition, err.Error())
+			if d := c.manager.dirOf(log.Partition); d != nil {
+				d.checkIO(err)
+			}
+			continue
+		}
+		c.firstDirty[log.Partition] = firstDirty
+	}
+
+	byDir := map[*LogDir]map[TopicPartition]int64{}
+	for tp, offset := range c.firstDirty {
+		d := c.manager.dirOf(tp)
+		if d == nil {
+			continue
+		}
+		if byDir[d] == nil {
+			byDir[d] = map[TopicPartition]int64{}
+		}
+		byDir[d][tp] = offset
+	}
+	for _, d := range c.manager.Dirs {
+		if d.Offline() || !d.exists() {
+			continue
+		}
+		if err := NewOffsetCheckpoint(d.Path, CleanerOffsetCheckpointFile).Write(byDir[d]); err != nil {
+			fmt.Printf("Error writing cleaner checkpoint: %s\n", err.Error())
+			d.checkIO(err)
+		}
+	}
+}
+
+// clean compacts the non-active segments of the log once the dirty part,
+// written since the last cleaning, makes up min.cleanable.dirty.ratio of
+// them. Only segments that lose records are rewritten. It returns the new
+// first dirty offset.
+func (c *LogCleaner) clean(log *Log, now time.Time) (int64, error) {
+	config := log.Config()
+	segments := log.Segments()
+	activeBaseOffset := segments[len(segments)-1].BaseOffset
+	segments = segments[:len(segments)-1]
+
+	firstDirty, ok := c.firstDirty[log.Partition]
+	if !ok || firstDirty > activeBaseOffset {
+		firstDirty = 0
+	}
+	firstDirty = max(firstDirty, log.LogStartOffset())
+
+	cleanBytes, dirtyBytes := int64(0), int64(0)
+	dirty := []*Segment{}
+	for _, segment := range segments {
+		if segment.NextOffset() > firstDirty {
+			dirtyBytes += segment.Size()
+			dirty = append(dirty, segment)
+		} else {
+			cleanBytes += segment.Size()
+		}
+	}
+	if dirtyBytes == 0 || float64(dirtyBytes)/float64(cleanBytes+dirtyBytes) < config.MinCleanableDirtyRatio {
+		return firstDirty, nil
+	}
+
+	offsetMap, err := c.buildOffsetMap(dirty)
+	if err != nil {
+		return firstDirty, err
+	}
+
+	log.mu.RLock()
+	cleanedDir := filepath.Join(log.Dir, cleanedDirName)
+	log.mu.RUnlock()
+	if err := os.RemoveAll(cleanedDir); err != nil {
+		return firstDirty, fmt.Errorf("unable to remove %s: %w", cleanedDir, err)
+	}
+	if err := os.MkdirAll(cleanedDir, 0755); err != nil {
+		return firstDirty, fmt.Errorf("unable to create %s: %w", cleanedDir, err)
+	}
+	defer os.RemoveAll(cleanedDir)
+
+	deleteHorizon := now.Add(-time.Duration(config.DeleteRetentionMs) * time.Millisecond)
+	sizeBefore, sizeAfter := int64(0), int64(0)
+	for _, segment := range segments {
+		// The time a segment was first cleaned is kept as the modification
+		// time of its log file. A tombstone is only dropped from a segment
+		// cleaned delete.retention.ms ago, so consumers get a chance to see
+		// it.
+		cleanedAt := now
+		if segment.NextOffset() <= firstDirty {
+			info, err := os.Stat(segment.file.Name())
+			if err != nil {
+				return firstDirty, skipDeleted(segment, err)
+			}
+			cleanedAt = info.ModTime()
+		}
+		dropTombstones := segment.NextOffset() <= firstDirty && cleanedAt.Before(deleteHorizon)
+		keep := func(offset int64, r *record.Record) bool {
+			if r.IsTombstone() && dropTombstones {
+				return false
+			}
+			if r.Key == nil {
+				return true
+			}
+			latest, ok := offsetMap[string(r.Key)]
+			return !ok || offset >= latest
+		}
+
+		sizeBefore += segment.Size()
+		drops, err := c.dropsRecords(segment, keep)
+		if err != nil {
+			return firstDirty, skipDeleted(segment, err)
+		}
+		if !drops {
+			sizeAfter += segment.Size()
+			if segment.NextOffset() > firstDirty {
+				if err := os.Chtimes(segment.file.Name(), time.Time{}, cleanedAt); err != nil {
+					return firstDirty, skipDeleted(segment, err)
+				}
+			}
+			continue
+		}
+		cleaned, err := c.cleanSegment(log, segment, cleanedDir, config, keep, cleanedAt)
+		if err != nil {
+			return firstDirty, skipDeleted(segment, err)
+		}
+		sizeAfter += cleaned
+	}
+	fmt.Printf("Cleaned %s up to offset %d, %d bytes down to %d\n", log.Partition, activeBaseOffset, sizeBefore, sizeAfter)
+	return activeBaseOffset, nil
+}
+
+// buildOffsetMap maps every key in the dirty segments to its newest offset.
+func (c *LogCleaner) buildOffsetMap(segments []*Segment) (map[string]int64, error) {
+	offsetMap := map[string]int64{}
+	for _, segment := range segments {
+		err := segment.forEachBatch(func(batch Batch) error {
+			if err := c.throttler.throttle(batch.Size()); err != nil {
+				return err
+			}
+			decoded, err := decodeCompactable(batch)
+			if decoded == nil {
+				return err
+			}
+			for i := range decoded.Records {
+				if key := decoded.Records[i].Key; key != nil {
+					offsetMap[string(key)] = decoded.Offset(&decoded.Records[i])
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, skipDeleted(segment, err)
+		}
+	}
+	return offsetMap, nil
+}
+
+// dropsRecords reports whether keep turns down any record of segment, which
+// is left as it is otherwise.
+func (c *LogCleaner) dropsRecords(segment *Segment, keep func(offset int64, r *record.Record) bool) (bool, error) {
+	drops := false
+	err := segment.forEachBatch(func(batch Batch) error {
+		if err := c.throttler.throttle(batch.Size()); err != nil {
+			return err
+		}
+		decoded, err := decodeCompactable(batch)
+		if decoded == nil {
+			return err
+		}
+		for i := range decoded.Records {
+			if !keep(decoded.Offset(&decoded.Records[i]), &decoded.Records[i]) {
+				drops = true
+				return errStopScan
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopScan) {
+		err = nil
+	}
+	return drops, err
+}
+
+// skipDeleted turns the error of reading a segment that was deleted meanwhile
+// into errSegmentDeleted.
+func skipDeleted(segment *Segment, err error) error {
+	if err != nil && segment.deleted.Load() && !errors.Is(err, errCleanerStopped) {
+		return fmt.Errorf("%w: %w", errSegmentDeleted, err)
+	}
+	return err
+}
+
+// cleanSegment writes the records of segment that keep accepts to a segment
+// with the same base offset in dir and swaps it into the log. Batches that
+// lose every record are dropped and the others are re-encoded, and
+// recompressed, only if they lost some. Control batches are copied unchanged.
+// The copy's log file gets cleanedAt as its modification time. It returns the
+// size of the cleaned segment.
+func (c *LogCleaner) cleanSegment(log *Log, segment *Segment, dir string, config LogConfig, keep func(offset int64, r *record.Record) bool, cleanedAt time.Time) (int64, error) {
+	cleaned, err := openSegment(dir, segment.BaseOffset, config)
+	if err != nil {
+		return 0, err
+	}
+	err = segment.forEachBatch(func(batch Batch) error {
+		if err := c.throttler.throttle(batch.Size()); err != nil {
+			return err
+		}
+		decoded, err := decodeCompactable(batch)
+		if err != nil {
+			return err
+		}
+		if decoded != nil {
+			retained := slices.DeleteFunc(slices.Clone(decoded.Records), func(r record.Record) bool {
+				return !keep(decoded.Offset(&r), &r)
+			})
+			if len(retained) == 0 {
+				return nil
+			}
+			if len(retained) < len(decoded.Records) {
+				// The header, last offset delta included, is kept so that
+				// offsets and the batch's place in the log do not change.
+				decoded.Records = retained
+				batch = parseBatchHeader(decoded.Encode())
+			}
+		}
+		if err := c.throttler.throttle(batch.Size()); err != nil {
+			return err
+		}
+		return cleaned.append(batch)
+	})
+	if err == nil {
+		err = cleaned.flush()
+	}
+	if closeErr := cleaned.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(cleaned.file.Name(), time.Time{}, cleanedAt)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cleaned.Size(), log.replaceSegment(segment, dir)
+}
+
+// decodeCompactable decodes a batch whose records the cleaner may drop. It
+// returns nil for control batches, which are kept whole.
+func decodeCompactable(batch Batch) (*record.RecordBatch, error) {
+	if header := record.DecodeHeader(batch.Data); header.IsControl() {
+		return nil, nil
+	}
+	return record.Decode(batch.Data)
+}
+
+// replaceSegment swaps a segment for the copy with the same base offset in
+// dir. The old indexes are removed before the copy is moved in, so a crash
+// half way leaves indexes that are rebuilt on load rather than ones pointing
+// into the wrong file.
+func (l *Log) replaceSegment(old *Segment, dir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := slices.Index(l.segments, old)
+	if i < 0 {
+		// Retention deleted the segment while it was being cleaned.
+		return nil
+	}
+	old.Close()
+	for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix} {
+		path := segmentFileName(l.Dir, old.BaseOffset, suffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to delete %s: %w", path, err)
+		}
+	}
+	for _, suffix := range []string{LogFileSuffix, IndexFileSuffix, TimeIndexFileSuffix} {
+		from, to := segmentFileName(dir, old.BaseOffset, suffix), segmentFileName(l.Dir, old.BaseOffset, suffix)
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("unable to rename %s: %w", from, err)
+		}
+	}
+	segment, err := openSegment(l.Dir, old.BaseOffset, l.config)
+	if err != nil {
+		return err
+	}
+	l.segments[i] = segment
+	return nil
+}
+
+// throttler keeps the cleaner's I/O under a number of bytes per second by
+// sleeping whenever it gets ahead of that rate.
+type throttler struct {
+	bytesPerSecond float64
+	stop           <-chan struct{}
+	start          time.Time
+	bytes          float64
+}
+
+func (t *throttler) reset() {
+	t.start, t.bytes = time.Now(), 0
+}
+
+func (t *throttler) throttle(n int) error {
+	if t.bytesPerSecond <= 0 || t.bytesPerSecond >= math.MaxFloat64 {
+		return nil
+	}
+	t.bytes += float64(n)
+	ahead := time.Duration(t.bytes/t.bytesPerSecond*float64(time.Second)) - time.Since(t.start)
+	if ahead <= 0 {
+		return nil
+	}
+	select {
+	case <-t.stop:
+		return errCleanerStopped
+	case <-time.After(ahead):
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// keyedBatch encodes a batch of a single record written an hour ago, a
+// tombstone if value is nil.
+func keyedBatch(key string, value []byte) []byte {
+	timestamp := time.Now().Add(-time.Hour).UnixMilli()
+	batch := &record.RecordBatch{
+		BaseTimestamp: timestamp,
+		MaxTimestamp:  timestamp,
+		ProducerId:    -1,
+		ProducerEpoch: -1,
+		BaseSequence:  -1,
+		Records:       []record.Record{{Key: []byte(key), Value: value}},
+	}
+	return batch.Encode()
+}
+
+// newTestCompactedLog opens a compacted log that rolls a segment for every
+// batch and is cleaned whenever it has dirty segments.
+func newTestCompactedLog(t *testing.T) (*LogCleaner, *Log) {
+	t.Helper()
+	m := NewLogManager([]string{t.TempDir()}, config.New(map[string]string{
+		"log.cleanup.policy":              "compact",
+		"log.segment.bytes":               "14",
+		"log.cleaner.min.cleanable.ratio": "0",
+		"log.cleaner.delete.retention.ms": "60000",
+	}))
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	return newLogCleaner(m, 0), log
+}
+
+func appendKeyed(t *testing.T, log *Log, key string, value []byte) {
+	t.Helper()
+	if _, err := log.Append(keyedBatch(key, value)); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+}
+
+// cleanLog runs a cleaning pass at now the way cleanLogs does.
+func cleanLog(t *testing.T, c *LogCleaner, log *Log, now time.Time) {
+	t.Helper()
+	firstDirty, err := c.clean(log, now)
+	if err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+	c.firstDirty[log.Partition] = firstDirty
+}
+
+// keys lists the key of every record left in the log, "-" for a tombstone.
+func keys(t *testing.T, log *Log) []string {
+	t.Helper()
+	var keys []string
+	for _, segment := range log.Segments() {
+		err := segment.forEachBatch(func(batch Batch) error {
+			decoded, err := record.Decode(batch.Data)
+			if err != nil {
+				return err
+			}
+			for _, r := range decoded.Records {
+				if r.IsTombstone() {
+					keys = append(keys, "-"+string(r.Key))
+				} else {
+					keys = append(keys, string(r.Key))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("reading segment %d: %v", segment.BaseOffset, err)
+		}
+	}
+	return keys
+}
+
+func TestCleanerSkipsDeletedSegment(t *testing.T) {
+	c, log := newTestCompactedLog(t)
+	for _, key := range []string{"a", "b", "a"} {
+		appendKeyed(t, log, key, []byte("value"))
+	}
+	// Retention deletes the first segment while the cleaner reads it.
+	log.Segments()[0].delete()
+
+	_, err := c.clean(log, time.Now())
+	if !errors.Is(err, errSegmentDeleted) {
+		t.Fatalf("clean returned %v, want errSegmentDeleted", err)
+	}
+	c.cleanLogs()
+	if d := c.manager.dirOf(log.Partition); d.Offline() {
+		t.Errorf("log dir taken offline by a segment deleted while cleaning")
+	}
+}
+
+func TestCleanerOnlyRewritesSegmentsThatLoseRecords(t *testing.T) {
+	c, log := newTestCompactedLog(t)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		appendKeyed(t, log, key, []byte("value"))
+	}
+	before, err := os.Stat(log.Segments()[1].file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanLog(t, c, log, time.Now())
+	if got := keys(t, log); len(got) != 3 || got[0] != "b" || got[1] != "a" {
+		t.Fatalf("got keys %v after cleaning, want [b a c]", got)
+	}
+	after, err := os.Stat(log.Segments()[1].file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("segment without superseded records was rewritten")
+	}
+}
+
+func TestCleanerKeepsTombstonesForDeleteRetentionAfterCleaning(t *testing.T) {
+	c, log := newTestCompactedLog(t)
+	appendKeyed(t, log, "a", []byte("value"))
+	appendKeyed(t, log, "a", nil)
+	appendKeyed(t, log, "b", []byte("value"))
+
+	// The first pass supersedes a and cleans the tombstone's segment. The
+	// second does not drop the tombstone, although it was written more than
+	// delete.retention.ms ago, as the segment was only just cleaned.
+	cleanLog(t, c, log, time.Now())
+	appendKeyed(t, log, "c", []byte("value"))
+	cleanLog(t, c, log, time.Now())
+	if got := keys(t, log); len(got) != 3 || got[0] != "-a" {
+		t.Fatalf("got keys %v, want the tombstone of a kept", got)
+	}
+
+	appendKeyed(t, log, "d", []byte("value"))
+	cleanLog(t, c, log, time.Now().Add(2*time.Minute))
+	if got := keys(t, log); len(got) != 3 || got[0] != "b" {
+		t.Errorf("got keys %v, want the tombstone of a dropped delete.retention.ms after cleaning", got)
+	}
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/compression"
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// LogConfig is the effective configuration of one partition log: the broker
+// defaults from server.properties overridden by the topic's own configs.
+type LogConfig struct {
+	SegmentBytes       int64
+	SegmentMs          int64
+	SegmentIndexBytes  int
+	IndexIntervalBytes int
+	RetentionMs        int64
+	RetentionBytes     int64
+	// FlushMessages and FlushMs bound how many appended records and for how
+	// long they may wait for an fsync. FlushMessages 1 syncs every append,
+	// concurrent appends sharing one fsync.
+	FlushMessages int64
+	FlushMs       int64
+	CleanupPolicy string
+	// DeleteRetentionMs is how long tombstones survive compaction.
+	DeleteRetentionMs      int64
+	MinCleanableDirtyRatio float64
+	// CompressionType is "producer" to keep the producer's codec, or the
+	// codec appended batches are recompressed with.
+	CompressionType string
+	// MessageDownConversion allows converting batches to the legacy formats
+	// for fetchers older than Fetch v4. Without it they get UNSUPPORTED_VERSION.
+	MessageDownConversion bool
+	// MessageFormat is the record format magic of message.format.version.
+	// Batches are kept as RecordBatch v2 whatever it is, but are served in
+	// this format at most, and records it cannot hold are refused.
+	MessageFormat int8
+	// RemoteStorageEnable tiers the log: rolled segments are copied to
+	// remote storage, and the local copies are kept only for
+	// LocalRetentionMs and LocalRetentionBytes. RetentionMs and
+	// RetentionBytes then apply to the whole log, remote segments included.
+	RemoteStorageEnable bool
+	LocalRetentionMs    int64
+	LocalRetentionBytes int64
+	// Keyring encrypts the segments created from now on, see segmentFile. It
+	// is nil unless log.encryption.keyfile is set.
+	Keyring *Keyring
+}
+
+// Compacts reports whether the log cleaner keeps only the newest record of
+// every key.
+func (c LogConfig) Compacts() bool {
+	return strings.Contains(c.CleanupPolicy, "compact")
+}
+
+// Codec returns the codec produced batches must be stored with, or false if
+// they keep the producer's.
+func (c LogConfig) Codec() (compression.Codec, bool) {
+	return compression.ParseCodec(c.CompressionType)
+}
+
+// Deletes reports whether old segments are removed by retention.
+func (c LogConfig) Deletes() bool {
+	return strings.Contains(c.CleanupPolicy, "delete")
+}
+
+// Bounds of segment.bytes, as in Kafka. Index entries hold positions in the
+// segment as 32 bit integers, so segments cannot grow past 2 GiB.
+const (
+	minSegmentBytes = 14
+	maxSegmentBytes = math.MaxInt32
+)
+
+func NewLogConfig(broker *config.Config, topic map[string]string) LogConfig {
+	rollMs := broker.Int64("log.roll.hours", 168) * int64(time.Hour/time.Millisecond)
+	retentionMs := broker.Int64("log.retention.hours", 168) * int64(time.Hour/time.Millisecond)
+	retentionMs = broker.Int64("log.retention.minutes", retentionMs/int64(time.Minute/time.Millisecond)) * int64(time.Minute/time.Millisecond)
+	c := LogConfig{
+		SegmentBytes:           broker.Int64("log.segment.bytes", 1<<30),
+		SegmentMs:              broker.Int64("log.roll.ms", rollMs),
+		SegmentIndexBytes:      broker.Int("log.index.size.max.bytes", 10<<20),
+		IndexIntervalBytes:     broker.Int("log.index.interval.bytes", 4096),
+		RetentionMs:            broker.Int64("log.retention.ms", retentionMs),
+		RetentionBytes:         broker.Int64("log.retention.bytes", -1),
+		FlushMessages:          broker.Int64("log.flush.interval.messages", math.MaxInt64),
+		FlushMs:                broker.Int64("log.flush.interval.ms", math.MaxInt64),
+		CleanupPolicy:          broker.String("log.cleanup.policy", "delete"),
+		DeleteRetentionMs:      broker.Int64("log.cleaner.delete.retention.ms", 24*int64(time.Hour/time.Millisecond)),
+		MinCleanableDirtyRatio: broker.Float64("log.cleaner.min.cleanable.ratio", 0.5),
+		CompressionType:        broker.String("compression.type", "producer"),
+		MessageDownConversion:  broker.Bool("log.message.downconversion.enable", true),
+		MessageFormat:          messageFormat("log.message.format.version", broker.String("log.message.format.version", "3.0-IV1"), record.Magic),
+		LocalRetentionMs:       broker.Int64("log.local.retention.ms", -2),
+		LocalRetentionBytes:    broker.Int64("log.local.retention.bytes", -2),
+	}
+	c.SegmentBytes = validSegmentBytes("log.segment.bytes", c.SegmentBytes, 1<<30)
+	c.SegmentBytes = validSegmentBytes("segment.bytes", topicInt64(topic, "segment.bytes", c.SegmentBytes), c.SegmentBytes)
+	c.SegmentMs = topicInt64(topic, "segment.ms", c.SegmentMs)
+	c.SegmentIndexBytes = int(topicInt64(topic, "segment.index.bytes", int64(c.SegmentIndexBytes)))
+	c.IndexIntervalBytes = int(topicInt64(topic, "index.interval.bytes", int64(c.IndexIntervalBytes)))
+	c.RetentionMs = topicInt64(topic, "retention.ms", c.RetentionMs)
+	c.RetentionBytes = topicInt64(topic, "retention.bytes", c.RetentionBytes)
+	c.FlushMessages = topicInt64(topic, "flush.messages", c.FlushMessages)
+	c.FlushMs = topicInt64(topic, "flush.ms", c.FlushMs)
+	c.DeleteRetentionMs = topicInt64(topic, "delete.retention.ms", c.DeleteRetentionMs)
+	if v, err := strconv.ParseFloat(topic["min.cleanable.dirty.ratio"], 64); err == nil {
+		c.MinCleanableDirtyRatio = v
+	}
+	if policy, ok := topic["cleanup.policy"]; ok {
+		c.CleanupPolicy = policy
+	}
+	if codec, ok := topic["compression.type"]; ok {
+		c.CompressionType = codec
+	}
+	if v, err := strconv.ParseBool(topic["message.downconversion.enable"]); err == nil {
+		c.MessageDownConversion = v
+	}
+	if v, ok := topic["message.format.version"]; ok {
+		c.MessageFormat = messageFormat("message.format.version", v, c.MessageFormat)
+	}
+	if v, err := strconv.ParseBool(topic["remote.storage.enable"]); err == nil {
+		c.RemoteStorageEnable = v
+	}
+	c.LocalRetentionMs = topicInt64(topic, "local.retention.ms", c.LocalRetentionMs)
+	c.LocalRetentionBytes = topicInt64(topic, "local.retention.bytes", c.LocalRetentionBytes)
+	// -2 keeps local segments as long as the whole log.
+	if c.LocalRetentionMs == -2 {
+		c.LocalRetentionMs = c.RetentionMs
+	}
+	if c.LocalRetentionBytes == -2 {
+		c.LocalRetentionBytes = c.RetentionBytes
+	}
+	return c
+}
+
+func topicInt64(topic map[string]string, key string, def int64) int64 {
+	v, ok := topic[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// validSegmentBytes returns the segment size set by key, or def if it is out
+// of bounds.
+func validSegmentBytes(key string, segmentBytes int64, def int64) int64 {
+	if segmentBytes < minSegmentBytes || segmentBytes > maxSegmentBytes {
+		fmt.Printf("Ignoring %s=%d: it must be between %d and %d\n", key, segmentBytes, minSegmentBytes, maxSegmentBytes)
+		return def
+	}
+	return segmentBytes
+}
+
+// messageFormat returns the record format magic of a Kafka version set by
+// key, such as 0.10.2 or 2.8-IV1, or def if it is not one. Messages gained
+// timestamps, magic 1, in 0.10.0 and became RecordBatch v2 in 0.11.0.
+func messageFormat(key, version string, def int8) int8 {
+	release, _, _ := strings.Cut(version, "-")
+	parts := strings.Split(release, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || len(parts) < 2 || len(parts) > 4 {
+			fmt.Printf("Ignoring %s=%s: it is not a Kafka version\n", key, version)
+			return def
+		}
+		numbers[i] = n
+	}
+	switch {
+	case numbers[0] > 0 || numbers[1] >= 11:
+		return record.Magic
+	case numbers[1] == 10:
+		return record.MagicV1
+	case numbers[1] >= 8:
+		return record.MagicV0
+	}
+	fmt.Printf("Ignoring %s=%s: it predates message format v0\n", key, version)
+	return def
+}
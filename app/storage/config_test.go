@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+func TestSegmentBytesBounds(t *testing.T) {
+	broker := config.New(map[string]string{"log.segment.bytes": "1048576"})
+	for _, tc := range []struct {
+		segmentBytes string
+		want         int64
+	}{
+		{"4096", 4096},
+		{strconv.Itoa(math.MaxInt32), math.MaxInt32},
+		{strconv.Itoa(math.MaxInt32 + 1), 1048576},
+		{"8589934592", 1048576},
+		{"13", 1048576},
+	} {
+		if got := NewLogConfig(broker, map[string]string{"segment.bytes": tc.segmentBytes}).SegmentBytes; got != tc.want {
+			t.Errorf("segment.bytes=%s gives %d, want %d", tc.segmentBytes, got, tc.want)
+		}
+	}
+
+	broker = config.New(map[string]string{"log.segment.bytes": "8589934592"})
+	if got := NewLogConfig(broker, nil).SegmentBytes; got != 1<<30 {
+		t.Errorf("log.segment.bytes=8589934592 gives %d, want the default %d", got, 1<<30)
+	}
+}
+
+func TestMessageFormatVersion(t *testing.T) {
+	broker := config.New(map[string]string{"log.message.format.version": "0.10.2-IV0"})
+	if got := NewLogConfig(broker, nil).MessageFormat; got != record.MagicV1 {
+		t.Errorf("log.message.format.version=0.10.2-IV0 gives v%d, want v1", got)
+	}
+	for version, want := range map[string]int8{
+		"0.8.2":   record.MagicV0,
+		"0.9.0.1": record.MagicV0,
+		"0.10.0":  record.MagicV1,
+		"0.11.0":  record.Magic,
+		"2.8-IV1": record.Magic,
+		"3.0":     record.Magic,
+		"0.7":     record.MagicV1,
+		"1":       record.MagicV1,
+		"latest":  record.MagicV1,
+	} {
+		if got := NewLogConfig(broker, map[string]string{"message.format.version": version}).MessageFormat; got != want {
+			t.Errorf("message.format.version=%s gives v%d, want v%d", version, got, want)
+		}
+	}
+	if got := NewLogConfig(config.New(nil), nil).MessageFormat; got != record.Magic {
+		t.Errorf("the default message format is v%d, want v2", got)
+	}
+}
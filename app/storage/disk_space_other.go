@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "errors"
+
+func diskSpace(path string) (total int64, usable int64, err error) {
+	return -1, -1, errors.New("disk space is not available on this platform")
+}
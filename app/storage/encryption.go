@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// encryptionMagic starts every encrypted segment and index file. It is
+	// followed by a version and the length prefixed id of the key the file is
+	// encrypted with.
+	encryptionMagic   = "KENC"
+	encryptionVersion = 1
+	maxKeyIdLength    = 255
+	maxHeaderSize     = len(encryptionMagic) + 2 + maxKeyIdLength
+
+	frameLengthSize = 4
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// errCorruptFrame is a frame that is cut short or fails authentication,
+	// because it was being written during a crash or was tampered with.
+	errCorruptFrame = errors.New("corrupt encrypted frame")
+)
+
+// Keyring holds the keys of encryption at rest, read from the keyfile named
+// by log.encryption.keyfile. Each line of the keyfile holds a key id and a hex
+// encoded 128, 192 or 256 bit AES key separated by whitespace; blank lines and
+// lines starting with # are ignored. New segment and index files are
+// encrypted with the current key, and name the key in their header, so keys
+// are rotated by adding one to the keyfile and making it current. An old key
+// can be removed once the reencrypt-logs tool has rewritten the segments
+// using it and the remote segments using it have expired.
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// LoadKeyring reads a keyfile. currentKeyId names the key new files are
+// encrypted with; if empty it is the last key in the file.
+func LoadKeyring(path string, currentKeyId string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open keyfile %s: %w", path, err)
+	}
+	defer f.Close()
+
+	k := &Keyring{keys: map[string]cipher.AEAD{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) > maxKeyIdLength {
+			return nil, fmt.Errorf("invalid key on line %d of keyfile %s", line, path)
+		}
+		id := fields[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key %s in keyfile %s", id, path)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in keyfile %s: %w", id, path, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in keyfile %s: %w", id, path, err)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("invalid key %s in keyfile %s: %w", id, path, err)
+		}
+		k.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read keyfile %s: %w", path, err)
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("no keys in keyfile %s", path)
+	}
+	if currentKeyId != "" {
+		if _, ok := k.keys[currentKeyId]; !ok {
+			return nil, fmt.Errorf("%w %s: not in keyfile %s", ErrUnknownKey, currentKeyId, path)
+		}
+		k.current = currentKeyId
+	}
+	return k, nil
+}
+
+// CurrentKeyId is the id of the key new files are encrypted with.
+func (k *Keyring) CurrentKeyId() string {
+	return k.current
+}
+
+func (k *Keyring) cipher(keyId string, baseOffset int64) (*fileCipher, error) {
+	aead, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, keyId)
+	}
+	return &fileCipher{keyId: keyId, aead: aead, baseOffset: baseOffset}, nil
+}
+
+// fileCipher seals and opens the frames of an encrypted file of a segment
+// with AES-GCM. A frame holds a 4 byte length, a random nonce and the sealed
+// data. The segment's base offset and the frame's position in the file are
+// authenticated with it, so frames cannot be moved around within or between
+// files unnoticed.
+type fileCipher struct {
+	keyId      string
+	aead       cipher.AEAD
+	baseOffset int64
+}
+
+func (c *fileCipher) header() []byte {
+	header := append([]byte(encryptionMagic), encryptionVersion, byte(len(c.keyId)))
+	return append(header, c.keyId...)
+}
+
+func (c *fileCipher) additionalData(position int64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(c.baseOffset))
+	return binary.BigEndian.AppendUint64(data, uint64(position))
+}
+
+// seal returns the frames of chunks written from position on.
+func (c *fileCipher) seal(position int64, chunks ...[]byte) []byte {
+	frames := []byte{}
+	for _, chunk := range chunks {
+		nonce := make([]byte, c.aead.NonceSize())
+		rand.Read(nonce)
+		size := len(nonce) + len(chunk) + c.aead.Overhead()
+		frames = binary.BigEndian.AppendUint32(frames, uint32(size))
+		frames = append(frames, nonce...)
+		frames = c.aead.Seal(frames, nonce, chunk, c.additionalData(position))
+		position += int64(frameLengthSize + size)
+	}
+	return frames
+}
+
+// open authenticates and decrypts the frame at position, body being the
+// frame without its length.
+func (c *fileCipher) open(position int64, body []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(body) < nonceSize+c.aead.Overhead() {
+		return nil, errCorruptFrame
+	}
+	data, err := c.aead.Open(nil, body[:nonceSize], body[nonceSize:], c.additionalData(position))
+	if err != nil {
+		return nil, errCorruptFrame
+	}
+	return data, nil
+}
+
+// parseEncryptionHeader reads the header at the start of data, which need only
+// hold its first maxHeaderSize bytes. It returns the key id and header size,
+// or false if the file is not encrypted.
+func parseEncryptionHeader(data []byte) (string, int, bool, error) {
+	if len(data) < len(encryptionMagic) || string(data[:len(encryptionMagic)]) != encryptionMagic {
+		return "", 0, false, nil
+	}
+	n := len(encryptionMagic)
+	if len(data) < n+2 || len(data) < n+2+int(data[n+1]) {
+		return "", 0, false, fmt.Errorf("truncated encryption header")
+	}
+	if data[n] != encryptionVersion {
+		return "", 0, false, fmt.Errorf("unsupported encryption version %d", data[n])
+	}
+	size := n + 2 + int(data[n+1])
+	return string(data[n+2 : size]), size, true, nil
+}
+
+// decryptFile returns the plaintext of a whole segment or index file read into
+// memory, which is data itself if it is not encrypted.
+func decryptFile(data []byte, baseOffset int64, keyring *Keyring) ([]byte, error) {
+	keyId, position, ok, err := parseEncryptionHeader(data)
+	if err != nil || !ok {
+		return data, err
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("%w %s: no log.encryption.keyfile", ErrUnknownKey, keyId)
+	}
+	c, err := keyring.cipher(keyId, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := []byte{}
+	for position < len(data) {
+		if len(data)-position < frameLengthSize {
+			return nil, errCorruptFrame
+		}
+		size := int(binary.BigEndian.Uint32(data[position:]))
+		if len(data)-position-frameLengthSize < size {
+			return nil, errCorruptFrame
+		}
+		chunk, err := c.open(int64(position), data[position+frameLengthSize:position+frameLengthSize+size])
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, chunk...)
+		position += frameLengthSize + size
+	}
+	return plaintext, nil
+}
+
+// segmentFile is the log file or an index file of a segment. Unless
+// encrypted, it holds the plaintext as is. An encrypted file starts with a
+// header naming its key, and every chunk written to it is sealed into a frame
+// of its own, which can only be read whole. A new file is encrypted with the
+// current key if a keyring is configured; an existing one is read with the
+// key its header names, so that files written before encryption was turned on
+// or before a key rotation stay readable.
+type segmentFile struct {
+	file   *os.File
+	cipher *fileCipher
+	// start is the size of the header, where the first frame is.
+	start int64
+	size  int64
+	// refs counts the segment and the FileRecords reading the file, which
+	// is only closed once all of them are done with it, so that records
+	// handed out stay readable after the segment is closed or deleted.
+	refs   atomic.Int32
+	closed atomic.Bool
+}
+
+func openSegmentFile(path string, baseOffset int64, keyring *Keyring) (*segmentFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &segmentFile{file: file}
+	f.refs.Store(1)
+	if err := f.init(baseOffset, keyring); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *segmentFile) init(baseOffset int64, keyring *Keyring) error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.size = info.Size()
+	if f.size == 0 {
+		if keyring == nil {
+			return nil
+		}
+		if f.cipher, err = keyring.cipher(keyring.current, baseOffset); err != nil {
+			return err
+		}
+		header := f.cipher.header()
+		if _, err := f.file.Write(header); err != nil {
+			return err
+		}
+		f.start, f.size = int64(len(header)), int64(len(header))
+		return nil
+	}
+
+	data := make([]byte, min(f.size, int64(maxHeaderSize)))
+	if _, err := f.file.ReadAt(data, 0); err != nil {
+		return err
+	}
+	keyId, size, ok, err := parseEncryptionHeader(data)
+	if err != nil || !ok {
+		return err
+	}
+	if keyring == nil {
+		return fmt.Errorf("%w %s: no log.encryption.keyfile", ErrUnknownKey, keyId)
+	}
+	if f.cipher, err = keyring.cipher(keyId, baseOffset); err != nil {
+		return err
+	}
+	f.start = int64(size)
+	return nil
+}
+
+func (f *segmentFile) Name() string {
+	return f.file.Name()
+}
+
+// keyId is the id of the key the file is encrypted with, or empty if it is
+// not.
+func (f *segmentFile) keyId() string {
+	if f.cipher == nil {
+		return ""
+	}
+	return f.cipher.keyId
+}
+
+// write appends chunks with a single write, and returns the position each was
+// written at.
+func (f *segmentFile) write(chunks ...[]byte) ([]int64, error) {
+	positions := make([]int64, len(chunks))
+	data := chunks[0]
+	if f.cipher != nil {
+		data = f.cipher.seal(f.size, chunks...)
+		position := f.size
+		for i, chunk := range chunks {
+			positions[i] = position
+			position += int64(frameLengthSize + f.cipher.aead.NonceSize() + len(chunk) + f.cipher.aead.Overhead())
+		}
+	} else {
+		if len(chunks) > 1 {
+			data = nil
+			for _, chunk := range chunks {
+				data = append(data, chunk...)
+			}
+		}
+		position := f.size
+		for i, chunk := range chunks {
+			positions[i] = position
+			position += int64(len(chunk))
+		}
+	}
+	if _, err := f.file.Write(data); err != nil {
+		return nil, err
+	}
+	f.size += int64(len(data))
+	return positions, nil
+}
+
+// ReadAt reads len(data) bytes at position of a file that is not encrypted.
+func (f *segmentFile) ReadAt(data []byte, position int64) (int, error) {
+	return f.file.ReadAt(data, position)
+}
+
+// readFrame returns the plaintext of the frame at position of an encrypted
+// file, and the position of the next frame.
+func (f *segmentFile) readFrame(position int64) ([]byte, int64, error) {
+	if f.size-position < frameLengthSize {
+		return nil, 0, fmt.Errorf("%w at position %d in %s", errCorruptFrame, position, f.Name())
+	}
+	length := make([]byte, frameLengthSize)
+	if _, err := f.file.ReadAt(length, position); err != nil {
+		return nil, 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(length))
+	if f.size-position-frameLengthSize < size {
+		return nil, 0, fmt.Errorf("%w at position %d in %s", errCorruptFrame, position, f.Name())
+	}
+	body := make([]byte, size)
+	if _, err := f.file.ReadAt(body, position+frameLengthSize); err != nil {
+		return nil, 0, err
+	}
+	data, err := f.cipher.open(position, body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w at position %d in %s", err, position, f.Name())
+	}
+	return data, position + frameLengthSize + size, nil
+}
+
+// readAll returns the plaintext of the whole file. If a frame is corrupt, it
+// returns the plaintext before it, the position it is at and an error
+// wrapping errCorruptFrame.
+func (f *segmentFile) readAll() ([]byte, int64, error) {
+	if f.cipher == nil {
+		data := make([]byte, f.size)
+		if _, err := f.file.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		return data, f.size, nil
+	}
+	plaintext := []byte{}
+	position := f.start
+	for position < f.size {
+		data, next, err := f.readFrame(position)
+		if err != nil {
+			return plaintext, position, err
+		}
+		plaintext = append(plaintext, data...)
+		position = next
+	}
+	return plaintext, position, nil
+}
+
+// truncate cuts the file down to size, which for an encrypted file must be the
+// position of a frame, or start to keep only the header.
+func (f *segmentFile) truncate(size int64) error {
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+func (f *segmentFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Close lets go of the segment's reference to the file.
+func (f *segmentFile) Close() error {
+	if f.closed.Swap(true) {
+		return &os.PathError{Op: "close", Path: f.Name(), Err: os.ErrClosed}
+	}
+	return f.release()
+}
+
+// retain takes a reference to the file for a reader, unless it is already
+// closed.
+func (f *segmentFile) retain() bool {
+	for {
+		refs := f.refs.Load()
+		if refs == 0 {
+			return false
+		}
+		if f.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release lets go of a reference, closing the file with the last one.
+func (f *segmentFile) release() error {
+	if f.refs.Add(-1) == 0 {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// encodeSegmentFile returns the contents of a file holding chunks, encrypted
+// with c unless it is nil.
+func encodeSegmentFile(c *fileCipher, chunks ...[]byte) []byte {
+	if c == nil {
+		data := []byte{}
+		for _, chunk := range chunks {
+			data = append(data, chunk...)
+		}
+		return data
+	}
+	header := c.header()
+	if len(chunks) == 0 {
+		return header
+	}
+	return append(header, c.seal(int64(len(header)), chunks...)...)
+}
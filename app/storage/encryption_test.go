@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f"
+	testKey2 = "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+)
+
+func writeKeyfile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keyfile")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestKeyring(t *testing.T, currentKeyId string, lines ...string) *Keyring {
+	t.Helper()
+	k, err := LoadKeyring(writeKeyfile(t, lines...), currentKeyId)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	return k
+}
+
+// openEncryptedLog opens partition 0 of topic test in dir, its segments
+// encrypted with keyring and holding two 85 byte batches each, 117 bytes once
+// framed.
+func openEncryptedLog(t *testing.T, dir string, keyring *Keyring) (*LogManager, *Log, error) {
+	t.Helper()
+	m := NewLogManager([]string{dir}, config.New(map[string]string{"log.segment.bytes": "300"}))
+	if keyring != nil {
+		m.SetKeyring(keyring)
+	}
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		m.Close()
+		return nil, nil, err
+	}
+	return m, log, nil
+}
+
+func TestLoadKeyring(t *testing.T) {
+	k := loadTestKeyring(t, "", "# rotated in order", "", "k1 "+testKey1, "k2 "+testKey2)
+	if k.CurrentKeyId() != "k2" {
+		t.Errorf("got current key %s, want the last one k2", k.CurrentKeyId())
+	}
+	if k := loadTestKeyring(t, "k1", "k1 "+testKey1, "k2 "+testKey2); k.CurrentKeyId() != "k1" {
+		t.Errorf("got current key %s, want k1 as asked", k.CurrentKeyId())
+	}
+
+	tests := map[string][]string{
+		"no keys":       {"# nothing"},
+		"bad hex":       {"k1 zz"},
+		"bad size":      {"k1 0001"},
+		"missing key":   {"k1"},
+		"extra field":   {"k1 " + testKey1 + " x"},
+		"duplicate key": {"k1 " + testKey1, "k1 " + testKey2},
+		"long key id":   {strings.Repeat("k", maxKeyIdLength+1) + " " + testKey1},
+	}
+	for name, lines := range tests {
+		if _, err := LoadKeyring(writeKeyfile(t, lines...), ""); err == nil {
+			t.Errorf("%s: LoadKeyring accepted %q", name, lines)
+		}
+	}
+	if _, err := LoadKeyring(writeKeyfile(t, "k1 "+testKey1), "k3"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("LoadKeyring with an unknown current key returned %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestEncryptedLogRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keyring := loadTestKeyring(t, "", "k1 "+testKey1)
+	m, log, err := openEncryptedLog(t, dir, keyring)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	logDir := log.Dir
+
+	records, err := log.ReadRecords(3, 1<<20, true, func(Batch) bool { return true })
+	if err != nil {
+		t.Fatalf("ReadRecords: %v", err)
+	}
+	var data bytes.Buffer
+	for _, r := range records {
+		r.WriteTo(&data)
+		r.Close()
+	}
+	got := []int64{}
+	for b := data.Bytes(); len(b) > 0; b = b[record.Size(b):] {
+		if err := record.Validate(b[:record.Size(b)]); err != nil {
+			t.Fatalf("ReadRecords returned an invalid batch: %v", err)
+		}
+		got = append(got, record.DecodeHeader(b).BaseOffset)
+	}
+	if want := []int64{2, 4, 6, 8}; !slices.Equal(got, want) {
+		t.Errorf("ReadRecords returned batches %v in the clear, want %v", got, want)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Every file of every segment is encrypted with the key, and holds none
+	// of the records in the clear.
+	for _, baseOffset := range []int64{0, 4, 8} {
+		for _, suffix := range []string{LogFileSuffix, IndexFileSuffix, TimeIndexFileSuffix} {
+			content, err := os.ReadFile(segmentFileName(logDir, baseOffset, suffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyId, _, ok, err := parseEncryptionHeader(content)
+			if err != nil || !ok || keyId != "k1" {
+				t.Errorf("segment %d %s has key %q (%t, %v), want k1", baseOffset, suffix, keyId, ok, err)
+			}
+			if bytes.Contains(content, []byte("value")) {
+				t.Errorf("segment %d %s holds records in the clear", baseOffset, suffix)
+			}
+		}
+	}
+
+	m, log, err = openEncryptedLog(t, dir, keyring)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer m.Close()
+	if got, want := readOffsets(t, log, 3, 1<<20), []int64{2, 4, 6, 8}; !slices.Equal(got, want) {
+		t.Errorf("reopened log read batches %v, want %v", got, want)
+	}
+	offset, _, ok, err := log.FindOffsetByTimestamp(0)
+	if err != nil || !ok || offset != 0 {
+		t.Errorf("FindOffsetByTimestamp returned %d, %t and %v, want offset 0", offset, ok, err)
+	}
+}
+
+func TestEncryptedLogNeedsItsKey(t *testing.T) {
+	dir := t.TempDir()
+	m, log, err := openEncryptedLog(t, dir, loadTestKeyring(t, "", "k1 "+testKey1))
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	appendBatches(t, log, testBatch(2, time.Now().UnixMilli()))
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, _, err := openEncryptedLog(t, dir, loadTestKeyring(t, "", "k2 "+testKey2)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("opening with another key returned %v, want ErrUnknownKey", err)
+	}
+	// A wrong key of the same id fails authentication.
+	if m, _, err := openEncryptedLog(t, dir, loadTestKeyring(t, "", "k1 "+testKey2)); err == nil {
+		m.Close()
+		t.Errorf("opening with a wrong key of the same id succeeded")
+	}
+}
+
+func TestEncryptedLogRecoversTornFrame(t *testing.T) {
+	dir := t.TempDir()
+	keyring := loadTestKeyring(t, "", "k1 "+testKey1)
+	m, log, err := openEncryptedLog(t, dir, keyring)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	batch := testBatch(2, time.Now().UnixMilli())
+	appendBatches(t, log, batch, batch)
+	path := segmentFileName(log.Dir, 0, LogFileSuffix)
+	crash(t, m, dir)
+	var size int64
+	editSegment(t, path, func(data []byte) []byte {
+		size = int64(len(data))
+		// The start of a frame, as left by a crash while it was written.
+		return append(data, data[len(data)-40:len(data)-10]...)
+	})
+
+	m, log, err = openEncryptedLog(t, dir, keyring)
+	if err != nil {
+		t.Fatalf("recovering: %v", err)
+	}
+	defer m.Close()
+	if got := log.LogEndOffset(); got != 4 {
+		t.Errorf("recovered log end offset %d, want 4", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != size {
+		t.Errorf("recovered segment is not %d bytes long: %v", size, err)
+	}
+	appendBatches(t, log, batch)
+	if got, want := readOffsets(t, log, 0, 1<<20), []int64{0, 2, 4}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v after recovery, want %v", got, want)
+	}
+}
+
+func TestEncryptedLogRetention(t *testing.T) {
+	m, log, err := openEncryptedLog(t, t.TempDir(), loadTestKeyring(t, "", "k1 "+testKey1))
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	defer m.Close()
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	if _, err := m.DeleteRecords(log.Partition, 5); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	if got, want := baseOffsets(log), []int64{4, 8}; !slices.Equal(got, want) {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+	if got, want := readOffsets(t, log, 5, 1<<20), []int64{4, 6, 8}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v, want %v", got, want)
+	}
+}
+
+func TestReencryptLogDir(t *testing.T) {
+	dir := t.TempDir()
+	m, log, err := openEncryptedLog(t, dir, nil)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reencrypt := func(keyring *Keyring, want int) {
+		t.Helper()
+		config := NewLogConfig(config.New(nil), nil)
+		config.Keyring = keyring
+		if n, err := ReencryptLogDir(dir, config); err != nil || n != want {
+			t.Fatalf("ReencryptLogDir rewrote %d segments and returned %v, want %d", n, err, want)
+		}
+		m, log, err := openEncryptedLog(t, dir, keyring)
+		if err != nil {
+			t.Fatalf("reopening: %v", err)
+		}
+		defer m.Close()
+		for _, segment := range log.Segments() {
+			if !segment.encryptedWith(keyring.CurrentKeyId()) {
+				t.Errorf("segment %d is not encrypted with %s", segment.BaseOffset, keyring.CurrentKeyId())
+			}
+		}
+		if got, want := readOffsets(t, log, 0, 1<<20), []int64{0, 2, 4, 6, 8}; !slices.Equal(got, want) {
+			t.Errorf("read batches %v, want %v", got, want)
+		}
+	}
+	// Encryption is turned on for the two segments written in the clear,
+	// three batches each, then the key rotated, and nothing is left to do
+	// once every segment uses the current key.
+	reencrypt(loadTestKeyring(t, "", "k1 "+testKey1), 2)
+	rotated := loadTestKeyring(t, "k2", "k1 "+testKey1, "k2 "+testKey2)
+	reencrypt(rotated, 2)
+	reencrypt(rotated, 0)
+}
+
+func TestEncryptedLogCompaction(t *testing.T) {
+	m := NewLogManager([]string{t.TempDir()}, config.New(map[string]string{
+		"log.cleanup.policy":              "compact",
+		"log.segment.bytes":               "14",
+		"log.cleaner.min.cleanable.ratio": "0",
+	}))
+	m.SetKeyring(loadTestKeyring(t, "", "k1 "+testKey1))
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	for _, key := range []string{"a", "b", "a", "c"} {
+		appendKeyed(t, log, key, []byte("value"))
+	}
+
+	cleanLog(t, newLogCleaner(m, 0), log, time.Now())
+	if got, want := keys(t, log), []string{"b", "a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("got keys %v after cleaning, want %v", got, want)
+	}
+	for _, segment := range log.Segments() {
+		if !segment.encryptedWith("k1") {
+			t.Errorf("cleaned segment %d is not encrypted", segment.BaseOffset)
+		}
+	}
+}
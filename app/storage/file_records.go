@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileRecords is a run of consecutive batches of a segment file, written to
+// clients straight from the file. It holds a reference to the segment's own
+// handle, so it stays readable after the segment is deleted, and must be
+// closed.
+type FileRecords struct {
+	file *segmentFile
+	// region is a handle of its own, opened while the segment is still
+	// there, whose offset WriteTo moves without racing other readers.
+	region   *os.File
+	position int64
+	size     int
+}
+
+func openFileRecords(file *segmentFile, position int64, size int) (*FileRecords, error) {
+	if !file.retain() {
+		return nil, fmt.Errorf("unable to read segment %s: %w", file.Name(), os.ErrClosed)
+	}
+	region, err := os.Open(file.Name())
+	if err != nil {
+		file.release()
+		return nil, fmt.Errorf("unable to open segment %s: %w", file.Name(), err)
+	}
+	return &FileRecords{file: file, region: region, position: position, size: size}, nil
+}
+
+func (r *FileRecords) Size() int {
+	return r.size
+}
+
+// WriteTo copies the batches to w. When w is a *net.TCPConn, io.Copy hands
+// the file to its ReadFrom, which sends it with sendfile.
+func (r *FileRecords) WriteTo(w io.Writer) (int64, error) {
+	if _, err := r.region.Seek(r.position, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("unable to read segment %s: %w", r.file.Name(), err)
+	}
+	n, err := io.Copy(w, io.LimitReader(r.region, int64(r.size)))
+	if err == nil && n < int64(r.size) {
+		err = fmt.Errorf("segment %s truncated at position %d", r.file.Name(), r.position+n)
+	}
+	return n, err
+}
+
+// ReadAll reads the batches into memory, for callers that need to look into
+// them.
+func (r *FileRecords) ReadAll() ([]byte, error) {
+	data := make([]byte, r.size)
+	if _, err := r.file.ReadAt(data, r.position); err != nil {
+		return nil, fmt.Errorf("unable to read segment %s: %w", r.file.Name(), err)
+	}
+	return data, nil
+}
+
+func (r *FileRecords) Close() error {
+	err := r.region.Close()
+	if releaseErr := r.file.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+)
+
+// readAppended appends a batch to a new log and reads it back as records.
+func readAppended(t *testing.T) (*Log, []byte, Records) {
+	t.Helper()
+	m := NewLogManager([]string{t.TempDir()}, config.New(nil))
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		t.Fatalf("getLog: %v", err)
+	}
+	data := testBatch(3, time.Now().UnixMilli())
+	if _, err := log.Append(data); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	records, err := log.ReadRecords(0, 1<<20, true, func(Batch) bool { return true })
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadRecords returned %d records and %v", len(records), err)
+	}
+	return log, data, records[0]
+}
+
+// readFromRecorder records the reader its ReadFrom is handed, as
+// *net.TCPConn.ReadFrom needs an *os.File behind it to use sendfile.
+type readFromRecorder struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.src = r
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestFileRecordsHandFileToReadFrom(t *testing.T) {
+	_, data, records := readAppended(t)
+	defer records.Close()
+
+	var w readFromRecorder
+	if _, err := records.WriteTo(&w); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	limited, ok := w.src.(*io.LimitedReader)
+	if !ok {
+		t.Fatalf("ReadFrom got a %T, want an *io.LimitedReader", w.src)
+	}
+	if _, ok := limited.R.(*os.File); !ok {
+		t.Errorf("ReadFrom got a LimitedReader of a %T, want an *os.File", limited.R)
+	}
+	if !bytes.Equal(w.Bytes()[8:], data[8:]) {
+		t.Errorf("wrote %x, want the appended batch", w.Bytes())
+	}
+}
+
+func TestFileRecordsOutliveDeletedSegment(t *testing.T) {
+	log, data, records := readAppended(t)
+	segment := log.Segments()[0]
+	segment.delete()
+
+	var written bytes.Buffer
+	if _, err := records.WriteTo(&written); err != nil {
+		t.Fatalf("WriteTo after the segment was deleted: %v", err)
+	}
+	if !bytes.Equal(written.Bytes()[8:], data[8:]) {
+		t.Errorf("wrote %x, want the appended batch", written.Bytes())
+	}
+	records.Close()
+	if refs := segment.file.refs.Load(); refs != 0 {
+		t.Errorf("segment file still has %d references after the records were closed", refs)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/metrics"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// flushTimer times every fsync of a log, the flushes of rolled segments
+// included.
+var flushTimer = metrics.GetTimer("kafka.log:type=LogFlushStats,name=LogFlushRateAndTimeMs")
+
+// pendingAppend is a batch waiting in Log.pending to be written.
+type pendingAppend struct {
+	data  []byte
+	batch Batch
+	err   error
+	// done is closed once the batch is written, or with lead set when the
+	// append is to commit the pending ones itself.
+	done chan struct{}
+	lead bool
+}
+
+// Append assigns the next offsets to a v2 record batch and writes it to the
+// active segment, rolling first if the segment is full or too old.
+//
+// Appends are group committed: those arriving while another commits queue
+// up, and the first of them then commits them all together, with one write
+// per segment and at most one flush. Under flush.messages=1 concurrent
+// producers thus share the fsyncs.
+func (l *Log) Append(data []byte) (Batch, error) {
+	if err := record.Validate(data); err != nil {
+		return Batch{}, err
+	}
+
+	p := &pendingAppend{data: data, done: make(chan struct{})}
+	l.appendMu.Lock()
+	l.pending = append(l.pending, p)
+	lead := !l.committing
+	l.committing = true
+	l.appendMu.Unlock()
+	if !lead {
+		<-p.done
+		if !p.lead {
+			return p.batch, p.err
+		}
+	}
+
+	l.appendMu.Lock()
+	group := l.pending
+	l.pending = nil
+	l.appendMu.Unlock()
+
+	l.commit(group)
+
+	l.appendMu.Lock()
+	if len(l.pending) > 0 {
+		next := l.pending[0]
+		next.lead = true
+		close(next.done)
+	} else {
+		l.committing = false
+	}
+	l.appendMu.Unlock()
+	appended := false
+	for _, q := range group {
+		appended = appended || q.err == nil
+		if q != p {
+			close(q.done)
+		}
+	}
+
+	l.mu.RLock()
+	onAppend := l.onAppend
+	l.mu.RUnlock()
+	if onAppend != nil && appended {
+		onAppend(l.Partition)
+	}
+	return p.batch, p.err
+}
+
+// commit writes a group of appends in order, then applies the flush policy.
+// The fsync is done outside the log lock, the appends of the group waiting
+// for it but not the readers, nor the appends queuing for the next group.
+func (l *Log) commit(group []*pendingAppend) {
+	f := l.writeGroup(group)
+	if f == nil {
+		return
+	}
+	if err := l.flushUnlocked(f); err != nil {
+		// The batches are written, but not as durably as the policy asks.
+		for _, p := range group {
+			if p.err == nil {
+				p.err = err
+			}
+		}
+	}
+}
+
+// writeGroup writes a group of appends in order and returns the flush that is due
+// after them, if any. The batches bound for the same segment are written
+// together; the segment is only rolled once those before are written, so
+// that it is rolled on its real size. Batches of idempotent producers are
+// checked against the producer state first: retries get the offsets of the
+// batch they repeat without being written again.
+//
+// The producer state is updated as batches get their offsets, ahead of the
+// write. A failed write takes the log directory offline, so the state is
+// never used past it.
+func (l *Log) writeGroup(group []*pendingAppend) *pendingFlush {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	segment := l.activeSegment()
+	nextOffset := segment.NextOffset()
+	batches := make([]Batch, 0, len(group))
+	// queued are the appends of the batches waiting to be written, and
+	// aborted the transactions their abort markers end.
+	queued := make([]*pendingAppend, 0, len(group))
+	aborted := []AbortedTxn{}
+	pendingBytes := 0
+	fail := func(err error, rest []*pendingAppend) {
+		err = l.checkIO(err)
+		for _, p := range append(queued, rest...) {
+			p.err = err
+		}
+	}
+	write := func() error {
+		if len(batches) == 0 {
+			return nil
+		}
+		if err := segment.append(batches...); err != nil {
+			return err
+		}
+		for i, batch := range batches {
+			queued[i].batch = batch
+		}
+		for _, txn := range aborted {
+			if err := segment.txnIndex.Append(txn); err != nil {
+				return err
+			}
+		}
+		batches, queued, aborted, pendingBytes = batches[:0], queued[:0], aborted[:0], 0
+		return nil
+	}
+
+	for i, p := range group {
+		duplicate, err := l.producers.check(p.data)
+		if err != nil {
+			p.err = err
+			continue
+		}
+		if duplicate != nil {
+			p.batch = *duplicate
+			continue
+		}
+		if pendingBytes > 0 && (segment.Size()+int64(pendingBytes+len(p.data)) > l.config.SegmentBytes || segment.shouldRoll(l.config, len(p.data), now)) {
+			if err := write(); err != nil {
+				fail(err, group[i:])
+				return nil
+			}
+		}
+		if segment.shouldRoll(l.config, len(p.data), now) {
+			rolled, err := l.roll()
+			if err != nil {
+				fail(err, group[i:])
+				return nil
+			}
+			segment = rolled
+		}
+		record.SetBaseOffset(p.data, nextOffset)
+		batch := parseBatchHeader(p.data)
+		nextOffset = batch.LastOffset + 1
+		if txn := l.producers.update(batch); txn != nil {
+			aborted = append(aborted, *txn)
+		}
+		batches = append(batches, batch)
+		queued = append(queued, p)
+		pendingBytes += len(p.data)
+	}
+	if err := write(); err != nil {
+		fail(err, nil)
+		return nil
+	}
+	l.maybeIncrementHighWatermark()
+	return l.dueFlush(now)
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	IndexFileSuffix     = ".index"
+	TimeIndexFileSuffix = ".timeindex"
+
+	offsetIndexEntrySize = 8
+	timeIndexEntrySize   = 12
+)
+
+var errCorruptIndex = errors.New("corrupt index")
+
+type offsetIndexEntry struct {
+	Offset   int64
+	Position int64
+}
+
+// OffsetIndex is the sparse .index file of a segment. Each 8 byte entry maps
+// an offset, relative to the segment's base offset, to the file position of
+// the batch holding it.
+type OffsetIndex struct {
+	baseOffset int64
+	file       *segmentFile
+	entries    []offsetIndexEntry
+	maxEntries int
+}
+
+func openOffsetIndex(path string, baseOffset int64, maxIndexBytes int, keyring *Keyring) (*OffsetIndex, error) {
+	file, data, err := openIndexFile(path, baseOffset, keyring)
+	if file == nil {
+		return nil, err
+	}
+	idx := &OffsetIndex{baseOffset: baseOffset, file: file, maxEntries: maxIndexBytes / offsetIndexEntrySize}
+	if err == nil {
+		idx.entries, err = parseOffsetIndex(data, baseOffset)
+	}
+	return idx, err
+}
+
+// parseOffsetIndex decodes the entries of an offset index, up to the first
+// invalid one.
+func parseOffsetIndex(data []byte, baseOffset int64) ([]offsetIndexEntry, error) {
+	if len(data)%offsetIndexEntrySize != 0 {
+		return nil, errCorruptIndex
+	}
+	entries := []offsetIndexEntry{}
+	for i := 0; i < len(data); i += offsetIndexEntrySize {
+		entry := offsetIndexEntry{
+			Offset:   baseOffset + int64(binary.BigEndian.Uint32(data[i:])),
+			Position: int64(binary.BigEndian.Uint32(data[i+4:])),
+		}
+		if n := len(entries); n > 0 && (entry.Offset <= entries[n-1].Offset || entry.Position <= entries[n-1].Position) {
+			return entries, errCorruptIndex
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (idx *OffsetIndex) IsFull() bool {
+	return len(idx.entries) >= idx.maxEntries
+}
+
+func (idx *OffsetIndex) LastEntry() (offsetIndexEntry, bool) {
+	if len(idx.entries) == 0 {
+		return offsetIndexEntry{}, false
+	}
+	return idx.entries[len(idx.entries)-1], true
+}
+
+func (idx *OffsetIndex) Append(offset int64, position int64) error {
+	if last, ok := idx.LastEntry(); ok && offset <= last.Offset {
+		return nil
+	}
+	entry := make([]byte, offsetIndexEntrySize)
+	binary.BigEndian.PutUint32(entry, uint32(offset-idx.baseOffset))
+	binary.BigEndian.PutUint32(entry[4:], uint32(position))
+	if _, err := idx.file.write(entry); err != nil {
+		return fmt.Errorf("unable to append to index %s: %w", idx.file.Name(), err)
+	}
+	idx.entries = append(idx.entries, offsetIndexEntry{Offset: offset, Position: position})
+	return nil
+}
+
+// Lookup returns the position to start scanning from to find offset: that of
+// the last entry at or below it, or 0.
+func (idx *OffsetIndex) Lookup(offset int64) int64 {
+	i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return idx.entries[i-1].Position
+}
+
+// Reset drops every entry, ahead of a rebuild.
+func (idx *OffsetIndex) Reset() error {
+	idx.entries = nil
+	return truncateIndexFile(idx.file)
+}
+
+func (idx *OffsetIndex) Close() error {
+	return idx.file.Close()
+}
+
+type timeIndexEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// TimeIndex is the sparse .timeindex file of a segment. Each 12 byte entry
+// maps a timestamp to the relative offset of the record carrying it, and
+// timestamps only ever increase.
+type TimeIndex struct {
+	baseOffset int64
+	file       *segmentFile
+	entries    []timeIndexEntry
+	maxEntries int
+}
+
+func openTimeIndex(path string, baseOffset int64, maxIndexBytes int, keyring *Keyring) (*TimeIndex, error) {
+	file, data, err := openIndexFile(path, baseOffset, keyring)
+	if file == nil {
+		return nil, err
+	}
+	idx := &TimeIndex{baseOffset: baseOffset, file: file, maxEntries: maxIndexBytes / timeIndexEntrySize}
+	if err == nil {
+		idx.entries, err = parseTimeIndex(data, baseOffset)
+	}
+	return idx, err
+}
+
+// parseTimeIndex decodes the entries of a time index, up to the first invalid
+// one.
+func parseTimeIndex(data []byte, baseOffset int64) ([]timeIndexEntry, error) {
+	if len(data)%timeIndexEntrySize != 0 {
+		return nil, errCorruptIndex
+	}
+	entries := []timeIndexEntry{}
+	for i := 0; i < len(data); i += timeIndexEntrySize {
+		entry := timeIndexEntry{
+			Timestamp: int64(binary.BigEndian.Uint64(data[i:])),
+			Offset:    baseOffset + int64(binary.BigEndian.Uint32(data[i+8:])),
+		}
+		if n := len(entries); n > 0 && (entry.Timestamp <= entries[n-1].Timestamp || entry.Offset < entries[n-1].Offset) {
+			return entries, errCorruptIndex
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (idx *TimeIndex) IsFull() bool {
+	return len(idx.entries) >= idx.maxEntries
+}
+
+func (idx *TimeIndex) LastEntry() (timeIndexEntry, bool) {
+	if len(idx.entries) == 0 {
+		return timeIndexEntry{}, false
+	}
+	return idx.entries[len(idx.entries)-1], true
+}
+
+func (idx *TimeIndex) Append(timestamp int64, offset int64) error {
+	if last, ok := idx.LastEntry(); ok && timestamp <= last.Timestamp {
+		return nil
+	}
+	entry := make([]byte, timeIndexEntrySize)
+	binary.BigEndian.PutUint64(entry, uint64(timestamp))
+	binary.BigEndian.PutUint32(entry[8:], uint32(offset-idx.baseOffset))
+	if _, err := idx.file.write(entry); err != nil {
+		return fmt.Errorf("unable to append to time index %s: %w", idx.file.Name(), err)
+	}
+	idx.entries = append(idx.entries, timeIndexEntry{Timestamp: timestamp, Offset: offset})
+	return nil
+}
+
+// Lookup returns the offset to start searching from for the first record
+// with a timestamp at or after timestamp.
+func (idx *TimeIndex) Lookup(timestamp int64) int64 {
+	i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Timestamp >= timestamp })
+	if i == 0 {
+		return idx.baseOffset
+	}
+	return idx.entries[i-1].Offset
+}
+
+func (idx *TimeIndex) Reset() error {
+	idx.entries = nil
+	return truncateIndexFile(idx.file)
+}
+
+func (idx *TimeIndex) Close() error {
+	return idx.file.Close()
+}
+
+// openIndexFile opens an index file and reads its entries. An encrypted index
+// with a corrupt frame is returned along with errCorruptIndex, to be rebuilt.
+func openIndexFile(path string, baseOffset int64, keyring *Keyring) (*segmentFile, []byte, error) {
+	file, err := openSegmentFile(path, baseOffset, keyring)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open index %s: %w", path, err)
+	}
+	data, _, err := file.readAll()
+	if errors.Is(err, errCorruptFrame) {
+		return file, nil, fmt.Errorf("%w: %w", errCorruptIndex, err)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("unable to read index %s: %w", path, err)
+	}
+	return file, data, nil
+}
+
+// truncateIndexFile drops every entry of an index, keeping the header of an
+// encrypted one.
+func truncateIndexFile(file *segmentFile) error {
+	if err := file.truncate(file.start); err != nil {
+		return fmt.Errorf("unable to truncate index %s: %w", file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,697 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// Log is a partition log made of segments ordered by base offset. Only the
+// last, active segment is ever appended to.
+type Log struct {
+	Dir       string
+	Partition TopicPartition
+
+	mu       sync.RWMutex
+	config   LogConfig
+	segments []*Segment
+	onAppend func(TopicPartition)
+	// logDir is the log directory holding Dir, told about I/O errors.
+	logDir *LogDir
+	// maintenance keeps the cleaner, replica moves and copies to remote
+	// storage from using the log's files at the same time.
+	maintenance sync.Mutex
+	// remote holds the segments below the first local one if the log is
+	// tiered, and highestRemoteOffset is the last offset copied there, or -1.
+	remote              *RemoteLogManager
+	highestRemoteOffset int64
+	// producers follows the idempotent and transactional producers writing
+	// to the log.
+	producers *producerState
+
+	// appendMu guards the appends waiting to be group committed, see
+	// Append.
+	appendMu   sync.Mutex
+	pending    []*pendingAppend
+	committing bool
+
+	logStartOffset int64
+	highWatermark  int64
+	// recoveryPoint is the offset up to which the log is known to be flushed
+	// to disk.
+	recoveryPoint int64
+	// lastFlush is when the log was last flushed, which flush.ms counts
+	// from.
+	lastFlush time.Time
+}
+
+// CheckpointedOffsets are the per partition offsets persisted in the log
+// directory's checkpoint files.
+type CheckpointedOffsets struct {
+	LogStartOffset int64
+	RecoveryPoint  int64
+	HighWatermark  int64
+}
+
+// OpenLog loads the segments of a partition. Unless the broker shut down
+// cleanly, the segments that may hold offsets past the recovery point are
+// recovered first, see recoverSegment.
+func OpenLog(dir string, tp TopicPartition, config LogConfig, offsets CheckpointedOffsets, cleanShutdown bool) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create log dir %s: %w", dir, err)
+	}
+	// A cleaned copy left behind by a crash was never swapped in.
+	if err := os.RemoveAll(filepath.Join(dir, cleanedDirName)); err != nil {
+		return nil, fmt.Errorf("unable to remove %s: %w", filepath.Join(dir, cleanedDirName), err)
+	}
+	l := &Log{Dir: dir, Partition: tp, config: config, highestRemoteOffset: -1, lastFlush: time.Now()}
+	recovered, err := l.loadSegments(offsets.RecoveryPoint, cleanShutdown)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if len(l.segments) == 0 {
+		segment, err := openSegment(dir, 0, config)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, segment)
+	}
+
+	logEndOffset := l.activeSegment().NextOffset()
+	l.logStartOffset = min(max(offsets.LogStartOffset, l.segments[0].BaseOffset), logEndOffset)
+	l.recoveryPoint = min(max(offsets.RecoveryPoint, 0), logEndOffset)
+	l.highWatermark = min(max(offsets.HighWatermark, l.logStartOffset), logEndOffset)
+	l.maybeIncrementHighWatermark()
+	if err := l.loadProducerState(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if recovered {
+		if err := l.flush(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// loadSegments opens the segments in offset order and reports whether any
+// had to be recovered.
+func (l *Log) loadSegments(recoveryPoint int64, cleanShutdown bool) (bool, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return false, fmt.Errorf("unable to list log dir %s: %w", l.Dir, err)
+	}
+
+	baseOffsets := []int64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, LogFileSuffix) {
+			continue
+		}
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, baseOffset)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	recovered := false
+	for i, baseOffset := range baseOffsets {
+		// A segment may hold unflushed offsets unless the next one starts at
+		// or before the recovery point.
+		if cleanShutdown || (i+1 < len(baseOffsets) && baseOffsets[i+1] <= recoveryPoint) {
+			segment, err := openSegment(l.Dir, baseOffset, l.config)
+			if err != nil {
+				return recovered, err
+			}
+			l.segments = append(l.segments, segment)
+			continue
+		}
+
+		segment, truncated, err := recoverSegment(l.Dir, baseOffset, l.config)
+		if err != nil {
+			return recovered, err
+		}
+		l.segments = append(l.segments, segment)
+		recovered = true
+		if truncated == 0 {
+			continue
+		}
+		fmt.Printf("Truncated %d bytes of invalid or partial batches from segment %d of %s\n", truncated, baseOffset, l.Partition)
+		// Anything written after a torn batch cannot be trusted either.
+		for _, later := range baseOffsets[i+1:] {
+			if err := deleteSegmentFiles(l.Dir, later); err != nil {
+				return recovered, err
+			}
+			fmt.Printf("Deleted segment %d of %s following the truncated one\n", later, l.Partition)
+		}
+		break
+	}
+	return recovered, nil
+}
+
+// loadProducerState rebuilds the producer state from the last snapshot and
+// the batches after it, or from the whole log if there is none. Snapshots past
+// the log end offset cover batches a crash lost, and are deleted. Replayed
+// abort markers are added to the transaction index of their segment if
+// missing, as when the crash came before the index was flushed.
+func (l *Log) loadProducerState() error {
+	logEndOffset := l.activeSegment().NextOffset()
+	if err := deleteProducerSnapshots(l.Dir, func(offset int64) bool { return offset > logEndOffset }); err != nil {
+		return err
+	}
+	offsets, err := listProducerSnapshots(l.Dir)
+	if err != nil {
+		return err
+	}
+	l.producers = newProducerState()
+	start := int64(0)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		state, err := readProducerSnapshot(segmentFileName(l.Dir, offsets[i], ProducerSnapshotFileSuffix))
+		if err != nil {
+			fmt.Printf("Ignoring producer snapshot of %s: %s\n", l.Partition, err.Error())
+			continue
+		}
+		l.producers, start = state, offsets[i]
+		break
+	}
+
+	for _, segment := range l.segments {
+		if segment.NextOffset() <= start {
+			continue
+		}
+		var replayErr error
+		err := segment.scan(segment.offsetIndex.Lookup(start), func(header Batch, position int64) bool {
+			decoded := record.DecodeHeader(header.Data)
+			if header.LastOffset < start || decoded.ProducerId == record.NoProducerId {
+				return true
+			}
+			batch := header
+			if decoded.IsControl() {
+				if batch, replayErr = segment.readWhole(header, position); replayErr != nil {
+					return false
+				}
+			}
+			if aborted := l.producers.update(batch); aborted != nil {
+				replayErr = segment.txnIndex.Append(*aborted)
+			}
+			return replayErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if replayErr != nil {
+			return replayErr
+		}
+	}
+	return nil
+}
+
+func (l *Log) Config() LogConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.config
+}
+
+func (l *Log) SetConfig(config LogConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+func (l *Log) setAppendListener(fn func(TopicPartition)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onAppend = fn
+}
+
+func (l *Log) activeSegment() *Segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// LogStartOffset is the first offset consumers may read. It can lie inside
+// the first segment once records have been deleted.
+func (l *Log) LogStartOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.logStartOffset
+}
+
+// LocalLogStartOffset is the first offset held in the local segments. Below
+// it, down to the log start offset, the records are in remote storage.
+func (l *Log) LocalLogStartOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.localLogStartOffset()
+}
+
+func (l *Log) localLogStartOffset() int64 {
+	return max(l.logStartOffset, l.segments[0].BaseOffset)
+}
+
+// HighestOffsetInRemoteStorage is the last offset copied to remote storage,
+// or -1 if there is none.
+func (l *Log) HighestOffsetInRemoteStorage() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.highestRemoteOffset
+}
+
+// maybeIncrementLogStartOffset moves the log start offset up to offset, but
+// never past the high watermark.
+func (l *Log) maybeIncrementLogStartOffset(offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset > l.logStartOffset {
+		l.logStartOffset = min(offset, l.highWatermark)
+	}
+}
+
+// tiered reports whether the log copies its segments to remote storage. It
+// must be called with the log locked.
+func (l *Log) tiered() bool {
+	return l.remote != nil && l.config.RemoteStorageEnable && !l.config.Compacts()
+}
+
+// LastStableOffset is the offset below which every transaction is decided,
+// which read_committed consumers read up to.
+func (l *Log) LastStableOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if offset, ok := l.producers.firstUnstableOffset(); ok {
+		return min(offset, l.highWatermark)
+	}
+	return l.highWatermark
+}
+
+func (l *Log) ActiveProducers() []ActiveProducer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.active()
+}
+
+// AbortedTransactions returns the aborted transactions with records from
+// startOffset up to upperOffset, for read_committed consumers to skip them.
+func (l *Log) AbortedTransactions(startOffset int64, upperOffset int64) ([]AbortedTxn, error) {
+	aborted := []AbortedTxn{}
+	l.mu.RLock()
+	remote, localStartOffset := l.remote, l.localLogStartOffset()
+	l.mu.RUnlock()
+	if remote != nil && startOffset < localStartOffset {
+		remoteAborted, complete, err := remote.abortedTransactions(l.Partition, startOffset, upperOffset)
+		if err != nil || complete {
+			return remoteAborted, err
+		}
+		aborted = remoteAborted
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, segment := range l.segments {
+		if segment.NextOffset() > startOffset {
+			aborted = segment.txnIndex.collect(aborted, startOffset, upperOffset)
+		}
+	}
+	return aborted, nil
+}
+
+// HighWatermark is the offset up to which records are committed and visible
+// to consumers.
+func (l *Log) HighWatermark() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.highWatermark
+}
+
+func (l *Log) RecoveryPoint() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recoveryPoint
+}
+
+func (l *Log) CheckpointedOffsets() CheckpointedOffsets {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return CheckpointedOffsets{
+		LogStartOffset: l.logStartOffset,
+		RecoveryPoint:  l.recoveryPoint,
+		HighWatermark:  l.highWatermark,
+	}
+}
+
+// maybeIncrementHighWatermark moves the high watermark up to the log end
+// offset. This broker is the only replica, and so the whole ISR, of every
+// partition it hosts, so a record is committed as soon as it is appended.
+func (l *Log) maybeIncrementHighWatermark() {
+	if leo := l.activeSegment().NextOffset(); leo > l.highWatermark {
+		l.highWatermark = leo
+	}
+}
+
+// LogEndOffset is the offset the next appended record will get.
+func (l *Log) LogEndOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment().NextOffset()
+}
+
+func (l *Log) OffsetMetadata(offset int64) (LogOffsetMetadata, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	active := l.activeSegment()
+	if offset < l.segments[0].BaseOffset || offset > active.NextOffset() {
+		return LogOffsetMetadata{}, fmt.Errorf("%w: %d is not in the local log of %s", ErrOffsetOutOfRange, offset, l.Partition)
+	}
+	if offset == active.NextOffset() {
+		return LogOffsetMetadata{Offset: offset, SegmentBaseOffset: active.BaseOffset, Position: active.size}, nil
+	}
+
+	segment := l.segments[sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].NextOffset() > offset
+	})]
+	metadata := LogOffsetMetadata{Offset: offset, SegmentBaseOffset: segment.BaseOffset, Position: segment.size}
+	err := segment.walk(offset, math.MaxInt, true, func(header Batch, position int64) bool {
+		metadata.Position = position
+		return false
+	})
+	if err != nil {
+		return LogOffsetMetadata{}, l.checkIO(err)
+	}
+	return metadata, nil
+}
+
+// Size is the total size of the log's segments.
+func (l *Log) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	size := int64(0)
+	for _, segment := range l.segments {
+		size += segment.Size()
+	}
+	return size
+}
+
+// checkIO reports I/O errors to the log's directory, see LogDir.checkIO. It
+// must be called with the log locked.
+func (l *Log) checkIO(err error) error {
+	if l.logDir == nil {
+		return err
+	}
+	return l.logDir.checkIO(err)
+}
+
+func (l *Log) Segments() []*Segment {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]*Segment{}, l.segments...)
+}
+
+// roll starts a new active segment. The previous one will not change again,
+// so it is flushed and the recovery point moves past it. The producer state
+// is snapshotted at the new segment's base offset.
+func (l *Log) roll() (*Segment, error) {
+	previous := l.activeSegment()
+	start := time.Now()
+	if err := previous.flush(); err != nil {
+		return nil, err
+	}
+	flushTimer.Update(time.Since(start))
+	l.recoveryPoint = max(l.recoveryPoint, previous.NextOffset())
+
+	if err := l.producers.writeSnapshot(l.Dir, previous.NextOffset()); err != nil {
+		return nil, err
+	}
+	segment, err := openSegment(l.Dir, previous.NextOffset(), l.config)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, segment)
+	return segment, nil
+}
+
+// Flush syncs every segment written since the recovery point and advances it
+// to the log end offset.
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkIO(l.flush())
+}
+
+func (l *Log) flush() error {
+	f := l.prepareFlush()
+	start := time.Now()
+	if err := syncFiles(f.files); err != nil {
+		return err
+	}
+	l.flushed(f, start)
+	return nil
+}
+
+// pendingFlush is a flush taken out of the log lock: the files to sync, and
+// the offset the recovery point reaches once they are.
+type pendingFlush struct {
+	files  []*segmentFile
+	offset int64
+}
+
+// prepareFlush returns the flush of every segment written since the recovery
+// point. It must be called with the log locked.
+func (l *Log) prepareFlush() *pendingFlush {
+	f := &pendingFlush{offset: l.activeSegment().NextOffset()}
+	for _, segment := range l.segments {
+		if segment.NextOffset() <= l.recoveryPoint && segment != l.activeSegment() {
+			continue
+		}
+		f.files = append(f.files, segment.files()...)
+	}
+	return f
+}
+
+// dueFlush returns the flush to do once flush.messages records have been
+// appended since the last flush, or flush.ms have passed with any appended,
+// or nil. It must be called with the log locked.
+func (l *Log) dueFlush(now time.Time) *pendingFlush {
+	unflushed := l.activeSegment().NextOffset() - l.recoveryPoint
+	if unflushed >= l.config.FlushMessages || (unflushed > 0 && now.Sub(l.lastFlush).Milliseconds() >= l.config.FlushMs) {
+		return l.prepareFlush()
+	}
+	return nil
+}
+
+// flushUnlocked syncs the files of f without holding the log lock, so that
+// reads and the appends queuing for the next group commit go on meanwhile,
+// then advances the recovery point.
+func (l *Log) flushUnlocked(f *pendingFlush) error {
+	start := time.Now()
+	err := syncFiles(f.files)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		return l.checkIO(err)
+	}
+	l.flushed(f, start)
+	return nil
+}
+
+// flushed moves the recovery point past a flush started at start. It must be
+// called with the log locked.
+func (l *Log) flushed(f *pendingFlush, start time.Time) {
+	l.recoveryPoint = max(l.recoveryPoint, min(f.offset, l.activeSegment().NextOffset()))
+	l.lastFlush = time.Now()
+	flushTimer.Update(l.lastFlush.Sub(start))
+}
+
+// flushIfDue applies the flush policy to a log that may not be appended to
+// for a while.
+func (l *Log) flushIfDue(now time.Time) error {
+	l.mu.Lock()
+	f := l.dueFlush(now)
+	l.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return l.flushUnlocked(f)
+}
+
+// Read returns the batches from the one containing startOffset onwards,
+// crossing segment boundaries, up to maxBytes. With minOneBatch the first
+// batch is returned even if it alone exceeds maxBytes.
+func (l *Log) Read(startOffset int64, maxBytes int, minOneBatch bool) ([]Batch, error) {
+	if batches, ok, err := l.readRemote(startOffset, maxBytes, minOneBatch, nil); ok {
+		return batches, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].NextOffset() > startOffset
+	})
+
+	batches := []Batch{}
+	for ; i < len(l.segments) && maxBytes > 0; i++ {
+		read, err := l.segments[i].read(startOffset, maxBytes, minOneBatch && len(batches) == 0)
+		if err != nil {
+			return nil, l.checkIO(err)
+		}
+		for _, batch := range read {
+			batches = append(batches, batch)
+			maxBytes -= batch.Size()
+		}
+		if len(read) == 0 && l.segments[i].Size() > 0 && l.segments[i].NextOffset() > startOffset {
+			break
+		}
+	}
+	return batches, nil
+}
+
+// readRemote reads from remote storage if startOffset is below the local log
+// start offset. It only reads the one remote segment holding startOffset, and
+// reports false if there is none.
+func (l *Log) readRemote(startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) ([]Batch, bool, error) {
+	l.mu.RLock()
+	remote, local := l.remote, startOffset >= l.localLogStartOffset()
+	l.mu.RUnlock()
+	if remote == nil || local {
+		return nil, false, nil
+	}
+	return remote.read(l.Partition, startOffset, maxBytes, minOneBatch, accept)
+}
+
+// ReadRecords is Read for sending the batches as they are: it returns them as
+// FileRecords, one per segment, without reading them. accept is called with
+// each batch header, and reading stops before the first one it turns down.
+// The FileRecords must be closed. Batches read from remote storage or from
+// encrypted segments are returned in memory instead.
+func (l *Log) ReadRecords(startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) ([]Records, error) {
+	if batches, ok, err := l.readRemote(startOffset, maxBytes, minOneBatch, accept); ok {
+		if err != nil || len(batches) == 0 {
+			return []Records{}, err
+		}
+		records := &memoryRecords{}
+		for _, batch := range batches {
+			records.batches = append(records.batches, batch.Data)
+			records.size += batch.Size()
+		}
+		return []Records{records}, nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].NextOffset() > startOffset
+	})
+
+	all := []Records{}
+	for ; i < len(l.segments) && maxBytes > 0; i++ {
+		records, rejected, err := l.segments[i].readRecords(startOffset, maxBytes, minOneBatch && len(all) == 0, accept)
+		if err != nil {
+			for _, r := range all {
+				r.Close()
+			}
+			return nil, l.checkIO(err)
+		}
+		if records != nil {
+			all = append(all, records)
+			maxBytes -= records.Size()
+		}
+		if rejected || (records == nil && l.segments[i].Size() > 0 && l.segments[i].NextOffset() > startOffset) {
+			break
+		}
+	}
+	return all, nil
+}
+
+// FindOffsetByTimestamp returns the offset and timestamp of the first record
+// from the log start offset on with a timestamp at or after timestamp,
+// searching remote storage first.
+func (l *Log) FindOffsetByTimestamp(timestamp int64) (offset int64, recordTimestamp int64, ok bool, err error) {
+	l.mu.RLock()
+	remote, logStartOffset, localStartOffset := l.remote, l.logStartOffset, l.localLogStartOffset()
+	l.mu.RUnlock()
+	if remote != nil && logStartOffset < localStartOffset {
+		offset, recordTimestamp, ok, err := remote.findOffsetByTimestamp(l.Partition, timestamp, logStartOffset, localStartOffset)
+		if err != nil || ok {
+			return offset, recordTimestamp, ok, err
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, segment := range l.segments {
+		offset, recordTimestamp, ok, err := segment.findByTimestamp(timestamp, l.logStartOffset)
+		if err != nil {
+			return -1, -1, false, l.checkIO(err)
+		}
+		if ok {
+			return offset, recordTimestamp, true, nil
+		}
+	}
+	return -1, -1, false, nil
+}
+
+// findInBatch returns the offset and timestamp of the first record of a batch
+// at or after startOffset with a timestamp at or after timestamp. There is
+// none if the records with such a timestamp lie below startOffset.
+func findInBatch(batch Batch, timestamp int64, startOffset int64) (int64, int64, bool, error) {
+	decoded, err := record.Decode(batch.Data)
+	if err != nil {
+		return -1, -1, false, err
+	}
+	for i := range decoded.Records {
+		offset, ts := decoded.Offset(&decoded.Records[i]), decoded.Timestamp(&decoded.Records[i])
+		if offset >= startOffset && ts >= timestamp {
+			return offset, ts, true, nil
+		}
+	}
+	return -1, -1, false, nil
+}
+
+// MaxTimestamp returns the batch holding the largest timestamp in the log.
+func (l *Log) MaxTimestamp() (timestamp int64, offset int64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	timestamp, offset = -1, -1
+	for _, segment := range l.segments {
+		if segment.maxTimestamp > timestamp {
+			timestamp, offset = segment.maxTimestamp, segment.offsetOfMaxTimestamp
+		}
+	}
+	return timestamp, offset
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.segments) == 0 {
+		// OpenLog failed before loading any segment.
+		return nil
+	}
+	firstErr := l.flush()
+	if firstErr == nil && l.producers != nil {
+		firstErr = l.producers.writeSnapshot(l.Dir, l.activeSegment().NextOffset())
+	}
+	for _, segment := range l.segments {
+		if err := segment.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func logDirName(root string, tp TopicPartition) string {
+	return filepath.Join(root, tp.String())
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	ErrLogDirNotFound = errors.New("log directory not found")
+	ErrLogDirOffline  = errors.New("log directory is offline")
+)
+
+// LogDir is one of the broker's log directories, holding partition
+// directories and the checkpoint files covering them. It goes offline on the
+// first I/O error and stays so until the broker restarts.
+type LogDir struct {
+	Path string
+
+	manager *LogManager
+	offline atomic.Bool
+
+	recoveryPoints  *OffsetCheckpoint
+	logStartOffsets *OffsetCheckpoint
+	highWatermarks  *OffsetCheckpoint
+	// checkpointed holds the last known offsets of the partitions placed in
+	// the directory, including those whose log has not been opened since
+	// startup. It is guarded by the manager's mutex.
+	checkpointed map[TopicPartition]CheckpointedOffsets
+	// cleanShutdown records whether the clean shutdown marker was present at
+	// startup.
+	cleanShutdown bool
+}
+
+func newLogDir(m *LogManager, path string) *LogDir {
+	d := &LogDir{
+		Path:            path,
+		manager:         m,
+		recoveryPoints:  NewOffsetCheckpoint(path, RecoveryPointCheckpointFile),
+		logStartOffsets: NewOffsetCheckpoint(path, LogStartOffsetCheckpointFile),
+		highWatermarks:  NewOffsetCheckpoint(path, HighWatermarkCheckpointFile),
+		checkpointed:    map[TopicPartition]CheckpointedOffsets{},
+	}
+	if _, err := os.Stat(filepath.Join(path, CleanShutdownFile)); err == nil {
+		d.cleanShutdown = true
+	}
+	d.loadCheckpoints()
+	return d
+}
+
+func (d *LogDir) loadCheckpoints() {
+	read := func(c *OffsetCheckpoint, set func(offsets *CheckpointedOffsets, offset int64)) {
+		entries, err := c.Read()
+		if err != nil {
+			fmt.Printf("Error loading checkpoint, ignoring it: %s\n", err.Error())
+			return
+		}
+		for tp, offset := range entries {
+			offsets := d.checkpointed[tp]
+			set(&offsets, offset)
+			d.checkpointed[tp] = offsets
+		}
+	}
+	read(d.recoveryPoints, func(o *CheckpointedOffsets, offset int64) { o.RecoveryPoint = offset })
+	read(d.logStartOffsets, func(o *CheckpointedOffsets, offset int64) { o.LogStartOffset = offset })
+	read(d.highWatermarks, func(o *CheckpointedOffsets, offset int64) { o.HighWatermark = offset })
+}
+
+func (d *LogDir) Offline() bool {
+	return d.offline.Load()
+}
+
+// exists reports whether anything has been written to the directory yet.
+func (d *LogDir) exists() bool {
+	_, err := os.Stat(d.Path)
+	return err == nil
+}
+
+// checkIO takes the directory offline if err is an I/O error, and returns
+// err.
+func (d *LogDir) checkIO(err error) error {
+	if err != nil && isIOError(err) {
+		d.manager.failDir(d, err)
+	}
+	return err
+}
+
+// isIOError tells the errors of the file system apart from those of the data
+// read from it.
+func isIOError(err error) bool {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var errno syscall.Errno
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &errno)
+}
+
+// failDir takes a directory offline and closes its logs. Clients get
+// KAFKA_STORAGE_ERROR for its partitions from then on, which are not
+// recreated elsewhere.
+func (m *LogManager) failDir(d *LogDir, err error) {
+	if m.closing.Load() || !d.offline.CompareAndSwap(false, true) {
+		return
+	}
+	fmt.Printf("Log directory %s is offline after an I/O error: %s\n", d.Path, err.Error())
+	// Logs are closed from their own goroutine, as the caller may hold the
+	// lock of one.
+	go func() {
+		m.mu.Lock()
+		logs := []*Log{}
+		for tp, log := range m.logs {
+			if m.placement[tp] == d {
+				logs = append(logs, log)
+				delete(m.logs, tp)
+			}
+		}
+		for tp, move := range m.moves {
+			if move.dest == d {
+				close(move.cancel)
+				delete(m.moves, tp)
+			}
+		}
+		m.mu.Unlock()
+		for _, log := range logs {
+			log.Close()
+		}
+		fmt.Printf("Stopped serving %d partitions of offline log directory %s\n", len(logs), d.Path)
+	}()
+}
+
+// ReplicaInfo describes a partition log for DescribeLogDirs.
+type ReplicaInfo struct {
+	Partition TopicPartition
+	Size      int64
+	// OffsetLag is how far the copy of a future replica is behind the log
+	// end offset.
+	OffsetLag int64
+	// IsFuture marks the copy of a log being moved into the directory.
+	IsFuture bool
+}
+
+type LogDirInfo struct {
+	Path    string
+	Offline bool
+	// TotalBytes and UsableBytes describe the file system holding the
+	// directory, or are -1 if unknown.
+	TotalBytes  int64
+	UsableBytes int64
+	Replicas    []ReplicaInfo
+}
+
+// DescribeLogDirs returns every log directory with the size of the logs it
+// holds and of the moves into it in progress.
+func (m *LogManager) DescribeLogDirs() []LogDirInfo {
+	m.mu.Lock()
+	logs := make(map[TopicPartition]*Log, len(m.logs))
+	for tp, log := range m.logs {
+		logs[tp] = log
+	}
+	placement := make(map[TopicPartition]*LogDir, len(m.placement))
+	for tp, d := range m.placement {
+		placement[tp] = d
+	}
+	moves := make(map[TopicPartition]*replicaMove, len(m.moves))
+	for tp, move := range m.moves {
+		moves[tp] = move
+	}
+	m.mu.Unlock()
+
+	infos := make([]LogDirInfo, len(m.Dirs))
+	for i, d := range m.Dirs {
+		info := &infos[i]
+		info.Path, info.Offline = d.Path, d.Offline()
+		info.TotalBytes, info.UsableBytes = -1, -1
+		info.Replicas = []ReplicaInfo{}
+		if info.Offline {
+			continue
+		}
+		if total, usable, err := diskSpace(d.Path); err == nil {
+			info.TotalBytes, info.UsableBytes = total, usable
+		}
+		for tp, log := range logs {
+			if placement[tp] == d {
+				info.Replicas = append(info.Replicas, ReplicaInfo{Partition: tp, Size: log.Size()})
+			}
+		}
+		for tp, move := range moves {
+			if move.dest == d {
+				info.Replicas = append(info.Replicas, ReplicaInfo{
+					Partition: tp,
+					Size:      move.copiedBytes.Load(),
+					OffsetLag: max(move.log.LogEndOffset()-move.copiedOffset.Load(), 0),
+					IsFuture:  true,
+				})
+			}
+		}
+	}
+	return infos
+}
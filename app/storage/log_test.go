@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+)
+
+// newTestLog opens partition 0 of topic test in a fresh log directory, the
+// broker configured with props.
+func newTestLog(t *testing.T, props map[string]string) (*LogManager, *Log) {
+	t.Helper()
+	m, log := openTestLog(t, t.TempDir(), props)
+	t.Cleanup(func() { m.Close() })
+	return m, log
+}
+
+// openTestLog opens partition 0 of topic test in dir, for the caller to
+// close.
+func openTestLog(t *testing.T, dir string, props map[string]string) (*LogManager, *Log) {
+	t.Helper()
+	m := NewLogManager([]string{dir}, config.New(props))
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		m.Close()
+		t.Fatalf("getLog: %v", err)
+	}
+	return m, log
+}
+
+func appendBatches(t *testing.T, log PartitionLog, batches ...[]byte) {
+	t.Helper()
+	for _, batch := range batches {
+		if _, err := log.Append(batch); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func baseOffsets(log *Log) []int64 {
+	offsets := []int64{}
+	for _, segment := range log.Segments() {
+		offsets = append(offsets, segment.BaseOffset)
+	}
+	return offsets
+}
+
+// readOffsets returns the base offsets of the batches Read returns.
+func readOffsets(t *testing.T, log PartitionLog, startOffset int64, maxBytes int) []int64 {
+	t.Helper()
+	batches, err := log.Read(startOffset, maxBytes, true)
+	if err != nil {
+		t.Fatalf("Read(%d): %v", startOffset, err)
+	}
+	offsets := []int64{}
+	for _, batch := range batches {
+		offsets = append(offsets, batch.BaseOffset)
+	}
+	return offsets
+}
+
+func TestLogRollsOnSegmentBytes(t *testing.T) {
+	// Segments of two 85 byte batches each.
+	_, log := newTestLog(t, map[string]string{"log.segment.bytes": "200"})
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+
+	if got, want := baseOffsets(log), []int64{0, 4, 8}; !slices.Equal(got, want) {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+	for _, baseOffset := range []int64{0, 4, 8} {
+		if _, err := os.Stat(segmentFileName(log.Dir, baseOffset, LogFileSuffix)); err != nil {
+			t.Errorf("segment %d: %v", baseOffset, err)
+		}
+	}
+	if got := log.LogEndOffset(); got != 10 {
+		t.Errorf("got log end offset %d, want 10", got)
+	}
+}
+
+func TestLogRollsOnSegmentMs(t *testing.T) {
+	_, log := newTestLog(t, map[string]string{"log.roll.ms": "60000"})
+	now := time.Now().UnixMilli()
+	// The segment is rolled on the timestamp of its first batch, however
+	// recent the later ones.
+	appendBatches(t, log, testBatch(1, now-120000), testBatch(1, now))
+	appendBatches(t, log, testBatch(1, now))
+	if got, want := baseOffsets(log), []int64{0, 1}; !slices.Equal(got, want) {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+}
+
+func TestLogRollsOnFullIndex(t *testing.T) {
+	// Room for three offset index entries, one for every batch but the first
+	// of a segment. The batches share a timestamp, indexed once.
+	_, log := newTestLog(t, map[string]string{
+		"log.index.interval.bytes": "1",
+		"log.index.size.max.bytes": "24",
+	})
+	batch := testBatch(1, time.Now().UnixMilli())
+	for range 6 {
+		appendBatches(t, log, batch)
+	}
+	if got, want := baseOffsets(log), []int64{0, 4}; !slices.Equal(got, want) {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+}
+
+func TestLogReadsAcrossSegments(t *testing.T) {
+	_, log := newTestLog(t, map[string]string{"log.segment.bytes": "200"})
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+
+	tests := []struct {
+		startOffset int64
+		maxBytes    int
+		want        []int64
+	}{
+		{0, 1 << 20, []int64{0, 2, 4, 6, 8}},
+		{3, 1 << 20, []int64{2, 4, 6, 8}},
+		{4, 1 << 20, []int64{4, 6, 8}},
+		{3, 3 * len(batch), []int64{2, 4, 6}},
+		// The first batch is returned however small maxBytes.
+		{5, 1, []int64{4}},
+		{10, 1 << 20, []int64{}},
+	}
+	for _, test := range tests {
+		if got := readOffsets(t, log, test.startOffset, test.maxBytes); !slices.Equal(got, test.want) {
+			t.Errorf("Read(%d, %d) returned batches %v, want %v", test.startOffset, test.maxBytes, got, test.want)
+		}
+	}
+}
+
+func TestLogReopensSegments(t *testing.T) {
+	dir := t.TempDir()
+	props := map[string]string{"log.segment.bytes": "200"}
+	m, log := openTestLog(t, dir, props)
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	m, log = openTestLog(t, dir, props)
+	defer m.Close()
+	if got, want := baseOffsets(log), []int64{0, 4, 8}; !slices.Equal(got, want) {
+		t.Errorf("reopened segments %v, want %v", got, want)
+	}
+	if got := log.LogEndOffset(); got != 10 {
+		t.Errorf("reopened log end offset %d, want 10", got)
+	}
+	appendBatches(t, log, batch)
+	if got, want := readOffsets(t, log, 0, 1<<20), []int64{0, 2, 4, 6, 8, 10}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v after reopening, want %v", got, want)
+	}
+}
+
+func TestOffsetMetadata(t *testing.T) {
+	// Segments of two batches each.
+	props := map[string]string{"log.segment.bytes": "200"}
+	_, fileLog := newTestLog(t, props)
+	memory := NewMemoryStorage(config.New(props))
+	t.Cleanup(func() { memory.Close() })
+	memoryLog, _ := memory.GetOrCreateLog(TopicPartition{Topic: "test", Partition: 0})
+
+	batch := testBatch(2, time.Now().UnixMilli())
+	for name, log := range map[string]PartitionLog{"file": fileLog, "memory": memoryLog} {
+		appendBatches(t, log, batch, batch, batch)
+		first, _ := log.OffsetMetadata(0)
+		tests := []struct {
+			offset, segment, position int64
+		}{
+			{0, 0, first.Position},
+			{1, 0, first.Position},
+			{2, 0, first.Position + int64(len(batch))},
+			{4, 4, first.Position},
+			{6, 4, first.Position + int64(len(batch))},
+		}
+		for _, test := range tests {
+			got, err := log.OffsetMetadata(test.offset)
+			if err != nil {
+				t.Errorf("%s: OffsetMetadata(%d): %v", name, test.offset, err)
+				continue
+			}
+			if want := (LogOffsetMetadata{test.offset, test.segment, test.position}); got != want {
+				t.Errorf("%s: OffsetMetadata(%d) = %+v, want %+v", name, test.offset, got, want)
+			}
+		}
+		if _, err := log.OffsetMetadata(7); !errors.Is(err, ErrOffsetOutOfRange) {
+			t.Errorf("%s: OffsetMetadata past the log end returned %v, want ErrOffsetOutOfRange", name, err)
+		}
+	}
+}
+
+func TestLogRetentionFallsBackToModificationTime(t *testing.T) {
+	_, log := newTestLog(t, map[string]string{"log.segment.bytes": "14", "log.retention.ms": "3600000"})
+	appendBatches(t, log, testBatch(1, -1), testBatch(1, -1), testBatch(1, -1))
+	if got, want := baseOffsets(log), []int64{0, 1, 2}; !slices.Equal(got, want) {
+		t.Fatalf("got segments %v, want %v", got, want)
+	}
+
+	// Only the first segment, of batches without timestamps, was last
+	// written two hours ago.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(log.Segments()[0].file.Name(), old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if deleted, err := log.DeleteOldSegments(time.Now()); err != nil || deleted != 1 {
+		t.Fatalf("DeleteOldSegments deleted %d segments (err %v), want 1", deleted, err)
+	}
+	if got, want := baseOffsets(log), []int64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("got segments %v, want %v", got, want)
+	}
+}
+
+func TestLogGroupCommit(t *testing.T) {
+	_, log := newTestLog(t, map[string]string{"log.flush.interval.messages": "1", "log.segment.bytes": "1000"})
+	const producers = 20
+	offsets := make(chan int64, producers)
+	var wg sync.WaitGroup
+	for range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch, err := log.Append(testBatch(2, time.Now().UnixMilli()))
+			if err != nil {
+				t.Errorf("Append: %v", err)
+				return
+			}
+			offsets <- batch.BaseOffset
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+
+	got := []int64{}
+	for offset := range offsets {
+		got = append(got, offset)
+	}
+	slices.Sort(got)
+	for i, offset := range got {
+		if offset != int64(2*i) {
+			t.Fatalf("got base offsets %v, want every other offset from 0 to %d", got, 2*producers-2)
+		}
+	}
+	// Every append returned once its batch was flushed.
+	if recoveryPoint, end := log.RecoveryPoint(), log.LogEndOffset(); recoveryPoint != end || end != 2*producers {
+		t.Errorf("got recovery point %d and log end offset %d, want both %d", recoveryPoint, end, 2*producers)
+	}
+	if got := readOffsets(t, log, 0, 1<<20); len(got) != producers {
+		t.Errorf("read %d batches, want %d", len(got), producers)
+	}
+}
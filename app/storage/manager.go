@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+)
+
+const (
+	DefaultLogDir = "/tmp/kraft-combined-logs"
+	// DefaultRemoteLogDir is where LocalTieredStorage keeps the remote tier.
+	DefaultRemoteLogDir = "/tmp/kraft-remote-logs"
+
+	// CleanShutdownFile marks a log directory whose logs were all flushed and
+	// closed, so they can be loaded without recovery.
+	CleanShutdownFile = ".kafka_cleanshutdown"
+)
+
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s-%d", tp.Topic, tp.Partition)
+}
+
+// LogManager owns every partition log under the broker's log directories
+// and the checkpoint files kept next to them. Each partition lives in exactly
+// one directory.
+type LogManager struct {
+	Dirs []*LogDir
+
+	broker *config.Config
+	mu     sync.Mutex
+	logs   map[TopicPartition]*Log
+	// placement records the directory of every partition known to the
+	// manager, including those on offline directories.
+	placement map[TopicPartition]*LogDir
+	// preferredDirs holds the directories AlterReplicaLogDirs asked for
+	// partitions that do not exist yet.
+	preferredDirs map[TopicPartition]*LogDir
+	moves         map[TopicPartition]*replicaMove
+	topicConfigs  map[string]map[string]string
+	onAppend      func(TopicPartition)
+	remote        *RemoteLogManager
+	keyring       *Keyring
+	// checkpointMu keeps the checkpoint files from being written twice at
+	// once.
+	checkpointMu sync.Mutex
+
+	closing atomic.Bool
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+func NewLogManager(dirs []string, broker *config.Config) *LogManager {
+	m := &LogManager{
+		broker:        broker,
+		logs:          map[TopicPartition]*Log{},
+		placement:     map[TopicPartition]*LogDir{},
+		preferredDirs: map[TopicPartition]*LogDir{},
+		moves:         map[TopicPartition]*replicaMove{},
+		topicConfigs:  map[string]map[string]string{},
+		stop:          make(chan struct{}),
+	}
+	for _, dir := range dirs {
+		m.Dirs = append(m.Dirs, newLogDir(m, dir))
+	}
+	return m
+}
+
+// StartCheckpointing writes the checkpoint files every interval until Close.
+func (m *LogManager) StartCheckpointing(interval time.Duration) {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				if err := m.Checkpoint(); err != nil {
+					fmt.Printf("Error writing checkpoints: %s\n", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// StartFlusher applies the flush policy to every open log each interval until
+// Close, so that the last records appended to a log do not wait for another
+// append to be flushed by flush.ms.
+func (m *LogManager) StartFlusher(interval time.Duration) {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				for _, log := range m.openLogs() {
+					if err := log.flushIfDue(now); err != nil {
+						fmt.Printf("Error flushing %s: %s\n", log.Partition, err.Error())
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Checkpoint persists the recovery point, log start offset and high
+// watermark of every partition, in the checkpoint files of its directory.
+func (m *LogManager) Checkpoint() error {
+	type checkpoints struct {
+		recoveryPoints, logStartOffsets, highWatermarks map[TopicPartition]int64
+	}
+	m.checkpointMu.Lock()
+	defer m.checkpointMu.Unlock()
+	m.mu.Lock()
+	for tp, log := range m.logs {
+		m.placement[tp].checkpointed[tp] = log.CheckpointedOffsets()
+	}
+	byDir := make([]checkpoints, len(m.Dirs))
+	for i, d := range m.Dirs {
+		c := checkpoints{
+			recoveryPoints:  make(map[TopicPartition]int64, len(d.checkpointed)),
+			logStartOffsets: make(map[TopicPartition]int64, len(d.checkpointed)),
+			highWatermarks:  make(map[TopicPartition]int64, len(d.checkpointed)),
+		}
+		for tp, offsets := range d.checkpointed {
+			c.recoveryPoints[tp] = offsets.RecoveryPoint
+			c.logStartOffsets[tp] = offsets.LogStartOffset
+			c.highWatermarks[tp] = offsets.HighWatermark
+		}
+		byDir[i] = c
+	}
+	m.mu.Unlock()
+
+	var firstErr error
+	for i, d := range m.Dirs {
+		// Nothing has been written to a missing directory, so there is
+		// nothing to checkpoint.
+		if d.Offline() || !d.exists() {
+			continue
+		}
+		c := byDir[i]
+		err := d.recoveryPoints.Write(c.recoveryPoints)
+		if err == nil {
+			err = d.logStartOffsets.Write(c.logStartOffsets)
+		}
+		if err == nil {
+			err = d.highWatermarks.Write(c.highWatermarks)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = d.checkIO(err)
+		}
+	}
+	return firstErr
+}
+
+// DeleteRecords deletes the records of a partition below offset, then writes
+// the checkpoints so that the new log start offset survives a crash.
+func (m *LogManager) DeleteRecords(tp TopicPartition, offset int64) (int64, error) {
+	log, err := m.getLog(tp, false)
+	if err != nil {
+		return -1, err
+	}
+	logStartOffset, err := log.deleteRecords(offset, time.Now())
+	if err != nil {
+		return -1, err
+	}
+	return logStartOffset, m.Checkpoint()
+}
+
+func (m *LogManager) LogConfig(topic string) LogConfig {
+	c := NewLogConfig(m.broker, m.topicConfigs[topic])
+	c.Keyring = m.keyring
+	return c
+}
+
+// SetKeyring turns on encryption at rest: segments created from now on are
+// encrypted with the keyring's current key. Like SetRemoteLogManager it must
+// be called before any log is opened, as encrypted segments cannot be read
+// without it.
+func (m *LogManager) SetKeyring(k *Keyring) {
+	m.keyring = k
+	if m.remote != nil {
+		m.remote.keyring = k
+	}
+}
+
+// SetTopicConfig records the topic level overrides and applies them to any
+// open logs of the topic.
+func (m *LogManager) SetTopicConfig(topic string, overrides map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.topicConfigs[topic] = overrides
+	for tp, log := range m.logs {
+		if tp.Topic == topic {
+			log.SetConfig(m.LogConfig(topic))
+		}
+	}
+}
+
+// LoadLogs opens every partition log found in the log directories, so that
+// background work such as retention covers partitions nobody has read yet. A
+// directory that cannot be read is taken offline.
+func (m *LogManager) LoadLogs() error {
+	for _, d := range m.Dirs {
+		entries, err := os.ReadDir(d.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			d.checkIO(fmt.Errorf("unable to list log dir %s: %w", d.Path, err))
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() && (strings.HasSuffix(name, futureDirSuffix) || strings.HasSuffix(name, deleteDirSuffix)) {
+				// A move interrupted by a restart is abandoned, its source
+				// kept.
+				if err := os.RemoveAll(filepath.Join(d.Path, name)); err != nil {
+					fmt.Printf("Error removing %s: %s\n", filepath.Join(d.Path, name), err.Error())
+				}
+				continue
+			}
+			tp, ok := parseTopicPartition(name)
+			if !entry.IsDir() || !ok {
+				continue
+			}
+			if other := m.dirOf(tp); other != nil && other != d {
+				// A move that stopped between its two renames leaves two
+				// identical copies.
+				fmt.Printf("Ignoring the copy of %s in %s, it is also in %s\n", tp, d.Path, other.Path)
+				continue
+			}
+			m.mu.Lock()
+			m.placement[tp] = d
+			m.mu.Unlock()
+			if _, err := m.GetLog(tp); err != nil {
+				fmt.Printf("Error loading log %s: %s\n", tp, err.Error())
+			}
+		}
+		// From here on the logs change, so only Close may vouch for them
+		// again.
+		if err := os.Remove(filepath.Join(d.Path, CleanShutdownFile)); err != nil && !os.IsNotExist(err) {
+			d.checkIO(fmt.Errorf("unable to remove clean shutdown marker: %w", err))
+		}
+	}
+	return nil
+}
+
+// parseTopicPartition parses a "topic-partition" directory name.
+func parseTopicPartition(name string) (TopicPartition, bool) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return TopicPartition{}, false
+	}
+	partition, err := strconv.ParseInt(name[i+1:], 10, 32)
+	if err != nil || partition < 0 {
+		return TopicPartition{}, false
+	}
+	return TopicPartition{Topic: name[:i], Partition: int32(partition)}, true
+}
+
+// SetAppendListener registers fn to be called after every append to any
+// log.
+func (m *LogManager) SetAppendListener(fn func(TopicPartition)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onAppend = fn
+	for _, log := range m.logs {
+		log.setAppendListener(fn)
+	}
+}
+
+// GetLog returns the log of an existing partition, opening it on first use.
+func (m *LogManager) GetLog(tp TopicPartition) (PartitionLog, error) {
+	return partitionLog(m.getLog(tp, false))
+}
+
+func (m *LogManager) GetOrCreateLog(tp TopicPartition) (PartitionLog, error) {
+	return partitionLog(m.getLog(tp, true))
+}
+
+// partitionLog keeps a nil *Log from becoming a non-nil PartitionLog.
+func partitionLog(log *Log, err error) (PartitionLog, error) {
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (m *LogManager) getLog(tp TopicPartition, create bool) (*Log, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if log, ok := m.logs[tp]; ok {
+		return log, nil
+	}
+	d := m.placement[tp]
+	if d == nil {
+		d = m.findLogDir(tp)
+	}
+	if d == nil && create {
+		if d = m.preferredDirs[tp]; d == nil || d.Offline() {
+			d = m.leastLoadedDir()
+		}
+		if d == nil {
+			return nil, fmt.Errorf("%w: no online log directory for %s", ErrLogDirOffline, tp)
+		}
+	}
+	if d == nil {
+		return nil, fmt.Errorf("no log for partition %s: %w", tp, os.ErrNotExist)
+	}
+	if d.Offline() {
+		return nil, fmt.Errorf("%w: %s holds %s", ErrLogDirOffline, d.Path, tp)
+	}
+	log, err := OpenLog(logDirName(d.Path, tp), tp, m.LogConfig(tp.Topic), d.checkpointed[tp], d.cleanShutdown)
+	if err != nil {
+		return nil, d.checkIO(err)
+	}
+	if m.remote != nil {
+		if err := m.remote.attach(log, d.checkpointed[tp]); err != nil {
+			log.Close()
+			return nil, fmt.Errorf("unable to read the remote segments of %s: %w", tp, err)
+		}
+	}
+	log.logDir = d
+	log.setAppendListener(m.onAppend)
+	m.logs[tp] = log
+	m.placement[tp] = d
+	delete(m.preferredDirs, tp)
+	return log, nil
+}
+
+// findLogDir looks for the partition's directory in the online log
+// directories.
+func (m *LogManager) findLogDir(tp TopicPartition) *LogDir {
+	for _, d := range m.Dirs {
+		if _, err := os.Stat(logDirName(d.Path, tp)); err == nil && !d.Offline() {
+			return d
+		}
+	}
+	return nil
+}
+
+// leastLoadedDir is the online directory holding, or about to hold, the
+// fewest partitions.
+func (m *LogManager) leastLoadedDir() *LogDir {
+	counts := map[*LogDir]int{}
+	for _, d := range m.placement {
+		counts[d]++
+	}
+	for _, move := range m.moves {
+		counts[move.dest]++
+	}
+	var least *LogDir
+	for _, d := range m.Dirs {
+		if !d.Offline() && (least == nil || counts[d] < counts[least]) {
+			least = d
+		}
+	}
+	return least
+}
+
+// dirOf returns the directory of a partition, or nil if it is not known.
+func (m *LogManager) dirOf(tp TopicPartition) *LogDir {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.placement[tp]
+}
+
+// logDir returns the log directory at path.
+func (m *LogManager) logDir(path string) *LogDir {
+	for _, d := range m.Dirs {
+		if filepath.Clean(d.Path) == filepath.Clean(path) {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *LogManager) openLogs() []*Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs := make([]*Log, 0, len(m.logs))
+	for _, log := range m.logs {
+		logs = append(logs, log)
+	}
+	return logs
+}
+
+// Close flushes and closes every log, then writes the final checkpoints and
+// the clean shutdown marker of every directory whose logs all closed. Nothing
+// may append to the logs any more, the request handlers having drained.
+func (m *LogManager) Close() error {
+	m.closing.Store(true)
+	close(m.stop)
+	m.done.Wait()
+
+	m.mu.Lock()
+	var firstErr error
+	failed := map[*LogDir]bool{}
+	for tp, log := range m.logs {
+		d := m.placement[tp]
+		if err := log.Close(); err != nil {
+			failed[d] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		d.checkpointed[tp] = log.CheckpointedOffsets()
+		delete(m.logs, tp)
+	}
+	m.mu.Unlock()
+
+	if err := m.Checkpoint(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	for _, d := range m.Dirs {
+		if failed[d] || d.Offline() || !d.exists() {
+			continue
+		}
+		if err := writeFileAtomically(filepath.Join(d.Path, CleanShutdownFile), nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
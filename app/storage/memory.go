@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// MemoryStorage keeps partition logs in memory, to run the broker
+// hermetically in tests and throwaway environments. Nothing survives a
+// restart, logs are never compacted, and there are no log directories to
+// describe or move replicas between.
+type MemoryStorage struct {
+	broker       *config.Config
+	mu           sync.Mutex
+	logs         map[TopicPartition]*MemoryLog
+	topicConfigs map[string]map[string]string
+	onAppend     func(TopicPartition)
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewMemoryStorage(broker *config.Config) *MemoryStorage {
+	return &MemoryStorage{
+		broker:       broker,
+		logs:         map[TopicPartition]*MemoryLog{},
+		topicConfigs: map[string]map[string]string{},
+		stop:         make(chan struct{}),
+	}
+}
+
+func (s *MemoryStorage) LogConfig(topic string) LogConfig {
+	return NewLogConfig(s.broker, s.topicConfigs[topic])
+}
+
+func (s *MemoryStorage) SetTopicConfig(topic string, overrides map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topicConfigs[topic] = overrides
+	for tp, log := range s.logs {
+		if tp.Topic == topic {
+			log.setConfig(s.LogConfig(topic))
+		}
+	}
+}
+
+func (s *MemoryStorage) SetAppendListener(fn func(TopicPartition)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onAppend = fn
+	for _, log := range s.logs {
+		log.setAppendListener(fn)
+	}
+}
+
+func (s *MemoryStorage) GetLog(tp TopicPartition) (PartitionLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log, ok := s.logs[tp]
+	if !ok {
+		return nil, fmt.Errorf("no log for partition %s: %w", tp, os.ErrNotExist)
+	}
+	return log, nil
+}
+
+func (s *MemoryStorage) GetOrCreateLog(tp TopicPartition) (PartitionLog, error) {
+	return s.getOrCreateLog(tp), nil
+}
+
+func (s *MemoryStorage) getOrCreateLog(tp TopicPartition) *MemoryLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log, ok := s.logs[tp]
+	if !ok {
+		log = &MemoryLog{Partition: tp, config: s.LogConfig(tp.Topic), onAppend: s.onAppend, producers: newProducerState(), aborted: []AbortedTxn{}}
+		log.segments = []*memorySegment{newMemorySegment(0)}
+		s.logs[tp] = log
+	}
+	return log
+}
+
+// LoadLog seeds a partition with the batches of the segment files in dir,
+// such as the cluster metadata log of a log directory, keeping their
+// offsets. The files are only read, and a partial batch ending one is
+// ignored.
+func (s *MemoryStorage) LoadLog(tp TopicPartition, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("unable to list log dir %s: %w", dir, err)
+	}
+	baseOffsets := []int64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64); err == nil && strings.HasSuffix(name, LogFileSuffix) {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	log := s.getOrCreateLog(tp)
+	for _, baseOffset := range baseOffsets {
+		path := segmentFileName(dir, baseOffset, LogFileSuffix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read segment %s: %w", path, err)
+		}
+		if _, _, encrypted, _ := parseEncryptionHeader(data); encrypted {
+			return fmt.Errorf("segment %s is encrypted, which the memory backend cannot read", path)
+		}
+		for len(data) >= record.HeaderSize && record.Size(data) <= len(data) {
+			size := record.Size(data)
+			if err := record.Validate(data[:size]); err != nil {
+				return fmt.Errorf("segment %s: %w", path, err)
+			}
+			log.restore(parseBatchHeader(data[:size]))
+			data = data[size:]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeleteRecords(tp TopicPartition, offset int64) (int64, error) {
+	s.mu.Lock()
+	log, ok := s.logs[tp]
+	s.mu.Unlock()
+	if !ok {
+		return -1, fmt.Errorf("no log for partition %s: %w", tp, os.ErrNotExist)
+	}
+	return log.deleteRecords(offset, time.Now())
+}
+
+// DescribeLogDirs returns no directories, there being none.
+func (s *MemoryStorage) DescribeLogDirs() []LogDirInfo {
+	return []LogDirInfo{}
+}
+
+func (s *MemoryStorage) AlterReplicaLogDir(tp TopicPartition, path string) error {
+	return fmt.Errorf("%w: %s", ErrLogDirNotFound, path)
+}
+
+func (s *MemoryStorage) StartRetention(interval time.Duration) {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.RunRetention()
+			}
+		}
+	}()
+}
+
+func (s *MemoryStorage) RunRetention() {
+	s.mu.Lock()
+	logs := make([]*MemoryLog, 0, len(s.logs))
+	for _, log := range s.logs {
+		logs = append(logs, log)
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, log := range logs {
+		log.DeleteOldSegments(now)
+	}
+}
+
+func (s *MemoryStorage) Close() error {
+	close(s.stop)
+	s.done.Wait()
+	return nil
+}
+
+// MemoryLog is a partition log of a MemoryStorage. Its segments roll and are
+// deleted like those of a Log, without the indexes.
+type MemoryLog struct {
+	Partition TopicPartition
+
+	mu       sync.RWMutex
+	config   LogConfig
+	segments []*memorySegment
+	onAppend func(TopicPartition)
+
+	// producers follows the idempotent and transactional producers, and
+	// aborted lists the transactions they aborted.
+	producers *producerState
+	aborted   []AbortedTxn
+
+	logStartOffset int64
+	highWatermark  int64
+}
+
+type memorySegment struct {
+	baseOffset           int64
+	nextOffset           int64
+	batches              []Batch
+	size                 int64
+	rollTimestamp        int64
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+	// lastModified stands in for the log file's modification time when
+	// no batch has a timestamp.
+	lastModified time.Time
+}
+
+func newMemorySegment(baseOffset int64) *memorySegment {
+	return &memorySegment{baseOffset: baseOffset, nextOffset: baseOffset, rollTimestamp: -1, maxTimestamp: -1, offsetOfMaxTimestamp: -1}
+}
+
+func (s *memorySegment) append(batch Batch) {
+	s.batches = append(s.batches, batch)
+	s.lastModified = time.Now()
+	s.size += int64(batch.Size())
+	s.nextOffset = batch.LastOffset + 1
+	if s.rollTimestamp < 0 {
+		s.rollTimestamp = batch.MaxTimestamp
+	}
+	if batch.MaxTimestamp > s.maxTimestamp {
+		s.maxTimestamp, s.offsetOfMaxTimestamp = batch.MaxTimestamp, batch.LastOffset
+	}
+}
+
+func (s *memorySegment) shouldRoll(config LogConfig, size int, now time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+	return s.size+int64(size) > config.SegmentBytes || (s.rollTimestamp >= 0 && now.UnixMilli()-s.rollTimestamp > config.SegmentMs)
+}
+
+func (l *MemoryLog) Config() LogConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.config
+}
+
+func (l *MemoryLog) setConfig(config LogConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+func (l *MemoryLog) setAppendListener(fn func(TopicPartition)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onAppend = fn
+}
+
+func (l *MemoryLog) activeSegment() *memorySegment {
+	return l.segments[len(l.segments)-1]
+}
+
+func (l *MemoryLog) Append(data []byte) (Batch, error) {
+	if err := record.Validate(data); err != nil {
+		return Batch{}, err
+	}
+	// The caller keeps its buffer.
+	data = bytes.Clone(data)
+
+	l.mu.Lock()
+	duplicate, err := l.producers.check(data)
+	if err != nil || duplicate != nil {
+		l.mu.Unlock()
+		if duplicate != nil {
+			return *duplicate, nil
+		}
+		return Batch{}, err
+	}
+	segment := l.activeSegment()
+	if segment.shouldRoll(l.config, len(data), time.Now()) {
+		segment = newMemorySegment(segment.nextOffset)
+		l.segments = append(l.segments, segment)
+	}
+	record.SetBaseOffset(data, segment.nextOffset)
+	batch := parseBatchHeader(data)
+	segment.append(batch)
+	if txn := l.producers.update(batch); txn != nil {
+		l.aborted = append(l.aborted, *txn)
+	}
+	l.highWatermark = segment.nextOffset
+	onAppend := l.onAppend
+	l.mu.Unlock()
+
+	if onAppend != nil {
+		onAppend(l.Partition)
+	}
+	return batch, nil
+}
+
+// restore appends a batch read back from a segment file with its offsets.
+func (l *MemoryLog) restore(batch Batch) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segment := l.activeSegment()
+	if segment.size == 0 && len(l.segments) == 1 {
+		segment.baseOffset = batch.BaseOffset
+		l.logStartOffset = batch.BaseOffset
+	}
+	segment.append(batch)
+	if txn := l.producers.update(batch); txn != nil {
+		l.aborted = append(l.aborted, *txn)
+	}
+	l.highWatermark = segment.nextOffset
+}
+
+// walk calls fn with the batches holding offsets >= startOffset, until it
+// returns false or maxBytes would be exceeded, see Segment.walk.
+func (l *MemoryLog) walk(startOffset int64, maxBytes int, minOneBatch bool, fn func(batch Batch) bool) {
+	total := 0
+	for _, segment := range l.segments {
+		if segment.nextOffset <= startOffset {
+			continue
+		}
+		for _, batch := range segment.batches {
+			if batch.LastOffset < startOffset {
+				continue
+			}
+			if total+batch.Size() > maxBytes && (total > 0 || !minOneBatch) {
+				return
+			}
+			total += batch.Size()
+			if !fn(batch) {
+				return
+			}
+		}
+	}
+}
+
+func (l *MemoryLog) Read(startOffset int64, maxBytes int, minOneBatch bool) ([]Batch, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	batches := []Batch{}
+	l.walk(startOffset, maxBytes, minOneBatch, func(batch Batch) bool {
+		batches = append(batches, batch)
+		return true
+	})
+	return batches, nil
+}
+
+// ReadRecords returns the batches as one memoryRecords. Appended batches
+// never change, so it shares them.
+func (l *MemoryLog) ReadRecords(startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) ([]Records, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	records := &memoryRecords{}
+	l.walk(startOffset, maxBytes, minOneBatch, func(batch Batch) bool {
+		if !accept(batch) {
+			return false
+		}
+		records.batches = append(records.batches, batch.Data)
+		records.size += batch.Size()
+		return true
+	})
+	if records.size == 0 {
+		return []Records{}, nil
+	}
+	return []Records{records}, nil
+}
+
+func (l *MemoryLog) LogStartOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.logStartOffset
+}
+
+// LocalLogStartOffset is the log start offset, a MemoryLog never being
+// tiered.
+func (l *MemoryLog) LocalLogStartOffset() int64 {
+	return l.LogStartOffset()
+}
+
+func (l *MemoryLog) HighestOffsetInRemoteStorage() int64 {
+	return -1
+}
+
+func (l *MemoryLog) HighWatermark() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.highWatermark
+}
+
+func (l *MemoryLog) LastStableOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if offset, ok := l.producers.firstUnstableOffset(); ok {
+		return min(offset, l.highWatermark)
+	}
+	return l.highWatermark
+}
+
+func (l *MemoryLog) ActiveProducers() []ActiveProducer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.active()
+}
+
+func (l *MemoryLog) AbortedTransactions(startOffset int64, upperOffset int64) ([]AbortedTxn, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	aborted := []AbortedTxn{}
+	for _, txn := range l.aborted {
+		if txn.LastOffset >= startOffset && txn.FirstOffset < upperOffset {
+			aborted = append(aborted, txn)
+		}
+	}
+	return aborted, nil
+}
+
+func (l *MemoryLog) LogEndOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment().nextOffset
+}
+
+func (l *MemoryLog) OffsetMetadata(offset int64) (LogOffsetMetadata, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if offset < l.segments[0].baseOffset || offset > l.activeSegment().nextOffset {
+		return LogOffsetMetadata{}, fmt.Errorf("%w: %d is not in the log of %s", ErrOffsetOutOfRange, offset, l.Partition)
+	}
+	for _, segment := range l.segments {
+		if segment.nextOffset <= offset && segment != l.activeSegment() {
+			continue
+		}
+		metadata := LogOffsetMetadata{Offset: offset, SegmentBaseOffset: segment.baseOffset, Position: segment.size}
+		position := int64(0)
+		for _, batch := range segment.batches {
+			if batch.LastOffset >= offset {
+				metadata.Position = position
+				break
+			}
+			position += int64(batch.Size())
+		}
+		return metadata, nil
+	}
+	panic("unreachable")
+}
+
+func (l *MemoryLog) FindOffsetByTimestamp(timestamp int64) (int64, int64, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, segment := range l.segments {
+		if segment.maxTimestamp < timestamp || segment.nextOffset <= l.logStartOffset {
+			continue
+		}
+		for _, batch := range segment.batches {
+			if batch.MaxTimestamp < timestamp || batch.LastOffset < l.logStartOffset {
+				continue
+			}
+			if offset, recordTimestamp, ok, err := findInBatch(batch, timestamp, l.logStartOffset); ok || err != nil {
+				return offset, recordTimestamp, ok, err
+			}
+		}
+	}
+	return -1, -1, false, nil
+}
+
+func (l *MemoryLog) MaxTimestamp() (int64, int64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	timestamp, offset := int64(-1), int64(-1)
+	for _, segment := range l.segments {
+		if segment.maxTimestamp > timestamp {
+			timestamp, offset = segment.maxTimestamp, segment.offsetOfMaxTimestamp
+		}
+	}
+	return timestamp, offset
+}
+
+func (l *MemoryLog) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	size := int64(0)
+	for _, segment := range l.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// Flush does nothing, there being nowhere to flush to.
+func (l *MemoryLog) Flush() error {
+	return nil
+}
+
+// deleteRecords is Log.deleteRecords.
+func (l *MemoryLog) deleteRecords(offset int64, now time.Time) (int64, error) {
+	l.mu.Lock()
+	if offset == HighWatermarkOffset {
+		offset = l.highWatermark
+	}
+	if offset < 0 || offset > l.highWatermark {
+		l.mu.Unlock()
+		return -1, fmt.Errorf("%w: %d is not between 0 and the high watermark %d of %s", ErrOffsetOutOfRange, offset, l.highWatermark, l.Partition)
+	}
+	l.logStartOffset = max(l.logStartOffset, offset)
+	if active := l.activeSegment(); active.size > 0 && active.nextOffset <= l.logStartOffset {
+		l.segments = append(l.segments, newMemorySegment(active.nextOffset))
+	}
+	l.mu.Unlock()
+
+	l.DeleteOldSegments(now)
+	return l.LogStartOffset(), nil
+}
+
+func (l *MemoryLog) DeleteOldSegments(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	totalSize := int64(0)
+	for _, segment := range l.segments {
+		totalSize += segment.size
+	}
+	deleted := 0
+	for len(l.segments) > 1 {
+		segment := l.segments[0]
+		timestamp := segment.maxTimestamp
+		if timestamp < 0 {
+			timestamp = segment.lastModified.UnixMilli()
+		}
+		reason := deletionReason(l.config, false, l.logStartOffset, segment.nextOffset, timestamp, segment.size, totalSize, now)
+		if reason == "" {
+			break
+		}
+		l.segments = l.segments[1:]
+		totalSize -= segment.size
+		deleted++
+		l.logStartOffset = max(l.logStartOffset, l.segments[0].baseOffset)
+		fmt.Printf("Deleted segment %d-%d of %s because %s\n", segment.baseOffset, segment.nextOffset-1, l.Partition, reason)
+	}
+	if deleted > 0 {
+		l.producers.truncateHead(l.logStartOffset)
+		for len(l.aborted) > 0 && l.aborted[0].LastOffset < l.logStartOffset {
+			l.aborted = l.aborted[1:]
+		}
+	}
+	return deleted, nil
+}
+
+// memoryRecords are batches held in memory, of a MemoryLog or read from
+// remote storage, for sending.
+type memoryRecords struct {
+	batches [][]byte
+	size    int
+}
+
+func (r *memoryRecords) Size() int {
+	return r.size
+}
+
+func (r *memoryRecords) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for _, data := range r.batches {
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (r *memoryRecords) Close() error {
+	return nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// testBatch encodes a batch of count records with timestamps from timestamp
+// on, one millisecond apart.
+func testBatch(count int, timestamp int64) []byte {
+	batch := &record.RecordBatch{
+		LastOffsetDelta: int32(count - 1),
+		BaseTimestamp:   timestamp,
+		MaxTimestamp:    timestamp + int64(count-1),
+		ProducerId:      -1,
+		ProducerEpoch:   -1,
+		BaseSequence:    -1,
+	}
+	for i := range count {
+		batch.Records = append(batch.Records, record.Record{
+			TimestampDelta: int64(i),
+			OffsetDelta:    int32(i),
+			Value:          []byte("value"),
+		})
+	}
+	return batch.Encode()
+}
+
+func newTestMemoryLog(t *testing.T) (*MemoryStorage, PartitionLog) {
+	t.Helper()
+	s := NewMemoryStorage(config.New(nil))
+	t.Cleanup(func() { s.Close() })
+	log, err := s.GetOrCreateLog(TopicPartition{Topic: "test", Partition: 0})
+	if err != nil {
+		t.Fatalf("GetOrCreateLog: %v", err)
+	}
+	return s, log
+}
+
+func TestMemoryLogAppendAndRead(t *testing.T) {
+	_, log := newTestMemoryLog(t)
+	for i := range 3 {
+		batch, err := log.Append(testBatch(2, time.Now().UnixMilli()))
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if batch.BaseOffset != int64(i)*2 {
+			t.Errorf("batch %d got base offset %d, want %d", i, batch.BaseOffset, i*2)
+		}
+	}
+	if got := log.LogEndOffset(); got != 6 {
+		t.Errorf("LogEndOffset() = %d, want 6", got)
+	}
+	if got := log.HighWatermark(); got != 6 {
+		t.Errorf("HighWatermark() = %d, want 6", got)
+	}
+
+	batches, err := log.Read(3, 1<<20, true)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(batches) != 2 || batches[0].BaseOffset != 2 || batches[1].BaseOffset != 4 {
+		t.Fatalf("Read(3) returned %d batches, want the batches at offsets 2 and 4", len(batches))
+	}
+	decoded, err := record.Decode(batches[1].Data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded.BaseOffset != 4 || len(decoded.Records) != 2 {
+		t.Errorf("read batch has base offset %d and %d records, want 4 and 2", decoded.BaseOffset, len(decoded.Records))
+	}
+
+	// Only the first batch is returned past maxBytes, and only with
+	// minOneBatch.
+	if batches, _ := log.Read(0, 1, true); len(batches) != 1 {
+		t.Errorf("Read with minOneBatch returned %d batches, want 1", len(batches))
+	}
+	if batches, _ := log.Read(0, 1, false); len(batches) != 0 {
+		t.Errorf("Read without minOneBatch returned %d batches, want 0", len(batches))
+	}
+}
+
+func TestMemoryLogFindOffsetByTimestamp(t *testing.T) {
+	_, log := newTestMemoryLog(t)
+	now := time.Now().UnixMilli()
+	log.Append(testBatch(2, now))
+	log.Append(testBatch(2, now+1000))
+
+	offset, timestamp, ok, err := log.FindOffsetByTimestamp(now + 500)
+	if err != nil || !ok || offset != 2 || timestamp != now+1000 {
+		t.Errorf("FindOffsetByTimestamp(now+500) = %d, %d, %t, %v, want 2, %d, true", offset, timestamp, ok, err, now+1000)
+	}
+	if _, _, ok, _ := log.FindOffsetByTimestamp(now + 2000); ok {
+		t.Errorf("FindOffsetByTimestamp(now+2000) found an offset past the last record")
+	}
+	if timestamp, offset := log.MaxTimestamp(); timestamp != now+1001 || offset != 3 {
+		t.Errorf("MaxTimestamp() = %d, %d, want %d, 3", timestamp, offset, now+1001)
+	}
+}
+
+func TestMemoryStorageDeleteRecords(t *testing.T) {
+	s, log := newTestMemoryLog(t)
+	tp := TopicPartition{Topic: "test", Partition: 0}
+	for i := range 3 {
+		log.Append(testBatch(2, time.Now().UnixMilli()+int64(i)))
+	}
+
+	start, err := s.DeleteRecords(tp, 3)
+	if err != nil || start != 3 {
+		t.Fatalf("DeleteRecords(3) = %d, %v, want 3", start, err)
+	}
+	if got := log.LogStartOffset(); got != 3 {
+		t.Errorf("LogStartOffset() = %d, want 3", got)
+	}
+	// Timestamp lookups skip the deleted records.
+	if offset, _, ok, _ := log.FindOffsetByTimestamp(0); !ok || offset != 3 {
+		t.Errorf("FindOffsetByTimestamp(0) = %d, %t, want 3, true", offset, ok)
+	}
+
+	if _, err := s.DeleteRecords(tp, 7); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("DeleteRecords past the high watermark returned %v, want ErrOffsetOutOfRange", err)
+	}
+	// The log start offset never moves back.
+	if start, err := s.DeleteRecords(tp, 1); err != nil || start != 3 {
+		t.Errorf("DeleteRecords(1) = %d, %v, want 3", start, err)
+	}
+	if start, err := s.DeleteRecords(tp, HighWatermarkOffset); err != nil || start != 6 {
+		t.Errorf("DeleteRecords(HighWatermarkOffset) = %d, %v, want 6", start, err)
+	}
+	if _, err := s.DeleteRecords(TopicPartition{Topic: "unknown", Partition: 0}, 0); err == nil {
+		t.Errorf("DeleteRecords on an unknown partition succeeded")
+	}
+}
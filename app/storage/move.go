@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// futureDirSuffix and deleteDirSuffix end the names of a log's copy
+	// being moved into a directory and of the original being removed.
+	futureDirSuffix = "-future"
+	deleteDirSuffix = "-delete"
+
+	moveChunkSize = 1 << 20
+)
+
+var errMoveCancelled = errors.New("replica move cancelled")
+
+// replicaMove is a move of a partition's log to another log directory in
+// progress, see LogManager.AlterReplicaLogDir.
+type replicaMove struct {
+	log  *Log
+	dest *LogDir
+	// cancel is closed when the move is superseded or its destination fails.
+	cancel chan struct{}
+
+	copiedBytes atomic.Int64
+	// copiedOffset is the offset up to which the copy has caught up.
+	copiedOffset atomic.Int64
+}
+
+// AlterReplicaLogDir moves the log of a partition to the log directory at
+// path. The files are copied into a future directory in the background while
+// the log keeps serving, then the log blocks just long enough to copy what
+// changed meanwhile and swap to the copy. A partition that does not exist yet
+// is created in path.
+func (m *LogManager) AlterReplicaLogDir(tp TopicPartition, path string) error {
+	dest := m.logDir(path)
+	if dest == nil {
+		return fmt.Errorf("%w: %s", ErrLogDirNotFound, path)
+	}
+	if dest.Offline() {
+		return fmt.Errorf("%w: %s", ErrLogDirOffline, path)
+	}
+	log, err := m.getLog(tp, false)
+	if errors.Is(err, ErrLogDirOffline) {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.preferredDirs[tp] = dest
+		return nil
+	}
+	if move := m.moves[tp]; move != nil {
+		if move.dest == dest {
+			return nil
+		}
+		close(move.cancel)
+		delete(m.moves, tp)
+	}
+	if m.placement[tp] == dest {
+		return nil
+	}
+	move := &replicaMove{log: log, dest: dest, cancel: make(chan struct{})}
+	m.moves[tp] = move
+	m.done.Add(1)
+	go m.runMove(move)
+	return nil
+}
+
+func (m *LogManager) runMove(move *replicaMove) {
+	defer m.done.Done()
+	tp := move.log.Partition
+	moved, err := move.log.moveTo(move, m.stop)
+
+	m.mu.Lock()
+	if m.moves[tp] == move {
+		delete(m.moves, tp)
+	}
+	if moved {
+		delete(m.placement[tp].checkpointed, tp)
+		m.placement[tp] = move.dest
+		move.dest.checkpointed[tp] = move.log.CheckpointedOffsets()
+	}
+	m.mu.Unlock()
+
+	switch {
+	case moved:
+		fmt.Printf("Moved %s to log directory %s\n", tp, move.dest.Path)
+	case errors.Is(err, errMoveCancelled):
+	case err != nil:
+		fmt.Printf("Error moving %s to log directory %s: %s\n", tp, move.dest.Path, err.Error())
+	}
+}
+
+// moveTo copies the log into a future directory of move.dest and swaps it
+// in. It reports whether the log moved, which it does not if it is already
+// in move.dest.
+func (l *Log) moveTo(move *replicaMove, stop <-chan struct{}) (bool, error) {
+	// An earlier move of the log finishes or gives up first.
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+
+	l.mu.RLock()
+	src, current := l.Dir, l.logDir
+	leo := l.activeSegment().NextOffset()
+	l.mu.RUnlock()
+	if current == move.dest {
+		return false, nil
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	future := filepath.Join(move.dest.Path, fmt.Sprintf("%s.%s%s", l.Partition, hex.EncodeToString(id), futureDirSuffix))
+	if err := os.MkdirAll(future, 0755); err != nil {
+		return false, move.dest.checkIO(fmt.Errorf("unable to create %s: %w", future, err))
+	}
+	defer os.RemoveAll(future)
+
+	copied := map[string]int64{}
+	cancelled := func() bool {
+		select {
+		case <-move.cancel:
+			return true
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+	if err := syncLogFiles(src, future, copied, move, cancelled); err != nil {
+		return false, err
+	}
+	move.copiedOffset.Store(leo)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cancelled() {
+		return false, errMoveCancelled
+	}
+	if err := l.flush(); err != nil {
+		return false, l.checkIO(err)
+	}
+	if err := syncLogFiles(src, future, copied, move, func() bool { return false }); err != nil {
+		return false, err
+	}
+
+	for _, segment := range l.segments {
+		segment.Close()
+	}
+	target := logDirName(move.dest.Path, l.Partition)
+	if err := os.Rename(future, target); err != nil {
+		err = fmt.Errorf("unable to rename %s: %w", future, err)
+		return false, errors.Join(err, l.reopenSegments())
+	}
+	l.Dir, l.logDir = target, move.dest
+	if err := l.reopenSegments(); err != nil {
+		return true, err
+	}
+	// Until the original is gone a restart finds two identical copies and
+	// keeps one.
+	deleted := fmt.Sprintf("%s.%s%s", src, hex.EncodeToString(id), deleteDirSuffix)
+	if err := os.Rename(src, deleted); err != nil {
+		fmt.Printf("Error removing the moved log %s: %s\n", src, err.Error())
+	} else if err := os.RemoveAll(deleted); err != nil {
+		fmt.Printf("Error removing the moved log %s: %s\n", src, err.Error())
+	}
+	return true, nil
+}
+
+// reopenSegments reloads the segments from l.Dir, which holds them flushed.
+func (l *Log) reopenSegments() error {
+	l.segments = nil
+	if _, err := l.loadSegments(l.recoveryPoint, true); err != nil {
+		return l.checkIO(err)
+	}
+	if len(l.segments) == 0 {
+		return fmt.Errorf("no segments left in %s", l.Dir)
+	}
+	return nil
+}
+
+// syncLogFiles brings the copy of a log directory in dst up to date. The
+// segment and index files only ever grow, so a file longer than what copied
+// records is copied from there on, and one that shrank is copied again.
+// Files deleted from src, by retention, are deleted from dst.
+func syncLogFiles(src string, dst string, copied map[string]int64, move *replicaMove, cancelled func() bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("unable to list log dir %s: %w", src, err)
+	}
+	present := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		present[name] = true
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to stat %s: %w", filepath.Join(src, name), err)
+		}
+		from, ok := copied[name]
+		if ok && info.Size() == from {
+			continue
+		}
+		if info.Size() < from {
+			move.copiedBytes.Add(-from)
+			from = 0
+		}
+		if strings.HasSuffix(name, LogFileSuffix) {
+			if baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64); err == nil {
+				move.copiedOffset.Store(baseOffset)
+			}
+		}
+		size, err := copyFileFrom(filepath.Join(src, name), filepath.Join(dst, name), from, move, cancelled)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		copied[name] = size
+	}
+	for name := range copied {
+		if present[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dst, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to delete %s: %w", filepath.Join(dst, name), err)
+		}
+		move.copiedBytes.Add(-copied[name])
+		delete(copied, name)
+	}
+	return nil
+}
+
+// copyFileFrom copies src to dst from position from on, then syncs dst. It
+// returns the size copied up to.
+func copyFileFrom(src string, dst string, from int64, move *replicaMove, cancelled func() bool) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return from, err
+	}
+	defer in.Close()
+	flags := os.O_WRONLY | os.O_CREATE
+	if from == 0 {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(dst, flags, 0644)
+	if err != nil {
+		return from, fmt.Errorf("unable to create %s: %w", dst, err)
+	}
+	defer out.Close()
+	if _, err := in.Seek(from, io.SeekStart); err != nil {
+		return from, fmt.Errorf("unable to seek %s: %w", src, err)
+	}
+	if _, err := out.Seek(from, io.SeekStart); err != nil {
+		return from, fmt.Errorf("unable to seek %s: %w", dst, err)
+	}
+
+	position := from
+	for {
+		if cancelled() {
+			return position, errMoveCancelled
+		}
+		n, err := io.CopyN(out, in, moveChunkSize)
+		position += n
+		move.copiedBytes.Add(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return position, fmt.Errorf("unable to copy %s to %s: %w", src, dst, err)
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return position, fmt.Errorf("unable to sync %s: %w", dst, err)
+	}
+	return position, nil
+}
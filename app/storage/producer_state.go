@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+const (
+	ProducerSnapshotFileSuffix = ".snapshot"
+
+	producerSnapshotVersion   = 1
+	producerSnapshotEntrySize = 46
+	// producerBatchesRetained is how many of its last batches a producer
+	// may retry, max.in.flight.requests.per.connection being at most 5 for
+	// idempotent producers.
+	producerBatchesRetained = 5
+)
+
+var (
+	ErrOutOfOrderSequence   = errors.New("out of order sequence number")
+	ErrInvalidProducerEpoch = errors.New("invalid producer epoch")
+	ErrInvalidTxnState      = errors.New("invalid transaction state")
+	// ErrTransactionCoordinatorFenced rejects a marker from a coordinator
+	// older than the last one to write one for the producer.
+	ErrTransactionCoordinatorFenced = errors.New("transaction coordinator fenced")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// producerBatch is what a log remembers of a batch of an idempotent producer
+// to answer its retries.
+type producerBatch struct {
+	FirstSequence int32
+	LastSequence  int32
+	LastOffset    int64
+	OffsetDelta   int32
+	Timestamp     int64
+}
+
+// producerStateEntry is the state of an idempotent producer in a partition:
+// its epoch, its last batches and its ongoing transaction, whose first offset
+// is CurrentTxnFirstOffset, or -1.
+type producerStateEntry struct {
+	ProducerId            int64
+	Epoch                 int16
+	CoordinatorEpoch      int32
+	CurrentTxnFirstOffset int64
+	batches               []producerBatch
+}
+
+func (e *producerStateEntry) lastBatch() (producerBatch, bool) {
+	if len(e.batches) == 0 {
+		return producerBatch{LastSequence: record.NoSequence, LastOffset: -1, Timestamp: -1}, false
+	}
+	return e.batches[len(e.batches)-1], true
+}
+
+// producerState tracks the idempotent and transactional producers of a log,
+// checking the sequence numbers of their batches and following their
+// transactions. A Log snapshots it to <offset>.snapshot files, holding the
+// state up to offset, so that it is rebuilt on load from the last snapshot
+// and the batches after it.
+type producerState struct {
+	producers map[int64]*producerStateEntry
+}
+
+func newProducerState() *producerState {
+	return &producerState{producers: map[int64]*producerStateEntry{}}
+}
+
+// incrementSequence adds n to a sequence number, which wraps around to 0
+// after math.MaxInt32, and decrementSequence subtracts it.
+func incrementSequence(sequence int32, n int32) int32 {
+	if sequence > math.MaxInt32-n {
+		return n - (math.MaxInt32 - sequence) - 1
+	}
+	return sequence + n
+}
+
+func decrementSequence(sequence int32, n int32) int32 {
+	if sequence < n {
+		return math.MaxInt32 - (n - sequence) + 1
+	}
+	return sequence - n
+}
+
+// check validates a batch against the state of its producer. It returns the
+// batch as first appended if this one is a retry of one of the producer's
+// last batches.
+func (s *producerState) check(data []byte) (*Batch, error) {
+	header := record.DecodeHeader(data)
+	if header.ProducerId == record.NoProducerId {
+		return nil, nil
+	}
+	entry, ok := s.producers[header.ProducerId]
+	if header.IsControl() {
+		decoded, err := record.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		marker, err := decoded.ControlRecord()
+		if err != nil {
+			return nil, err
+		}
+		if ok && header.ProducerEpoch < entry.Epoch {
+			return nil, fmt.Errorf("%w: marker of producer %d has epoch %d, older than %d", ErrInvalidProducerEpoch, header.ProducerId, header.ProducerEpoch, entry.Epoch)
+		}
+		if ok && marker.CoordinatorEpoch < entry.CoordinatorEpoch {
+			return nil, fmt.Errorf("%w: marker of producer %d has coordinator epoch %d, older than %d", ErrTransactionCoordinatorFenced, header.ProducerId, marker.CoordinatorEpoch, entry.CoordinatorEpoch)
+		}
+		return nil, nil
+	}
+	if !ok {
+		// The producer is new, or its state expired: any sequence goes.
+		return nil, nil
+	}
+	if header.ProducerEpoch < entry.Epoch {
+		return nil, fmt.Errorf("%w: producer %d has epoch %d, older than %d", ErrInvalidProducerEpoch, header.ProducerId, header.ProducerEpoch, entry.Epoch)
+	}
+	if !header.IsTransactional() && entry.CurrentTxnFirstOffset >= 0 {
+		return nil, fmt.Errorf("%w: producer %d wrote a non-transactional batch in a transaction", ErrInvalidTxnState, header.ProducerId)
+	}
+
+	firstSequence := header.BaseSequence
+	lastSequence := incrementSequence(firstSequence, header.LastOffsetDelta)
+	if header.ProducerEpoch > entry.Epoch {
+		if firstSequence != 0 {
+			return nil, fmt.Errorf("%w: producer %d starts epoch %d at sequence %d", ErrOutOfOrderSequence, header.ProducerId, header.ProducerEpoch, firstSequence)
+		}
+		return nil, nil
+	}
+	for _, batch := range entry.batches {
+		if batch.FirstSequence == firstSequence && batch.LastSequence == lastSequence {
+			return &Batch{
+				BaseOffset:   batch.LastOffset - int64(batch.OffsetDelta),
+				LastOffset:   batch.LastOffset,
+				MaxTimestamp: batch.Timestamp,
+				Data:         data,
+			}, nil
+		}
+	}
+	last, ok := entry.lastBatch()
+	if (ok && firstSequence != incrementSequence(last.LastSequence, 1)) || (!ok && firstSequence != 0) {
+		return nil, fmt.Errorf("%w: producer %d sent sequence %d after %d", ErrOutOfOrderSequence, header.ProducerId, firstSequence, last.LastSequence)
+	}
+	return nil, nil
+}
+
+// update applies a batch check accepted, once it has its offsets. It returns
+// the transaction the batch aborts, if it is an abort marker.
+func (s *producerState) update(batch Batch) *AbortedTxn {
+	header := record.DecodeHeader(batch.Data)
+	if header.ProducerId == record.NoProducerId {
+		return nil
+	}
+	entry, ok := s.producers[header.ProducerId]
+	if !ok {
+		entry = &producerStateEntry{ProducerId: header.ProducerId, Epoch: header.ProducerEpoch, CoordinatorEpoch: -1, CurrentTxnFirstOffset: -1}
+		s.producers[header.ProducerId] = entry
+	}
+	if header.ProducerEpoch > entry.Epoch {
+		entry.Epoch, entry.batches = header.ProducerEpoch, nil
+	}
+
+	if header.IsControl() {
+		decoded, err := record.Decode(batch.Data)
+		if err != nil {
+			return nil
+		}
+		marker, err := decoded.ControlRecord()
+		if err != nil {
+			return nil
+		}
+		entry.CoordinatorEpoch = marker.CoordinatorEpoch
+		firstOffset := entry.CurrentTxnFirstOffset
+		entry.CurrentTxnFirstOffset = -1
+		if firstOffset < 0 || marker.Type != record.AbortMarker {
+			return nil
+		}
+		lastStableOffset := batch.LastOffset + 1
+		if offset, ok := s.firstUnstableOffset(); ok {
+			lastStableOffset = offset
+		}
+		return &AbortedTxn{ProducerId: header.ProducerId, FirstOffset: firstOffset, LastOffset: batch.LastOffset, LastStableOffset: lastStableOffset}
+	}
+
+	entry.batches = append(entry.batches, producerBatch{
+		FirstSequence: header.BaseSequence,
+		LastSequence:  incrementSequence(header.BaseSequence, header.LastOffsetDelta),
+		LastOffset:    batch.LastOffset,
+		OffsetDelta:   header.LastOffsetDelta,
+		Timestamp:     batch.MaxTimestamp,
+	})
+	if len(entry.batches) > producerBatchesRetained {
+		entry.batches = entry.batches[1:]
+	}
+	if header.IsTransactional() && entry.CurrentTxnFirstOffset < 0 {
+		entry.CurrentTxnFirstOffset = batch.BaseOffset
+	}
+	return nil
+}
+
+// firstUnstableOffset is the first offset of the oldest ongoing transaction.
+func (s *producerState) firstUnstableOffset() (int64, bool) {
+	first, ok := int64(math.MaxInt64), false
+	for _, entry := range s.producers {
+		if entry.CurrentTxnFirstOffset >= 0 {
+			first, ok = min(first, entry.CurrentTxnFirstOffset), true
+		}
+	}
+	return first, ok
+}
+
+// ActiveProducer is the state of a producer writing to a log, as
+// DescribeProducers reports it. LastSequence and LastTimestamp are -1 before
+// its first batch of the epoch, and CurrentTxnStartOffset is -1 outside a
+// transaction.
+type ActiveProducer struct {
+	ProducerId            int64
+	ProducerEpoch         int16
+	LastSequence          int32
+	LastTimestamp         int64
+	CoordinatorEpoch      int32
+	CurrentTxnStartOffset int64
+}
+
+// active returns the producers ordered by id.
+func (s *producerState) active() []ActiveProducer {
+	producers := make([]ActiveProducer, 0, len(s.producers))
+	for _, entry := range s.producers {
+		last, _ := entry.lastBatch()
+		producers = append(producers, ActiveProducer{
+			ProducerId:            entry.ProducerId,
+			ProducerEpoch:         entry.Epoch,
+			LastSequence:          last.LastSequence,
+			LastTimestamp:         last.Timestamp,
+			CoordinatorEpoch:      entry.CoordinatorEpoch,
+			CurrentTxnStartOffset: entry.CurrentTxnFirstOffset,
+		})
+	}
+	sort.Slice(producers, func(i, j int) bool { return producers[i].ProducerId < producers[j].ProducerId })
+	return producers
+}
+
+// truncateHead forgets the producers whose last batch retention deleted,
+// unless they are in a transaction.
+func (s *producerState) truncateHead(logStartOffset int64) {
+	for id, entry := range s.producers {
+		if last, _ := entry.lastBatch(); entry.CurrentTxnFirstOffset < 0 && last.LastOffset < logStartOffset {
+			delete(s.producers, id)
+		}
+	}
+}
+
+// writeSnapshot writes the state to <dir>/<offset>.snapshot, in Kafka's v1
+// format: a version, a CRC32C of the rest, then a count and the entries,
+// which only keep each producer's last batch.
+func (s *producerState) writeSnapshot(dir string, offset int64) error {
+	ids := make([]int64, 0, len(s.producers))
+	for id := range s.producers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	data := make([]byte, 10, 10+len(ids)*producerSnapshotEntrySize)
+	binary.BigEndian.PutUint16(data, producerSnapshotVersion)
+	binary.BigEndian.PutUint32(data[6:], uint32(len(ids)))
+	for _, id := range ids {
+		entry := s.producers[id]
+		last, _ := entry.lastBatch()
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.ProducerId))
+		data = binary.BigEndian.AppendUint16(data, uint16(entry.Epoch))
+		data = binary.BigEndian.AppendUint32(data, uint32(last.LastSequence))
+		data = binary.BigEndian.AppendUint64(data, uint64(last.LastOffset))
+		data = binary.BigEndian.AppendUint32(data, uint32(last.OffsetDelta))
+		data = binary.BigEndian.AppendUint64(data, uint64(last.Timestamp))
+		data = binary.BigEndian.AppendUint32(data, uint32(entry.CoordinatorEpoch))
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.CurrentTxnFirstOffset))
+	}
+	binary.BigEndian.PutUint32(data[2:], crc32.Checksum(data[6:], crc32c))
+	return writeFileAtomically(segmentFileName(dir, offset, ProducerSnapshotFileSuffix), data)
+}
+
+func readProducerSnapshot(path string) (*producerState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read producer snapshot %s: %w", path, err)
+	}
+	if len(data) < 10 || binary.BigEndian.Uint16(data) != producerSnapshotVersion {
+		return nil, fmt.Errorf("malformed producer snapshot %s", path)
+	}
+	if crc32.Checksum(data[6:], crc32c) != binary.BigEndian.Uint32(data[2:]) {
+		return nil, fmt.Errorf("malformed producer snapshot %s: CRC mismatch", path)
+	}
+	count := int(binary.BigEndian.Uint32(data[6:]))
+	if len(data) != 10+count*producerSnapshotEntrySize {
+		return nil, fmt.Errorf("malformed producer snapshot %s: bad entry count %d", path, count)
+	}
+
+	s := newProducerState()
+	for i := 10; i < len(data); i += producerSnapshotEntrySize {
+		entry := &producerStateEntry{
+			ProducerId:            int64(binary.BigEndian.Uint64(data[i:])),
+			Epoch:                 int16(binary.BigEndian.Uint16(data[i+8:])),
+			CoordinatorEpoch:      int32(binary.BigEndian.Uint32(data[i+34:])),
+			CurrentTxnFirstOffset: int64(binary.BigEndian.Uint64(data[i+38:])),
+		}
+		batch := producerBatch{
+			LastSequence: int32(binary.BigEndian.Uint32(data[i+10:])),
+			LastOffset:   int64(binary.BigEndian.Uint64(data[i+14:])),
+			OffsetDelta:  int32(binary.BigEndian.Uint32(data[i+22:])),
+			Timestamp:    int64(binary.BigEndian.Uint64(data[i+26:])),
+		}
+		if batch.LastSequence != record.NoSequence {
+			batch.FirstSequence = decrementSequence(batch.LastSequence, batch.OffsetDelta)
+			entry.batches = []producerBatch{batch}
+		}
+		s.producers[entry.ProducerId] = entry
+	}
+	return s, nil
+}
+
+// listProducerSnapshots returns the offsets of the snapshots in dir, in
+// order.
+func listProducerSnapshots(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list log dir %s: %w", dir, err)
+	}
+	offsets := []int64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ProducerSnapshotFileSuffix) {
+			continue
+		}
+		if offset, err := strconv.ParseInt(strings.TrimSuffix(name, ProducerSnapshotFileSuffix), 10, 64); err == nil {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
+
+// deleteProducerSnapshots removes the snapshots in dir for which remove
+// reports true.
+func deleteProducerSnapshots(dir string, remove func(offset int64) bool) error {
+	offsets, err := listProducerSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		if !remove(offset) {
+			continue
+		}
+		path := segmentFileName(dir, offset, ProducerSnapshotFileSuffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to delete %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// The transactional bit of the batch attributes.
+const transactional = 0x10
+
+// idempotentBatch encodes a batch of count records of a producer from
+// sequence on, with the given attributes.
+func idempotentBatch(producerId int64, epoch int16, sequence int32, count int, attributes int16) []byte {
+	batch, err := record.Decode(testBatch(count, time.Now().UnixMilli()))
+	if err != nil {
+		panic(err)
+	}
+	batch.ProducerId, batch.ProducerEpoch, batch.BaseSequence = producerId, epoch, sequence
+	batch.Attributes = attributes
+	return batch.Encode()
+}
+
+func markerBatch(producerId int64, epoch int16, markerType record.ControlType) []byte {
+	return record.NewControlBatch(producerId, epoch, time.Now().UnixMilli(), record.EndTxnMarker{Type: markerType}).Encode()
+}
+
+func TestProducerSequences(t *testing.T) {
+	_, log := newTestLog(t, nil)
+	appendBatches(t, log, idempotentBatch(1, 0, 0, 2, 0), idempotentBatch(1, 0, 2, 2, 0))
+
+	// A retry of one of the last batches gets its offsets back without being
+	// written again.
+	retry, err := log.Append(idempotentBatch(1, 0, 0, 2, 0))
+	if err != nil || retry.BaseOffset != 0 || retry.LastOffset != 1 {
+		t.Errorf("retry got offsets %d-%d and %v, want those of the first batch", retry.BaseOffset, retry.LastOffset, err)
+	}
+	if got := log.LogEndOffset(); got != 4 {
+		t.Errorf("got log end offset %d after a retry, want 4", got)
+	}
+
+	// Each step is appended after the ones before.
+	steps := []struct {
+		name  string
+		batch []byte
+		want  error
+	}{
+		{"sequence gap", idempotentBatch(1, 0, 5, 1, 0), ErrOutOfOrderSequence},
+		{"new epoch not at 0", idempotentBatch(1, 1, 4, 1, 0), ErrOutOfOrderSequence},
+		{"next sequence", idempotentBatch(1, 0, 4, 1, 0), nil},
+		{"new producer from any sequence", idempotentBatch(2, 0, 7, 1, 0), nil},
+		{"new epoch from 0", idempotentBatch(1, 1, 0, 1, 0), nil},
+		{"old epoch", idempotentBatch(1, 0, 5, 1, 0), ErrInvalidProducerEpoch},
+		{"transaction begins", idempotentBatch(2, 0, 8, 1, transactional), nil},
+		{"non transactional in a transaction", idempotentBatch(2, 0, 9, 1, 0), ErrInvalidTxnState},
+	}
+	for _, step := range steps {
+		if _, err := log.Append(step.batch); !errors.Is(err, step.want) {
+			t.Errorf("%s: Append returned %v, want %v", step.name, err, step.want)
+		}
+	}
+
+	want := []ActiveProducer{
+		{ProducerId: 1, ProducerEpoch: 1, LastSequence: 0, LastTimestamp: -1, CoordinatorEpoch: -1, CurrentTxnStartOffset: -1},
+		{ProducerId: 2, ProducerEpoch: 0, LastSequence: 8, LastTimestamp: -1, CoordinatorEpoch: -1, CurrentTxnStartOffset: 7},
+	}
+	got := log.ActiveProducers()
+	for i := range got {
+		got[i].LastTimestamp = -1
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got producers %+v, want %+v", got, want)
+	}
+}
+
+func TestProducerSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := newProducerState()
+	for _, data := range [][]byte{
+		idempotentBatch(1, 0, 0, 2, 0),
+		idempotentBatch(1, 0, 2, 3, 0),
+		idempotentBatch(2, 4, 10, 1, transactional),
+	} {
+		record.SetBaseOffset(data, 100)
+		s.update(parseBatchHeader(data))
+	}
+	if err := s.writeSnapshot(dir, 101); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	path := segmentFileName(dir, 101, ProducerSnapshotFileSuffix)
+	read, err := readProducerSnapshot(path)
+	if err != nil {
+		t.Fatalf("readProducerSnapshot: %v", err)
+	}
+	if !reflect.DeepEqual(read.active(), s.active()) {
+		t.Errorf("read producers %+v, want %+v", read.active(), s.active())
+	}
+	// Only the last batch of each producer is kept, and still deduplicates.
+	if duplicate, err := read.check(idempotentBatch(1, 0, 2, 3, 0)); err != nil || duplicate == nil {
+		t.Errorf("check of a retry of the last batch returned %v and %v, want a duplicate", duplicate, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProducerSnapshot(path); err == nil {
+		t.Errorf("readProducerSnapshot accepted a snapshot failing its CRC")
+	}
+}
+
+func TestProducerStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	props := map[string]string{"log.segment.bytes": "200"}
+	m, log := openTestLog(t, dir, props)
+	for i := range 5 {
+		appendBatches(t, log, idempotentBatch(1, 0, int32(2*i), 2, 0))
+	}
+	appendBatches(t, log, idempotentBatch(2, 0, 0, 1, transactional))
+	want := log.ActiveProducers()
+	logDir := log.Dir
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Snapshots are written as segments roll, and at shutdown.
+	offsets, err := listProducerSnapshots(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{4, 8, 11}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("got snapshots at %v, want %v", offsets, want)
+	}
+
+	restart := func(name string) {
+		m, log := openTestLog(t, dir, props)
+		defer m.Close()
+		if got := log.ActiveProducers(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got producers %+v, want %+v", name, got, want)
+		}
+		if got := log.LastStableOffset(); got != 10 {
+			t.Errorf("%s: got last stable offset %d, want the transaction's first offset 10", name, got)
+		}
+		retry, err := log.Append(idempotentBatch(1, 0, 8, 2, 0))
+		if err != nil || retry.BaseOffset != 8 {
+			t.Errorf("%s: retry got base offset %d and %v, want 8", name, retry.BaseOffset, err)
+		}
+	}
+	restart("from the shutdown snapshot")
+
+	// Without the later snapshots the state is rebuilt from the one at 4 and
+	// the batches after it.
+	for _, offset := range []int64{8, 11} {
+		if err := os.Remove(segmentFileName(logDir, offset, ProducerSnapshotFileSuffix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restart("from the log tail")
+}
+
+func TestTxnIndexListsAbortedTransactions(t *testing.T) {
+	dir := t.TempDir()
+	m, log := openTestLog(t, dir, nil)
+	appendBatches(t, log,
+		idempotentBatch(1, 0, 0, 2, transactional), // 0-1
+		idempotentBatch(2, 0, 0, 1, transactional), // 2
+		markerBatch(1, 0, record.AbortMarker),      // 3
+		idempotentBatch(3, 0, 0, 1, transactional), // 4
+		markerBatch(3, 0, record.CommitMarker),     // 5
+		markerBatch(2, 0, record.AbortMarker),      // 6
+	)
+	want := []AbortedTxn{
+		{ProducerId: 1, FirstOffset: 0, LastOffset: 3, LastStableOffset: 2},
+		{ProducerId: 2, FirstOffset: 2, LastOffset: 6, LastStableOffset: 7},
+	}
+	check := func(name string, log *Log) {
+		t.Helper()
+		got, err := log.AbortedTransactions(0, log.LogEndOffset())
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got aborted transactions %+v and %v, want %+v", name, got, err, want)
+		}
+		// Transactions ending before the range are left out.
+		if got, err := log.AbortedTransactions(4, log.LogEndOffset()); err != nil || len(got) != 1 || got[0].ProducerId != 2 {
+			t.Errorf("%s: got aborted transactions %+v and %v from offset 4, want that of producer 2", name, got, err)
+		}
+	}
+	check("appended", log)
+	logDir := log.Dir
+	crash(t, m, dir)
+
+	// A lost index is rebuilt as the markers are replayed, which they are
+	// without the snapshot written at shutdown.
+	path := segmentFileName(logDir, 0, TxnIndexFileSuffix)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(segmentFileName(logDir, 7, ProducerSnapshotFileSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	m, log = openTestLog(t, dir, nil)
+	defer m.Close()
+	check("rebuilt", log)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("transaction index not rebuilt: %v", err)
+	}
+}
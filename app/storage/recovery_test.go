@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// crash closes m, then removes the clean shutdown marker it wrote, as if the
+// broker had stopped without closing its logs.
+func crash(t *testing.T, m *LogManager, dir string) {
+	t.Helper()
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, CleanShutdownFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editSegment applies edit to the content of a segment file.
+func editSegment(t *testing.T, path string, edit func(data []byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, edit(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	m, log := openTestLog(t, dir, nil)
+	batch := testBatch(2, time.Now().UnixMilli())
+	appendBatches(t, log, batch, batch, batch)
+	path := segmentFileName(log.Dir, 0, LogFileSuffix)
+	crash(t, m, dir)
+	editSegment(t, path, func(data []byte) []byte { return append(data, batch[:len(batch)/2]...) })
+
+	m, log = openTestLog(t, dir, nil)
+	defer m.Close()
+	if got := log.LogEndOffset(); got != 6 {
+		t.Errorf("recovered log end offset %d, want 6", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(3*len(batch)) {
+		t.Errorf("recovered segment has %d bytes, want %d with the torn batch truncated", info.Size(), 3*len(batch))
+	}
+	appendBatches(t, log, batch)
+	if got, want := readOffsets(t, log, 0, 1<<20), []int64{0, 2, 4, 6}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v after recovery, want %v", got, want)
+	}
+}
+
+func TestRecoveryTruncatesAtCorruptBatch(t *testing.T) {
+	dir := t.TempDir()
+	props := map[string]string{"log.segment.bytes": "200"}
+	m, log := openTestLog(t, dir, props)
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	logDir := log.Dir
+	crash(t, m, dir)
+	// Recover from the start: nothing is known to have been flushed.
+	if err := NewOffsetCheckpoint(dir, RecoveryPointCheckpointFile).Write(map[TopicPartition]int64{log.Partition: 0}); err != nil {
+		t.Fatal(err)
+	}
+	editSegment(t, segmentFileName(logDir, 0, LogFileSuffix), func(data []byte) []byte {
+		data[len(data)-1] ^= 0xFF // The CRC of the second batch fails.
+		return data
+	})
+
+	m, log = openTestLog(t, dir, props)
+	defer m.Close()
+	if got := log.LogEndOffset(); got != 2 {
+		t.Errorf("recovered log end offset %d, want 2", got)
+	}
+	// The segments written after the corrupt batch are not trusted either.
+	if got, want := baseOffsets(log), []int64{0}; !slices.Equal(got, want) {
+		t.Errorf("recovered segments %v, want %v", got, want)
+	}
+	for _, baseOffset := range []int64{4, 8} {
+		if _, err := os.Stat(segmentFileName(logDir, baseOffset, LogFileSuffix)); !os.IsNotExist(err) {
+			t.Errorf("segment %d was kept: %v", baseOffset, err)
+		}
+	}
+}
+
+func TestCleanShutdownSkipsRecovery(t *testing.T) {
+	dir := t.TempDir()
+	m, log := openTestLog(t, dir, nil)
+	batch := testBatch(2, time.Now().UnixMilli())
+	appendBatches(t, log, batch, batch, batch)
+	path := segmentFileName(log.Dir, 0, LogFileSuffix)
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Only a full scan would see the CRC of a batch fail.
+	editSegment(t, path, func(data []byte) []byte {
+		data[len(data)-1] ^= 0xFF
+		return data
+	})
+
+	m, log = openTestLog(t, dir, nil)
+	defer m.Close()
+	if got := log.LogEndOffset(); got != 6 {
+		t.Errorf("log end offset %d after a clean shutdown, want 6 without a scan", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, CleanShutdownFile)); !os.IsNotExist(err) {
+		t.Errorf("the clean shutdown marker outlived loading the logs: %v", err)
+	}
+}
+
+func TestRecoveryRebuildsMissingIndexes(t *testing.T) {
+	dir := t.TempDir()
+	props := map[string]string{"log.index.interval.bytes": "1"}
+	m, log := openTestLog(t, dir, props)
+	now := time.Now().UnixMilli()
+	for i := range 4 {
+		appendBatches(t, log, testBatch(2, now+int64(i)*10))
+	}
+	logDir := log.Dir
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix} {
+		if err := os.Remove(segmentFileName(logDir, 0, suffix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, log = openTestLog(t, dir, props)
+	defer m.Close()
+	if got, want := readOffsets(t, log, 5, 1<<20), []int64{4, 6}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v with rebuilt indexes, want %v", got, want)
+	}
+	offset, _, ok, err := log.FindOffsetByTimestamp(now + 15)
+	if err != nil || !ok || offset != 4 {
+		t.Errorf("FindOffsetByTimestamp returned %d, %t and %v, want offset 4", offset, ok, err)
+	}
+	for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix} {
+		if _, err := os.Stat(segmentFileName(logDir, 0, suffix)); err != nil {
+			t.Errorf("index %s not rebuilt: %v", suffix, err)
+		}
+	}
+}
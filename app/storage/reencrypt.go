@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReencryptLogDir rewrites every segment of the partitions under a log
+// directory whose log or index files are not encrypted with the current key
+// of config.Keyring, those in the clear included. It is how encryption is
+// turned on for existing logs and how a rotated key is retired, and must only
+// run against a broker that is stopped after shutting down cleanly. Each
+// segment is copied batch by batch to a scratch directory, as the cleaner
+// does, and swapped in. It returns the number of segments rewritten.
+func ReencryptLogDir(path string, config LogConfig) (int, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list log dir %s: %w", path, err)
+	}
+	rewritten := 0
+	for _, entry := range entries {
+		tp, ok := parseTopicPartition(entry.Name())
+		if !entry.IsDir() || !ok {
+			continue
+		}
+		n, err := reencryptLog(filepath.Join(path, entry.Name()), tp, config)
+		rewritten += n
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+func reencryptLog(dir string, tp TopicPartition, config LogConfig) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list log dir %s: %w", dir, err)
+	}
+	baseOffsets := []int64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64); err == nil && strings.HasSuffix(name, LogFileSuffix) {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	rewritten := 0
+	for _, baseOffset := range baseOffsets {
+		segment, err := openSegment(dir, baseOffset, config)
+		if err != nil {
+			return rewritten, err
+		}
+		if segment.encryptedWith(config.Keyring.CurrentKeyId()) {
+			segment.Close()
+			continue
+		}
+		if err := reencryptSegment(dir, segment, config); err != nil {
+			return rewritten, fmt.Errorf("unable to re-encrypt segment %d of %s: %w", baseOffset, tp, err)
+		}
+		rewritten++
+		fmt.Printf("Re-encrypted segment %d of %s with key %s\n", baseOffset, tp, config.Keyring.CurrentKeyId())
+	}
+	return rewritten, nil
+}
+
+// encryptedWith reports whether the log and index files of the segment are
+// all encrypted with keyId.
+func (s *Segment) encryptedWith(keyId string) bool {
+	files := []*segmentFile{s.file, s.offsetIndex.file, s.timeIndex.file}
+	if s.txnIndex.file != nil {
+		files = append(files, s.txnIndex.file)
+	}
+	for _, f := range files {
+		if f.keyId() != keyId {
+			return false
+		}
+	}
+	return true
+}
+
+// reencryptSegment copies a segment, which it closes, to one written with the
+// current key and swaps the copy in. The transaction index is moved first and
+// the old offset and time indexes are removed before the log, so a crash half
+// way leaves indexes that are rebuilt on load.
+func reencryptSegment(dir string, segment *Segment, config LogConfig) error {
+	scratch := filepath.Join(dir, cleanedDirName)
+	if err := os.RemoveAll(scratch); err != nil {
+		segment.Close()
+		return fmt.Errorf("unable to remove %s: %w", scratch, err)
+	}
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		segment.Close()
+		return fmt.Errorf("unable to create %s: %w", scratch, err)
+	}
+	defer os.RemoveAll(scratch)
+
+	copied, err := openSegment(scratch, segment.BaseOffset, config)
+	if err != nil {
+		segment.Close()
+		return err
+	}
+	err = segment.forEachBatch(func(batch Batch) error {
+		return copied.append(batch)
+	})
+	for _, txn := range segment.txnIndex.entries {
+		if err == nil {
+			err = copied.txnIndex.Append(txn)
+		}
+	}
+	if err == nil {
+		err = copied.flush()
+	}
+	if closeErr := copied.Close(); err == nil {
+		err = closeErr
+	}
+	segment.Close()
+	if err != nil {
+		return err
+	}
+
+	txnIndexPath := segmentFileName(dir, segment.BaseOffset, TxnIndexFileSuffix)
+	if len(segment.txnIndex.entries) > 0 {
+		if err := os.Rename(segmentFileName(scratch, segment.BaseOffset, TxnIndexFileSuffix), txnIndexPath); err != nil {
+			return fmt.Errorf("unable to rename %s: %w", txnIndexPath, err)
+		}
+	} else if err := os.Remove(txnIndexPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to delete %s: %w", txnIndexPath, err)
+	}
+	for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix} {
+		path := segmentFileName(dir, segment.BaseOffset, suffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to delete %s: %w", path, err)
+		}
+	}
+	for _, suffix := range []string{LogFileSuffix, IndexFileSuffix, TimeIndexFileSuffix} {
+		from, to := segmentFileName(scratch, segment.BaseOffset, suffix), segmentFileName(dir, segment.BaseOffset, suffix)
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("unable to rename %s: %w", from, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	RemoteLogMetadataFile = "remote-log-segment-metadata"
+
+	remoteLogMetadataVersion = 0
+)
+
+// RemoteLogSegmentMetadataUpdate moves a remote segment to a new state.
+type RemoteLogSegmentMetadataUpdate struct {
+	Id               string
+	Partition        TopicPartition
+	State            RemoteLogSegmentState
+	EventTimestampMs int64
+}
+
+// RemoteLogMetadataManager tracks which segments of each partition are in
+// remote storage and how far their copy or deletion got.
+type RemoteLogMetadataManager interface {
+	// AddRemoteLogSegmentMetadata records a segment whose copy is starting.
+	AddRemoteLogSegmentMetadata(metadata RemoteLogSegmentMetadata) error
+	// UpdateRemoteLogSegmentMetadata changes a segment's state. A segment
+	// whose deletion finished is forgotten.
+	UpdateRemoteLogSegmentMetadata(update RemoteLogSegmentMetadataUpdate) error
+	// RemoteLogSegmentMetadata returns the copied segment holding offset.
+	RemoteLogSegmentMetadata(tp TopicPartition, offset int64) (RemoteLogSegmentMetadata, bool, error)
+	// ListRemoteLogSegments returns the segments of a partition in every
+	// state, ordered by start offset.
+	ListRemoteLogSegments(tp TopicPartition) ([]RemoteLogSegmentMetadata, error)
+}
+
+// FileRemoteLogMetadataManager keeps the metadata of each partition's remote
+// segments in <dir>/<topic>-<partition>/remote-log-segment-metadata, next to
+// the segments of a LocalTieredStorage in the same dir. The file holds a
+// version line, an entry count line and one "id start end max-timestamp size
+// state event-timestamp" line per segment, and is rewritten on every change.
+type FileRemoteLogMetadataManager struct {
+	Dir string
+
+	mu         sync.Mutex
+	partitions map[TopicPartition][]RemoteLogSegmentMetadata
+}
+
+func NewFileRemoteLogMetadataManager(dir string) *FileRemoteLogMetadataManager {
+	return &FileRemoteLogMetadataManager{Dir: dir, partitions: map[TopicPartition][]RemoteLogSegmentMetadata{}}
+}
+
+func (m *FileRemoteLogMetadataManager) path(tp TopicPartition) string {
+	return filepath.Join(logDirName(m.Dir, tp), RemoteLogMetadataFile)
+}
+
+// segments returns the partition's metadata, reading the file on first use.
+func (m *FileRemoteLogMetadataManager) segments(tp TopicPartition) ([]RemoteLogSegmentMetadata, error) {
+	if segments, ok := m.partitions[tp]; ok {
+		return segments, nil
+	}
+	segments, err := readRemoteLogMetadata(m.path(tp), tp)
+	if err != nil {
+		return nil, err
+	}
+	m.partitions[tp] = segments
+	return segments, nil
+}
+
+func readRemoteLogMetadata(path string, tp TopicPartition) ([]RemoteLogSegmentMetadata, error) {
+	segments := []RemoteLogSegmentMetadata{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return segments, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("malformed remote log metadata %s: missing header", path)
+	}
+	if version, err := strconv.Atoi(lines[0]); err != nil || version != remoteLogMetadataVersion {
+		return nil, fmt.Errorf("malformed remote log metadata %s: unsupported version %q", path, lines[0])
+	}
+	count, err := strconv.Atoi(lines[1])
+	if err != nil || count != len(lines)-2 {
+		return nil, fmt.Errorf("malformed remote log metadata %s: bad entry count %q", path, lines[1])
+	}
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("malformed remote log metadata %s: %q", path, line)
+		}
+		values := make([]int64, 6)
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+				return nil, fmt.Errorf("malformed remote log metadata %s: %q", path, line)
+			}
+		}
+		segments = append(segments, RemoteLogSegmentMetadata{
+			Id:                 fields[0],
+			Partition:          tp,
+			StartOffset:        values[0],
+			EndOffset:          values[1],
+			MaxTimestamp:       values[2],
+			SegmentSizeInBytes: values[3],
+			State:              RemoteLogSegmentState(values[4]),
+			EventTimestampMs:   values[5],
+		})
+	}
+	return segments, nil
+}
+
+func (m *FileRemoteLogMetadataManager) write(tp TopicPartition, segments []RemoteLogSegmentMetadata) error {
+	sort.Slice(segments, func(i, j int) bool { return segments[i].StartOffset < segments[j].StartOffset })
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n%d\n", remoteLogMetadataVersion, len(segments))
+	for _, s := range segments {
+		fmt.Fprintf(&b, "%s %d %d %d %d %d %d\n", s.Id, s.StartOffset, s.EndOffset, s.MaxTimestamp, s.SegmentSizeInBytes, s.State, s.EventTimestampMs)
+	}
+	if err := os.MkdirAll(logDirName(m.Dir, tp), 0755); err != nil {
+		return fmt.Errorf("unable to create remote log dir: %w", err)
+	}
+	if err := writeFileAtomically(m.path(tp), []byte(b.String())); err != nil {
+		return err
+	}
+	m.partitions[tp] = segments
+	return nil
+}
+
+func (m *FileRemoteLogMetadataManager) AddRemoteLogSegmentMetadata(metadata RemoteLogSegmentMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if metadata.State != CopySegmentStarted {
+		return fmt.Errorf("remote segment %s of %s added in state %s", metadata.Id, metadata.Partition, metadata.State)
+	}
+	segments, err := m.segments(metadata.Partition)
+	if err != nil {
+		return err
+	}
+	return m.write(metadata.Partition, append(append([]RemoteLogSegmentMetadata{}, segments...), metadata))
+}
+
+func (m *FileRemoteLogMetadataManager) UpdateRemoteLogSegmentMetadata(update RemoteLogSegmentMetadataUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	segments, err := m.segments(update.Partition)
+	if err != nil {
+		return err
+	}
+	updated := make([]RemoteLogSegmentMetadata, 0, len(segments))
+	found := false
+	for _, s := range segments {
+		if s.Id == update.Id {
+			found = true
+			if update.State == DeleteSegmentFinished {
+				continue
+			}
+			s.State, s.EventTimestampMs = update.State, update.EventTimestampMs
+		}
+		updated = append(updated, s)
+	}
+	if !found {
+		return fmt.Errorf("no remote segment %s of %s", update.Id, update.Partition)
+	}
+	return m.write(update.Partition, updated)
+}
+
+func (m *FileRemoteLogMetadataManager) RemoteLogSegmentMetadata(tp TopicPartition, offset int64) (RemoteLogSegmentMetadata, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	segments, err := m.segments(tp)
+	if err != nil {
+		return RemoteLogSegmentMetadata{}, false, err
+	}
+	for _, s := range segments {
+		if s.State == CopySegmentFinished && s.StartOffset <= offset && offset <= s.EndOffset {
+			return s, true, nil
+		}
+	}
+	return RemoteLogSegmentMetadata{}, false, nil
+}
+
+func (m *FileRemoteLogMetadataManager) ListRemoteLogSegments(tp TopicPartition) ([]RemoteLogSegmentMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	segments, err := m.segments(tp)
+	if err != nil {
+		return nil, err
+	}
+	return append([]RemoteLogSegmentMetadata{}, segments...), nil
+}
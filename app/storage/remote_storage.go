@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RemoteLogSegmentState tracks a segment's copy to and deletion from remote
+// storage.
+type RemoteLogSegmentState int8
+
+const (
+	CopySegmentStarted RemoteLogSegmentState = iota
+	CopySegmentFinished
+	DeleteSegmentStarted
+	DeleteSegmentFinished
+)
+
+func (s RemoteLogSegmentState) String() string {
+	switch s {
+	case CopySegmentStarted:
+		return "COPY_SEGMENT_STARTED"
+	case CopySegmentFinished:
+		return "COPY_SEGMENT_FINISHED"
+	case DeleteSegmentStarted:
+		return "DELETE_SEGMENT_STARTED"
+	case DeleteSegmentFinished:
+		return "DELETE_SEGMENT_FINISHED"
+	}
+	return fmt.Sprintf("RemoteLogSegmentState(%d)", int8(s))
+}
+
+// RemoteLogSegmentMetadata describes a segment copied to remote storage. Id
+// tells apart copies of the same offsets, say from a copy retried after a
+// crash.
+type RemoteLogSegmentMetadata struct {
+	Id                 string
+	Partition          TopicPartition
+	StartOffset        int64
+	EndOffset          int64
+	MaxTimestamp       int64
+	SegmentSizeInBytes int64
+	State              RemoteLogSegmentState
+	EventTimestampMs   int64
+}
+
+// LogSegmentData are the files of a rolled segment to copy to remote
+// storage. TxnIndex is empty if no transaction was aborted in the segment.
+type LogSegmentData struct {
+	LogSegment  string
+	OffsetIndex string
+	TimeIndex   string
+	TxnIndex    string
+}
+
+type IndexType int8
+
+const (
+	OffsetIndexType IndexType = iota
+	TimestampIndexType
+	TransactionIndexType
+)
+
+// RemoteStorageManager keeps copies of rolled segments in a remote tier, as
+// in KIP-405. It only stores and serves bytes; which segments it holds is
+// tracked by a RemoteLogMetadataManager.
+type RemoteStorageManager interface {
+	CopyLogSegmentData(metadata RemoteLogSegmentMetadata, data LogSegmentData) error
+	// FetchLogSegment returns the segment from startPosition on. It must be
+	// closed.
+	FetchLogSegment(metadata RemoteLogSegmentMetadata, startPosition int64) (io.ReadCloser, error)
+	// FetchIndex returns an index of the segment. A transaction index that
+	// was not copied is reported as an os.ErrNotExist error.
+	FetchIndex(metadata RemoteLogSegmentMetadata, indexType IndexType) (io.ReadCloser, error)
+	// DeleteLogSegmentData removes the segment's files, succeeding if they
+	// are already gone.
+	DeleteLogSegmentData(metadata RemoteLogSegmentMetadata) error
+}
+
+// LocalTieredStorage is a RemoteStorageManager keeping the remote tier in a
+// directory, typically on a cheaper or network mounted disk. Segments are
+// stored as <dir>/<topic>-<partition>/<start offset>-<id>.log, with their
+// indexes next to them.
+type LocalTieredStorage struct {
+	Dir string
+}
+
+func NewLocalTieredStorage(dir string) *LocalTieredStorage {
+	return &LocalTieredStorage{Dir: dir}
+}
+
+func (s *LocalTieredStorage) fileName(metadata RemoteLogSegmentMetadata, suffix string) string {
+	return filepath.Join(logDirName(s.Dir, metadata.Partition), fmt.Sprintf("%020d-%s%s", metadata.StartOffset, metadata.Id, suffix))
+}
+
+// CopyLogSegmentData copies the segment and its indexes, each written to a
+// temporary file first so that a partial copy never has the final name.
+func (s *LocalTieredStorage) CopyLogSegmentData(metadata RemoteLogSegmentMetadata, data LogSegmentData) error {
+	if err := os.MkdirAll(logDirName(s.Dir, metadata.Partition), 0755); err != nil {
+		return fmt.Errorf("unable to create remote log dir: %w", err)
+	}
+	for src, suffix := range map[string]string{
+		data.LogSegment:  LogFileSuffix,
+		data.OffsetIndex: IndexFileSuffix,
+		data.TimeIndex:   TimeIndexFileSuffix,
+		data.TxnIndex:    TxnIndexFileSuffix,
+	} {
+		if src == "" {
+			continue
+		}
+		if err := copyFile(src, s.fileName(metadata, suffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", src, err)
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmp, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("unable to copy %s to %s: %w", src, tmp, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("unable to sync %s: %w", tmp, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("unable to rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+func (s *LocalTieredStorage) FetchLogSegment(metadata RemoteLogSegmentMetadata, startPosition int64) (io.ReadCloser, error) {
+	path := s.fileName(metadata, LogFileSuffix)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open remote segment %s: %w", path, err)
+	}
+	if _, err := f.Seek(startPosition, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to seek remote segment %s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (s *LocalTieredStorage) FetchIndex(metadata RemoteLogSegmentMetadata, indexType IndexType) (io.ReadCloser, error) {
+	suffix := IndexFileSuffix
+	switch indexType {
+	case TimestampIndexType:
+		suffix = TimeIndexFileSuffix
+	case TransactionIndexType:
+		suffix = TxnIndexFileSuffix
+	}
+	path := s.fileName(metadata, suffix)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open remote index %s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (s *LocalTieredStorage) DeleteLogSegmentData(metadata RemoteLogSegmentMetadata) error {
+	for _, suffix := range []string{LogFileSuffix, IndexFileSuffix, TimeIndexFileSuffix, TxnIndexFileSuffix} {
+		path := s.fileName(metadata, suffix)
+		for _, p := range []string{path, path + ".tmp"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("unable to delete %s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
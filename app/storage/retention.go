@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HighWatermarkOffset asks DeleteRecords to delete every committed record.
+const HighWatermarkOffset int64 = -1
+
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
+// deleteRecords moves the log start offset up to offset, for DeleteRecords,
+// and deletes the segments falling wholly below it. The active segment is
+// rolled first if it does, so that no record below the offset stays on disk.
+// The remote copies of a tiered log are left to the RemoteLogManager, whose
+// retention deletes those below the log start offset. It returns the new log
+// start offset.
+func (l *Log) deleteRecords(offset int64, now time.Time) (int64, error) {
+	l.mu.Lock()
+	if offset == HighWatermarkOffset {
+		offset = l.highWatermark
+	}
+	if offset < 0 || offset > l.highWatermark {
+		l.mu.Unlock()
+		return -1, fmt.Errorf("%w: %d is not between 0 and the high watermark %d of %s", ErrOffsetOutOfRange, offset, l.highWatermark, l.Partition)
+	}
+	l.logStartOffset = max(l.logStartOffset, offset)
+	if active := l.activeSegment(); active.Size() > 0 && active.NextOffset() <= l.logStartOffset {
+		if _, err := l.roll(); err != nil {
+			err = l.checkIO(err)
+			l.mu.Unlock()
+			return -1, err
+		}
+	}
+	l.mu.Unlock()
+
+	if _, err := l.DeleteOldSegments(now); err != nil {
+		return -1, err
+	}
+	return l.LogStartOffset(), nil
+}
+
+// DeleteOldSegments removes the oldest segments that fall entirely below the
+// log start offset, are older than retention.ms, or push the log beyond
+// retention.bytes. The active segment is never removed. It returns the
+// number of segments deleted. The producer snapshots below the first segment
+// left go with them.
+//
+// A tiered log instead keeps its local segments for local.retention.ms and
+// local.retention.bytes, and only once they are in remote storage. Deleting
+// them leaves the log start offset where it is, the remote copies being
+// expired by the RemoteLogManager.
+func (l *Log) DeleteOldSegments(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	config := l.config
+	tiered := l.tiered()
+	totalSize := int64(0)
+	for _, segment := range l.segments {
+		totalSize += segment.Size()
+	}
+
+	deleted := 0
+	for len(l.segments) > 1 {
+		segment := l.segments[0]
+		timestamp, err := segment.LargestTimestamp()
+		if err != nil {
+			return deleted, l.checkIO(err)
+		}
+		reason := deletionReason(config, tiered, l.logStartOffset, segment.NextOffset(), timestamp, segment.Size(), totalSize, now)
+		if reason == "" || (tiered && segment.NextOffset() > l.logStartOffset && segment.NextOffset()-1 > l.highestRemoteOffset) {
+			break
+		}
+
+		if err := segment.delete(); err != nil {
+			return deleted, l.checkIO(err)
+		}
+		l.segments = l.segments[1:]
+		totalSize -= segment.Size()
+		deleted++
+		if !tiered {
+			l.logStartOffset = max(l.logStartOffset, l.segments[0].BaseOffset)
+		}
+		fmt.Printf("Deleted segment %d-%d of %s because %s\n", segment.BaseOffset, segment.NextOffset()-1, l.Partition, reason)
+	}
+	if deleted > 0 {
+		l.producers.truncateHead(l.logStartOffset)
+		baseOffset := l.segments[0].BaseOffset
+		if err := deleteProducerSnapshots(l.Dir, func(offset int64) bool { return offset < baseOffset }); err != nil {
+			return deleted, l.checkIO(err)
+		}
+	}
+	return deleted, nil
+}
+
+// deletionReason says why retention deletes the oldest segment of a log,
+// given its next offset, largest timestamp and size, or is empty if it keeps
+// it. With local the local retention limits of a tiered log apply.
+func deletionReason(config LogConfig, local bool, logStartOffset int64, nextOffset int64, maxTimestamp int64, size int64, totalSize int64, now time.Time) string {
+	prefix, retentionMs, retentionBytes := "", config.RetentionMs, config.RetentionBytes
+	if local {
+		prefix, retentionMs, retentionBytes = "local.", config.LocalRetentionMs, config.LocalRetentionBytes
+	}
+	switch {
+	case nextOffset <= logStartOffset:
+		return fmt.Sprintf("it is below the log start offset %d", logStartOffset)
+	case !config.Deletes():
+	case retentionMs >= 0 && maxTimestamp >= 0 && now.UnixMilli()-maxTimestamp > retentionMs:
+		return fmt.Sprintf("its largest timestamp %d breaches %sretention.ms=%d", maxTimestamp, prefix, retentionMs)
+	case retentionBytes >= 0 && totalSize-size >= retentionBytes:
+		return fmt.Sprintf("the log size %d breaches %sretention.bytes=%d", totalSize, prefix, retentionBytes)
+	}
+	return ""
+}
+
+// StartRetention runs retention over every open log each interval until
+// Close.
+func (m *LogManager) StartRetention(interval time.Duration) {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.RunRetention()
+			}
+		}
+	}()
+}
+
+// RunRetention applies retention to every open log once.
+func (m *LogManager) RunRetention() {
+	now := time.Now()
+	for _, log := range m.openLogs() {
+		if _, err := log.DeleteOldSegments(now); err != nil {
+			fmt.Printf("Error applying retention to %s: %s\n", log.Partition, err.Error())
+		}
+	}
+}
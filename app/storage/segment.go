@@ -0,0 +1,554 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+const LogFileSuffix = ".log"
+
+var errCorruptBatch = errors.New("truncated or corrupt batch")
+
+func segmentFileName(dir string, baseOffset int64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, suffix))
+}
+
+// Segment is one file of a partition log, named after the offset of its first
+// record, together with its offset, time and transaction indexes. When the
+// segment is encrypted every batch is a frame of its own, see segmentFile,
+// and positions are those of the frames.
+type Segment struct {
+	BaseOffset  int64
+	file        *segmentFile
+	offsetIndex *OffsetIndex
+	timeIndex   *TimeIndex
+	txnIndex    *TxnIndex
+	size        int64
+	nextOffset  int64
+	// rollTimestamp is the max timestamp of the first batch, which segment.ms
+	// is measured from.
+	rollTimestamp        int64
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+
+	indexIntervalBytes       int
+	bytesSinceLastIndexEntry int
+
+	// deleted is set once retention or DeleteRecords deleted the segment,
+	// so that a reader that did not hold the log lock, the cleaner, can
+	// tell its failed read from an I/O error.
+	deleted atomic.Bool
+}
+
+func openSegment(dir string, baseOffset int64, config LogConfig) (*Segment, error) {
+	s, _, err := loadSegment(dir, baseOffset, config, false)
+	return s, err
+}
+
+// recoverSegment opens a segment that may not have been fully flushed before
+// a crash, validating every batch. It returns the number of bytes truncated
+// from its tail.
+func recoverSegment(dir string, baseOffset int64, config LogConfig) (*Segment, int64, error) {
+	return loadSegment(dir, baseOffset, config, true)
+}
+
+func loadSegment(dir string, baseOffset int64, config LogConfig, recover bool) (*Segment, int64, error) {
+	path := segmentFileName(dir, baseOffset, LogFileSuffix)
+	file, err := openSegmentFile(path, baseOffset, config.Keyring)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to open segment %s: %w", path, err)
+	}
+	s := &Segment{
+		BaseOffset:           baseOffset,
+		file:                 file,
+		nextOffset:           baseOffset,
+		rollTimestamp:        -1,
+		maxTimestamp:         -1,
+		offsetOfMaxTimestamp: -1,
+		indexIntervalBytes:   config.IndexIntervalBytes,
+	}
+	truncated, err := s.load(config, recover)
+	if err != nil {
+		s.Close()
+		return nil, 0, err
+	}
+	return s, truncated, nil
+}
+
+// load opens the indexes and finds the segment's size and next offset. Only
+// the tail after the last offset index entry is scanned, unless an index is
+// missing or fails its sanity checks, in which case both are rebuilt. With
+// recover the whole segment is validated instead, see recover.
+func (s *Segment) load(config LogConfig, recover bool) (int64, error) {
+	s.size = s.file.size
+
+	dir := filepath.Dir(s.file.Name())
+	indexPath := segmentFileName(dir, s.BaseOffset, IndexFileSuffix)
+	timeIndexPath := segmentFileName(dir, s.BaseOffset, TimeIndexFileSuffix)
+	_, indexErr := os.Stat(indexPath)
+	_, timeIndexErr := os.Stat(timeIndexPath)
+	missing := indexErr != nil || timeIndexErr != nil
+
+	var offsetIndexErr, timeIndexOpenErr error
+	s.offsetIndex, offsetIndexErr = openOffsetIndex(indexPath, s.BaseOffset, config.SegmentIndexBytes, config.Keyring)
+	if s.offsetIndex == nil {
+		return 0, offsetIndexErr
+	}
+	s.timeIndex, timeIndexOpenErr = openTimeIndex(timeIndexPath, s.BaseOffset, config.SegmentIndexBytes, config.Keyring)
+	if s.timeIndex == nil {
+		return 0, timeIndexOpenErr
+	}
+	var err error
+	if s.txnIndex, err = openTxnIndex(segmentFileName(dir, s.BaseOffset, TxnIndexFileSuffix), s.BaseOffset, config.Keyring); err != nil {
+		return 0, err
+	}
+	if recover {
+		return s.recover()
+	}
+
+	corrupt := errors.Is(offsetIndexErr, errCorruptIndex) || errors.Is(timeIndexOpenErr, errCorruptIndex)
+	if last, ok := s.offsetIndex.LastEntry(); ok && last.Position >= s.size {
+		corrupt = true
+	}
+	if (missing && s.Size() > 0) || corrupt {
+		fmt.Printf("Rebuilding indexes of segment %s\n", s.file.Name())
+		return 0, s.rebuildIndexes()
+	}
+	return 0, s.scanTail()
+}
+
+func (s *Segment) scanTail() error {
+	if err := s.scan(0, func(batch Batch, position int64) bool {
+		s.rollTimestamp = batch.MaxTimestamp
+		return false
+	}); err != nil {
+		return err
+	}
+	if last, ok := s.timeIndex.LastEntry(); ok {
+		s.maxTimestamp, s.offsetOfMaxTimestamp = last.Timestamp, last.Offset
+	}
+
+	position := int64(0)
+	if last, ok := s.offsetIndex.LastEntry(); ok {
+		position = last.Position
+	}
+	return s.scan(position, func(batch Batch, position int64) bool {
+		s.nextOffset = batch.LastOffset + 1
+		s.bytesSinceLastIndexEntry += record.Size(batch.Data)
+		s.trackTimestamp(batch)
+		return true
+	})
+}
+
+func (s *Segment) rebuildIndexes() error {
+	if err := s.resetIndexes(); err != nil {
+		return err
+	}
+	var indexErr error
+	err := s.scan(0, func(batch Batch, position int64) bool {
+		indexErr = s.indexBatch(batch, position)
+		return indexErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return indexErr
+}
+
+func (s *Segment) resetIndexes() error {
+	if err := s.offsetIndex.Reset(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Reset(); err != nil {
+		return err
+	}
+	s.nextOffset = s.BaseOffset
+	s.rollTimestamp, s.maxTimestamp, s.offsetOfMaxTimestamp = -1, -1, -1
+	s.bytesSinceLastIndexEntry = 0
+	return nil
+}
+
+// recover rebuilds the indexes while validating every batch: it must fit in
+// the file, be a v2 batch with a matching CRC32C and follow the previous
+// batch's offsets, and if encrypted its frame must authenticate. The segment
+// is truncated at the first batch that fails,
+// which after a crash is the one that was being written, and the aborted
+// transactions whose marker is lost are dropped. It returns the number of
+// bytes truncated.
+func (s *Segment) recover() (int64, error) {
+	if err := s.resetIndexes(); err != nil {
+		return 0, err
+	}
+
+	position := s.file.start
+	for position < s.size {
+		data, next, err := s.readBatch(position, true)
+		if errors.Is(err, errCorruptBatch) || errors.Is(err, errCorruptFrame) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		batch := parseBatchHeader(data)
+		if record.Validate(data) != nil || batch.BaseOffset < s.nextOffset || batch.LastOffset < batch.BaseOffset {
+			break
+		}
+		if err := s.indexBatch(batch, position); err != nil {
+			return 0, err
+		}
+		position = next
+	}
+
+	truncated := s.size - position
+	if truncated > 0 {
+		if err := s.file.truncate(position); err != nil {
+			return 0, fmt.Errorf("unable to truncate segment %s: %w", s.file.Name(), err)
+		}
+		s.size = position
+	}
+	return truncated, s.txnIndex.TruncateTo(s.nextOffset)
+}
+
+// readBatch returns the batch at position and the position of the next. Only
+// the header of a batch in the clear is read unless whole is set; an
+// encrypted batch is always read whole, as its frame can only be decrypted
+// whole.
+func (s *Segment) readBatch(position int64, whole bool) ([]byte, int64, error) {
+	if s.file.cipher != nil {
+		data, next, err := s.file.readFrame(position)
+		if err == nil && (len(data) < record.HeaderSize || record.Size(data) != len(data)) {
+			err = fmt.Errorf("%w at position %d in %s", errCorruptBatch, position, s.file.Name())
+		}
+		return data, next, err
+	}
+	header := make([]byte, record.HeaderSize)
+	if _, err := s.file.ReadAt(header, position); err != nil {
+		if err == io.EOF {
+			return nil, 0, fmt.Errorf("%w at position %d in %s", errCorruptBatch, position, s.file.Name())
+		}
+		return nil, 0, fmt.Errorf("unable to read segment %s: %w", s.file.Name(), err)
+	}
+	size := record.Size(header)
+	if size < record.HeaderSize || position+int64(size) > s.size {
+		return nil, 0, fmt.Errorf("%w at position %d in %s", errCorruptBatch, position, s.file.Name())
+	}
+	if !whole {
+		return header, position + int64(size), nil
+	}
+	data := make([]byte, size)
+	if _, err := s.file.ReadAt(data, position); err != nil {
+		return nil, 0, fmt.Errorf("unable to read segment %s: %w", s.file.Name(), err)
+	}
+	return data, position + int64(size), nil
+}
+
+// readWhole returns the whole batch of a header scan passed at position.
+func (s *Segment) readWhole(header Batch, position int64) (Batch, error) {
+	if s.file.cipher != nil {
+		return header, nil
+	}
+	data, _, err := s.readBatch(position, true)
+	if err != nil {
+		return Batch{}, err
+	}
+	return parseBatchHeader(data), nil
+}
+
+// scan walks the batches from position, calling fn until it returns false.
+// Batch.Data only holds the header, unless the segment is encrypted.
+func (s *Segment) scan(position int64, fn func(batch Batch, position int64) bool) error {
+	position = max(position, s.file.start)
+	for position < s.size {
+		header, next, err := s.readBatch(position, false)
+		if err != nil {
+			return err
+		}
+		if !fn(parseBatchHeader(header), position) {
+			return nil
+		}
+		position = next
+	}
+	return nil
+}
+
+// forEachBatch reads every batch of the segment in order, stopping at the
+// first error fn returns.
+func (s *Segment) forEachBatch(fn func(batch Batch) error) error {
+	var fnErr error
+	err := s.scan(0, func(header Batch, position int64) bool {
+		var batch Batch
+		if batch, fnErr = s.readWhole(header, position); fnErr == nil {
+			fnErr = fn(batch)
+		}
+		return fnErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Size is the size of the segment's batches, without the header of an
+// encrypted segment.
+func (s *Segment) Size() int64 {
+	return s.size - s.file.start
+}
+
+func (s *Segment) NextOffset() int64 {
+	return s.nextOffset
+}
+
+// MaxTimestamp is the largest record timestamp in the segment, or -1 if it is
+// empty.
+func (s *Segment) MaxTimestamp() int64 {
+	return s.maxTimestamp
+}
+
+// LargestTimestamp is the timestamp retention.ms is measured from: the
+// largest record timestamp, or for batches without timestamps the last
+// modification time of the log file, as Kafka does.
+func (s *Segment) LargestTimestamp() (int64, error) {
+	if s.maxTimestamp >= 0 {
+		return s.maxTimestamp, nil
+	}
+	info, err := os.Stat(s.file.Name())
+	if err != nil {
+		return -1, err
+	}
+	return info.ModTime().UnixMilli(), nil
+}
+
+func (s *Segment) trackTimestamp(batch Batch) {
+	if s.rollTimestamp < 0 {
+		s.rollTimestamp = batch.MaxTimestamp
+	}
+	if batch.MaxTimestamp > s.maxTimestamp {
+		s.maxTimestamp = batch.MaxTimestamp
+		s.offsetOfMaxTimestamp = batch.LastOffset
+	}
+}
+
+// indexBatch updates the in-memory state for a batch written at position and
+// adds index entries once index.interval.bytes have passed since the last.
+func (s *Segment) indexBatch(batch Batch, position int64) error {
+	s.trackTimestamp(batch)
+	s.nextOffset = batch.LastOffset + 1
+	if s.bytesSinceLastIndexEntry > s.indexIntervalBytes {
+		if err := s.offsetIndex.Append(batch.LastOffset, position); err != nil {
+			return err
+		}
+		if err := s.timeIndex.Append(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return err
+		}
+		s.bytesSinceLastIndexEntry = 0
+	}
+	s.bytesSinceLastIndexEntry += record.Size(batch.Data)
+	return nil
+}
+
+// append writes the batches with a single write and indexes them.
+func (s *Segment) append(batches ...Batch) error {
+	chunks := make([][]byte, len(batches))
+	for i, batch := range batches {
+		chunks[i] = batch.Data
+	}
+	positions, err := s.file.write(chunks...)
+	if err != nil {
+		return fmt.Errorf("unable to append to segment %s: %w", s.file.Name(), err)
+	}
+	s.size = s.file.size
+	for i, batch := range batches {
+		if err := s.indexBatch(batch, positions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shouldRoll reports whether appending size more bytes must go to a new
+// segment.
+func (s *Segment) shouldRoll(config LogConfig, size int, now time.Time) bool {
+	if s.Size() == 0 {
+		return false
+	}
+	if s.Size()+int64(size) > config.SegmentBytes {
+		return true
+	}
+	if s.offsetIndex.IsFull() || s.timeIndex.IsFull() {
+		return true
+	}
+	return s.rollTimestamp >= 0 && now.UnixMilli()-s.rollTimestamp > config.SegmentMs
+}
+
+// walk calls fn with the header and position of the batches holding offsets
+// >= startOffset, until it returns false or maxBytes would be exceeded. With
+// minOneBatch the first batch is walked even if it is larger than maxBytes,
+// so that readers can make progress.
+func (s *Segment) walk(startOffset int64, maxBytes int, minOneBatch bool, fn func(header Batch, position int64) bool) error {
+	total := 0
+	return s.scan(s.offsetIndex.Lookup(startOffset), func(header Batch, position int64) bool {
+		if header.LastOffset < startOffset {
+			return true
+		}
+		size := record.Size(header.Data)
+		if total+size > maxBytes && (total > 0 || !minOneBatch) {
+			return false
+		}
+		total += size
+		return fn(header, position)
+	})
+}
+
+// read returns the batches walk visits.
+func (s *Segment) read(startOffset int64, maxBytes int, minOneBatch bool) ([]Batch, error) {
+	batches := []Batch{}
+	var readErr error
+	err := s.walk(startOffset, maxBytes, minOneBatch, func(header Batch, position int64) bool {
+		var batch Batch
+		if batch, readErr = s.readWhole(header, position); readErr != nil {
+			return false
+		}
+		batches = append(batches, batch)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return batches, nil
+}
+
+// readRecords returns the batches walk visits as FileRecords, without
+// reading them, ending before the first header accept turns down. The
+// batches of an encrypted segment are decrypted into memory instead. It is
+// nil if there are none. It also reports whether accept turned one down.
+func (s *Segment) readRecords(startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) (Records, bool, error) {
+	start, end := int64(-1), int64(-1)
+	rejected := false
+	decrypted := &memoryRecords{}
+	err := s.walk(startOffset, maxBytes, minOneBatch, func(header Batch, position int64) bool {
+		if rejected = !accept(header); rejected {
+			return false
+		}
+		if s.file.cipher != nil {
+			decrypted.batches = append(decrypted.batches, header.Data)
+			decrypted.size += header.Size()
+			return true
+		}
+		if start < 0 {
+			start = position
+		}
+		end = position + int64(record.Size(header.Data))
+		return true
+	})
+	if err != nil {
+		return nil, rejected, err
+	}
+	if decrypted.size > 0 {
+		return decrypted, rejected, nil
+	}
+	if start < 0 {
+		return nil, rejected, nil
+	}
+	records, err := openFileRecords(s.file, start, int(end-start))
+	return records, rejected, err
+}
+
+// findByTimestamp returns the offset and timestamp of the first record at or
+// after startOffset with a timestamp at or after timestamp, using the indexes
+// to skip ahead.
+func (s *Segment) findByTimestamp(timestamp int64, startOffset int64) (int64, int64, bool, error) {
+	if s.maxTimestamp < timestamp || s.nextOffset <= startOffset {
+		return -1, -1, false, nil
+	}
+	offset, recordTimestamp, ok := int64(-1), int64(-1), false
+	var findErr error
+	position := max(s.offsetIndex.Lookup(s.timeIndex.Lookup(timestamp)), s.offsetIndex.Lookup(startOffset))
+	err := s.scan(position, func(header Batch, position int64) bool {
+		if header.MaxTimestamp < timestamp || header.LastOffset < startOffset {
+			return true
+		}
+		var batch Batch
+		if batch, findErr = s.readWhole(header, position); findErr != nil {
+			return false
+		}
+		offset, recordTimestamp, ok, findErr = findInBatch(batch, timestamp, startOffset)
+		return !ok && findErr == nil
+	})
+	if err != nil {
+		return -1, -1, false, err
+	}
+	return offset, recordTimestamp, ok, findErr
+}
+
+func (s *Segment) flush() error {
+	return syncFiles(s.files())
+}
+
+// files returns the files of the segment that a flush syncs, the transaction
+// index only once it exists.
+func (s *Segment) files() []*segmentFile {
+	files := []*segmentFile{s.file, s.offsetIndex.file, s.timeIndex.file}
+	if s.txnIndex.file != nil {
+		files = append(files, s.txnIndex.file)
+	}
+	return files
+}
+
+// syncFiles syncs files to disk. A file closed meanwhile by a flush outside
+// the log lock is skipped: its segment was deleted, or flushed as the log
+// was closed.
+func syncFiles(files []*segmentFile) error {
+	for _, f := range files {
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return fmt.Errorf("unable to flush %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// delete closes the segment and removes its files.
+func (s *Segment) delete() error {
+	s.deleted.Store(true)
+	s.Close()
+	return deleteSegmentFiles(filepath.Dir(s.file.Name()), s.BaseOffset)
+}
+
+func deleteSegmentFiles(dir string, baseOffset int64) error {
+	for _, suffix := range []string{LogFileSuffix, IndexFileSuffix, TimeIndexFileSuffix, TxnIndexFileSuffix} {
+		path := segmentFileName(dir, baseOffset, suffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to delete %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (s *Segment) Close() error {
+	err := s.file.Close()
+	if s.offsetIndex != nil {
+		if indexErr := s.offsetIndex.Close(); err == nil {
+			err = indexErr
+		}
+	}
+	if s.timeIndex != nil {
+		if indexErr := s.timeIndex.Close(); err == nil {
+			err = indexErr
+		}
+	}
+	if s.txnIndex != nil {
+		if indexErr := s.txnIndex.Close(); err == nil {
+			err = indexErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// Storage is a storage backend. It keeps the log of every partition, the
+// cluster metadata log __cluster_metadata-0 included, with its offsets and
+// segments. LogManager keeps them in segment files under the log
+// directories, and MemoryStorage in memory.
+type Storage interface {
+	// GetLog returns the log of an existing partition.
+	GetLog(tp TopicPartition) (PartitionLog, error)
+	GetOrCreateLog(tp TopicPartition) (PartitionLog, error)
+	// SetTopicConfig records the topic level overrides and applies them to
+	// the topic's logs.
+	SetTopicConfig(topic string, overrides map[string]string)
+	// SetAppendListener registers fn to be called after every append to any
+	// log.
+	SetAppendListener(fn func(TopicPartition))
+	DescribeLogDirs() []LogDirInfo
+	AlterReplicaLogDir(tp TopicPartition, path string) error
+	// DeleteRecords moves the log start offset of a partition up to offset,
+	// or its high watermark for HighWatermarkOffset, deleting the records
+	// below. It returns the new log start offset.
+	DeleteRecords(tp TopicPartition, offset int64) (int64, error)
+	// StartRetention deletes old segments every interval until Close.
+	StartRetention(interval time.Duration)
+	Close() error
+}
+
+// PartitionLog is the log of one partition: v2 record batches at increasing
+// offsets, kept in segments that retention deletes from the front.
+type PartitionLog interface {
+	Config() LogConfig
+	// Append assigns the next offsets to a v2 record batch and appends it.
+	Append(data []byte) (Batch, error)
+	// Read returns the batches from the one containing startOffset onwards,
+	// up to maxBytes. With minOneBatch the first batch is returned even if
+	// it alone exceeds maxBytes.
+	Read(startOffset int64, maxBytes int, minOneBatch bool) ([]Batch, error)
+	// ReadRecords is Read for sending the batches as they are. accept is
+	// called with each batch header, and reading stops before the first
+	// one it turns down. The Records must be closed.
+	ReadRecords(startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) ([]Records, error)
+
+	LogStartOffset() int64
+	// LocalLogStartOffset is the first offset not only in remote storage.
+	LocalLogStartOffset() int64
+	// HighestOffsetInRemoteStorage is the last offset copied to remote
+	// storage, or -1.
+	HighestOffsetInRemoteStorage() int64
+	HighWatermark() int64
+	// LastStableOffset is the offset below which every transaction is
+	// decided.
+	LastStableOffset() int64
+	LogEndOffset() int64
+	// OffsetMetadata locates offset in the local log, so that the bytes
+	// appended after it can be estimated without reading them.
+	OffsetMetadata(offset int64) (LogOffsetMetadata, error)
+	// FindOffsetByTimestamp returns the offset and timestamp of the first
+	// record with a timestamp at or after timestamp.
+	FindOffsetByTimestamp(timestamp int64) (offset int64, recordTimestamp int64, ok bool, err error)
+	// MaxTimestamp returns the largest timestamp in the log and the offset
+	// of the batch holding it.
+	MaxTimestamp() (timestamp int64, offset int64)
+	// AbortedTransactions returns the aborted transactions with records
+	// from startOffset up to upperOffset.
+	AbortedTransactions(startOffset int64, upperOffset int64) ([]AbortedTxn, error)
+	// ActiveProducers returns the idempotent and transactional producers
+	// writing to the log.
+	ActiveProducers() []ActiveProducer
+
+	// Size is the total size of the segments.
+	Size() int64
+	Flush() error
+	// DeleteOldSegments applies retention, returning the number of segments
+	// deleted.
+	DeleteOldSegments(now time.Time) (int, error)
+}
+
+// LogOffsetMetadata locates an offset in a log: the segment holding it and
+// the position of its batch there, or the end of the active segment for the
+// log end offset. The positions of two offsets in the same segment differ by
+// the size of the batches between them.
+type LogOffsetMetadata struct {
+	Offset            int64
+	SegmentBaseOffset int64
+	Position          int64
+}
+
+// Records are batches read for sending as they are, written out by WriteTo.
+type Records interface {
+	io.WriterTo
+	Size() int
+	Close() error
+}
+
+var (
+	_ Storage      = (*LogManager)(nil)
+	_ PartitionLog = (*Log)(nil)
+	_ Storage      = (*MemoryStorage)(nil)
+	_ PartitionLog = (*MemoryLog)(nil)
+)
@@ -0,0 +1,487 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/record"
+)
+
+// RemoteLogManager tiers the logs of topics with remote.storage.enable. It
+// copies their rolled, committed segments to a RemoteStorageManager, applies
+// retention.ms and retention.bytes to the copies, and serves reads below a
+// log's local start offset from them. Local retention then only deletes
+// segments that were copied, see Log.DeleteOldSegments.
+type RemoteLogManager struct {
+	storage  RemoteStorageManager
+	metadata RemoteLogMetadataManager
+	// keyring decrypts the copies of encrypted segments, which are copied as
+	// they are.
+	keyring *Keyring
+}
+
+func NewRemoteLogManager(storage RemoteStorageManager, metadata RemoteLogMetadataManager) *RemoteLogManager {
+	return &RemoteLogManager{storage: storage, metadata: metadata}
+}
+
+// attach connects a log just opened to remote storage. Its log start offset
+// goes back below its first local segment if the segments before it are in
+// remote storage.
+func (r *RemoteLogManager) attach(l *Log, offsets CheckpointedOffsets) error {
+	segments, err := r.metadata.ListRemoteLogSegments(l.Partition)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remote = r
+	earliest := int64(-1)
+	for _, segment := range segments {
+		if segment.State != CopySegmentFinished {
+			continue
+		}
+		if earliest < 0 {
+			earliest = segment.StartOffset
+		}
+		l.highestRemoteOffset = max(l.highestRemoteOffset, segment.EndOffset)
+	}
+	if earliest >= 0 && earliest < l.logStartOffset {
+		l.logStartOffset = min(l.logStartOffset, max(offsets.LogStartOffset, earliest))
+	}
+	return nil
+}
+
+// SetRemoteLogManager tiers the logs of topics with remote.storage.enable. It
+// must be called before any log is opened.
+func (m *LogManager) SetRemoteLogManager(r *RemoteLogManager) {
+	m.remote = r
+	r.keyring = m.keyring
+}
+
+// StartRemoteLogManager copies segments to remote storage and expires remote
+// segments every interval until Close.
+func (m *LogManager) StartRemoteLogManager(interval time.Duration) {
+	m.done.Add(1)
+	go func() {
+		defer m.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.RunRemoteLogManager()
+			}
+		}
+	}()
+}
+
+// RunRemoteLogManager copies and expires the remote segments of every open
+// log once.
+func (m *LogManager) RunRemoteLogManager() {
+	if m.remote == nil {
+		return
+	}
+	now := time.Now()
+	for _, log := range m.openLogs() {
+		if err := m.remote.run(log, now); err != nil {
+			fmt.Printf("Error tiering %s: %s\n", log.Partition, err.Error())
+		}
+	}
+}
+
+func (r *RemoteLogManager) run(l *Log, now time.Time) error {
+	// Compacted logs rewrite their segments, so they are never tiered.
+	if config := l.Config(); !config.RemoteStorageEnable || config.Compacts() {
+		return nil
+	}
+	// The cleaner and replica moves would swap the files being copied.
+	if !l.maintenance.TryLock() {
+		return nil
+	}
+	defer l.maintenance.Unlock()
+	if err := r.copyLogSegments(l); err != nil {
+		return err
+	}
+	return r.deleteExpiredSegments(l, now)
+}
+
+// copyLogSegments copies the rolled segments not in remote storage yet, as
+// long as all their records are committed.
+func (r *RemoteLogManager) copyLogSegments(l *Log) error {
+	segments := l.Segments()
+	highWatermark := l.HighWatermark()
+	highest := l.HighestOffsetInRemoteStorage()
+	for _, segment := range segments[:len(segments)-1] {
+		if segment.NextOffset() > highWatermark {
+			break
+		}
+		if segment.NextOffset()-1 <= highest || segment.Size() == 0 {
+			continue
+		}
+		if err := r.copySegment(l, segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RemoteLogManager) copySegment(l *Log, segment *Segment) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	metadata := RemoteLogSegmentMetadata{
+		Id:                 hex.EncodeToString(id),
+		Partition:          l.Partition,
+		StartOffset:        segment.BaseOffset,
+		EndOffset:          segment.NextOffset() - 1,
+		MaxTimestamp:       segment.MaxTimestamp(),
+		SegmentSizeInBytes: segment.Size(),
+		State:              CopySegmentStarted,
+		EventTimestampMs:   time.Now().UnixMilli(),
+	}
+	if err := r.metadata.AddRemoteLogSegmentMetadata(metadata); err != nil {
+		return err
+	}
+	dir := filepath.Dir(segment.file.Name())
+	data := LogSegmentData{
+		LogSegment:  segmentFileName(dir, segment.BaseOffset, LogFileSuffix),
+		OffsetIndex: segmentFileName(dir, segment.BaseOffset, IndexFileSuffix),
+		TimeIndex:   segmentFileName(dir, segment.BaseOffset, TimeIndexFileSuffix),
+	}
+	if _, err := os.Stat(segmentFileName(dir, segment.BaseOffset, TxnIndexFileSuffix)); err == nil {
+		data.TxnIndex = segmentFileName(dir, segment.BaseOffset, TxnIndexFileSuffix)
+	}
+	err := r.storage.CopyLogSegmentData(metadata, data)
+	if err != nil {
+		err = fmt.Errorf("unable to copy segment %d of %s to remote storage: %w", segment.BaseOffset, l.Partition, err)
+		return errors.Join(err, r.deleteSegment(metadata))
+	}
+	if err := r.metadata.UpdateRemoteLogSegmentMetadata(RemoteLogSegmentMetadataUpdate{
+		Id:               metadata.Id,
+		Partition:        metadata.Partition,
+		State:            CopySegmentFinished,
+		EventTimestampMs: time.Now().UnixMilli(),
+	}); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.highestRemoteOffset = max(l.highestRemoteOffset, metadata.EndOffset)
+	l.mu.Unlock()
+	fmt.Printf("Copied segment %d-%d of %s to remote storage\n", metadata.StartOffset, metadata.EndOffset, l.Partition)
+	return nil
+}
+
+// deleteSegment removes a segment from remote storage, recording the
+// deletion first so that it is finished after a crash.
+func (r *RemoteLogManager) deleteSegment(metadata RemoteLogSegmentMetadata) error {
+	update := RemoteLogSegmentMetadataUpdate{Id: metadata.Id, Partition: metadata.Partition}
+	if metadata.State != DeleteSegmentStarted {
+		update.State, update.EventTimestampMs = DeleteSegmentStarted, time.Now().UnixMilli()
+		if err := r.metadata.UpdateRemoteLogSegmentMetadata(update); err != nil {
+			return err
+		}
+	}
+	if err := r.storage.DeleteLogSegmentData(metadata); err != nil {
+		return err
+	}
+	update.State, update.EventTimestampMs = DeleteSegmentFinished, time.Now().UnixMilli()
+	return r.metadata.UpdateRemoteLogSegmentMetadata(update)
+}
+
+// deleteExpiredSegments applies retention to the remote segments of a log,
+// which together with its local ones make up its whole size. Copies left
+// unfinished by a failure or crash are removed first. Deleting a segment
+// moves the log start offset past it.
+func (r *RemoteLogManager) deleteExpiredSegments(l *Log, now time.Time) error {
+	segments, err := r.metadata.ListRemoteLogSegments(l.Partition)
+	if err != nil {
+		return err
+	}
+	copied := []RemoteLogSegmentMetadata{}
+	for _, segment := range segments {
+		if segment.State == CopySegmentFinished {
+			copied = append(copied, segment)
+			continue
+		}
+		if err := r.deleteSegment(segment); err != nil {
+			return err
+		}
+	}
+
+	config := l.Config()
+	logStartOffset, localStartOffset := l.LogStartOffset(), l.LocalLogStartOffset()
+	totalSize := l.Size()
+	for _, segment := range copied {
+		if segment.EndOffset < localStartOffset {
+			totalSize += segment.SegmentSizeInBytes
+		}
+	}
+	for _, segment := range copied {
+		onlyRemote := segment.EndOffset < localStartOffset
+		segmentConfig := config
+		if !onlyRemote {
+			// Deleting the copy of a segment still held locally would not
+			// make the log any smaller.
+			segmentConfig.RetentionBytes = -1
+		}
+		reason := deletionReason(segmentConfig, false, logStartOffset, segment.EndOffset+1, segment.MaxTimestamp, segment.SegmentSizeInBytes, totalSize, now)
+		if reason == "" {
+			break
+		}
+		if err := r.deleteSegment(segment); err != nil {
+			return err
+		}
+		if onlyRemote {
+			totalSize -= segment.SegmentSizeInBytes
+		}
+		logStartOffset = max(logStartOffset, segment.EndOffset+1)
+		l.maybeIncrementLogStartOffset(logStartOffset)
+		fmt.Printf("Deleted remote segment %d-%d of %s because %s\n", segment.StartOffset, segment.EndOffset, l.Partition, reason)
+	}
+	return nil
+}
+
+// read returns the batches of the remote segment holding startOffset from
+// the one containing it on, up to maxBytes, as Log.ReadRecords does. It
+// reports false if no remote segment holds startOffset.
+func (r *RemoteLogManager) read(tp TopicPartition, startOffset int64, maxBytes int, minOneBatch bool, accept func(header Batch) bool) ([]Batch, bool, error) {
+	metadata, ok, err := r.metadata.RemoteLogSegmentMetadata(tp, startOffset)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	offsetIndex, err := r.offsetIndex(metadata)
+	if err != nil {
+		return nil, true, err
+	}
+	batches := []Batch{}
+	total := 0
+	err = r.scanSegment(metadata, offsetIndex.Lookup(startOffset), func(batch Batch) bool {
+		if batch.LastOffset < startOffset {
+			return true
+		}
+		if total+batch.Size() > maxBytes && (total > 0 || !minOneBatch) {
+			return false
+		}
+		if accept != nil && !accept(batch) {
+			return false
+		}
+		batches = append(batches, batch)
+		total += batch.Size()
+		return true
+	})
+	return batches, true, err
+}
+
+// findOffsetByTimestamp searches the remote segments holding offsets from
+// logStartOffset up to localStartOffset, as Log.FindOffsetByTimestamp.
+func (r *RemoteLogManager) findOffsetByTimestamp(tp TopicPartition, timestamp int64, logStartOffset int64, localStartOffset int64) (int64, int64, bool, error) {
+	segments, err := r.metadata.ListRemoteLogSegments(tp)
+	if err != nil {
+		return -1, -1, false, err
+	}
+	for _, metadata := range segments {
+		if metadata.State != CopySegmentFinished || metadata.EndOffset < logStartOffset || metadata.MaxTimestamp < timestamp {
+			continue
+		}
+		if metadata.StartOffset >= localStartOffset {
+			break
+		}
+		timeIndex, err := r.timeIndex(metadata)
+		if err != nil {
+			return -1, -1, false, err
+		}
+		offsetIndex, err := r.offsetIndex(metadata)
+		if err != nil {
+			return -1, -1, false, err
+		}
+		offset, recordTimestamp, ok := int64(-1), int64(-1), false
+		var findErr error
+		position := max(offsetIndex.Lookup(timeIndex.Lookup(timestamp)), offsetIndex.Lookup(logStartOffset))
+		err = r.scanSegment(metadata, position, func(batch Batch) bool {
+			if batch.MaxTimestamp < timestamp || batch.LastOffset < logStartOffset {
+				return true
+			}
+			offset, recordTimestamp, ok, findErr = findInBatch(batch, timestamp, logStartOffset)
+			return !ok && findErr == nil
+		})
+		if err != nil || findErr != nil || ok {
+			return offset, recordTimestamp, ok, errors.Join(err, findErr)
+		}
+	}
+	return -1, -1, false, nil
+}
+
+// abortedTransactions collects the aborted transactions of the remote
+// segments from the one holding startOffset on, as Log.AbortedTransactions.
+// It stops early, reporting complete, at an abort after which every
+// transaction started below upperOffset was decided.
+func (r *RemoteLogManager) abortedTransactions(tp TopicPartition, startOffset int64, upperOffset int64) ([]AbortedTxn, bool, error) {
+	aborted := []AbortedTxn{}
+	segments, err := r.metadata.ListRemoteLogSegments(tp)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, metadata := range segments {
+		if metadata.State != CopySegmentFinished || metadata.EndOffset < startOffset {
+			continue
+		}
+		data, err := r.fetchIndex(metadata, TransactionIndexType)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for _, txn := range parseTxnIndex(data) {
+			if txn.LastOffset >= startOffset && txn.FirstOffset < upperOffset {
+				aborted = append(aborted, txn)
+			}
+			if txn.LastStableOffset >= upperOffset {
+				return aborted, true, nil
+			}
+		}
+	}
+	return aborted, false, nil
+}
+
+// scanSegment reads the batches of a remote segment from position on,
+// calling fn until it returns false.
+func (r *RemoteLogManager) scanSegment(metadata RemoteLogSegmentMetadata, position int64, fn func(batch Batch) bool) error {
+	c, start, err := r.segmentCipher(metadata)
+	if err != nil {
+		return err
+	}
+	position = max(position, start)
+	segment, err := r.storage.FetchLogSegment(metadata, position)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+	reader := bufio.NewReader(segment)
+	if c != nil {
+		return scanFrames(reader, c, position, metadata, fn)
+	}
+	header := make([]byte, record.HeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+		}
+		size := record.Size(header)
+		if size < record.HeaderSize {
+			return fmt.Errorf("corrupt batch in remote segment %d of %s", metadata.StartOffset, metadata.Partition)
+		}
+		data := make([]byte, size)
+		copy(data, header)
+		if _, err := io.ReadFull(reader, data[record.HeaderSize:]); err != nil {
+			return fmt.Errorf("unable to read remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+		}
+		if !fn(parseBatchHeader(data)) {
+			return nil
+		}
+	}
+}
+
+// segmentCipher reads the header of a remote segment if a keyring is
+// configured. It returns the cipher of an encrypted segment, nil for one in
+// the clear, and the position of its first batch.
+func (r *RemoteLogManager) segmentCipher(metadata RemoteLogSegmentMetadata) (*fileCipher, int64, error) {
+	if r.keyring == nil {
+		return nil, 0, nil
+	}
+	segment, err := r.storage.FetchLogSegment(metadata, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer segment.Close()
+	header := make([]byte, maxHeaderSize)
+	n, err := io.ReadFull(segment, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("unable to read remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+	}
+	keyId, size, ok, err := parseEncryptionHeader(header[:n])
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	c, err := r.keyring.cipher(keyId, metadata.StartOffset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+	}
+	return c, int64(size), nil
+}
+
+// scanFrames is scanSegment for an encrypted segment read from position on.
+func scanFrames(reader io.Reader, c *fileCipher, position int64, metadata RemoteLogSegmentMetadata, fn func(batch Batch) bool) error {
+	length := make([]byte, frameLengthSize)
+	for {
+		if _, err := io.ReadFull(reader, length); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+		}
+		size := int64(binary.BigEndian.Uint32(length))
+		if size > metadata.SegmentSizeInBytes {
+			return fmt.Errorf("corrupt frame in remote segment %d of %s", metadata.StartOffset, metadata.Partition)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return fmt.Errorf("unable to read remote segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+		}
+		data, err := c.open(position, body)
+		if err == nil && (len(data) < record.HeaderSize || record.Size(data) != len(data)) {
+			err = errCorruptBatch
+		}
+		if err != nil {
+			return fmt.Errorf("remote segment %d of %s: %w at position %d", metadata.StartOffset, metadata.Partition, err, position)
+		}
+		if !fn(parseBatchHeader(data)) {
+			return nil
+		}
+		position += frameLengthSize + size
+	}
+}
+
+func (r *RemoteLogManager) fetchIndex(metadata RemoteLogSegmentMetadata, indexType IndexType) ([]byte, error) {
+	index, err := r.storage.FetchIndex(metadata, indexType)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	data, err := io.ReadAll(index)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read remote index of segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+	}
+	if data, err = decryptFile(data, metadata.StartOffset, r.keyring); err != nil {
+		return nil, fmt.Errorf("unable to decrypt remote index of segment %d of %s: %w", metadata.StartOffset, metadata.Partition, err)
+	}
+	return data, nil
+}
+
+func (r *RemoteLogManager) offsetIndex(metadata RemoteLogSegmentMetadata) (*OffsetIndex, error) {
+	data, err := r.fetchIndex(metadata, OffsetIndexType)
+	if err != nil {
+		return nil, err
+	}
+	// A damaged index only costs a longer scan.
+	entries, _ := parseOffsetIndex(data, metadata.StartOffset)
+	return &OffsetIndex{baseOffset: metadata.StartOffset, entries: entries}, nil
+}
+
+func (r *RemoteLogManager) timeIndex(metadata RemoteLogSegmentMetadata) (*TimeIndex, error) {
+	data, err := r.fetchIndex(metadata, TimestampIndexType)
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := parseTimeIndex(data, metadata.StartOffset)
+	return &TimeIndex{baseOffset: metadata.StartOffset, entries: entries}, nil
+}
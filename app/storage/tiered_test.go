@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/config"
+)
+
+// openTieredLog opens partition 0 of topic test in dir/logs, tiered to
+// dir/remote with the topic configured with overrides. Segments hold two 85
+// byte batches each.
+func openTieredLog(t *testing.T, dir string, overrides map[string]string) (*LogManager, *Log) {
+	t.Helper()
+	m := NewLogManager([]string{filepath.Join(dir, "logs")}, config.New(map[string]string{"log.segment.bytes": "200"}))
+	m.SetRemoteLogManager(NewRemoteLogManager(
+		NewLocalTieredStorage(filepath.Join(dir, "remote")),
+		NewFileRemoteLogMetadataManager(filepath.Join(dir, "remote-metadata")),
+	))
+	m.SetTopicConfig("test", overrides)
+	if err := m.LoadLogs(); err != nil {
+		t.Fatalf("LoadLogs: %v", err)
+	}
+	log, err := m.getLog(TopicPartition{Topic: "test", Partition: 0}, true)
+	if err != nil {
+		m.Close()
+		t.Fatalf("getLog: %v", err)
+	}
+	return m, log
+}
+
+// remoteStates returns the state of each remote segment of log by start
+// offset.
+func remoteStates(t *testing.T, log *Log) map[int64]RemoteLogSegmentState {
+	t.Helper()
+	segments, err := log.remote.metadata.ListRemoteLogSegments(log.Partition)
+	if err != nil {
+		t.Fatalf("ListRemoteLogSegments: %v", err)
+	}
+	states := map[int64]RemoteLogSegmentState{}
+	for _, segment := range segments {
+		states[segment.StartOffset] = segment.State
+	}
+	return states
+}
+
+// tierLog appends five batches of two records, copies the rolled segments to
+// remote storage and deletes their local copies.
+func tierLog(t *testing.T, m *LogManager, log *Log) {
+	t.Helper()
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	m.RunRemoteLogManager()
+	if _, err := log.DeleteOldSegments(time.Now()); err != nil {
+		t.Fatalf("DeleteOldSegments: %v", err)
+	}
+}
+
+func TestTieredLogReadsRemoteSegments(t *testing.T) {
+	dir := t.TempDir()
+	m, log := openTieredLog(t, dir, map[string]string{"remote.storage.enable": "true", "local.retention.bytes": "0"})
+	tierLog(t, m, log)
+
+	// The active segment is never copied.
+	want := map[int64]RemoteLogSegmentState{0: CopySegmentFinished, 4: CopySegmentFinished}
+	if got := remoteStates(t, log); !maps.Equal(got, want) {
+		t.Errorf("got remote segments %v, want %v", got, want)
+	}
+	if got := log.HighestOffsetInRemoteStorage(); got != 7 {
+		t.Errorf("got highest remote offset %d, want 7", got)
+	}
+	// Only copied segments are deleted locally, leaving the log start offset.
+	if got, want := baseOffsets(log), []int64{8}; !slices.Equal(got, want) {
+		t.Errorf("got local segments %v, want %v", got, want)
+	}
+	if log.LogStartOffset() != 0 || log.LocalLogStartOffset() != 8 {
+		t.Errorf("got log start offset %d and local log start offset %d, want 0 and 8", log.LogStartOffset(), log.LocalLogStartOffset())
+	}
+
+	// A read below the local log start offset reads the one remote segment
+	// holding it.
+	if got, want := readOffsets(t, log, 1, 1<<20), []int64{0, 2}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v from offset 1, want %v", got, want)
+	}
+	if got, want := readOffsets(t, log, 6, 1<<20), []int64{6}; !slices.Equal(got, want) {
+		t.Errorf("read batches %v from offset 6, want %v", got, want)
+	}
+	records, err := log.ReadRecords(5, 1<<20, true, func(Batch) bool { return true })
+	if err != nil || len(records) != 1 || records[0].Size() != 2*85 {
+		t.Errorf("ReadRecords from remote storage returned %d records and %v, want the two batches of segment 4", len(records), err)
+	}
+	offset, _, ok, err := log.FindOffsetByTimestamp(0)
+	if err != nil || !ok || offset != 0 {
+		t.Errorf("FindOffsetByTimestamp returned %d, %t and %v, want the first remote offset", offset, ok, err)
+	}
+
+	// Reopened, the log finds its remote segments again.
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	m, log = openTieredLog(t, dir, map[string]string{"remote.storage.enable": "true", "local.retention.bytes": "0"})
+	defer m.Close()
+	if log.LogStartOffset() != 0 || log.HighestOffsetInRemoteStorage() != 7 {
+		t.Errorf("reopened log has log start offset %d and highest remote offset %d, want 0 and 7", log.LogStartOffset(), log.HighestOffsetInRemoteStorage())
+	}
+	if got, want := readOffsets(t, log, 0, 1<<20), []int64{0, 2}; !slices.Equal(got, want) {
+		t.Errorf("reopened log read batches %v, want %v", got, want)
+	}
+}
+
+func TestTieredLogKeepsUncopiedSegments(t *testing.T) {
+	// local.retention.bytes would delete every rolled segment, but none is
+	// copied yet.
+	m, log := openTieredLog(t, t.TempDir(), map[string]string{"remote.storage.enable": "true", "local.retention.bytes": "0"})
+	defer m.Close()
+	batch := testBatch(2, time.Now().UnixMilli())
+	for range 5 {
+		appendBatches(t, log, batch)
+	}
+	if deleted, err := log.DeleteOldSegments(time.Now()); err != nil || deleted != 0 {
+		t.Errorf("DeleteOldSegments deleted %d segments and returned %v, want none deleted before they are copied", deleted, err)
+	}
+}
+
+func TestTieredLogRemoteRetention(t *testing.T) {
+	dir := t.TempDir()
+	// The whole log, remote segments included, is kept to 170 bytes.
+	m, log := openTieredLog(t, dir, map[string]string{
+		"remote.storage.enable": "true",
+		"local.retention.bytes": "0",
+		"retention.bytes":       "170",
+	})
+	defer m.Close()
+	tierLog(t, m, log)
+
+	// The two remote segments and the local one make 425 bytes; dropping
+	// segment 0 leaves 255, and segment 4 as well would leave less than the
+	// limit.
+	m.RunRemoteLogManager()
+	want := map[int64]RemoteLogSegmentState{4: CopySegmentFinished}
+	if got := remoteStates(t, log); !maps.Equal(got, want) {
+		t.Errorf("got remote segments %v, want %v", got, want)
+	}
+	if got := log.LogStartOffset(); got != 4 {
+		t.Errorf("got log start offset %d, want 4 past the deleted remote segment", got)
+	}
+	files, err := filepath.Glob(filepath.Join(logDirName(filepath.Join(dir, "remote"), log.Partition), "*"+LogFileSuffix))
+	if err != nil || len(files) != 1 {
+		t.Errorf("got remote segment files %v (%v), want only that of segment 4", files, err)
+	}
+}
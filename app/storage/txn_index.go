@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	TxnIndexFileSuffix = ".txnindex"
+
+	txnIndexEntrySize = 34
+	txnIndexVersion   = 0
+)
+
+// AbortedTxn is an aborted transaction of a producer: its records lie between
+// FirstOffset and the abort marker at LastOffset. LastStableOffset is the
+// partition's last stable offset once the marker was written.
+type AbortedTxn struct {
+	ProducerId       int64
+	FirstOffset      int64
+	LastOffset       int64
+	LastStableOffset int64
+}
+
+// TxnIndex is the .txnindex file of a segment, listing the transactions
+// aborted by a marker in the segment so that read_committed fetches can tell
+// consumers which records to skip without reading them. Each 34 byte entry
+// holds a version, the producer id, and the first, last and last stable
+// offsets. The file is only created once a transaction is aborted.
+type TxnIndex struct {
+	path       string
+	baseOffset int64
+	keyring    *Keyring
+	file       *segmentFile
+	entries    []AbortedTxn
+}
+
+// openTxnIndex reads a transaction index. An encrypted one whose last frames
+// are corrupt, as after a crash, is rewritten without them.
+func openTxnIndex(path string, baseOffset int64, keyring *Keyring) (*TxnIndex, error) {
+	idx := &TxnIndex{path: path, baseOffset: baseOffset, keyring: keyring}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return idx, nil
+	}
+	file, err := openSegmentFile(path, baseOffset, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open index %s: %w", path, err)
+	}
+	idx.file = file
+	data, _, err := file.readAll()
+	if err != nil && !errors.Is(err, errCorruptFrame) {
+		file.Close()
+		return nil, fmt.Errorf("unable to read index %s: %w", path, err)
+	}
+	idx.entries = parseTxnIndex(data)
+	if err != nil {
+		fmt.Printf("Dropping the corrupt end of %s: %s\n", path, err.Error())
+		if err := idx.rewrite(idx.entries); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// parseTxnIndex decodes the entries of a transaction index, ignoring a
+// partial one at the end.
+func parseTxnIndex(data []byte) []AbortedTxn {
+	entries := []AbortedTxn{}
+	for i := 0; i+txnIndexEntrySize <= len(data); i += txnIndexEntrySize {
+		entries = append(entries, AbortedTxn{
+			ProducerId:       int64(binary.BigEndian.Uint64(data[i+2:])),
+			FirstOffset:      int64(binary.BigEndian.Uint64(data[i+10:])),
+			LastOffset:       int64(binary.BigEndian.Uint64(data[i+18:])),
+			LastStableOffset: int64(binary.BigEndian.Uint64(data[i+26:])),
+		})
+	}
+	return entries
+}
+
+func encodeTxnIndexEntry(txn AbortedTxn) []byte {
+	data := make([]byte, txnIndexEntrySize)
+	binary.BigEndian.PutUint16(data, txnIndexVersion)
+	binary.BigEndian.PutUint64(data[2:], uint64(txn.ProducerId))
+	binary.BigEndian.PutUint64(data[10:], uint64(txn.FirstOffset))
+	binary.BigEndian.PutUint64(data[18:], uint64(txn.LastOffset))
+	binary.BigEndian.PutUint64(data[26:], uint64(txn.LastStableOffset))
+	return data
+}
+
+// Append adds an aborted transaction, unless it is already listed, as when
+// its marker is replayed while loading the log.
+func (idx *TxnIndex) Append(txn AbortedTxn) error {
+	for _, entry := range idx.entries {
+		if entry.ProducerId == txn.ProducerId && entry.LastOffset == txn.LastOffset {
+			return nil
+		}
+	}
+	if idx.file == nil {
+		file, err := openSegmentFile(idx.path, idx.baseOffset, idx.keyring)
+		if err != nil {
+			return fmt.Errorf("unable to open index %s: %w", idx.path, err)
+		}
+		idx.file = file
+	}
+	if _, err := idx.file.write(encodeTxnIndexEntry(txn)); err != nil {
+		return fmt.Errorf("unable to append to index %s: %w", idx.path, err)
+	}
+	idx.entries = append(idx.entries, txn)
+	return nil
+}
+
+// collect appends the transactions overlapping offsets from startOffset up to
+// upperOffset.
+func (idx *TxnIndex) collect(aborted []AbortedTxn, startOffset int64, upperOffset int64) []AbortedTxn {
+	for _, entry := range idx.entries {
+		if entry.LastOffset >= startOffset && entry.FirstOffset < upperOffset {
+			aborted = append(aborted, entry)
+		}
+	}
+	return aborted
+}
+
+// TruncateTo drops the transactions whose marker is at or after offset, which
+// a recovered segment no longer holds.
+func (idx *TxnIndex) TruncateTo(offset int64) error {
+	kept := []AbortedTxn{}
+	for _, entry := range idx.entries {
+		if entry.LastOffset < offset {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(idx.entries) {
+		return nil
+	}
+	return idx.rewrite(kept)
+}
+
+// rewrite replaces the file with one holding entries, encrypted with the same
+// key as before.
+func (idx *TxnIndex) rewrite(entries []AbortedTxn) error {
+	var c *fileCipher
+	if idx.file != nil {
+		c = idx.file.cipher
+	}
+	if err := idx.Close(); err != nil {
+		return err
+	}
+	chunks := make([][]byte, len(entries))
+	for i, entry := range entries {
+		chunks[i] = encodeTxnIndexEntry(entry)
+	}
+	if err := writeFileAtomically(idx.path, encodeSegmentFile(c, chunks...)); err != nil {
+		return err
+	}
+	file, err := openSegmentFile(idx.path, idx.baseOffset, idx.keyring)
+	if err != nil {
+		return fmt.Errorf("unable to open index %s: %w", idx.path, err)
+	}
+	idx.file, idx.entries = file, entries
+	return nil
+}
+
+func (idx *TxnIndex) Close() error {
+	if idx.file == nil {
+		return nil
+	}
+	err := idx.file.Close()
+	idx.file = nil
+	return err
+}
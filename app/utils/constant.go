@@ -4,14 +4,36 @@ type APIKeys int16
 type ErrorCode int16
 
 const (
+	Produce                 APIKeys = 0
 	ApiVersions             APIKeys = 18
 	DescribeTopicPartitions APIKeys = 75
-	Fetch 								 APIKeys = 1
+	Fetch                   APIKeys = 1
+	ListOffsets             APIKeys = 2
+	DeleteRecords           APIKeys = 21
+	WriteTxnMarkers         APIKeys = 27
+	AlterReplicaLogDirs     APIKeys = 34
+	DescribeLogDirs         APIKeys = 35
+	DescribeProducers       APIKeys = 61
 )
 
 const (
-	NONE                       ErrorCode = 0
-	UNSUPPORTED_VERSION        ErrorCode = 35
-	UNKNOWN_TOPIC_OR_PARTITION ErrorCode = 3
-	UNKNOWN_TOPIC_ID					 ErrorCode = 100
+	UNKNOWN_SERVER_ERROR           ErrorCode = -1
+	NONE                           ErrorCode = 0
+	OFFSET_OUT_OF_RANGE            ErrorCode = 1
+	CORRUPT_MESSAGE                ErrorCode = 2
+	UNSUPPORTED_VERSION            ErrorCode = 35
+	UNSUPPORTED_FOR_MESSAGE_FORMAT ErrorCode = 43
+	OUT_OF_ORDER_SEQUENCE_NUMBER   ErrorCode = 45
+	INVALID_PRODUCER_EPOCH         ErrorCode = 47
+	INVALID_TXN_STATE              ErrorCode = 48
+	TRANSACTION_COORDINATOR_FENCED ErrorCode = 52
+	UNKNOWN_TOPIC_OR_PARTITION     ErrorCode = 3
+	INVALID_REQUIRED_ACKS          ErrorCode = 21
+	KAFKA_STORAGE_ERROR            ErrorCode = 56
+	LOG_DIR_NOT_FOUND              ErrorCode = 57
+	FETCH_SESSION_ID_NOT_FOUND     ErrorCode = 70
+	INVALID_FETCH_SESSION_EPOCH    ErrorCode = 71
+	UNSUPPORTED_COMPRESSION_TYPE   ErrorCode = 76
+	INVALID_RECORD                 ErrorCode = 87
+	UNKNOWN_TOPIC_ID               ErrorCode = 100
 )